@@ -20,6 +20,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
@@ -29,8 +30,12 @@ import (
 	"github.com/hashicorp/go-multierror"
 	"github.com/rs/zerolog"
 	"math/rand"
+	"sort"
+	"src/metrics"
+	"src/tracing"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -40,6 +45,8 @@ var (
 	LockReleaseFailedError           = errors.New("failed to release lock")
 	LockConditionalUpdateFailedError = errors.New("failed to update lock due to condition not being met")
 	LockAbandonedError               = errors.New("lock abandoned")
+	InvalidLockConfigError           = errors.New("invalid lock config")
+	LockTableUnavailableError        = errors.New("lock table unavailable")
 )
 
 type LockCurrentlyUnavailableError struct {
@@ -49,20 +56,64 @@ func (e LockCurrentlyUnavailableError) Error() string {
 	return "lock is currently unavailable"
 }
 
+// MalformedLockItemError is returned when a lock item in the table is missing an attribute, or an attribute has the
+// wrong type or an unparseable value, e.g. after a manual edit of the table.
+type MalformedLockItemError struct {
+	Attribute string
+	Reason    string
+}
+
+func (e MalformedLockItemError) Error() string {
+	return fmt.Sprintf("malformed lock item: attribute %s %s", e.Attribute, e.Reason)
+}
+
 type DynamoDBLockConfig struct {
 	Owner                    string
 	MaxShards                int
 	LeaseDurationSeconds     int
 	HeartbeatIntervalSeconds int
+
+	// CreateTable, if true, creates the lock table with EnsureLockTable if it does not exist, for first-time setup.
+	CreateTable bool
+}
+
+// Validate returns an error wrapping InvalidLockConfigError if the timings are not positive, or if the heartbeat
+// interval is not less than half the lease duration. A lock must be heartbeated at least twice per lease, so that one
+// slow or failed heartbeat does not let it expire while it is still held.
+func (c DynamoDBLockConfig) Validate() error {
+	if c.LeaseDurationSeconds <= 0 || c.HeartbeatIntervalSeconds <= 0 {
+		return fmt.Errorf(
+			"%w: lease duration (%ds) and heartbeat interval (%ds) must be positive",
+			InvalidLockConfigError, c.LeaseDurationSeconds, c.HeartbeatIntervalSeconds,
+		)
+	}
+	if c.HeartbeatIntervalSeconds*2 >= c.LeaseDurationSeconds {
+		return fmt.Errorf(
+			"%w: heartbeat interval (%ds) must be less than half the lease duration (%ds)",
+			InvalidLockConfigError, c.HeartbeatIntervalSeconds, c.LeaseDurationSeconds,
+		)
+	}
+	return nil
+}
+
+// DynamoDBAPI is the part of the DynamoDB client that DynamoDBLockClient uses, so that tests can fake it.
+type DynamoDBAPI interface {
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
 }
 
 type DynamoDBLockClient struct {
-	Client             *dynamodb.Client
+	Client             DynamoDBAPI
 	TableName          string
 	Config             DynamoDBLockConfig
 	locks              map[string]Lock
+	shardCounts        []int // locks created by this client in each shard, protected by mu
 	mu                 sync.Mutex
 	stopBackgroundJobs chan struct{}
+	backgroundJobsDone chan struct{}
+	closeOnce          sync.Once
+	heartbeatRunning   atomic.Bool
 	zlog               *zerolog.Logger
 }
 
@@ -78,64 +129,87 @@ func NewDynamoDBClient(region string) (*dynamodb.Client, error) {
 	return dynamodb.NewFromConfig(cfg), nil
 }
 
+// checkTableTimeout bounds the startup check that the lock table is reachable, so that an unreachable DynamoDB fails
+// fast rather than after the SDK's retries.
+const checkTableTimeout = 10 * time.Second
+
+// checkTable returns an error wrapping LockTableUnavailableError if tableName cannot be described, e.g. because
+// DynamoDB is unreachable, the credentials lack access, or the table does not exist, or if the table is not active.
+func checkTable(client *dynamodb.Client, tableName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), checkTableTimeout)
+	defer cancel()
+
+	output, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+	if err != nil {
+		return fmt.Errorf("%w: failed to describe table %s: %v", LockTableUnavailableError, tableName, err)
+	}
+	if status := output.Table.TableStatus; status != dynamodbtypes.TableStatusActive {
+		return fmt.Errorf("%w: table %s is %s, not ACTIVE", LockTableUnavailableError, tableName, status)
+	}
+	return nil
+}
+
 func NewDynamoDBLockClient(
 	tableName string,
 	region string,
 	config DynamoDBLockConfig,
 	zlog *zerolog.Logger,
 ) (*DynamoDBLockClient, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
 	client, err := NewDynamoDBClient(region)
 	if err != nil {
 		return nil, err
 	}
+	if config.CreateTable {
+		ctx, cancel := context.WithTimeout(context.Background(), createTableTimeout)
+		err := EnsureLockTable(ctx, client, tableName, zlog)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", LockTableUnavailableError, err)
+		}
+	}
+	if err := checkTable(client, tableName); err != nil {
+		return nil, err
+	}
 
 	d := DynamoDBLockClient{
 		Client:             client,
 		TableName:          tableName,
 		Config:             config,
 		locks:              make(map[string]Lock),
+		shardCounts:        make([]int, config.MaxShards),
 		mu:                 sync.Mutex{},
 		stopBackgroundJobs: make(chan struct{}),
+		backgroundJobsDone: make(chan struct{}),
 		zlog:               zlog,
 	}
+	d.startBackgroundJobs(time.Duration(config.HeartbeatIntervalSeconds) * time.Second)
+	return &d, nil
+}
 
-	// Start a background job that once a minute heartbeat all locks that we own. There is another
-	// channel that tells the background job to stop.
+// startBackgroundJobs starts a background job that heartbeats all locks that we own every heartbeatInterval, and
+// periodically logs how locks are spread across shards. Closing stopBackgroundJobs tells the job to stop.
+func (d *DynamoDBLockClient) startBackgroundJobs(heartbeatInterval time.Duration) {
+	zlog := d.zlog
+	d.heartbeatRunning.Store(true)
 	go func() {
-		ticker := time.NewTicker(time.Duration(d.Config.HeartbeatIntervalSeconds) * time.Second)
+		defer close(d.backgroundJobsDone)
+		defer d.heartbeatRunning.Store(false)
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		shardTicker := time.NewTicker(shardLogInterval)
+		defer shardTicker.Stop()
 		for {
 			select {
 			case <-ticker.C:
-				// Make a []string of lock IDs to heartbeat
-				d.mu.Lock()
-				lockIDs := make([]string, 0, len(d.locks))
-				for lockID := range d.locks {
-					lockIDs = append(lockIDs, lockID)
-				}
-				d.mu.Unlock()
-
-				var wg sync.WaitGroup
-				var errs multierror.Error
-				for _, lockID := range lockIDs {
-					wg.Add(1)
-					go func(lockID string) {
-						defer wg.Done()
-						err := d.Heartbeat(context.TODO(), lockID, nil)
-						if err != nil {
-							// if we are abandoning a lock, remove it from the map
-							if errors.Is(err, LockAbandonedError) {
-								d.mu.Lock()
-								delete(d.locks, lockID)
-								d.mu.Unlock()
-							}
-							errs.Errors = append(errs.Errors, err)
-						}
-					}(lockID)
-				}
-				wg.Wait()
-				if len(errs.Errors) > 0 {
-					zlog.Error().Err(errs.ErrorOrNil()).Msg("failed to heartbeat locks")
-				}
+				d.heartbeatAll(zlog)
+
+			case <-shardTicker.C:
+				zlog.Debug().
+					Ints("locksByShard", d.shardDistribution()).
+					Msg("lock shard distribution")
 
 			case <-d.stopBackgroundJobs:
 				zlog.Info().Msg("stopping background heartbeat job")
@@ -143,25 +217,166 @@ func NewDynamoDBLockClient(
 			}
 		}
 	}()
+}
 
-	return &d, nil
+// heartbeatAll heartbeats every lock we own concurrently, and forgets locks that have been abandoned. A panic while
+// heartbeating is logged and recovered so that it neither crashes the process nor stops the background job.
+func (d *DynamoDBLockClient) heartbeatAll(zlog *zerolog.Logger) {
+	defer func() {
+		if r := recover(); r != nil {
+			zlog.Error().Interface("panic", r).Msg("recovered from panic while heartbeating locks")
+			metrics.Errors.WithLabelValues("lock").Inc()
+		}
+	}()
+
+	// Snapshot the locks to heartbeat along with their record version numbers, so that each heartbeat only updates
+	// the lock if it is still held locally in the same version, i.e. it was not released or replaced meanwhile.
+	locks := d.ListOwnedLocks()
+
+	var wg sync.WaitGroup
+	var errsMu sync.Mutex
+	var errs multierror.Error
+	for _, lock := range locks {
+		wg.Add(1)
+		go func(lock Lock) {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					zlog.Error().Interface("panic", r).Str("id", lock.ID).Msg("recovered from panic while heartbeating lock")
+					metrics.Errors.WithLabelValues("lock").Inc()
+				}
+			}()
+			err := d.heartbeat(context.TODO(), lock, nil)
+			if err != nil {
+				// a lock released since the snapshot is not an error
+				if errors.Is(err, LockNotFoundError) {
+					return
+				}
+				// if we are abandoning a lock, remove it from the map
+				if errors.Is(err, LockAbandonedError) {
+					metrics.Locks.WithLabelValues("abandoned").Inc()
+					d.removeLocalLockIfCurrent(lock)
+				}
+				errsMu.Lock()
+				errs.Errors = append(errs.Errors, err)
+				errsMu.Unlock()
+			}
+		}(lock)
+	}
+	wg.Wait()
+	if len(errs.Errors) > 0 {
+		zlog.Error().Err(errs.ErrorOrNil()).Msg("failed to heartbeat locks")
+	}
 }
 
+// closeReleaseTimeout bounds how long Close spends releasing the locks still held.
+const closeReleaseTimeout = 5 * time.Second
+
+// Close stops the background heartbeat job, waiting for any in-flight heartbeats to finish, and then releases every
+// lock this client still holds. It is safe to call more than once.
 func (d *DynamoDBLockClient) Close() error {
-	d.stopBackgroundJobs <- struct{}{}
-	return nil
+	var resultError error
+	d.closeOnce.Do(func() {
+		close(d.stopBackgroundJobs)
+		<-d.backgroundJobsDone
+
+		ctx, cancel := context.WithTimeout(context.Background(), closeReleaseTimeout)
+		defer cancel()
+
+		// Release concurrently, so that holding many locks does not use up the timeout before they are all handed off.
+		locks := d.ListOwnedLocks()
+		var wg sync.WaitGroup
+		var mu sync.Mutex // protects resultError
+		for _, lock := range locks {
+			wg.Add(1)
+			go func(id string) {
+				defer wg.Done()
+				if err := d.Release(ctx, id); err != nil {
+					d.zlog.Error().Err(err).Str("id", id).Msg("failed to release lock on close")
+					mu.Lock()
+					resultError = multierror.Append(resultError, err)
+					mu.Unlock()
+				}
+			}(lock.ID)
+		}
+		wg.Wait()
+		if len(locks) > 0 {
+			d.zlog.Info().Int("locks", len(locks)).Msg("released held locks on close for other instances to take over")
+		}
+	})
+	return resultError
 }
 
 func (d *DynamoDBLockClient) Owner() string {
 	return d.Config.Owner
 }
 
+// Healthy returns whether the background heartbeat job is still running.
+func (d *DynamoDBLockClient) Healthy() bool {
+	return d.heartbeatRunning.Load()
+}
+
+// ttlLeaseMultiple is how many lease durations a lock item outlives its last update before DynamoDB's TTL deletes it.
+// It is well past the point the lock has expired, so TTL only cleans up locks that were never released.
+const ttlLeaseMultiple = 10
+
+// computeTTLEpochSeconds returns the TTL, in seconds since the epoch, of a lock item last updated at nowMilliseconds
+// with a lease of leaseDurationMilliseconds, i.e. now + ttlLeaseMultiple leases, rounded down to the second.
+func computeTTLEpochSeconds(nowMilliseconds int64, leaseDurationMilliseconds int64) int64 {
+	return (nowMilliseconds + ttlLeaseMultiple*leaseDurationMilliseconds) / 1000
+}
+
+const (
+	acquireRetryInitialBackoff = 100 * time.Millisecond
+	acquireRetryMaxBackoff     = 2 * time.Second
+)
+
+// AcquireWithRetry is like Acquire, but if the lock is held by someone else it polls with jittered exponential backoff
+// until the lock is acquired, maxWait has passed, or ctx is done. It returns the last error if the lock could not be
+// acquired in time. Errors other than LockCurrentlyUnavailableError are returned immediately.
+func (d *DynamoDBLockClient) AcquireWithRetry(
+	ctx context.Context,
+	id string,
+	data interface{},
+	maxWait time.Duration,
+) (*Lock, error) {
+	zlog := tracing.Logger(ctx, d.zlog).With().Str("id", id).Logger()
+	ctx, cancel := context.WithTimeout(ctx, maxWait)
+	defer cancel()
+
+	backoff := acquireRetryInitialBackoff
+	for attempt := 1; ; attempt++ {
+		lock, err := d.Acquire(ctx, id, data)
+		var unavailable LockCurrentlyUnavailableError
+		if err == nil || !errors.As(err, &unavailable) {
+			return lock, err
+		}
+
+		// Sleep for between half and all of the backoff, so that contending callers spread out.
+		sleep := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		zlog.Debug().Int("attempt", attempt).Dur("sleep", sleep).Msg("lock is unavailable, retrying")
+		timer := time.NewTimer(sleep)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			zlog.Debug().Int("attempts", attempt).Msg("gave up waiting for lock")
+			return nil, err
+		case <-timer.C:
+		}
+
+		backoff *= 2
+		if backoff > acquireRetryMaxBackoff {
+			backoff = acquireRetryMaxBackoff
+		}
+	}
+}
+
 func (d *DynamoDBLockClient) Acquire(
 	ctx context.Context,
 	id string,
 	data interface{},
 ) (*Lock, error) {
-	zlog := d.zlog.With().Str("id", id).Logger()
+	zlog := tracing.Logger(ctx, d.zlog).With().Str("id", id).Logger()
 	nowMilliseconds := time.Now().UnixNano() / int64(time.Millisecond)
 	existingLock, err := d.getLock(ctx, id)
 	if err != nil {
@@ -182,16 +397,19 @@ func (d *DynamoDBLockClient) Acquire(
 			// the lease to someone else. We need to evict the lock from our cache and return an error.
 			if err == LockConditionalUpdateFailedError {
 				zlog.Debug().Msg("lock is already acquired but expired and conditional check failed")
-				d.mu.Lock()
-				delete(d.locks, id)
-				d.mu.Unlock()
 				return nil, LockCurrentlyUnavailableError{}
 			}
 
 			zlog.Error().Err(err).Msg("failed to update existing lock")
+			metrics.Errors.WithLabelValues("lock").Inc()
 			return nil, err
 		}
 
+		d.mu.Lock()
+		d.locks[id] = *newLock
+		d.mu.Unlock()
+
+		metrics.Locks.WithLabelValues("acquired").Inc()
 		return newLock, nil
 	}
 
@@ -199,9 +417,11 @@ func (d *DynamoDBLockClient) Acquire(
 	lock, err := d.putNewLock(ctx, id, data, nowMilliseconds)
 	if err != nil {
 		zlog.Error().Err(err).Msg("failed to put new lock")
+		metrics.Errors.WithLabelValues("lock").Inc()
 		return nil, err
 	}
 
+	metrics.Locks.WithLabelValues("acquired").Inc()
 	zlog.Info().Interface("lock", lock).Msg("acquired lock")
 	return lock, nil
 }
@@ -211,12 +431,28 @@ func (d *DynamoDBLockClient) Heartbeat(
 	id string,
 	maybeNewData *interface{},
 ) error {
+	existingLock, ok := d.getLocalLock(id)
+	if !ok {
+		d.zlog.Debug().Str("id", id).Msg("lock is not locally acquired")
+		return LockNotFoundError
+	}
+	return d.heartbeat(ctx, existingLock, maybeNewData)
+}
+
+// heartbeat renews the lease on existingLock. It returns LockNotFoundError without updating the lock if the lock is no
+// longer held locally in the same version, e.g. because it was released concurrently, and only stores the renewed lock
+// locally if that is still the case once the update has succeeded.
+func (d *DynamoDBLockClient) heartbeat(
+	ctx context.Context,
+	existingLock Lock,
+	maybeNewData *interface{},
+) error {
+	id := existingLock.ID
 	zlog := d.zlog.With().Str("id", id).Logger()
 	zlog.Debug().Msg("heartbeat")
 
-	existingLock, ok := d.getLocalLock(id)
-	if !ok {
-		zlog.Debug().Msg("lock is not locally acquired")
+	if !d.isLocalLockCurrent(existingLock) {
+		zlog.Debug().Msg("lock is no longer locally acquired in this version")
 		return LockNotFoundError
 	}
 
@@ -236,27 +472,27 @@ func (d *DynamoDBLockClient) Heartbeat(
 
 	var resultError multierror.Error
 	nowMilliseconds := time.Now().UnixNano() / int64(time.Millisecond)
-	_, err := d.updateExistingLock(ctx, existingLock, newData, nowMilliseconds)
+	newLock, err := d.updateExistingLock(ctx, existingLock, newData, nowMilliseconds)
 	if err != nil {
-		// Lock is acquired, expired, and when we tried to get it we got a conditional error, meaning we lost
-		// the lease to someone else. We need to evict the lock from our cache and return an error.
+		// The conditional check failed, meaning we lost the lease to someone else or the lock was released. We need
+		// to evict the lock from our cache and return an error.
 		if err == LockConditionalUpdateFailedError {
-			zlog.Debug().Msg("lock is already acquired but expired and conditional check failed")
-			d.mu.Lock()
-			delete(d.locks, id)
-			d.mu.Unlock()
+			zlog.Debug().Msg("lock was taken or released, conditional check failed")
+			d.removeLocalLockIfCurrent(existingLock)
 			return LockCurrentlyUnavailableError{}
 		}
 
 		zlog.Error().Err(err).Msg("failed to update existing lock")
 		resultError = *multierror.Append(&resultError, err, LockHeartbeatFailedError)
+	} else if !d.replaceLocalLockIfCurrent(existingLock, *newLock) {
+		zlog.Debug().Msg("lock was released during heartbeat, not storing renewed lock")
 	}
 
 	return resultError.ErrorOrNil()
 }
 
 func (d *DynamoDBLockClient) Release(ctx context.Context, id string) error {
-	zlog := d.zlog.With().Str("id", id).Logger()
+	zlog := tracing.Logger(ctx, d.zlog).With().Str("id", id).Logger()
 	zlog.Debug().Msg("releasing lock")
 
 	existingLock, ok := d.getLocalLock(id)
@@ -267,13 +503,59 @@ func (d *DynamoDBLockClient) Release(ctx context.Context, id string) error {
 	var resultError multierror.Error
 	err := d.releaseLock(ctx, existingLock, &zlog)
 	if err != nil {
-		d.zlog.Error().Err(err).Msg("failed to delete lock")
+		zlog.Error().Err(err).Msg("failed to delete lock")
+		metrics.Errors.WithLabelValues("lock").Inc()
 		resultError = *multierror.Append(&resultError, err, LockReleaseFailedError)
+	} else {
+		metrics.Locks.WithLabelValues("released").Inc()
 	}
 
 	return resultError.ErrorOrNil()
 }
 
+// itemString returns the string attribute name of a lock item.
+func itemString(item map[string]dynamodbtypes.AttributeValue, name string) (string, error) {
+	value, ok := item[name]
+	if !ok {
+		return "", MalformedLockItemError{Attribute: name, Reason: "is missing"}
+	}
+	member, ok := value.(*dynamodbtypes.AttributeValueMemberS)
+	if !ok {
+		return "", MalformedLockItemError{Attribute: name, Reason: "is not a string"}
+	}
+	return member.Value, nil
+}
+
+// itemNumber returns the integer number attribute name of a lock item.
+func itemNumber(item map[string]dynamodbtypes.AttributeValue, name string) (int64, error) {
+	value, ok := item[name]
+	if !ok {
+		return 0, MalformedLockItemError{Attribute: name, Reason: "is missing"}
+	}
+	member, ok := value.(*dynamodbtypes.AttributeValueMemberN)
+	if !ok {
+		return 0, MalformedLockItemError{Attribute: name, Reason: "is not a number"}
+	}
+	number, err := strconv.ParseInt(member.Value, 10, 64)
+	if err != nil {
+		return 0, MalformedLockItemError{Attribute: name, Reason: "is not an integer: " + err.Error()}
+	}
+	return number, nil
+}
+
+// itemBinary returns the binary attribute name of a lock item.
+func itemBinary(item map[string]dynamodbtypes.AttributeValue, name string) ([]byte, error) {
+	value, ok := item[name]
+	if !ok {
+		return nil, MalformedLockItemError{Attribute: name, Reason: "is missing"}
+	}
+	member, ok := value.(*dynamodbtypes.AttributeValueMemberB)
+	if !ok {
+		return nil, MalformedLockItemError{Attribute: name, Reason: "is not binary"}
+	}
+	return member.Value, nil
+}
+
 // getLock returns the lock with the given ID. If the lock is not found, then it returns nil.
 func (d *DynamoDBLockClient) getLock(
 	ctx context.Context,
@@ -302,73 +584,81 @@ func (d *DynamoDBLockClient) getLock(
 		return nil, nil
 	}
 
-	owner := resp.Item["Owner"].(*dynamodbtypes.AttributeValueMemberS).Value
+	owner, err := itemString(resp.Item, "Owner")
+	if err != nil {
+		zlog.Error().Err(err).Msg("malformed lock item")
+		return nil, err
+	}
 	zlog.Debug().Str("owner", owner).Msg("got owner")
 
-	leaseDurationMilliseconds, err := strconv.Atoi(resp.Item["LeaseDurationMilliseconds"].(*dynamodbtypes.AttributeValueMemberN).Value)
+	leaseDurationMilliseconds, err := itemNumber(resp.Item, "LeaseDurationMilliseconds")
 	if err != nil {
-		zlog.Error().Err(err).Msg("failed to parse lease duration")
+		zlog.Error().Err(err).Msg("malformed lock item")
 		return nil, err
 	}
-	zlog.Debug().Int("leaseDurationMilliseconds", leaseDurationMilliseconds).Msg("got lease duration")
+	zlog.Debug().Int64("leaseDurationMilliseconds", leaseDurationMilliseconds).Msg("got lease duration")
 
-	lastUpdatedTimeMilliseconds, err := strconv.Atoi(resp.Item["LastUpdatedTimeMilliseconds"].(*dynamodbtypes.AttributeValueMemberN).Value)
+	lastUpdatedTimeMilliseconds, err := itemNumber(resp.Item, "LastUpdatedTimeMilliseconds")
 	if err != nil {
-		zlog.Error().Err(err).Msg("failed to parse last updated time")
+		zlog.Error().Err(err).Msg("malformed lock item")
 		return nil, err
 	}
-	zlog.Debug().Int("lastUpdatedTimeMilliseconds", lastUpdatedTimeMilliseconds).Msg("got last updated time")
+	zlog.Debug().Int64("lastUpdatedTimeMilliseconds", lastUpdatedTimeMilliseconds).Msg("got last updated time")
 
-	recordVersionNumber := resp.Item["RecordVersionNumber"].(*dynamodbtypes.AttributeValueMemberS).Value
+	recordVersionNumber, err := itemString(resp.Item, "RecordVersionNumber")
+	if err != nil {
+		zlog.Error().Err(err).Msg("malformed lock item")
+		return nil, err
+	}
 	zlog.Debug().Str("recordVersionNumber", recordVersionNumber).Msg("got record version number")
 
-	shard, err := strconv.Atoi(resp.Item["Shard"].(*dynamodbtypes.AttributeValueMemberN).Value)
+	shard, err := itemNumber(resp.Item, "Shard")
 	if err != nil {
-		zlog.Error().Err(err).Msg("failed to parse shard")
+		zlog.Error().Err(err).Msg("malformed lock item")
 		return nil, err
 	}
 
-	ttl, err := strconv.Atoi(resp.Item["TTL"].(*dynamodbtypes.AttributeValueMemberN).Value)
+	ttl, err := itemNumber(resp.Item, "TTL")
 	if err != nil {
-		zlog.Error().Err(err).Msg("failed to parse TTL")
+		zlog.Error().Err(err).Msg("malformed lock item")
 		return nil, err
 	}
-	zlog.Debug().Int("ttl", ttl).Msg("got TTL")
+	zlog.Debug().Int64("ttl", ttl).Msg("got TTL")
 
-	createdAtMilliseconds, err := strconv.Atoi(resp.Item["CreatedAtMilliseconds"].(*dynamodbtypes.AttributeValueMemberN).Value)
+	createdAtMilliseconds, err := itemNumber(resp.Item, "CreatedAtMilliseconds")
 	if err != nil {
-		zlog.Error().Err(err).Msg("failed to parse createdAt")
+		zlog.Error().Err(err).Msg("malformed lock item")
 		return nil, err
 	}
 
-	dataSerialized := resp.Item["Data"].(*dynamodbtypes.AttributeValueMemberB).Value
+	dataSerialized, err := itemBinary(resp.Item, "Data")
+	if err != nil {
+		zlog.Error().Err(err).Msg("malformed lock item")
+		return nil, err
+	}
 	zlog.Debug().Str("dataSerialized", string(dataSerialized)).Msg("got data")
 
 	var data interface{}
 	err = json.Unmarshal(dataSerialized, &data)
 	if err != nil {
 		zlog.Error().Err(err).Msg("failed to deserialize data")
-		return nil, err
+		return nil, MalformedLockItemError{Attribute: "Data", Reason: err.Error()}
 	}
 	zlog.Debug().Interface("data", data).Msg("got deserialized data")
 
 	newLock := PtrToLock(NewLock(
 		id,
 		owner,
-		int64(leaseDurationMilliseconds),
-		int64(lastUpdatedTimeMilliseconds),
+		leaseDurationMilliseconds,
+		lastUpdatedTimeMilliseconds,
 		recordVersionNumber,
-		int64(shard),
-		int64(ttl),
-		int64(createdAtMilliseconds),
+		shard,
+		ttl,
+		createdAtMilliseconds,
 		data,
 	))
 	zlog.Debug().Interface("lock", newLock).Msg("returning new lock")
 
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	d.locks[id] = *newLock
-
 	return newLock, nil
 }
 
@@ -385,7 +675,7 @@ func (d *DynamoDBLockClient) updateExistingLock(
 		zlog.Error().Err(err).Msg("failed to generate record version number")
 		return nil, err
 	}
-	newTtl := nowMilliseconds/1000 + 10*leaseDurationMilliseconds/1000
+	newTtl := computeTTLEpochSeconds(nowMilliseconds, leaseDurationMilliseconds)
 
 	newLock := NewLock(
 		existingLock.ID,
@@ -408,7 +698,12 @@ func (d *DynamoDBLockClient) updateExistingLock(
 	conditionSameOwner := expression.Name("Owner").Equal(expression.Value(existingLock.Owner))
 	conditionDifferentOwner := expression.Name("Owner").NotEqual(expression.Value(existingLock.Owner))
 	conditionExpired := expression.Name("LastUpdatedTimeMilliseconds").LessThan(expression.Value(nowMilliseconds - leaseDurationMilliseconds))
-	condition := conditionSameRecordVersionNumber.And(conditionSameOwner.Or(conditionDifferentOwner.And(conditionExpired)))
+	// The row must still exist, so that a heartbeat racing with another process's Release does not recreate the lock.
+	conditionExists := expression.AttributeExists(expression.Name("LockID"))
+	condition := conditionExists.And(
+		conditionSameRecordVersionNumber,
+		conditionSameOwner.Or(conditionDifferentOwner.And(conditionExpired)),
+	)
 	builder := expression.NewBuilder()
 	builder = builder.WithCondition(condition)
 	expr, err := builder.Build()
@@ -437,10 +732,6 @@ func (d *DynamoDBLockClient) updateExistingLock(
 		return nil, err
 	}
 
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	d.locks[existingLock.ID] = newLock
-
 	return &newLock, nil
 }
 
@@ -457,7 +748,7 @@ func (d *DynamoDBLockClient) putNewLock(
 		return nil, err
 	}
 	shard := rand.Intn(d.Config.MaxShards)
-	ttl := nowMilliseconds/1000 + int64(d.Config.LeaseDurationSeconds)*10
+	ttl := computeTTLEpochSeconds(nowMilliseconds, leaseDurationMilliseconds)
 
 	lock := NewLock(
 		id,
@@ -496,13 +787,29 @@ func (d *DynamoDBLockClient) putNewLock(
 		return nil, err
 	}
 
+	metrics.LockShards.WithLabelValues(strconv.Itoa(shard)).Inc()
+
 	d.mu.Lock()
 	defer d.mu.Unlock()
 	d.locks[id] = lock
+	d.shardCounts[shard]++
 
 	return PtrToLock(lock), nil
 }
 
+// shardLogInterval is how often the distribution of locks across shards is logged, at debug level.
+const shardLogInterval = 10 * time.Minute
+
+// shardDistribution returns the number of locks this client has created in each shard, indexed by shard.
+func (d *DynamoDBLockClient) shardDistribution() []int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	distribution := make([]int, len(d.shardCounts))
+	copy(distribution, d.shardCounts)
+	return distribution
+}
+
 func (d *DynamoDBLockClient) releaseLock(
 	ctx context.Context,
 	existingLock Lock,
@@ -543,6 +850,50 @@ func (d *DynamoDBLockClient) releaseLock(
 	return nil
 }
 
+// ListOwnedLocks returns a snapshot of the locks this client currently holds, sorted by ID.
+func (d *DynamoDBLockClient) ListOwnedLocks() []Lock {
+	d.mu.Lock()
+	locks := make([]Lock, 0, len(d.locks))
+	for _, lock := range d.locks {
+		locks = append(locks, lock)
+	}
+	d.mu.Unlock()
+
+	sort.Slice(locks, func(i, j int) bool { return locks[i].ID < locks[j].ID })
+	return locks
+}
+
+// isLocalLockCurrent returns whether lock is still held locally with the same record version number.
+func (d *DynamoDBLockClient) isLocalLockCurrent(lock Lock) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	current, ok := d.locks[lock.ID]
+	return ok && current.RecordVersionNumber == lock.RecordVersionNumber
+}
+
+// replaceLocalLockIfCurrent stores newLock in place of expected if expected is still held locally with the same
+// record version number, and returns whether it did.
+func (d *DynamoDBLockClient) replaceLocalLockIfCurrent(expected Lock, newLock Lock) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	current, ok := d.locks[expected.ID]
+	if !ok || current.RecordVersionNumber != expected.RecordVersionNumber {
+		return false
+	}
+	d.locks[expected.ID] = newLock
+	return true
+}
+
+// removeLocalLockIfCurrent forgets lock if it is still held locally with the same record version number.
+func (d *DynamoDBLockClient) removeLocalLockIfCurrent(lock Lock) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	current, ok := d.locks[lock.ID]
+	if ok && current.RecordVersionNumber == lock.RecordVersionNumber {
+		delete(d.locks, lock.ID)
+	}
+}
+
 func (d *DynamoDBLockClient) getLocalLock(id string) (Lock, bool) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
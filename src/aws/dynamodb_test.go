@@ -0,0 +1,581 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestComputeTTLEpochSeconds(t *testing.T) {
+	tests := []struct {
+		name                 string
+		nowMilliseconds      int64
+		leaseDurationSeconds int64
+		want                 int64
+	}{
+		{name: "whole second", nowMilliseconds: 1_700_000_000_000, leaseDurationSeconds: 60, want: 1_700_000_600},
+		{name: "rounds down", nowMilliseconds: 1_700_000_000_999, leaseDurationSeconds: 60, want: 1_700_000_600},
+		{name: "short lease", nowMilliseconds: 1_700_000_000_500, leaseDurationSeconds: 1, want: 1_700_000_010},
+		{name: "zero lease", nowMilliseconds: 1_700_000_000_500, leaseDurationSeconds: 0, want: 1_700_000_000},
+		{name: "epoch", nowMilliseconds: 0, leaseDurationSeconds: 30, want: 300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			leaseDurationMilliseconds := tt.leaseDurationSeconds * 1000
+			got := computeTTLEpochSeconds(tt.nowMilliseconds, leaseDurationMilliseconds)
+			if got != tt.want {
+				t.Errorf("computeTTLEpochSeconds(%d, %d) = %d, want %d",
+					tt.nowMilliseconds, leaseDurationMilliseconds, got, tt.want)
+			}
+
+			// The helper replaced these inline formulas in updateExistingLock and putNewLock, which leases of whole
+			// seconds must still agree with.
+			updateExistingLockTTL := tt.nowMilliseconds/1000 + 10*leaseDurationMilliseconds/1000
+			putNewLockTTL := tt.nowMilliseconds/1000 + tt.leaseDurationSeconds*10
+			if got != updateExistingLockTTL || got != putNewLockTTL {
+				t.Errorf("computeTTLEpochSeconds() = %d, want the previous updateExistingLock TTL %d and putNewLock TTL %d",
+					got, updateExistingLockTTL, putNewLockTTL)
+			}
+		})
+	}
+}
+
+func TestGetLockMalformedItem(t *testing.T) {
+	tests := []struct {
+		name      string
+		attribute string
+		value     dynamodbtypes.AttributeValue // replaces attribute, or removes it if nil
+		wantErr   MalformedLockItemError
+	}{
+		{name: "missing owner", attribute: "Owner", wantErr: MalformedLockItemError{Attribute: "Owner", Reason: "is missing"}},
+		{
+			name:      "owner not a string",
+			attribute: "Owner",
+			value:     &dynamodbtypes.AttributeValueMemberN{Value: "1"},
+			wantErr:   MalformedLockItemError{Attribute: "Owner", Reason: "is not a string"},
+		},
+		{
+			name:      "missing record version number",
+			attribute: "RecordVersionNumber",
+			wantErr:   MalformedLockItemError{Attribute: "RecordVersionNumber", Reason: "is missing"},
+		},
+		{name: "missing shard", attribute: "Shard", wantErr: MalformedLockItemError{Attribute: "Shard", Reason: "is missing"}},
+		{
+			name:      "lease duration not a number",
+			attribute: "LeaseDurationMilliseconds",
+			value:     &dynamodbtypes.AttributeValueMemberS{Value: "60000"},
+			wantErr:   MalformedLockItemError{Attribute: "LeaseDurationMilliseconds", Reason: "is not a number"},
+		},
+		{
+			name:      "TTL not an integer",
+			attribute: "TTL",
+			value:     &dynamodbtypes.AttributeValueMemberN{Value: "1.5"},
+			wantErr: MalformedLockItemError{
+				Attribute: "TTL",
+				Reason:    `is not an integer: strconv.ParseInt: parsing "1.5": invalid syntax`,
+			},
+		},
+		{
+			name:      "data not binary",
+			attribute: "Data",
+			value:     &dynamodbtypes.AttributeValueMemberS{Value: "{}"},
+			wantErr:   MalformedLockItemError{Attribute: "Data", Reason: "is not binary"},
+		},
+		{
+			name:      "data not JSON",
+			attribute: "Data",
+			value:     &dynamodbtypes.AttributeValueMemberB{Value: []byte("{")},
+			wantErr:   MalformedLockItemError{Attribute: "Data", Reason: "unexpected end of JSON input"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item, err := lockToDynamoDBAttributeValues(NewLock("lock", "owner", 60000, 1000, "v1", 0, 600, 1000, "data"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.value == nil {
+				delete(item, tt.attribute)
+			} else {
+				item[tt.attribute] = tt.value
+			}
+			client := newTestDynamoDBLockClient(newFakeDynamoDB())
+			client.Client.(*fakeDynamoDB).items["lock"] = item
+
+			lock, err := client.getLock(context.Background(), "lock")
+			var malformed MalformedLockItemError
+			if !errors.As(err, &malformed) {
+				t.Fatalf("getLock() error = %v, want MalformedLockItemError", err)
+			}
+			if malformed != tt.wantErr {
+				t.Errorf("getLock() error = %#v, want %#v", malformed, tt.wantErr)
+			}
+			if lock != nil {
+				t.Errorf("getLock() = %v, want nil", lock)
+			}
+		})
+	}
+}
+
+func TestGetLock(t *testing.T) {
+	fake := newFakeDynamoDB()
+	want := NewLock("lock", "owner", 60000, 1000, "v1", 3, 600, 1000, "data")
+	item, err := lockToDynamoDBAttributeValues(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.items["lock"] = item
+	client := newTestDynamoDBLockClient(fake)
+
+	got, err := client.getLock(context.Background(), "lock")
+	if err != nil {
+		t.Fatalf("getLock() error = %v", err)
+	}
+	if !reflect.DeepEqual(*got, want) {
+		t.Errorf("getLock() = %+v, want %+v", *got, want)
+	}
+
+	got, err = client.getLock(context.Background(), "missing")
+	if err != nil || got != nil {
+		t.Errorf("getLock() of a missing lock = %v, %v, want nil, nil", got, err)
+	}
+}
+
+// TestCloseWaitsForHeartbeat closes the client while a heartbeat is in flight: Close must wait for the heartbeat job
+// to exit before releasing the lock, so that the heartbeat cannot write the lock back after it has been released.
+func TestCloseWaitsForHeartbeat(t *testing.T) {
+	fake := newFakeDynamoDB()
+	client := newTestDynamoDBLockClient(fake)
+	if _, err := client.Acquire(context.Background(), "lock", "data"); err != nil {
+		t.Fatalf("Acquire() error = %v", err)
+	}
+	started, release := make(chan string), make(chan struct{})
+	fake.mu.Lock()
+	fake.putStarted, fake.putRelease = started, release
+	fake.mu.Unlock()
+	client.startBackgroundJobs(time.Millisecond)
+	<-started
+
+	closed := make(chan error)
+	go func() {
+		closed <- client.Close()
+	}()
+	select {
+	case err := <-closed:
+		t.Fatalf("Close() = %v before the in-flight heartbeat finished", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-closed; err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	// More heartbeats may have run before the job saw it was stopped, but none after the release.
+	calls := fake.callLog()
+	if len(calls) < 3 || calls[len(calls)-1] != "DeleteItem lock" {
+		t.Errorf("calls = %v, want acquire and heartbeat puts followed by a single delete", calls)
+	}
+	for _, call := range calls[:len(calls)-1] {
+		if call != "PutItem lock" {
+			t.Errorf("calls = %v, want only puts before the delete", calls)
+		}
+	}
+	if client.Healthy() {
+		t.Error("Healthy() = true after Close, want false")
+	}
+	if locks := client.ListOwnedLocks(); len(locks) != 0 {
+		t.Errorf("ListOwnedLocks() = %v after Close, want none", locks)
+	}
+}
+
+// TestCloseReleasesConcurrently holds every release on Close until all of them have started, which only happens if
+// they run concurrently, and then checks that closing again does nothing.
+func TestCloseReleasesConcurrently(t *testing.T) {
+	fake := newFakeDynamoDB()
+	client := newTestDynamoDBLockClient(fake)
+	ids := []string{"a", "b", "c", "d"}
+	for _, id := range ids {
+		if _, err := client.Acquire(context.Background(), id, nil); err != nil {
+			t.Fatalf("Acquire(%s) error = %v", id, err)
+		}
+	}
+	client.startBackgroundJobs(time.Hour)
+
+	inFlight := make(chan string, len(ids))
+	release := make(chan struct{})
+	fake.onDelete = func(id string) {
+		inFlight <- id
+		<-release
+	}
+	closed := make(chan error)
+	go func() {
+		closed <- client.Close()
+	}()
+	for range ids {
+		select {
+		case <-inFlight:
+		case <-time.After(time.Second):
+			close(release)
+			t.Fatal("Close() released locks one at a time, want concurrently")
+		}
+	}
+	close(release)
+	if err := <-closed; err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if locks := client.ListOwnedLocks(); len(locks) != 0 {
+		t.Errorf("ListOwnedLocks() = %v after Close, want none", locks)
+	}
+
+	calls := len(fake.callLog())
+	if err := client.Close(); err != nil {
+		t.Errorf("second Close() error = %v, want nil", err)
+	}
+	if got := len(fake.callLog()); got != calls {
+		t.Errorf("second Close() made %d calls, want none", got-calls)
+	}
+}
+
+// TestShardDistribution acquires many locks and checks that they are spread evenly across shards. Each shard's count
+// is binomial with a standard deviation of about 27, so the tolerance of 150 fails by chance far less than once in a
+// million runs.
+func TestShardDistribution(t *testing.T) {
+	const locks = 4000
+	const tolerance = 150
+	client := newTestDynamoDBLockClient(newFakeDynamoDB())
+	for i := 0; i < locks; i++ {
+		if _, err := client.Acquire(context.Background(), fmt.Sprintf("lock-%d", i), nil); err != nil {
+			t.Fatalf("Acquire() error = %v", err)
+		}
+	}
+
+	distribution := client.shardDistribution()
+	if len(distribution) != client.Config.MaxShards {
+		t.Fatalf("shardDistribution() has %d shards, want %d", len(distribution), client.Config.MaxShards)
+	}
+	want := locks / client.Config.MaxShards
+	total := 0
+	for shard, count := range distribution {
+		total += count
+		if count < want-tolerance || count > want+tolerance {
+			t.Errorf("shard %d has %d locks, want %d ± %d", shard, count, want, tolerance)
+		}
+	}
+	if total != locks {
+		t.Errorf("shardDistribution() counts %d locks, want %d", total, locks)
+	}
+
+	// The distribution is a copy, so changing it does not affect the client's counts.
+	distribution[0] = -1
+	if client.shardDistribution()[0] == -1 {
+		t.Error("shardDistribution() returned the client's counts rather than a copy")
+	}
+}
+
+// panickingDynamoDB is a fakeDynamoDB whose PutItem panics while panicking is set, counting the panics.
+type panickingDynamoDB struct {
+	*fakeDynamoDB
+	panicking atomic.Bool
+	panics    atomic.Int32
+}
+
+func (p *panickingDynamoDB) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	if p.panicking.Load() {
+		p.panics.Add(1)
+		panic("assignment to entry in nil map")
+	}
+	return p.fakeDynamoDB.PutItem(ctx, params, optFns...)
+}
+
+// TestHeartbeatSurvivesPanic checks that the heartbeat job keeps running, and heartbeating, after heartbeats panic.
+func TestHeartbeatSurvivesPanic(t *testing.T) {
+	fake := &panickingDynamoDB{fakeDynamoDB: newFakeDynamoDB()}
+	client := newTestDynamoDBLockClient(fake)
+	if _, err := client.Acquire(context.Background(), "lock", "data"); err != nil {
+		t.Fatalf("Acquire() error = %v", err)
+	}
+	fake.panicking.Store(true)
+	client.startBackgroundJobs(time.Millisecond)
+	defer func() {
+		if err := client.Close(); err != nil {
+			t.Errorf("Close() error = %v", err)
+		}
+	}()
+
+	waitFor := func(what string, condition func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !condition() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitFor("heartbeats to panic", func() bool { return fake.panics.Load() >= 3 })
+	if !client.Healthy() {
+		t.Fatal("Healthy() = false after heartbeats panicked, want true")
+	}
+
+	fake.panicking.Store(false)
+	puts := len(fake.callLog())
+	waitFor("a heartbeat after the panics", func() bool { return len(fake.callLog()) > puts })
+	if locks := client.ListOwnedLocks(); len(locks) != 1 {
+		t.Errorf("ListOwnedLocks() = %v, want the lock still held", locks)
+	}
+}
+
+func TestAcquireWithRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		releaseIn time.Duration // how long the other owner holds the lock, or forever if zero
+		maxWait   time.Duration
+		wantErr   bool
+	}{
+		{name: "held lock is released", releaseIn: 150 * time.Millisecond, maxWait: 5 * time.Second},
+		{name: "held lock is not released in time", maxWait: 200 * time.Millisecond, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeDynamoDB()
+			other := newTestDynamoDBLockClient(fake)
+			other.Config.Owner = "other"
+			if _, err := other.Acquire(context.Background(), "lock", "data"); err != nil {
+				t.Fatalf("other Acquire() error = %v", err)
+			}
+			if tt.releaseIn > 0 {
+				timer := time.AfterFunc(tt.releaseIn, func() {
+					if err := other.Release(context.Background(), "lock"); err != nil {
+						t.Errorf("other Release() error = %v", err)
+					}
+				})
+				defer timer.Stop()
+			}
+
+			client := newTestDynamoDBLockClient(fake)
+			start := time.Now()
+			lock, err := client.AcquireWithRetry(context.Background(), "lock", "data", tt.maxWait)
+			elapsed := time.Since(start)
+
+			if tt.wantErr {
+				var unavailable LockCurrentlyUnavailableError
+				if !errors.As(err, &unavailable) {
+					t.Errorf("AcquireWithRetry() error = %v, want LockCurrentlyUnavailableError", err)
+				}
+				if elapsed < tt.maxWait {
+					t.Errorf("AcquireWithRetry() gave up after %v, want at least %v", elapsed, tt.maxWait)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("AcquireWithRetry() error = %v", err)
+			}
+			if lock.Owner != "owner" {
+				t.Errorf("AcquireWithRetry() lock owner = %q, want owner", lock.Owner)
+			}
+			if elapsed < tt.releaseIn {
+				t.Errorf("AcquireWithRetry() acquired after %v, before the lock was released", elapsed)
+			}
+		})
+	}
+}
+
+// TestHeartbeatAfterConcurrentRelease releases the lock from another process while a heartbeat is in flight, and
+// checks that the heartbeat does not recreate the lock, and that the lock is forgotten locally.
+func TestHeartbeatAfterConcurrentRelease(t *testing.T) {
+	fake := newFakeDynamoDB()
+	client := newTestDynamoDBLockClient(fake)
+	if _, err := client.Acquire(context.Background(), "lock", "data"); err != nil {
+		t.Fatalf("Acquire() error = %v", err)
+	}
+	started, release := make(chan string), make(chan struct{})
+	fake.mu.Lock()
+	fake.putStarted, fake.putRelease = started, release
+	fake.mu.Unlock()
+
+	heartbeat := make(chan error)
+	go func() {
+		heartbeat <- client.Heartbeat(context.Background(), "lock", nil)
+	}()
+	<-started
+	// Another process releases the lock, deleting its row.
+	if _, err := fake.DeleteItem(context.Background(), &dynamodb.DeleteItemInput{
+		Key: map[string]dynamodbtypes.AttributeValue{"LockID": &dynamodbtypes.AttributeValueMemberS{Value: "lock"}},
+	}); err != nil {
+		t.Fatalf("DeleteItem() error = %v", err)
+	}
+	close(release)
+
+	var unavailable LockCurrentlyUnavailableError
+	if err := <-heartbeat; !errors.As(err, &unavailable) {
+		t.Errorf("Heartbeat() error = %v, want LockCurrentlyUnavailableError", err)
+	}
+	fake.mu.Lock()
+	_, exists := fake.items["lock"]
+	fake.mu.Unlock()
+	if exists {
+		t.Error("Heartbeat() recreated the released lock")
+	}
+	if locks := client.ListOwnedLocks(); len(locks) != 0 {
+		t.Errorf("ListOwnedLocks() = %v, want the released lock forgotten", locks)
+	}
+}
+
+// TestListOwnedLocksIsCopy checks that changing the returned snapshot does not change the locks the client holds, and
+// that later acquires do not change an earlier snapshot.
+func TestListOwnedLocksIsCopy(t *testing.T) {
+	client := newTestDynamoDBLockClient(newFakeDynamoDB())
+	for _, id := range []string{"b", "a"} {
+		if _, err := client.Acquire(context.Background(), id, "data"); err != nil {
+			t.Fatalf("Acquire(%q) error = %v", id, err)
+		}
+	}
+
+	snapshot := client.ListOwnedLocks()
+	if len(snapshot) != 2 || snapshot[0].ID != "a" || snapshot[1].ID != "b" {
+		t.Fatalf("ListOwnedLocks() = %v, want locks a and b in order", snapshot)
+	}
+	snapshot[0].Owner = "someone else"
+	snapshot[1] = Lock{ID: "c"}
+
+	if _, err := client.Acquire(context.Background(), "d", "data"); err != nil {
+		t.Fatalf("Acquire(d) error = %v", err)
+	}
+	if len(snapshot) != 2 || snapshot[0].ID != "a" || snapshot[1].ID != "c" {
+		t.Errorf("snapshot = %v after another acquire, want it unchanged", snapshot)
+	}
+
+	locks := client.ListOwnedLocks()
+	var ids []string
+	for _, lock := range locks {
+		ids = append(ids, lock.ID)
+		if lock.Owner != "owner" {
+			t.Errorf("ListOwnedLocks() lock %s owner = %q, want owner", lock.ID, lock.Owner)
+		}
+	}
+	if want := []string{"a", "b", "d"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("ListOwnedLocks() IDs = %v, want %v", ids, want)
+	}
+}
+
+// TestConcurrentAcquireReleaseHeartbeat acquires and releases locks while they are heartbeated, and is meant to be run
+// with -race. Once everything is released, no heartbeat may have left a lock behind.
+func TestConcurrentAcquireReleaseHeartbeat(t *testing.T) {
+	fake := newFakeDynamoDB()
+	client := newTestDynamoDBLockClient(fake)
+	client.startBackgroundJobs(time.Millisecond)
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				id := fmt.Sprintf("lock-%d-%d", worker, i%3)
+				if _, err := client.Acquire(context.Background(), id, "data"); err != nil {
+					t.Errorf("Acquire(%q) error = %v", id, err)
+					return
+				}
+				client.heartbeatAll(client.zlog)
+				if err := client.Release(context.Background(), id); err != nil {
+					t.Errorf("Release(%q) error = %v", id, err)
+					return
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+	if err := client.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	if locks := client.ListOwnedLocks(); len(locks) != 0 {
+		t.Errorf("ListOwnedLocks() = %v, want none", locks)
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.items) != 0 {
+		t.Errorf("items left behind = %v, want none", fake.items)
+	}
+}
+
+// TestHeartbeatStaleVersion checks that a heartbeat of a lock snapshot taken before the lock was released and
+// acquired again does not update the newer lock.
+func TestHeartbeatStaleVersion(t *testing.T) {
+	fake := newFakeDynamoDB()
+	client := newTestDynamoDBLockClient(fake)
+	stale, err := client.Acquire(context.Background(), "lock", "data")
+	if err != nil {
+		t.Fatalf("Acquire() error = %v", err)
+	}
+	if err := client.Release(context.Background(), "lock"); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+	current, err := client.Acquire(context.Background(), "lock", "data")
+	if err != nil {
+		t.Fatalf("second Acquire() error = %v", err)
+	}
+	calls := len(fake.callLog())
+
+	if err := client.heartbeat(context.Background(), *stale, nil); !errors.Is(err, LockNotFoundError) {
+		t.Errorf("heartbeat() of stale lock error = %v, want %v", err, LockNotFoundError)
+	}
+	if got := len(fake.callLog()); got != calls {
+		t.Errorf("heartbeat() of stale lock made %d calls, want none", got-calls)
+	}
+	if locks := client.ListOwnedLocks(); len(locks) != 1 || locks[0].RecordVersionNumber != current.RecordVersionNumber {
+		t.Errorf("ListOwnedLocks() = %v, want the current lock", locks)
+	}
+}
+
+func TestDynamoDBLockConfigValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		lease     int
+		heartbeat int
+		wantErr   bool
+	}{
+		{name: "defaults", lease: 10, heartbeat: 3},
+		{name: "heartbeat just under half the lease", lease: 30, heartbeat: 14},
+		{name: "heartbeat half the lease", lease: 10, heartbeat: 5, wantErr: true},
+		{name: "heartbeat longer than the lease", lease: 10, heartbeat: 20, wantErr: true},
+		{name: "zero lease", heartbeat: 3, wantErr: true},
+		{name: "zero heartbeat", lease: 10, wantErr: true},
+		{name: "negative heartbeat", lease: 10, heartbeat: -1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DynamoDBLockConfig{LeaseDurationSeconds: tt.lease, HeartbeatIntervalSeconds: tt.heartbeat}
+			err := config.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, InvalidLockConfigError) {
+				t.Errorf("Validate() error = %v, want InvalidLockConfigError", err)
+			}
+		})
+	}
+}
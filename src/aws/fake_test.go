@@ -0,0 +1,122 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package aws
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/rs/zerolog"
+	"strings"
+	"sync"
+)
+
+// fakeDynamoDB is a DynamoDBAPI that serves lock items from memory, keyed by LockID, and records the calls made to
+// it. Condition expressions are not evaluated, except that a PutItem requiring LockID to exist fails with
+// ConditionalCheckFailedException if the item does not. If putStarted is set, the next PutItem sends on it and then waits for
+// putRelease, so that a test can hold a write in flight; DeleteItem calls onDelete, if set, before deleting. Methods a
+// test does not set up are left to the embedded nil client, and panic if called.
+type fakeDynamoDB struct {
+	DynamoDBAPI
+
+	mu    sync.Mutex
+	items map[string]map[string]dynamodbtypes.AttributeValue
+	calls []string
+
+	putStarted chan string
+	putRelease chan struct{}
+	onDelete   func(id string)
+}
+
+func newFakeDynamoDB() *fakeDynamoDB {
+	return &fakeDynamoDB{items: make(map[string]map[string]dynamodbtypes.AttributeValue)}
+}
+
+func (f *fakeDynamoDB) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := params.Key["LockID"].(*dynamodbtypes.AttributeValueMemberS).Value
+	return &dynamodb.GetItemOutput{Item: f.items[id]}, nil
+}
+
+func (f *fakeDynamoDB) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	id := params.Item["LockID"].(*dynamodbtypes.AttributeValueMemberS).Value
+	f.mu.Lock()
+	started, release := f.putStarted, f.putRelease
+	f.putStarted, f.putRelease = nil, nil
+	f.mu.Unlock()
+	if started != nil {
+		started <- id
+		<-release
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "PutItem "+id)
+	if _, exists := f.items[id]; !exists && requiresLockIDExists(params) {
+		return nil, &dynamodbtypes.ConditionalCheckFailedException{Message: aws.String("The conditional request failed")}
+	}
+	f.items[id] = params.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+// requiresLockIDExists returns whether the condition of params includes attribute_exists(LockID).
+func requiresLockIDExists(params *dynamodb.PutItemInput) bool {
+	condition := aws.ToString(params.ConditionExpression)
+	for placeholder, name := range params.ExpressionAttributeNames {
+		if name == "LockID" && strings.Contains(condition, "attribute_exists ("+placeholder+")") {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeDynamoDB) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	id := params.Key["LockID"].(*dynamodbtypes.AttributeValueMemberS).Value
+	if f.onDelete != nil {
+		f.onDelete(id)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "DeleteItem "+id)
+	delete(f.items, id)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+// callLog returns the calls made so far, e.g. "PutItem lock", in order.
+func (f *fakeDynamoDB) callLog() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+// newTestDynamoDBLockClient returns a lock client backed by client, without a background heartbeat job; tests that
+// need one start it with startBackgroundJobs.
+func newTestDynamoDBLockClient(client DynamoDBAPI) *DynamoDBLockClient {
+	zlog := zerolog.Nop()
+	return &DynamoDBLockClient{
+		Client:             client,
+		TableName:          "locks",
+		Config:             DynamoDBLockConfig{Owner: "owner", MaxShards: 4, LeaseDurationSeconds: 60, HeartbeatIntervalSeconds: 10},
+		locks:              make(map[string]Lock),
+		shardCounts:        make([]int, 4),
+		stopBackgroundJobs: make(chan struct{}),
+		backgroundJobsDone: make(chan struct{}),
+		zlog:               &zlog,
+	}
+}
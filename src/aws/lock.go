@@ -42,6 +42,8 @@ type LockClient interface {
 	Release(ctx context.Context, id string) error
 	Close() error
 	Owner() string
+	ListOwnedLocks() []Lock
+	Healthy() bool
 }
 
 func NewLock(
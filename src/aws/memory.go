@@ -0,0 +1,129 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package aws
+
+import (
+	"context"
+	"github.com/gofrs/uuid"
+	"github.com/rs/zerolog"
+	"src/metrics"
+	"src/tracing"
+	"sync"
+	"time"
+)
+
+// InMemoryLockClient is a LockClient that only locks within this process. It is a fallback for when DynamoDB is not
+// available, and is only safe if a single instance of the bot is running; several instances would each handle every
+// interaction.
+type InMemoryLockClient struct {
+	owner string
+	locks map[string]Lock
+	mu    sync.Mutex // protects locks
+	zlog  *zerolog.Logger
+}
+
+func NewInMemoryLockClient(owner string, zlog *zerolog.Logger) *InMemoryLockClient {
+	return &InMemoryLockClient{
+		owner: owner,
+		locks: make(map[string]Lock),
+		zlog:  zlog,
+	}
+}
+
+// Acquire takes the lock with id, returning LockCurrentlyUnavailableError if it is already held. Locks are held until
+// they are released; they do not expire.
+func (m *InMemoryLockClient) Acquire(ctx context.Context, id string, data interface{}) (*Lock, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if existingLock, ok := m.locks[id]; ok {
+		tracing.Logger(ctx, m.zlog).Debug().Str("id", id).Msg("lock is already acquired")
+		return &existingLock, LockCurrentlyUnavailableError{}
+	}
+	nowMilliseconds := time.Now().UnixNano() / int64(time.Millisecond)
+	lock := NewLock(
+		id,
+		m.owner,
+		0, /*LeaseDurationMilliseconds*/
+		nowMilliseconds,
+		uuid.Must(uuid.NewV4()).String(),
+		0, /*Shard*/
+		0, /*TTLEpochSeconds*/
+		nowMilliseconds,
+		data,
+	)
+	m.locks[id] = lock
+	metrics.Locks.WithLabelValues("acquired").Inc()
+	return &lock, nil
+}
+
+func (m *InMemoryLockClient) Heartbeat(ctx context.Context, id string, maybeNewData *interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lock, ok := m.locks[id]
+	if !ok {
+		return LockNotFoundError
+	}
+	lock.LastUpdatedTimeMilliseconds = time.Now().UnixNano() / int64(time.Millisecond)
+	if maybeNewData != nil {
+		lock.Data = *maybeNewData
+	}
+	m.locks[id] = lock
+	return nil
+}
+
+func (m *InMemoryLockClient) Release(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.locks[id]; !ok {
+		return LockNotFoundError
+	}
+	delete(m.locks, id)
+	metrics.Locks.WithLabelValues("released").Inc()
+	return nil
+}
+
+// Close drops every lock. It is safe to call more than once.
+func (m *InMemoryLockClient) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.locks = make(map[string]Lock)
+	return nil
+}
+
+func (m *InMemoryLockClient) Owner() string {
+	return m.owner
+}
+
+func (m *InMemoryLockClient) ListOwnedLocks() []Lock {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	locks := make([]Lock, 0, len(m.locks))
+	for _, lock := range m.locks {
+		locks = append(locks, lock)
+	}
+	return locks
+}
+
+// Healthy always returns true, since there is no background work to fail.
+func (m *InMemoryLockClient) Healthy() bool {
+	return true
+}
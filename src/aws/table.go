@@ -0,0 +1,124 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/rs/zerolog"
+	"time"
+)
+
+const (
+	// lockTableShardIndex is the global secondary index over Shard and LastUpdated, matching infra/main.tf.
+	lockTableShardIndex = "ShardIndex"
+
+	// createTableTimeout bounds how long to wait for a newly created lock table to become active.
+	createTableTimeout = 5 * time.Minute
+)
+
+// EnsureLockTable creates the lock table tableName, as infra/main.tf would, if it does not exist, and waits for it to
+// become active. It then enables TTL on the TTL attribute, if it is not already enabled, so that DynamoDB deletes
+// locks that were never released.
+func EnsureLockTable(ctx context.Context, client *dynamodb.Client, tableName string, zlog *zerolog.Logger) error {
+	_, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+	var notFound *dynamodbtypes.ResourceNotFoundException
+	switch {
+	case err == nil:
+		zlog.Debug().Str("table", tableName).Msg("lock table already exists")
+	case errors.As(err, &notFound):
+		if err := createLockTable(ctx, client, tableName, zlog); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("failed to describe table %s: %w", tableName, err)
+	}
+	return enableTTL(ctx, client, tableName, zlog)
+}
+
+// createLockTable creates the lock table tableName and waits for it to become active.
+func createLockTable(ctx context.Context, client *dynamodb.Client, tableName string, zlog *zerolog.Logger) error {
+	zlog.Info().Str("table", tableName).Msg("creating lock table")
+	_, err := client.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName:   aws.String(tableName),
+		BillingMode: dynamodbtypes.BillingModePayPerRequest,
+		AttributeDefinitions: []dynamodbtypes.AttributeDefinition{
+			{AttributeName: aws.String("LockID"), AttributeType: dynamodbtypes.ScalarAttributeTypeS},
+			{AttributeName: aws.String("Shard"), AttributeType: dynamodbtypes.ScalarAttributeTypeN},
+			{AttributeName: aws.String("LastUpdated"), AttributeType: dynamodbtypes.ScalarAttributeTypeN},
+		},
+		KeySchema: []dynamodbtypes.KeySchemaElement{
+			{AttributeName: aws.String("LockID"), KeyType: dynamodbtypes.KeyTypeHash},
+		},
+		GlobalSecondaryIndexes: []dynamodbtypes.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String(lockTableShardIndex),
+				KeySchema: []dynamodbtypes.KeySchemaElement{
+					{AttributeName: aws.String("Shard"), KeyType: dynamodbtypes.KeyTypeHash},
+					{AttributeName: aws.String("LastUpdated"), KeyType: dynamodbtypes.KeyTypeRange},
+				},
+				Projection: &dynamodbtypes.Projection{ProjectionType: dynamodbtypes.ProjectionTypeAll},
+			},
+		},
+		SSESpecification: &dynamodbtypes.SSESpecification{Enabled: aws.Bool(true)},
+	})
+	// Another instance starting at the same time may have created the table first.
+	var inUse *dynamodbtypes.ResourceInUseException
+	if err != nil && !errors.As(err, &inUse) {
+		return fmt.Errorf("failed to create table %s: %w", tableName, err)
+	}
+
+	waiter := dynamodb.NewTableExistsWaiter(client)
+	err = waiter.Wait(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(tableName)}, createTableTimeout)
+	if err != nil {
+		return fmt.Errorf("table %s did not become active: %w", tableName, err)
+	}
+	zlog.Info().Str("table", tableName).Msg("lock table is active")
+	return nil
+}
+
+// enableTTL enables TTL on the TTL attribute of tableName. DynamoDB rejects enabling TTL that is already enabled or
+// being enabled, so the current status is checked first.
+func enableTTL(ctx context.Context, client *dynamodb.Client, tableName string, zlog *zerolog.Logger) error {
+	output, err := client.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: aws.String(tableName)})
+	if err != nil {
+		return fmt.Errorf("failed to describe TTL of table %s: %w", tableName, err)
+	}
+	if description := output.TimeToLiveDescription; description != nil {
+		switch description.TimeToLiveStatus {
+		case dynamodbtypes.TimeToLiveStatusEnabled, dynamodbtypes.TimeToLiveStatusEnabling:
+			return nil
+		}
+	}
+
+	zlog.Info().Str("table", tableName).Msg("enabling TTL on lock table")
+	_, err = client.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(tableName),
+		TimeToLiveSpecification: &dynamodbtypes.TimeToLiveSpecification{
+			AttributeName: aws.String("TTL"),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enable TTL on table %s: %w", tableName, err)
+	}
+	return nil
+}
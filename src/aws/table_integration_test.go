@@ -0,0 +1,93 @@
+//go:build integration
+
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package aws
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/rs/zerolog"
+	"os"
+	"testing"
+	"time"
+)
+
+// newDynamoDBLocalClient returns a client for the DynamoDB Local endpoint in DYNAMODB_LOCAL_ENDPOINT, e.g.
+// http://localhost:8000, skipping the test if it is unset.
+func newDynamoDBLocalClient(t *testing.T) *dynamodb.Client {
+	t.Helper()
+	endpoint := os.Getenv("DYNAMODB_LOCAL_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("DYNAMODB_LOCAL_ENDPOINT is not set")
+	}
+	return dynamodb.New(dynamodb.Options{
+		Region:           "us-west-2",
+		EndpointResolver: dynamodb.EndpointResolverFromURL(endpoint),
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "local", SecretAccessKey: "local"}, nil
+		}),
+	})
+}
+
+func TestEnsureLockTable(t *testing.T) {
+	client := newDynamoDBLocalClient(t)
+	ctx := context.Background()
+	zlog := zerolog.Nop()
+	tableName := fmt.Sprintf("locks-%d", time.Now().UnixNano())
+	t.Cleanup(func() {
+		_, _ = client.DeleteTable(ctx, &dynamodb.DeleteTableInput{TableName: aws.String(tableName)})
+	})
+
+	if err := EnsureLockTable(ctx, client, tableName, &zlog); err != nil {
+		t.Fatalf("EnsureLockTable() error = %v", err)
+	}
+	// A second call finds the table and TTL already in place.
+	if err := EnsureLockTable(ctx, client, tableName, &zlog); err != nil {
+		t.Fatalf("EnsureLockTable() on existing table error = %v", err)
+	}
+
+	table, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+	if err != nil {
+		t.Fatalf("DescribeTable() error = %v", err)
+	}
+	if status := table.Table.TableStatus; status != dynamodbtypes.TableStatusActive {
+		t.Errorf("TableStatus = %v, want %v", status, dynamodbtypes.TableStatusActive)
+	}
+	keySchema := table.Table.KeySchema
+	if len(keySchema) != 1 || aws.ToString(keySchema[0].AttributeName) != "LockID" ||
+		keySchema[0].KeyType != dynamodbtypes.KeyTypeHash {
+		t.Errorf("KeySchema = %+v, want LockID hash key", keySchema)
+	}
+	if indexes := table.Table.GlobalSecondaryIndexes; len(indexes) != 1 ||
+		aws.ToString(indexes[0].IndexName) != lockTableShardIndex {
+		t.Errorf("GlobalSecondaryIndexes = %+v, want %s", indexes, lockTableShardIndex)
+	}
+
+	ttl, err := client.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: aws.String(tableName)})
+	if err != nil {
+		t.Fatalf("DescribeTimeToLive() error = %v", err)
+	}
+	description := ttl.TimeToLiveDescription
+	if description == nil || aws.ToString(description.AttributeName) != "TTL" ||
+		description.TimeToLiveStatus != dynamodbtypes.TimeToLiveStatusEnabled {
+		t.Errorf("TimeToLiveDescription = %+v, want enabled on TTL", description)
+	}
+}
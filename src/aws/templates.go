@@ -0,0 +1,173 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package aws
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/rs/zerolog"
+	"strconv"
+	"time"
+)
+
+var (
+	TemplateNotFoundError = errors.New("template not found")
+)
+
+// PromptTemplate is a named prompt saved for reuse in a guild. Text may contain {placeholders} that are filled in when
+// the template is used.
+type PromptTemplate struct {
+	GuildID   string
+	Name      string
+	Text      string
+	CreatedBy string
+	CreatedAt time.Time
+}
+
+// TemplateStore saves prompt templates per guild. Saving a template with the name of an existing one in the same guild
+// replaces it.
+type TemplateStore interface {
+	SaveTemplate(ctx context.Context, template PromptTemplate) error
+	GetTemplate(ctx context.Context, guildID string, name string) (*PromptTemplate, error)
+	ListTemplates(ctx context.Context, guildID string) ([]PromptTemplate, error)
+}
+
+// DynamoDBTemplateStore stores templates in a table with the partition key GuildID and the sort key Name, both
+// strings.
+type DynamoDBTemplateStore struct {
+	Client    *dynamodb.Client
+	TableName string
+	zlog      *zerolog.Logger
+}
+
+func NewDynamoDBTemplateStore(tableName string, region string, zlog *zerolog.Logger) (*DynamoDBTemplateStore, error) {
+	client, err := NewDynamoDBClient(region)
+	if err != nil {
+		return nil, err
+	}
+	return &DynamoDBTemplateStore{
+		Client:    client,
+		TableName: tableName,
+		zlog:      zlog,
+	}, nil
+}
+
+func (t *DynamoDBTemplateStore) SaveTemplate(ctx context.Context, template PromptTemplate) error {
+	zlog := t.zlog.With().Str("guild", template.GuildID).Str("template", template.Name).Logger()
+	_, err := t.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: &t.TableName,
+		Item: map[string]dynamodbtypes.AttributeValue{
+			"GuildID":   &dynamodbtypes.AttributeValueMemberS{Value: template.GuildID},
+			"Name":      &dynamodbtypes.AttributeValueMemberS{Value: template.Name},
+			"Text":      &dynamodbtypes.AttributeValueMemberS{Value: template.Text},
+			"CreatedBy": &dynamodbtypes.AttributeValueMemberS{Value: template.CreatedBy},
+			"CreatedAt": &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(template.CreatedAt.Unix(), 10)},
+		},
+	})
+	if err != nil {
+		zlog.Error().Err(err).Msg("failed to save template")
+		return err
+	}
+	zlog.Debug().Msg("saved template")
+	return nil
+}
+
+// GetTemplate returns the template called name in guildID, or TemplateNotFoundError if there is none.
+func (t *DynamoDBTemplateStore) GetTemplate(ctx context.Context, guildID string, name string) (*PromptTemplate, error) {
+	zlog := t.zlog.With().Str("guild", guildID).Str("template", name).Logger()
+	resp, err := t.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: &t.TableName,
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"GuildID": &dynamodbtypes.AttributeValueMemberS{Value: guildID},
+			"Name":    &dynamodbtypes.AttributeValueMemberS{Value: name},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		zlog.Error().Err(err).Msg("failed to get template")
+		return nil, err
+	}
+	if resp.Item == nil {
+		return nil, TemplateNotFoundError
+	}
+	template, err := templateFromItem(resp.Item)
+	if err != nil {
+		zlog.Error().Err(err).Msg("malformed template item")
+		return nil, err
+	}
+	return template, nil
+}
+
+// ListTemplates returns the templates in guildID sorted by name.
+func (t *DynamoDBTemplateStore) ListTemplates(ctx context.Context, guildID string) ([]PromptTemplate, error) {
+	zlog := t.zlog.With().Str("guild", guildID).Logger()
+	keyCondition := expression.Key("GuildID").Equal(expression.Value(guildID))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyCondition).Build()
+	if err != nil {
+		zlog.Error().Err(err).Msg("failed to build expression")
+		return nil, err
+	}
+
+	templates := make([]PromptTemplate, 0)
+	paginator := dynamodb.NewQueryPaginator(t.Client, &dynamodb.QueryInput{
+		TableName:                 &t.TableName,
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			zlog.Error().Err(err).Msg("failed to list templates")
+			return nil, err
+		}
+		for _, item := range page.Items {
+			template, err := templateFromItem(item)
+			if err != nil {
+				zlog.Warn().Err(err).Msg("skipping malformed template item")
+				continue
+			}
+			templates = append(templates, *template)
+		}
+	}
+	return templates, nil
+}
+
+func templateFromItem(item map[string]dynamodbtypes.AttributeValue) (*PromptTemplate, error) {
+	var template PromptTemplate
+	var err error
+	for name, value := range map[string]*string{
+		"GuildID":   &template.GuildID,
+		"Name":      &template.Name,
+		"Text":      &template.Text,
+		"CreatedBy": &template.CreatedBy,
+	} {
+		if *value, err = itemString(item, name); err != nil {
+			return nil, err
+		}
+	}
+	createdAt, err := itemNumber(item, "CreatedAt")
+	if err != nil {
+		return nil, err
+	}
+	template.CreatedAt = time.Unix(createdAt, 0)
+	return &template, nil
+}
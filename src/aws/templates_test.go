@@ -0,0 +1,64 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package aws
+
+import (
+	"errors"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTemplateFromItem(t *testing.T) {
+	item := func() map[string]dynamodbtypes.AttributeValue {
+		return map[string]dynamodbtypes.AttributeValue{
+			"GuildID":   &dynamodbtypes.AttributeValueMemberS{Value: "guild"},
+			"Name":      &dynamodbtypes.AttributeValueMemberS{Value: "explain"},
+			"Text":      &dynamodbtypes.AttributeValueMemberS{Value: "Explain {topic}."},
+			"CreatedBy": &dynamodbtypes.AttributeValueMemberS{Value: "user"},
+			"CreatedAt": &dynamodbtypes.AttributeValueMemberN{Value: "1700000000"},
+		}
+	}
+
+	got, err := templateFromItem(item())
+	if err != nil {
+		t.Fatalf("templateFromItem() error = %v", err)
+	}
+	want := &PromptTemplate{
+		GuildID:   "guild",
+		Name:      "explain",
+		Text:      "Explain {topic}.",
+		CreatedBy: "user",
+		CreatedAt: time.Unix(1700000000, 0),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("templateFromItem() = %+v, want %+v", got, want)
+	}
+
+	for _, attribute := range []string{"GuildID", "Name", "Text", "CreatedBy", "CreatedAt"} {
+		t.Run("missing "+attribute, func(t *testing.T) {
+			malformed := item()
+			delete(malformed, attribute)
+			_, err := templateFromItem(malformed)
+			var malformedErr MalformedLockItemError
+			if !errors.As(err, &malformedErr) || malformedErr.Attribute != attribute {
+				t.Errorf("templateFromItem() error = %v, want %s reported missing", err, attribute)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package aws
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/rs/zerolog"
+	"src/metrics"
+	"src/openai"
+	"time"
+)
+
+// Transcript is a conversation the bot replied to, recorded for auditing. Undelivered is set if the reply could not be
+// sent to Discord, so that the generated response can be recovered.
+type Transcript struct {
+	ThreadID    string                `json:"threadId"`
+	Timestamp   time.Time             `json:"timestamp"`
+	Messages    []*openai.ChatMessage `json:"messages"`
+	Response    string                `json:"response"`
+	Undelivered bool                  `json:"undelivered,omitempty"`
+}
+
+type TranscriptWriter interface {
+	Write(ctx context.Context, transcript Transcript) error
+}
+
+// S3API is the subset of the S3 client used by S3TranscriptWriter.
+type S3API interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+}
+
+// S3TranscriptWriter writes each transcript as a JSON object to Bucket, keyed by thread ID and timestamp.
+type S3TranscriptWriter struct {
+	Client S3API
+	Bucket string
+	zlog   *zerolog.Logger
+}
+
+func NewS3Client(region string) (*s3.Client, error) {
+	cfg, err := config.LoadDefaultConfig(context.TODO(),
+		config.WithRegion(region),
+		config.WithRetryMaxAttempts(3),
+		config.WithDefaultsMode(aws.DefaultsModeAuto),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return s3.NewFromConfig(cfg), nil
+}
+
+func NewS3TranscriptWriter(bucket string, region string, zlog *zerolog.Logger) (*S3TranscriptWriter, error) {
+	client, err := NewS3Client(region)
+	if err != nil {
+		return nil, err
+	}
+	return &S3TranscriptWriter{
+		Client: client,
+		Bucket: bucket,
+		zlog:   zlog,
+	}, nil
+}
+
+// TranscriptKey returns the object key for transcript, e.g. transcripts/1234/2023-02-04T05:06:07.123456789Z.json.
+func TranscriptKey(transcript Transcript) string {
+	return fmt.Sprintf("transcripts/%s/%s.json", transcript.ThreadID, transcript.Timestamp.UTC().Format(time.RFC3339Nano))
+}
+
+func (w *S3TranscriptWriter) Write(ctx context.Context, transcript Transcript) error {
+	body, err := json.Marshal(transcript)
+	if err != nil {
+		w.zlog.Error().Err(err).Str("threadID", transcript.ThreadID).Msg("Failed to marshal transcript")
+		return err
+	}
+
+	key := TranscriptKey(transcript)
+	_, err = w.Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(w.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		w.zlog.Error().Err(err).Str("bucket", w.Bucket).Str("key", key).Msg("Failed to upload transcript")
+		metrics.Errors.WithLabelValues("transcript").Inc()
+		return err
+	}
+	w.zlog.Debug().Str("bucket", w.Bucket).Str("key", key).Msg("Uploaded transcript")
+	return nil
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/rs/zerolog"
+	"io"
+	"reflect"
+	"src/openai"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an S3API that records the objects put, or fails with err.
+type fakeS3 struct {
+	S3API
+	err     error
+	inputs  []*s3.PutObjectInput
+	objects map[string][]byte
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	f.inputs = append(f.inputs, params)
+	if f.err != nil {
+		return nil, f.err
+	}
+	body, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	if f.objects == nil {
+		f.objects = make(map[string][]byte)
+	}
+	f.objects[aws.ToString(params.Key)] = body
+	return &s3.PutObjectOutput{}, nil
+}
+
+func TestTranscriptKey(t *testing.T) {
+	transcript := Transcript{
+		ThreadID:  "1234",
+		Timestamp: time.Date(2023, 2, 4, 5, 6, 7, 123456789, time.FixedZone("PST", -8*60*60)),
+	}
+	want := "transcripts/1234/2023-02-04T13:06:07.123456789Z.json"
+	if got := TranscriptKey(transcript); got != want {
+		t.Errorf("TranscriptKey() = %q, want %q", got, want)
+	}
+}
+
+func TestS3TranscriptWriterWrite(t *testing.T) {
+	zlog := zerolog.Nop()
+	transcript := Transcript{
+		ThreadID:  "1234",
+		Timestamp: time.Date(2023, 2, 4, 5, 6, 7, 0, time.UTC),
+		Messages: []*openai.ChatMessage{
+			{FromHuman: true, Text: "hello"},
+		},
+		Response: "hi there",
+	}
+
+	tests := []struct {
+		name    string
+		err     error
+		wantErr bool
+	}{
+		{name: "uploaded"},
+		{name: "upload fails", err: errors.New("access denied"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeS3{err: tt.err}
+			writer := &S3TranscriptWriter{Client: client, Bucket: "bucket", zlog: &zlog}
+
+			err := writer.Write(context.Background(), transcript)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Write() error = %v, want error %v", err, tt.wantErr)
+			}
+			if len(client.inputs) != 1 {
+				t.Fatalf("Write() made %d PutObject calls, want 1", len(client.inputs))
+			}
+			input := client.inputs[0]
+			key := TranscriptKey(transcript)
+			if aws.ToString(input.Bucket) != "bucket" || aws.ToString(input.Key) != key {
+				t.Errorf("PutObject() bucket, key = %q, %q, want %q, %q", aws.ToString(input.Bucket), aws.ToString(input.Key), "bucket", key)
+			}
+			if aws.ToString(input.ContentType) != "application/json" {
+				t.Errorf("PutObject() content type = %q, want application/json", aws.ToString(input.ContentType))
+			}
+			if tt.wantErr {
+				return
+			}
+
+			var got Transcript
+			if err := json.Unmarshal(client.objects[key], &got); err != nil {
+				t.Fatalf("parsing uploaded transcript: %v", err)
+			}
+			if !reflect.DeepEqual(got, transcript) {
+				t.Errorf("uploaded transcript = %+v, want %+v", got, transcript)
+			}
+		})
+	}
+}
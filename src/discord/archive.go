@@ -0,0 +1,125 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// defaultAutoArchiveDuration is how long, in minutes, new threads stay open without activity.
+	defaultAutoArchiveDuration = 1440 /* 1 day */
+
+	// maxAutoArchiveDuration is the longest auto-archive duration Discord allows, used for threads kept with /keep.
+	maxAutoArchiveDuration = 10080 /* 7 days */
+)
+
+// autoArchiveDurations are the auto-archive durations, in minutes, that Discord accepts.
+var autoArchiveDurations = map[int]bool{
+	60:    true,
+	1440:  true,
+	4320:  true,
+	10080: true,
+}
+
+// threadArchiveEdit returns the channel edit that sets a thread's auto-archive duration to minutes, or an error if
+// Discord does not accept that duration.
+func threadArchiveEdit(minutes int) (*discordgo.ChannelEdit, error) {
+	if !autoArchiveDurations[minutes] {
+		return nil, fmt.Errorf("invalid auto-archive duration %d minutes, must be one of 60, 1440, 4320, or 10080", minutes)
+	}
+	return &discordgo.ChannelEdit{AutoArchiveDuration: minutes}, nil
+}
+
+// threadUpdateHandler keeps the tracked threads in sync with archival, so that the bot does not post to, and thereby
+// unarchive, a thread that has been archived, and listens again once it is unarchived.
+func (d *Discord) threadUpdateHandler(s *discordgo.Session, t *discordgo.ThreadUpdate) {
+	if t.Channel == nil || t.ThreadMetadata == nil {
+		return
+	}
+	zlog := d.zlog.With().Str("channel", t.ID).Logger()
+	threadID := ThreadID(t.ID)
+
+	if t.ThreadMetadata.Archived {
+		if d.idsMap.ArchiveThread(threadID) {
+			zlog.Info().Msg("Stopped listening to archived thread")
+		}
+		return
+	}
+	if d.lookupChannel(t.ID).isThread {
+		return
+	}
+	if d.idsMap.UnarchiveThread(threadID, ChannelID(t.ParentID)) {
+		zlog.Info().Msg("Listening to unarchived thread")
+	}
+}
+
+// keepInteractionHandler keeps the current thread open for as long as Discord allows without activity.
+func (d *Discord) keepInteractionHandler(s Session, i *discordgo.InteractionCreate, ctx context.Context, zlog *zerolog.Logger) {
+	d.setThreadAutoArchive(s, i, maxAutoArchiveDuration, msgThreadKept, zlog)
+}
+
+// unkeepInteractionHandler restores the default auto-archive duration of the current thread.
+func (d *Discord) unkeepInteractionHandler(s Session, i *discordgo.InteractionCreate, ctx context.Context, zlog *zerolog.Logger) {
+	d.setThreadAutoArchive(s, i, defaultAutoArchiveDuration, msgThreadUnkept, zlog)
+}
+
+// setThreadAutoArchive sets the auto-archive duration of the thread the interaction was sent in to minutes, and
+// replies with success if it worked.
+func (d *Discord) setThreadAutoArchive(
+	s Session,
+	i *discordgo.InteractionCreate,
+	minutes int,
+	success messageKey,
+	zlog *zerolog.Logger,
+) {
+	zlog.Info().Int("minutes", minutes).Msg("Received thread auto-archive command")
+
+	respond := func(content string) {
+		_, err := s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+			Content: Ptr(content),
+		})
+		if err != nil {
+			zlog.Error().Err(err).Msg("Failed to respond to interaction")
+		}
+	}
+
+	if !d.lookupChannel(i.ChannelID).isThread {
+		respond(Localize(msgKeepInThread, i.Locale))
+		return
+	}
+
+	edit, err := threadArchiveEdit(minutes)
+	if err != nil {
+		zlog.Error().Err(err).Msg("Invalid auto-archive duration")
+		respond(userErrorMessage(err, i.Locale))
+		return
+	}
+	err = withDiscordRetry(func() error {
+		_, err := s.ChannelEditComplex(i.ChannelID, edit)
+		return err
+	}, zlog)
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to change thread auto-archive duration")
+		respond(userErrorMessage(err, i.Locale))
+		return
+	}
+	respond(Localize(success, i.Locale))
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"testing"
+)
+
+func TestThreadArchiveEdit(t *testing.T) {
+	tests := []struct {
+		name    string
+		minutes int
+		wantErr bool
+	}{
+		{name: "one hour", minutes: 60},
+		{name: "default", minutes: defaultAutoArchiveDuration},
+		{name: "three days", minutes: 4320},
+		{name: "max", minutes: maxAutoArchiveDuration},
+		{name: "zero", minutes: 0, wantErr: true},
+		{name: "unsupported", minutes: 120, wantErr: true},
+		{name: "longer than max", minutes: 20160, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			edit, err := threadArchiveEdit(tt.minutes)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("threadArchiveEdit(%d) error = %v, want error %v", tt.minutes, err, tt.wantErr)
+			}
+			if err == nil && edit.AutoArchiveDuration != tt.minutes {
+				t.Errorf("threadArchiveEdit(%d) AutoArchiveDuration = %d, want %d", tt.minutes, edit.AutoArchiveDuration, tt.minutes)
+			}
+		})
+	}
+}
+
+func TestKeepInteractionHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		command     string
+		channelID   string
+		wantMinutes int
+		wantReply   string
+	}{
+		{name: "keep", command: "keep", channelID: "thread", wantMinutes: maxAutoArchiveDuration, wantReply: Localize(msgThreadKept, "")},
+		{name: "unkeep", command: "unkeep", channelID: "thread", wantMinutes: defaultAutoArchiveDuration, wantReply: Localize(msgThreadUnkept, "")},
+		{name: "outside a thread", command: "keep", channelID: "channel", wantReply: Localize(msgKeepInThread, "")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newFakeSession()
+			session.channels["thread"] = &discordgo.Channel{ID: "thread", ParentID: "channel", Type: discordgo.ChannelTypeGuildPublicThread}
+			d := newTestDiscord(session, nil)
+			d.idsMap.SetChannels(map[ChannelID]bool{"channel": true})
+			d.idsMap.AddThread("thread", "channel")
+			zlog := zerolog.Nop()
+			i := newCommandInteraction(tt.channelID, "user", tt.command)
+
+			if tt.command == "keep" {
+				d.keepInteractionHandler(session, i, context.Background(), &zlog)
+			} else {
+				d.unkeepInteractionHandler(session, i, context.Background(), &zlog)
+			}
+
+			if tt.wantMinutes == 0 {
+				if len(session.channelEdits) != 0 {
+					t.Errorf("edited channels %+v, want no edits outside a thread", session.channelEdits)
+				}
+			} else if len(session.channelEdits) != 1 || session.channelEdits[0].AutoArchiveDuration != tt.wantMinutes {
+				t.Errorf("channel edits = %+v, want auto-archive after %d minutes", session.channelEdits, tt.wantMinutes)
+			}
+			if len(session.responseEdits) != 1 || *session.responseEdits[0].Content != tt.wantReply {
+				t.Errorf("responses = %+v, want %q", session.responseEdits, tt.wantReply)
+			}
+		})
+	}
+}
+
+func TestThreadUpdateHandler(t *testing.T) {
+	d := newTestDiscord(newFakeSession(), nil)
+	d.idsMap.SetChannels(map[ChannelID]bool{"channel": true})
+	d.idsMap.AddThread("thread", "channel")
+	update := func(archived bool) *discordgo.ThreadUpdate {
+		return &discordgo.ThreadUpdate{Channel: &discordgo.Channel{
+			ID:             "thread",
+			ParentID:       "channel",
+			Type:           discordgo.ChannelTypeGuildPublicThread,
+			ThreadMetadata: &discordgo.ThreadMetadata{Archived: archived},
+		}}
+	}
+
+	d.threadUpdateHandler(nil, update(true))
+	if d.idsMap.HasThread("thread") {
+		t.Error("HasThread(thread) = true after archival, want false")
+	}
+	d.threadUpdateHandler(nil, update(false))
+	if !d.idsMap.HasThread("thread") {
+		t.Error("HasThread(thread) = false after unarchival, want true")
+	}
+	d.threadUpdateHandler(nil, &discordgo.ThreadUpdate{Channel: &discordgo.Channel{ID: "thread"}})
+	if !d.idsMap.HasThread("thread") {
+		t.Error("HasThread(thread) = false after an update without metadata, want it unchanged")
+	}
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// maxImageAttachmentBytes is the largest image OpenAI accepts for edits and variations.
+	maxImageAttachmentBytes = 4 * 1024 * 1024
+
+	attachmentDownloadTimeout = 30 * time.Second
+)
+
+var (
+	AttachmentNotPNGError   = errors.New("the image must be a PNG")
+	AttachmentTooLargeError = errors.New("the image must be smaller than 4 MB")
+)
+
+// downloadImageAttachment downloads a PNG attachment, checking its type and size first.
+func downloadImageAttachment(ctx context.Context, attachment *discordgo.MessageAttachment) ([]byte, error) {
+	if attachment.ContentType != "image/png" {
+		return nil, AttachmentNotPNGError
+	}
+	return downloadAttachment(ctx, attachment, maxImageAttachmentBytes, AttachmentTooLargeError)
+}
+
+// downloadAttachment downloads an attachment of at most maxBytes, returning tooLargeErr if it is any larger.
+func downloadAttachment(
+	ctx context.Context,
+	attachment *discordgo.MessageAttachment,
+	maxBytes int,
+	tooLargeErr error,
+) ([]byte, error) {
+	if attachment.Size > maxBytes {
+		return nil, tooLargeErr
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, attachmentDownloadTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, attachment.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download attachment: %s", response.Status)
+	}
+
+	// Read one byte past the limit so that an attachment larger than its reported size is still rejected.
+	data, err := io.ReadAll(io.LimitReader(response.Body, int64(maxBytes)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxBytes {
+		return nil, tooLargeErr
+	}
+	return data, nil
+}
+
+// maxFilenameStemLength bounds the part of an image filename derived from the prompt.
+const maxFilenameStemLength = 50
+
+// imageFilename returns a safe filename for the index'th image generated from prompt, e.g. "a-cat-in-a-hat-1.png" for
+// "A cat in a hat!". Only ASCII letters and digits are kept from the prompt, with every other run of characters,
+// including slashes and non-ASCII letters, replaced by a single hyphen. If nothing is left, fallback is used instead.
+func imageFilename(prompt string, fallback string, index int) string {
+	var builder strings.Builder
+	pendingHyphen := false
+	for _, r := range strings.ToLower(prompt) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if pendingHyphen && builder.Len() > 0 {
+				builder.WriteByte('-')
+			}
+			pendingHyphen = false
+			builder.WriteRune(r)
+		} else {
+			pendingHyphen = true
+		}
+		if builder.Len() >= maxFilenameStemLength {
+			break
+		}
+	}
+
+	stem := builder.String()
+	if len(stem) > maxFilenameStemLength {
+		stem = stem[:maxFilenameStemLength]
+	}
+	stem = strings.TrimRight(stem, "-")
+	if stem == "" {
+		stem = fallback
+	}
+	return fmt.Sprintf("%s-%d.png", stem, index+1)
+}
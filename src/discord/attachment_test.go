@@ -0,0 +1,52 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestImageFilename(t *testing.T) {
+	tests := []struct {
+		name   string
+		prompt string
+		index  int
+		want   string
+	}{
+		{name: "words", prompt: "A cat in a hat!", want: "a-cat-in-a-hat-1.png"},
+		{name: "index", prompt: "A cat", index: 2, want: "a-cat-3.png"},
+		{name: "slashes", prompt: "../../etc/passwd", want: "etc-passwd-1.png"},
+		{name: "backslashes", prompt: `C:\Windows\win.ini`, want: "c-windows-win-ini-1.png"},
+		{name: "unicode", prompt: "Café au lait ☕ 日本", want: "caf-au-lait-1.png"},
+		{name: "only unicode", prompt: "日本の猫", want: "image-1.png"},
+		{name: "empty", prompt: "", want: "image-1.png"},
+		{name: "long", prompt: strings.Repeat("a", 80), want: strings.Repeat("a", maxFilenameStemLength) + "-1.png"},
+		{
+			name:   "long with a hyphen at the limit",
+			prompt: strings.Repeat("a", maxFilenameStemLength-1) + " b",
+			want:   strings.Repeat("a", maxFilenameStemLength-1) + "-1.png",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := imageFilename(tt.prompt, "image", tt.index); got != tt.want {
+				t.Errorf("imageFilename(%q, %q, %d) = %q, want %q", tt.prompt, "image", tt.index, got, tt.want)
+			}
+		})
+	}
+}
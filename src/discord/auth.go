@@ -0,0 +1,89 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+)
+
+// isAuthorized returns whether a user with the given roles may run commands. If both allowlists are empty, everyone is
+// allowed; otherwise the user must be in allowedUserIDs or have at least one role in allowedRoleIDs.
+func isAuthorized(userID string, roleIDs []string, allowedUserIDs []string, allowedRoleIDs []string) bool {
+	if len(allowedUserIDs) == 0 && len(allowedRoleIDs) == 0 {
+		return true
+	}
+	for _, allowedUserID := range allowedUserIDs {
+		if userID == allowedUserID {
+			return true
+		}
+	}
+	for _, roleID := range roleIDs {
+		for _, allowedRoleID := range allowedRoleIDs {
+			if roleID == allowedRoleID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authorizeInteraction returns whether the user who created the interaction may run commands. The member's roles are
+// taken from the interaction, and fetched from Discord if they are missing.
+func (d *Discord) authorizeInteraction(s Session, i *discordgo.InteractionCreate, zlog *zerolog.Logger) bool {
+	if len(d.config.AllowedUserIDs) == 0 && len(d.config.AllowedRoleIDs) == 0 {
+		return true
+	}
+
+	var userID string
+	var roleIDs []string
+	if i.Member != nil && i.Member.User != nil {
+		userID = i.Member.User.ID
+		roleIDs = i.Member.Roles
+	} else if i.User != nil {
+		userID = i.User.ID
+	}
+
+	if roleIDs == nil && i.GuildID != "" && userID != "" && len(d.config.AllowedRoleIDs) > 0 {
+		member, err := s.GuildMember(i.GuildID, userID)
+		if err != nil {
+			zlog.Error().Err(err).Str("user", userID).Msg("Failed to get guild member")
+		} else {
+			roleIDs = member.Roles
+		}
+	}
+
+	return isAuthorized(userID, roleIDs, d.config.AllowedUserIDs, d.config.AllowedRoleIDs)
+}
+
+// respondNotPermitted tells the user, and only the user, that they may not run the command.
+func (d *Discord) respondNotPermitted(s Session, i *discordgo.InteractionCreate, zlog *zerolog.Logger) {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: Localize(msgNotPermitted, i.Locale),
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+	switch {
+	case err == nil:
+	case isAlreadyAcknowledgedError(err):
+		zlog.Debug().Msg("Another instance already rejected the unauthorized interaction")
+	default:
+		zlog.Error().Err(err).Msg("Failed to respond to unauthorized interaction")
+	}
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"net/http"
+	"testing"
+)
+
+func TestIsAuthorized(t *testing.T) {
+	tests := []struct {
+		name           string
+		userID         string
+		roleIDs        []string
+		allowedUserIDs []string
+		allowedRoleIDs []string
+		want           bool
+	}{
+		{name: "no allowlists", userID: "user", want: true},
+		{name: "allowed user", userID: "user", allowedUserIDs: []string{"other", "user"}, want: true},
+		{name: "user not allowed", userID: "user", allowedUserIDs: []string{"other"}, want: false},
+		{name: "allowed role", userID: "user", roleIDs: []string{"member", "admin"}, allowedRoleIDs: []string{"admin"}, want: true},
+		{name: "no allowed role", userID: "user", roleIDs: []string{"member"}, allowedRoleIDs: []string{"admin"}, want: false},
+		{name: "no roles", userID: "user", allowedRoleIDs: []string{"admin"}, want: false},
+		{
+			name:           "allowed by role when users are also listed",
+			userID:         "user",
+			roleIDs:        []string{"admin"},
+			allowedUserIDs: []string{"other"},
+			allowedRoleIDs: []string{"admin"},
+			want:           true,
+		},
+		{name: "missing user", userID: "", allowedUserIDs: []string{"user"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isAuthorized(tt.userID, tt.roleIDs, tt.allowedUserIDs, tt.allowedRoleIDs); got != tt.want {
+				t.Errorf("isAuthorized() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestAuthorizeInteractionFetchesRoles checks that a member's roles are fetched from Discord when the interaction does
+// not include them.
+func TestAuthorizeInteractionFetchesRoles(t *testing.T) {
+	session := newFakeSession()
+	session.members["user"] = &discordgo.Member{Roles: []string{"admin"}}
+	d := newTestDiscord(session, &fakeOpenAI{})
+	d.config.AllowedRoleIDs = []string{"admin"}
+	zlog := zerolog.Nop()
+
+	i := newCommandInteraction("channel", "user", "ping")
+	i.Member.Roles = nil
+	if !d.authorizeInteraction(session, i, &zlog) {
+		t.Errorf("authorizeInteraction() = false for a member whose fetched roles are allowed")
+	}
+
+	i = newCommandInteraction("channel", "stranger", "ping")
+	i.Member.Roles = nil
+	if d.authorizeInteraction(session, i, &zlog) {
+		t.Errorf("authorizeInteraction() = true for a member whose roles could not be fetched")
+	}
+}
+
+// TestUnauthorizedCommandRejectedBeforeLock checks that an unauthorized command is refused without taking a lock, so
+// that it costs no lock write on any instance.
+func TestUnauthorizedCommandRejectedBeforeLock(t *testing.T) {
+	session := newFakeSession()
+	d := newTestDiscord(session, &fakeOpenAI{})
+	locks := &countingLockClient{LockClient: d.lockClient}
+	d.lockClient = locks
+	d.config.AllowedUserIDs = []string{"owner"}
+	d.idsMap.SetChannels(map[ChannelID]bool{"channel": true})
+	zlog := zerolog.Nop()
+	handlers := interactionHandlers{"ping": d.pingInteractionHandler}
+
+	i := newCommandInteraction("channel", "stranger", "ping")
+	if _, ok := d.acknowledgeInteraction(session, i, handlers, context.Background(), &zlog); ok {
+		t.Fatalf("acknowledgeInteraction() = true for an unauthorized user")
+	}
+	if locks.acquired != 0 {
+		t.Errorf("acquired %d locks, want none", locks.acquired)
+	}
+	if len(session.responses) != 1 {
+		t.Fatalf("sent %d responses, want 1", len(session.responses))
+	}
+	response := session.responses[0]
+	if response.Data.Content != Localize(msgNotPermitted, "") || response.Data.Flags != discordgo.MessageFlagsEphemeral {
+		t.Errorf("response = %+v, want an ephemeral not permitted message", response.Data)
+	}
+
+	i = newCommandInteraction("channel", "owner", "ping")
+	release, ok := d.acknowledgeInteraction(session, i, handlers, context.Background(), &zlog)
+	if !ok {
+		t.Fatalf("acknowledgeInteraction() = false for an allowed user")
+	}
+	release()
+	if locks.acquired != 1 {
+		t.Errorf("acquired %d locks, want 1", locks.acquired)
+	}
+}
+
+func TestIsAlreadyAcknowledgedError(t *testing.T) {
+	acknowledged := &discordgo.RESTError{
+		Response: &http.Response{StatusCode: http.StatusBadRequest},
+		Message:  &discordgo.APIErrorMessage{Code: discordgo.ErrCodeInteractionHasAlreadyBeenAcknowledged},
+	}
+	if !isAlreadyAcknowledgedError(acknowledged) {
+		t.Errorf("isAlreadyAcknowledgedError() = false for an already acknowledged interaction")
+	}
+	other := &discordgo.RESTError{
+		Response: &http.Response{StatusCode: http.StatusBadRequest},
+		Message:  &discordgo.APIErrorMessage{Code: discordgo.ErrCodeUnknownInteraction},
+	}
+	if isAlreadyAcknowledgedError(other) || isAlreadyAcknowledgedError(nil) {
+		t.Errorf("isAlreadyAcknowledgedError() = true for another error")
+	}
+}
@@ -0,0 +1,335 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"io"
+	"reflect"
+	"src/openai"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCompleteJSONInteraction(t *testing.T) {
+	tests := []struct {
+		name      string
+		jsonReply json.RawMessage
+		err       error
+		want      string
+	}{
+		{name: "reply", jsonReply: json.RawMessage(`{"name":"Tom"}`), want: "```json\n{\n  \"name\": \"Tom\"\n}\n```"},
+		{
+			name: "invalid JSON",
+			err:  openai.InvalidJSONResponseError,
+			want: Localize(msgGenericError, discordgo.EnglishUS),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newFakeSession()
+			client := &fakeOpenAI{jsonReply: tt.jsonReply, err: tt.err}
+			d := newTestDiscord(session, client)
+			i := newCommandInteraction("channel", "user", "complete",
+				&discordgo.ApplicationCommandInteractionDataOption{
+					Name: "prompt", Type: discordgo.ApplicationCommandOptionString, Value: "Name a cat.",
+				},
+				&discordgo.ApplicationCommandInteractionDataOption{
+					Name: "json", Type: discordgo.ApplicationCommandOptionBoolean, Value: true,
+				},
+			)
+			zlog := zerolog.Nop()
+			d.completeInteractionHandler(session, i, context.Background(), &zlog)
+
+			if len(client.chats) != 1 || client.chats[0][0].Text != "Name a cat." {
+				t.Fatalf("CompleteChatJSON() calls = %v, want one with the prompt", client.chats)
+			}
+			if len(session.responseEdits) != 1 {
+				t.Fatalf("got %d response edits, want 1", len(session.responseEdits))
+			}
+			if got := *session.responseEdits[0].Content; got != tt.want {
+				t.Errorf("response = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInteractionJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []*discordgo.ApplicationCommandInteractionDataOption
+		want    bool
+	}{
+		{name: "unset"},
+		{
+			name:    "false",
+			options: []*discordgo.ApplicationCommandInteractionDataOption{{Name: "json", Type: discordgo.ApplicationCommandOptionBoolean, Value: false}},
+		},
+		{
+			name:    "true",
+			options: []*discordgo.ApplicationCommandInteractionDataOption{{Name: "json", Type: discordgo.ApplicationCommandOptionBoolean, Value: true}},
+			want:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := newCommandInteraction("channel", "user", "complete", tt.options...)
+			if got := interactionJSON(i); got != tt.want {
+				t.Errorf("interactionJSON() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInteractionStopSequences(t *testing.T) {
+	stop := func(value string) []*discordgo.ApplicationCommandInteractionDataOption {
+		return []*discordgo.ApplicationCommandInteractionDataOption{{Name: "stop", Type: discordgo.ApplicationCommandOptionString, Value: value}}
+	}
+	tests := []struct {
+		name    string
+		options []*discordgo.ApplicationCommandInteractionDataOption
+		want    []string
+		wantOK  bool
+	}{
+		{name: "unset"},
+		{name: "one sequence", options: stop("```"), want: []string{"```"}, wantOK: true},
+		{name: "several sequences", options: stop("```,END, "), want: []string{"```", "END", " "}, wantOK: true},
+		{name: "only separators", options: stop(",,")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := newCommandInteraction("channel", "user", "complete", tt.options...)
+			got, ok := interactionStopSequences(i)
+			if ok != tt.wantOK || (ok && !reflect.DeepEqual(got, tt.want)) {
+				t.Errorf("interactionStopSequences() = %q, %v, want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestPromptTooLong(t *testing.T) {
+	tests := []struct {
+		name      string
+		prompt    string
+		maxLength int
+		want      bool
+	}{
+		{name: "under the limit", prompt: strings.Repeat("a", 9), maxLength: 10},
+		{name: "exactly the limit", prompt: strings.Repeat("a", 10), maxLength: 10},
+		{name: "one over the limit", prompt: strings.Repeat("a", 11), maxLength: 10, want: true},
+		{name: "characters not bytes", prompt: strings.Repeat("é", 10), maxLength: 10},
+		{name: "no limit", prompt: strings.Repeat("a", 100000), maxLength: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := promptTooLong(tt.prompt, tt.maxLength); got != tt.want {
+				t.Errorf("promptTooLong(%d characters, %d) = %v, want %v", len([]rune(tt.prompt)), tt.maxLength, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestCompletePromptLength checks that /complete answers a prompt at exactly the limit, and refuses one a character
+// longer, privately and without calling OpenAI.
+func TestCompletePromptLength(t *testing.T) {
+	tests := []struct {
+		name        string
+		length      int
+		wantRefused bool
+	}{
+		{name: "exactly the limit", length: 20},
+		{name: "one over the limit", length: 21, wantRefused: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newFakeSession()
+			client := &fakeOpenAI{completion: &openai.Completion{Text: "done"}}
+			d := newTestDiscord(session, client)
+			d.config.MaxPromptLength = 20
+			i := newCommandInteraction("channel", "user", "complete", promptOption(strings.Repeat("a", tt.length)))
+			zlog := zerolog.Nop()
+
+			d.completeInteractionHandler(session, i, context.Background(), &zlog)
+
+			if !tt.wantRefused {
+				if len(session.followups) != 0 || len(client.prompts) != 1 {
+					t.Errorf("followups = %+v after %d completions, want the prompt answered", session.followups, len(client.prompts))
+				}
+				return
+			}
+			if len(client.prompts) != 0 {
+				t.Errorf("completed %d prompts, want none", len(client.prompts))
+			}
+			if len(session.followups) != 1 || session.followups[0].Flags != discordgo.MessageFlagsEphemeral {
+				t.Fatalf("followups = %+v, want one ephemeral refusal", session.followups)
+			}
+			want := "Prompts can be at most 20 characters long, but yours is 21."
+			if got := session.followups[0].Content; got != want {
+				t.Errorf("refusal = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestCompleteResponse(t *testing.T) {
+	// A quoted prompt adds "> " before it and a blank line after it.
+	const overhead = len("> \n\n")
+	tests := []struct {
+		name          string
+		promptLength  int
+		completion    string
+		wantAttached  bool
+		wantMaxLength int
+	}{
+		{name: "short", promptLength: 10, completion: "done"},
+		{name: "exactly the limit", promptLength: maxMessageLength - overhead - len("done"), completion: "done"},
+		{name: "one over the limit", promptLength: maxMessageLength - overhead - len("done") + 1, completion: "done", wantAttached: true},
+		{name: "long completion", promptLength: 10, completion: strings.Repeat("c", 3000), wantAttached: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prompt := strings.Repeat("p", tt.promptLength)
+			content, attached := completeResponse(prompt, tt.completion)
+			if attached != tt.wantAttached {
+				t.Errorf("completeResponse() attached = %v, want %v", attached, tt.wantAttached)
+			}
+			if length := utf8.RuneCountInString(content); length > maxMessageLength {
+				t.Errorf("completeResponse() is %d characters, want at most %d", length, maxMessageLength)
+			}
+			if attached && strings.Contains(content, prompt) {
+				t.Errorf("completeResponse() = %q, want the prompt left out when attached", content)
+			}
+			if !attached && content != "> "+prompt+"\n\n"+tt.completion {
+				t.Errorf("completeResponse() = %q, want the quoted prompt and completion", content)
+			}
+		})
+	}
+}
+
+func TestPromptFile(t *testing.T) {
+	file := promptFile("a long prompt")
+	if file.Name != "prompt.txt" || file.ContentType != "text/plain" {
+		t.Errorf("promptFile() = %q of type %q, want prompt.txt of type text/plain", file.Name, file.ContentType)
+	}
+	content, err := io.ReadAll(file.Reader)
+	if err != nil || string(content) != "a long prompt" {
+		t.Errorf("promptFile() content = %q, %v, want the prompt", content, err)
+	}
+}
+
+func TestCompleteAttachesLongPrompt(t *testing.T) {
+	session := newFakeSession()
+	client := &fakeOpenAI{completion: &openai.Completion{Text: "done"}}
+	d := newTestDiscord(session, client)
+	prompt := strings.Repeat("a", 2500)
+	i := newCommandInteraction("channel", "user", "complete", promptOption(prompt))
+	zlog := zerolog.Nop()
+
+	d.completeInteractionHandler(session, i, context.Background(), &zlog)
+
+	if len(session.responseEdits) != 1 {
+		t.Fatalf("responseEdits = %+v, want one reply", session.responseEdits)
+	}
+	edit := session.responseEdits[0]
+	if *edit.Content != "done" {
+		t.Errorf("reply = %q, want only the completion", *edit.Content)
+	}
+	if len(edit.Files) != 1 {
+		t.Fatalf("reply files = %+v, want the prompt attached", edit.Files)
+	}
+	if content, _ := io.ReadAll(edit.Files[0].Reader); string(content) != prompt {
+		t.Errorf("attached prompt is %d characters, want %d", len(content), len(prompt))
+	}
+}
+
+func countOption(count int64) *discordgo.ApplicationCommandInteractionDataOption {
+	return &discordgo.ApplicationCommandInteractionDataOption{Name: "count", Type: discordgo.ApplicationCommandOptionInteger, Value: float64(count)}
+}
+
+func TestInteractionCount(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []*discordgo.ApplicationCommandInteractionDataOption
+		want    int
+	}{
+		{name: "unset", options: []*discordgo.ApplicationCommandInteractionDataOption{promptOption("Hi")}, want: 1},
+		{name: "set", options: []*discordgo.ApplicationCommandInteractionDataOption{countOption(2)}, want: 2},
+		{name: "below the minimum", options: []*discordgo.ApplicationCommandInteractionDataOption{countOption(0)}, want: 1},
+		{name: "above the maximum", options: []*discordgo.ApplicationCommandInteractionDataOption{countOption(10)}, want: maxCompletionCandidates},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := newCommandInteraction("channel", "user", "complete", tt.options...)
+			if got := interactionCount(i); got != tt.want {
+				t.Errorf("interactionCount() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatCandidates(t *testing.T) {
+	tests := []struct {
+		name       string
+		candidates []string
+		maxLength  int
+		want       string
+	}{
+		{name: "none", maxLength: 100, want: ""},
+		{name: "one", candidates: []string{"foo"}, maxLength: 100, want: "**1.**\nfoo"},
+		{name: "several, trimmed", candidates: []string{" foo\n", "bar ", "baz"}, maxLength: 100, want: "**1.**\nfoo\n\n**2.**\nbar\n\n**3.**\nbaz"},
+		{name: "exactly fits", candidates: []string{"foo", "bar"}, maxLength: len("**1.**\nfoo\n\n**2.**\nbar"), want: "**1.**\nfoo\n\n**2.**\nbar"},
+		// The 16 characters of headings and separator leave 4 for each candidate.
+		{name: "too long", candidates: []string{"abcdefgh", "ab"}, maxLength: 24, want: "**1.**\nabc…\n\n**2.**\nab"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatCandidates(tt.candidates, tt.maxLength); got != tt.want {
+				t.Errorf("formatCandidates() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	long := strings.Repeat("a", 1000)
+	got := formatCandidates([]string{long, long, long}, maxMessageLength)
+	if length := utf8.RuneCountInString(got); length > maxMessageLength {
+		t.Errorf("formatCandidates() of long candidates is %d characters, want at most %d", length, maxMessageLength)
+	}
+	for _, heading := range []string{"**1.**", "**2.**", "**3.**"} {
+		if !strings.Contains(got, heading) {
+			t.Errorf("formatCandidates() of long candidates = %q, want every candidate shown", got)
+		}
+	}
+}
+
+func TestCompleteCandidates(t *testing.T) {
+	session := newFakeSession()
+	client := &fakeOpenAI{completion: &openai.Completion{Text: "one", Choices: []string{"one", "two"}}}
+	d := newTestDiscord(session, client)
+	i := newCommandInteraction("channel", "user", "complete", promptOption("Count"), countOption(2))
+	zlog := zerolog.Nop()
+
+	d.completeInteractionHandler(session, i, context.Background(), &zlog)
+
+	want := "> Count\n\n**1.**\none\n\n**2.**\ntwo"
+	if len(session.responseEdits) != 1 || *session.responseEdits[0].Content != want {
+		t.Errorf("responseEdits = %+v, want %q", session.responseEdits, want)
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"math"
+	"sync"
+	"time"
+)
+
+// maxCooldownEntries bounds the number of cooldowns tracked at once. Expired cooldowns are cleaned up when it is
+// reached, and if every cooldown is still active the one closest to expiring is dropped.
+const maxCooldownEntries = 10000
+
+type cooldownKey struct {
+	userID  string
+	command string
+}
+
+// CooldownTracker limits how often each user may run each command. It stores when each user's cooldown for a command
+// expires, rather than when they last ran it, so that cooldowns of different lengths can be cleaned up alike.
+type CooldownTracker struct {
+	expiries   map[cooldownKey]time.Time
+	maxEntries int
+	sync.Mutex // protects expiries
+}
+
+func NewCooldownTracker() *CooldownTracker {
+	return &CooldownTracker{
+		expiries:   make(map[cooldownKey]time.Time),
+		maxEntries: maxCooldownEntries,
+	}
+}
+
+// Use records that userID ran command at now, starting a cooldown of length cooldown, and returns zero. If the user's
+// cooldown for the command is still active, it returns the time remaining instead and does not record the use.
+func (c *CooldownTracker) Use(userID string, command string, cooldown time.Duration, now time.Time) time.Duration {
+	c.Lock()
+	defer c.Unlock()
+
+	key := cooldownKey{userID: userID, command: command}
+	if expiry, ok := c.expiries[key]; ok && now.Before(expiry) {
+		return expiry.Sub(now)
+	}
+
+	if _, ok := c.expiries[key]; !ok && len(c.expiries) >= c.maxEntries {
+		c.cleanupLocked(now)
+	}
+	c.expiries[key] = now.Add(cooldown)
+	return 0
+}
+
+// cleanupLocked removes expired cooldowns, and if that frees no room, the cooldown closest to expiring.
+func (c *CooldownTracker) cleanupLocked(now time.Time) {
+	for key, expiry := range c.expiries {
+		if !now.Before(expiry) {
+			delete(c.expiries, key)
+		}
+	}
+	if len(c.expiries) < c.maxEntries {
+		return
+	}
+
+	var soonestKey cooldownKey
+	var soonest time.Time
+	for key, expiry := range c.expiries {
+		if soonest.IsZero() || expiry.Before(soonest) {
+			soonestKey, soonest = key, expiry
+		}
+	}
+	delete(c.expiries, soonestKey)
+}
+
+// checkCooldown returns whether the user who created the interaction may run the command now, and if not tells them,
+// and only them, how long they must wait.
+func (d *Discord) checkCooldown(s Session, i *discordgo.InteractionCreate, zlog *zerolog.Logger) bool {
+	command := i.ApplicationCommandData().Name
+	cooldown, ok := d.config.CommandCooldowns[command]
+	if !ok || cooldown <= 0 {
+		return true
+	}
+
+	var userID string
+	if i.Member != nil && i.Member.User != nil {
+		userID = i.Member.User.ID
+	} else if i.User != nil {
+		userID = i.User.ID
+	}
+
+	remaining := d.cooldowns.Use(userID, command, cooldown, time.Now())
+	if remaining <= 0 {
+		return true
+	}
+
+	zlog.Info().Str("command", command).Str("user", userID).Dur("remaining", remaining).Msg("Command is on cooldown")
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: fmt.Sprintf(Localize(msgCooldown, i.Locale), command, int(math.Ceil(remaining.Seconds()))),
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+	switch {
+	case err == nil:
+	case isAlreadyAcknowledgedError(err):
+		zlog.Debug().Msg("Another instance already rejected the interaction on cooldown")
+	default:
+		zlog.Error().Err(err).Msg("Failed to respond to interaction on cooldown")
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"github.com/rs/zerolog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCooldownTrackerUse(t *testing.T) {
+	tracker := NewCooldownTracker()
+	start := time.Date(2023, 12, 1, 12, 0, 0, 0, time.UTC)
+	cooldown := 30 * time.Second
+
+	if remaining := tracker.Use("user", "image", cooldown, start); remaining != 0 {
+		t.Fatalf("first Use() = %v, want 0", remaining)
+	}
+	if remaining := tracker.Use("user", "image", cooldown, start.Add(10*time.Second)); remaining != 20*time.Second {
+		t.Errorf("Use() during cooldown = %v, want 20s", remaining)
+	}
+	if remaining := tracker.Use("other", "image", cooldown, start.Add(10*time.Second)); remaining != 0 {
+		t.Errorf("Use() by another user = %v, want 0", remaining)
+	}
+	if remaining := tracker.Use("user", "image-edit", cooldown, start.Add(10*time.Second)); remaining != 0 {
+		t.Errorf("Use() of another command = %v, want 0", remaining)
+	}
+
+	// A refused use does not extend the cooldown, which expires exactly cooldown after the last allowed use.
+	if remaining := tracker.Use("user", "image", cooldown, start.Add(cooldown-time.Nanosecond)); remaining != time.Nanosecond {
+		t.Errorf("Use() just before expiry = %v, want 1ns", remaining)
+	}
+	if remaining := tracker.Use("user", "image", cooldown, start.Add(cooldown)); remaining != 0 {
+		t.Errorf("Use() at expiry = %v, want 0", remaining)
+	}
+	if remaining := tracker.Use("user", "image", cooldown, start.Add(cooldown+time.Second)); remaining != cooldown-time.Second {
+		t.Errorf("Use() after a new use = %v, want %v", remaining, cooldown-time.Second)
+	}
+}
+
+// TestCooldownTrackerBounded checks that the tracker never holds more than its maximum number of cooldowns, dropping
+// expired ones first and then the one closest to expiring.
+func TestCooldownTrackerBounded(t *testing.T) {
+	tracker := NewCooldownTracker()
+	tracker.maxEntries = 3
+	start := time.Date(2023, 12, 1, 12, 0, 0, 0, time.UTC)
+
+	tracker.Use("expired", "image", time.Second, start)
+	tracker.Use("soonest", "image", time.Minute, start)
+	tracker.Use("latest", "image", time.Hour, start)
+
+	tracker.Use("new", "image", time.Hour, start.Add(2*time.Second))
+	if len(tracker.expiries) != 3 {
+		t.Fatalf("tracking %d cooldowns, want 3", len(tracker.expiries))
+	}
+	if _, ok := tracker.expiries[cooldownKey{userID: "expired", command: "image"}]; ok {
+		t.Errorf("expired cooldown was kept")
+	}
+
+	tracker.Use("newest", "image", time.Hour, start.Add(3*time.Second))
+	if len(tracker.expiries) != 3 {
+		t.Fatalf("tracking %d cooldowns, want 3", len(tracker.expiries))
+	}
+	if _, ok := tracker.expiries[cooldownKey{userID: "soonest", command: "image"}]; ok {
+		t.Errorf("cooldown closest to expiring was kept")
+	}
+	if remaining := tracker.Use("latest", "image", time.Hour, start.Add(3*time.Second)); remaining == 0 {
+		t.Errorf("active cooldown was dropped")
+	}
+}
+
+// TestCommandOnCooldownRejectedBeforeLock runs a command twice in a row: the second run is refused, with the time
+// remaining, before a lock is taken.
+func TestCommandOnCooldownRejectedBeforeLock(t *testing.T) {
+	session := newFakeSession()
+	d := newTestDiscord(session, &fakeOpenAI{})
+	locks := &countingLockClient{LockClient: d.lockClient}
+	d.lockClient = locks
+	d.config.CommandCooldowns = map[string]time.Duration{"ping": time.Hour}
+	d.idsMap.SetChannels(map[ChannelID]bool{"channel": true})
+	zlog := zerolog.Nop()
+	handlers := interactionHandlers{"ping": d.pingInteractionHandler}
+
+	release, ok := d.acknowledgeInteraction(session, newCommandInteraction("channel", "user", "ping"), handlers, context.Background(), &zlog)
+	if !ok {
+		t.Fatalf("acknowledgeInteraction() = false for the first run")
+	}
+	release()
+
+	if _, ok := d.acknowledgeInteraction(session, newCommandInteraction("channel", "user", "ping"), handlers, context.Background(), &zlog); ok {
+		t.Fatalf("acknowledgeInteraction() = true for a run on cooldown")
+	}
+	if locks.acquired != 1 {
+		t.Errorf("acquired %d locks, want only the first run's", locks.acquired)
+	}
+	last := session.responses[len(session.responses)-1]
+	if !strings.Contains(last.Data.Content, "ping") || !strings.Contains(last.Data.Content, "3600") {
+		t.Errorf("cooldown response = %q, want the command and the seconds remaining", last.Data.Content)
+	}
+}
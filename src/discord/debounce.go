@@ -0,0 +1,58 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"sync"
+	"time"
+)
+
+// debouncer runs a function once events for a key stop arriving for a while, so that a burst of events, such as
+// repeated edits to a message, is handled once.
+type debouncer struct {
+	timers map[string]*time.Timer
+	mu     sync.Mutex // protects timers
+}
+
+func newDebouncer() *debouncer {
+	return &debouncer{timers: make(map[string]*time.Timer)}
+}
+
+// Debounce runs fn after delay, unless Debounce is called again for key first, in which case the earlier call is
+// dropped and the delay starts again.
+func (b *debouncer) Debounce(key string, delay time.Duration, fn func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if timer, ok := b.timers[key]; ok {
+		timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		b.mu.Lock()
+		// A later call may have replaced this timer just as it fired, in which case that call runs instead.
+		current := b.timers[key] == timer
+		if current {
+			delete(b.timers, key)
+		}
+		b.mu.Unlock()
+		if current {
+			fn()
+		}
+	})
+	b.timers[key] = timer
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+)
+
+// lastBotMessage returns the most recent message by botUserID in messages, which are in chronological order, or false
+// if the bot has not sent any.
+func lastBotMessage(messages []*discordgo.Message, botUserID string) (*discordgo.Message, bool) {
+	for index := len(messages) - 1; index >= 0; index-- {
+		if author := messages[index].Author; author != nil && author.ID == botUserID {
+			return messages[index], true
+		}
+	}
+	return nil, false
+}
+
+// canDeleteReplies returns whether a user may delete the bot's replies in a thread: the thread's creator may, as may
+// moderators, i.e. members with permission to manage messages.
+func canDeleteReplies(userID string, creatorID string, permissions int64) bool {
+	if creatorID != "" && userID == creatorID {
+		return true
+	}
+	return permissions&discordgo.PermissionManageMessages != 0
+}
+
+// deleteLastInteractionHandler deletes the bot's most recent message in the current thread, as an undo for an unwanted
+// reply.
+func (d *Discord) deleteLastInteractionHandler(s Session, i *discordgo.InteractionCreate, ctx context.Context, zlog *zerolog.Logger) {
+	zlog.Info().Msg("Received delete-last command")
+
+	respond := func(content string) {
+		_, err := s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+			Content: Ptr(content),
+		})
+		if err != nil {
+			zlog.Error().Err(err).Msg("Failed to respond to interaction")
+		}
+	}
+
+	if !d.lookupChannel(i.ChannelID).isThread {
+		respond(Localize(msgDeleteInThread, i.Locale))
+		return
+	}
+
+	messages, starterMessage, err := d.gatherThreadMessages(s, i.ChannelID, zlog)
+	if err != nil {
+		respond(userErrorMessage(err, i.Locale))
+		return
+	}
+
+	var userID string
+	var permissions int64
+	if i.Member != nil && i.Member.User != nil {
+		userID = i.Member.User.ID
+		permissions = i.Member.Permissions
+	} else if i.User != nil {
+		userID = i.User.ID
+	}
+	var creatorID string
+	if starterMessage != nil {
+		creatorID = starterMessage.Author.ID
+	} else if len(messages) > 0 {
+		creatorID = messages[0].Author.ID
+	}
+	if !canDeleteReplies(userID, creatorID, permissions) {
+		zlog.Info().Str("user", userID).Str("creator", creatorID).Msg("User may not delete replies in this thread")
+		respond(Localize(msgNotPermitted, i.Locale))
+		return
+	}
+
+	message, ok := lastBotMessage(messages, d.discordClient.State.User.ID)
+	if !ok {
+		respond(Localize(msgNothingToDelete, i.Locale))
+		return
+	}
+	err = withDiscordRetry(func() error {
+		return s.ChannelMessageDelete(i.ChannelID, message.ID)
+	}, zlog)
+	if err != nil {
+		zlog.Error().Err(err).Str("message", message.ID).Msg("Failed to delete message")
+		respond(userErrorMessage(err, i.Locale))
+		return
+	}
+	zlog.Info().Str("message", message.ID).Str("user", userID).Msg("Deleted the bot's last message")
+	respond(Localize(msgLastMessageDeleted, i.Locale))
+}
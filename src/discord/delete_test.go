@@ -0,0 +1,82 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"testing"
+)
+
+func TestLastBotMessage(t *testing.T) {
+	message := func(id string, authorID string) *discordgo.Message {
+		return &discordgo.Message{ID: id, Author: &discordgo.User{ID: authorID}}
+	}
+	tests := []struct {
+		name     string
+		messages []*discordgo.Message
+		wantID   string
+		wantOK   bool
+	}{
+		{name: "no messages"},
+		{name: "only users", messages: []*discordgo.Message{message("1", "user"), message("2", "other")}},
+		{name: "bot last", messages: []*discordgo.Message{message("1", "user"), message("2", "bot")}, wantID: "2", wantOK: true},
+		{
+			name:     "user replied since",
+			messages: []*discordgo.Message{message("1", "user"), message("2", "bot"), message("3", "user")},
+			wantID:   "2",
+			wantOK:   true,
+		},
+		{
+			name:     "most recent of several",
+			messages: []*discordgo.Message{message("1", "bot"), message("2", "user"), message("3", "bot"), message("4", "user")},
+			wantID:   "3",
+			wantOK:   true,
+		},
+		{name: "another bot", messages: []*discordgo.Message{message("1", "user"), message("2", "other-bot")}},
+		{name: "message without author", messages: []*discordgo.Message{message("1", "bot"), {ID: "2"}}, wantID: "1", wantOK: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := lastBotMessage(tt.messages, "bot")
+			if ok != tt.wantOK || (ok && got.ID != tt.wantID) {
+				t.Errorf("lastBotMessage() = %+v, %v, want message %q, %v", got, ok, tt.wantID, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestCanDeleteReplies(t *testing.T) {
+	tests := []struct {
+		name        string
+		userID      string
+		creatorID   string
+		permissions int64
+		want        bool
+	}{
+		{name: "thread creator", userID: "creator", creatorID: "creator", want: true},
+		{name: "moderator", userID: "moderator", creatorID: "creator", permissions: discordgo.PermissionManageMessages, want: true},
+		{name: "other member", userID: "member", creatorID: "creator", permissions: discordgo.PermissionSendMessages},
+		{name: "unknown creator", userID: "", creatorID: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := canDeleteReplies(tt.userID, tt.creatorID, tt.permissions); got != tt.want {
+				t.Errorf("canDeleteReplies(%q, %q, %d) = %v, want %v", tt.userID, tt.creatorID, tt.permissions, got, tt.want)
+			}
+		})
+	}
+}
@@ -19,67 +19,228 @@ package discord
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/bwmarrin/discordgo"
 	"github.com/hashicorp/go-multierror"
 	"github.com/rs/zerolog"
-	"sort"
+	"regexp"
 	"src/aws"
+	"src/metrics"
 	"src/openai"
+	"src/tracing"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 type GuildID string
 type ChannelID string
 type ThreadID string
 
-// IDsMap stores which guildIDs, channelIDs, and threadIDs the bot is listening to. It also uses a RWMutex to protect
-// concurrent access.
-type IDsMap struct {
-	guildIDs     map[GuildID]bool
-	channelIDs   map[ChannelID]bool
-	threadIDs    map[ThreadID]bool
-	sync.RWMutex // protects guildIDs, channelIDs, and threadIDs
-}
-
-func NewIDsMap(guildIDs []GuildID) IDsMap {
-	guildIDsMap := make(map[GuildID]bool)
-	for _, guildID := range guildIDs {
-		guildIDsMap[guildID] = true
-	}
-
-	return IDsMap{
-		guildIDs:   guildIDsMap,
-		channelIDs: make(map[ChannelID]bool),
-		threadIDs:  make(map[ThreadID]bool),
-	}
-}
-
 type Config struct {
 	RemoveCommands    bool
 	ChannelPrefix     string
 	WatchdogThreshold time.Duration
 	WatchdogInterval  time.Duration
+
+	// DeniedChannels are channel names or IDs the bot ignores even though their names start with ChannelPrefix, e.g.
+	// openai-announcements.
+	DeniedChannels []string
+
+	// InteractionExpiryMargin is how long before an interaction's token expires, 15 minutes after the interaction,
+	// the bot stops editing its response. A /complete result ready after that is sent as a new message in the channel
+	// instead, since editing would fail with "Unknown interaction".
+	InteractionExpiryMargin time.Duration
+
+	// ReconcileInterval is how often the tracked channels and threads are refetched, to catch up on any missed
+	// events. If it is not positive, they are only fetched at startup and on channel and message events.
+	ReconcileInterval time.Duration
+
+	// LoadingReaction, SuccessReaction, and FailureReaction are the emojis the bot reacts with on the message it is
+	// responding to. Each may be a unicode emoji or a custom Discord emoji, e.g. <:name:id>.
+	LoadingReaction string
+	SuccessReaction string
+	FailureReaction string
+
+	// RespondOnlyToCreator, if true, means only messages from the thread creator trigger a response. Messages from
+	// anyone else are still included in the conversation as context.
+	RespondOnlyToCreator bool
+
+	// MaxBotReplyDepth is how many messages from other bots in a row the bot answers in a thread, so that it cannot
+	// reply to another bot forever. Zero means other bots are never answered. The bot never answers itself.
+	MaxBotReplyDepth int
+
+	// MaxHistoryMessages caps the number of most recent thread messages sent to OpenAI verbatim. Older messages, and
+	// any recent messages that do not fit in the model's context window, are summarized. If it is not positive, as
+	// many messages are sent as fit.
+	MaxHistoryMessages int
+
+	// MaxPromptLength is the most characters allowed in the prompt of /complete and /image. If it is not positive,
+	// prompts are not limited.
+	MaxPromptLength int
+
+	// ThreadTitleWords is the most words in the summary of a message used to name the thread created for it.
+	ThreadTitleWords int
+
+	// IgnorePrefix, if set, marks messages the bot should ignore, e.g. "//" for side conversations in a thread. Such
+	// messages never trigger a response and are left out of the conversation sent to OpenAI.
+	IgnorePrefix string
+
+	// AllowedUserIDs and AllowedRoleIDs restrict who may run commands. If both are empty, everyone may.
+	AllowedUserIDs []string
+	AllowedRoleIDs []string
+
+	// EnableModeration, if true, checks prompts with OpenAI's moderation endpoint and refuses flagged ones.
+	EnableModeration bool
+
+	// ImagePromptBlocklist refuses image prompts that match any of its patterns, e.g. to enforce server rules that
+	// the moderation endpoint does not cover. Use CompilePromptBlocklist to build it.
+	ImagePromptBlocklist []*regexp.Regexp
+
+	// CommandCooldowns is how long each user must wait between uses of a command, by command name.
+	CommandCooldowns map[string]time.Duration
+
+	// SendRetryAttempts is the number of times sending a thread reply is attempted before giving up and recording the
+	// reply as undelivered.
+	SendRetryAttempts int
+
+	// ExtendReplies, if true, answers a message such as "continue" or "go on" that directly follows one of the bot's
+	// replies by appending to that reply, rather than sending a new message, as long as it still fits in one message.
+	// It does not apply to embed responses.
+	ExtendReplies bool
+
+	// StreamResponses, if true, shows the /complete response as it is generated, rather than only once it is done.
+	StreamResponses bool
+
+	// EmbedResponses, if true, renders replies to /complete and in threads as embeds, with a footer showing the model
+	// and token usage, rather than as plain text.
+	EmbedResponses bool
+
+	// AllowedModels are the chat models offered by the settings command, as a fixed list so that Discord only accepts
+	// valid models. If it is empty, any model name can be typed in. Discord shows at most 25.
+	AllowedModels []string
+
+	// FallbackModels are the chat models tried in order when the configured model is overloaded or unavailable.
+	FallbackModels []string
+
+	// Stop is the default stop sequences for completions and chats. The complete command can override it.
+	Stop []string
+
+	// Seed, if set, is the default seed for chat completions, for reproducible replies. It can be overridden with the
+	// settings command.
+	Seed *int
+
+	// ModelPrices is the price of each model, used by the stats command to estimate what OpenAI has cost. A dated
+	// model such as gpt-4-0613 uses the price of gpt-4 if it has none of its own.
+	ModelPrices map[string]ModelPrice
+
+	// LogProbs, if true, logs the log probabilities of the first tokens of each chat reply at debug level.
+	LogProbs bool
+
+	// PresencePenalty and FrequencyPenalty, between -2.0 and 2.0, are the penalties for chat completions. Positive
+	// values make replies in long threads less repetitive.
+	PresencePenalty  float32
+	FrequencyPenalty float32
+
+	// Tools are the functions the model may call before replying in threads, e.g. openai.CurrentTimeTool.
+	Tools []openai.Tool
+
+	// Language, if set, is the default language of chat replies, or openai.LanguageMatchUser to reply in the language
+	// of the user's latest message. It can be overridden with the settings command.
+	Language string
+
+	// InteractionWorkers is the most interactions handled at once, and InteractionQueueSize the most waiting for a
+	// free worker. Interactions beyond that are refused with a message asking the user to try again. If either is not
+	// positive, the default is used.
+	InteractionWorkers   int
+	InteractionQueueSize int
+
+	// ComponentSettings are the settings of the bot's other components, e.g. the lock and OpenAI clients, by name, shown
+	// by the config command alongside this config. Settings whose names suggest a secret are redacted regardless.
+	ComponentSettings map[string]string
+
+	// GlobalCommands, if true, registers commands globally, so they are available in every guild the bot joins,
+	// rather than in each configured guild. Discord can take up to an hour to propagate new or changed global
+	// commands, whereas guild commands are available immediately.
+	GlobalCommands bool
+}
+
+// DefaultConfig returns the configuration used when no overrides are provided.
+func DefaultConfig() Config {
+	return Config{
+		RemoveCommands:          false,
+		ChannelPrefix:           "openai",
+		WatchdogThreshold:       30 * time.Second,
+		WatchdogInterval:        30 * time.Second,
+		ReconcileInterval:       5 * time.Minute,
+		InteractionExpiryMargin: 30 * time.Second,
+		LoadingReaction:         "🤖",
+		SuccessReaction:         "✅",
+		FailureReaction:         "❌",
+		RespondOnlyToCreator:    false,
+		MaxBotReplyDepth:        1,
+		MaxHistoryMessages:      0,
+		SendRetryAttempts:       3,
+		ThreadTitleWords:        10,
+		MaxPromptLength:         4000,
+		ModelPrices:             DefaultModelPrices(),
+		AllowedModels:           []string{"gpt-4", "gpt-4-turbo-preview", "gpt-3.5-turbo", "gpt-3.5-turbo-1106"},
+		InteractionWorkers:      8,
+		InteractionQueueSize:    32,
+		CommandCooldowns: map[string]time.Duration{
+			"image":      30 * time.Second,
+			"image-edit": 30 * time.Second,
+		},
+	}
 }
 
 type Discord struct {
 	discordClient      *discordgo.Session
-	openaiClient       *openai.OpenAI
+	session            Session
+	openaiClient       openai.OpenAIClient
 	lockClient         aws.LockClient
+	transcripts        aws.TranscriptWriter
+	templates          aws.TemplateStore
 	registeredCommands []*discordgo.ApplicationCommand
 	config             Config
-	idsMap             IDsMap
+	idsMap             *IDsMap
+	settings           *SettingsStore
+	feedback           *FeedbackStore
+	editDebouncer      *debouncer
+	cooldowns          *CooldownTracker
+	interactions       *interactionQueue
+	completed          *CompletedInteractions
+	pins               *pinCache
+	stopReconcile      chan struct{}
+	reconcileDone      chan struct{}
+	usage              *UsageTracker
 	zlog               *zerolog.Logger
 }
 
+const (
+	// defaultSummarySentences and maxSummarySentences bound the length of summaries from the summarize command.
+	defaultSummarySentences = 3
+	maxSummarySentences     = 10
+
+	// maxImageVariations is the most variations the image-edit command creates at once.
+	maxImageVariations = 4
+
+	// maxCompletionCandidates is the most candidate completions the complete command generates at once.
+	maxCompletionCandidates = 3
+)
+
 type Command struct {
 	Name        string
 	Description string
 	Type        discordgo.ApplicationCommandType
-	Handler     func(s *discordgo.Session, i *discordgo.InteractionCreate)
+	Handler     func(s Session, i *discordgo.InteractionCreate, ctx context.Context, zlog *zerolog.Logger)
 	Options     []*discordgo.ApplicationCommandOption
+
+	// DefaultMemberPermissions, if set, hides the command from members without these permissions by default.
+	DefaultMemberPermissions *int64
 }
 
 func (d *Discord) getDiscordCommands() []Command {
@@ -104,6 +265,32 @@ func (d *Discord) getDiscordCommands() []Command {
 					Required:     true,
 					Autocomplete: true,
 				},
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "private",
+					Description: "Only show the completion to you",
+					Required:    false,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "stop",
+					Description: "Up to 4 comma-separated sequences that end the completion, e.g. ```",
+					Required:    false,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "count",
+					Description: "The number of candidate completions to show",
+					Required:    false,
+					MinValue:    Ptr(1.0),
+					MaxValue:    maxCompletionCandidates,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "json",
+					Description: "Reply with a JSON object",
+					Required:    false,
+				},
 			},
 		},
 		{
@@ -121,84 +308,462 @@ func (d *Discord) getDiscordCommands() []Command {
 				},
 			},
 		},
+		{
+			Name:        "image-edit",
+			Description: "Edit an image as described by a prompt, or create variations of it if there is no prompt",
+			Type:        discordgo.ChatApplicationCommand,
+			Handler:     d.imageEditInteractionHandler,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionAttachment,
+					Name:        "image",
+					Description: "A square PNG smaller than 4 MB",
+					Required:    true,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "prompt",
+					Description: "How to edit the image; leave empty to create variations",
+					Required:    false,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionAttachment,
+					Name:        "mask",
+					Description: "A PNG whose transparent areas mark where to edit; defaults to the image's own",
+					Required:    false,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "variations",
+					Description: "The number of variations to create",
+					Required:    false,
+					MinValue:    Ptr(1.0),
+					MaxValue:    maxImageVariations,
+				},
+			},
+		},
+		{
+			Name:        "summarize",
+			Description: "Summarize some text, or the conversation in this thread",
+			Type:        discordgo.ChatApplicationCommand,
+			Handler:     d.summarizeInteractionHandler,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "text",
+					Description: "The text to summarize; defaults to the conversation in this thread",
+					Required:    false,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "sentences",
+					Description: "The maximum number of sentences in the summary",
+					Required:    false,
+					MinValue:    Ptr(1.0),
+					MaxValue:    maxSummarySentences,
+				},
+			},
+		},
+		{
+			Name:        "regenerate",
+			Description: "Regenerate the last response in this thread",
+			Type:        discordgo.ChatApplicationCommand,
+			Handler:     d.regenerateInteractionHandler,
+			Options:     nil,
+		},
+		{
+			Name:        "import",
+			Description: "Continue a conversation uploaded as a file",
+			Type:        discordgo.ChatApplicationCommand,
+			Handler:     d.importInteractionHandler,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionAttachment,
+					Name:        "conversation",
+					Description: "A JSON or text file of messages, ending with one from the user",
+					Required:    true,
+				},
+			},
+		},
+		{
+			Name:        "delete-last",
+			Description: "Delete the bot's last message in this thread",
+			Type:        discordgo.ChatApplicationCommand,
+			Handler:     d.deleteLastInteractionHandler,
+			Options:     nil,
+		},
+		{
+			Name:        "settings",
+			Description: "Show or change the model, temperature, persona, and seed used for conversations",
+			Type:        discordgo.ChatApplicationCommand,
+			Handler:     d.settingsInteractionHandler,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "scope",
+					Description: "Where to apply the settings; defaults to the current thread or channel",
+					Required:    false,
+					Choices: []*discordgo.ApplicationCommandOptionChoice{
+						{Name: "thread", Value: settingsScopeThread},
+						{Name: "channel", Value: settingsScopeChannel},
+						{Name: "server", Value: settingsScopeGuild},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "model",
+					Description: "The OpenAI chat model, e.g. gpt-4",
+					Required:    false,
+					Choices:     modelChoices(d.config.AllowedModels),
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionNumber,
+					Name:        "temperature",
+					Description: "The sampling temperature, between 0 and 2",
+					Required:    false,
+					MinValue:    Ptr(0.0),
+					MaxValue:    2.0,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "persona",
+					Description: "A system prompt describing how the bot should behave",
+					Required:    false,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "language",
+					Description: "The language to always reply in, \"auto\" to match the user, or \"none\" to not say",
+					Required:    false,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "seed",
+					Description: "A seed for reproducible replies",
+					Required:    false,
+				},
+			},
+		},
+		{
+			Name:        "template",
+			Description: "Save a prompt template for this server, with {placeholders} filled in by /use",
+			Type:        discordgo.ChatApplicationCommand,
+			Handler:     d.templateInteractionHandler,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "name",
+					Description: "The name of the template; an existing template with this name is replaced",
+					Required:    true,
+					MaxLength:   maxTemplateNameLength,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "prompt",
+					Description: "The prompt, e.g. Explain {topic} in {lang}",
+					Required:    true,
+				},
+			},
+		},
+		{
+			Name:        "use",
+			Description: "Run a saved prompt template",
+			Type:        discordgo.ChatApplicationCommand,
+			Handler:     d.useInteractionHandler,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "name",
+					Description: "The name of the template",
+					Required:    true,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "values",
+					Description: "Values for the placeholders, e.g. topic=\"error handling\" lang=Go",
+					Required:    false,
+				},
+			},
+		},
+		{
+			Name:        "keep",
+			Description: "Keep this thread open for 7 days without activity instead of 1",
+			Type:        discordgo.ChatApplicationCommand,
+			Handler:     d.keepInteractionHandler,
+			Options:     nil,
+		},
+		{
+			Name:        "unkeep",
+			Description: "Archive this thread after the default 1 day without activity",
+			Type:        discordgo.ChatApplicationCommand,
+			Handler:     d.unkeepInteractionHandler,
+			Options:     nil,
+		},
+		{
+			Name:                     "whoami",
+			Description:              "Show which bot instance handled this command",
+			Type:                     discordgo.ChatApplicationCommand,
+			Handler:                  d.whoAmIInteractionHandler,
+			DefaultMemberPermissions: Ptr(int64(discordgo.PermissionManageServer)),
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "private",
+					Description: "Only show the answer to you",
+					Required:    false,
+				},
+			},
+		},
+		{
+			Name:                     "config",
+			Description:              "Show the configuration the bot is running with",
+			Type:                     discordgo.ChatApplicationCommand,
+			Handler:                  d.configInteractionHandler,
+			DefaultMemberPermissions: Ptr(int64(discordgo.PermissionManageServer)),
+			Options:                  nil,
+		},
+		{
+			Name:                     "stats",
+			Description:              "Show the OpenAI tokens, requests, and estimated cost used in this server",
+			Type:                     discordgo.ChatApplicationCommand,
+			Handler:                  d.statsInteractionHandler,
+			DefaultMemberPermissions: Ptr(int64(discordgo.PermissionManageServer)),
+			Options:                  nil,
+		},
+		{
+			Name:                     "threads",
+			Description:              "List or forget the threads the bot is listening to",
+			Type:                     discordgo.ChatApplicationCommand,
+			Handler:                  d.threadsInteractionHandler,
+			DefaultMemberPermissions: Ptr(int64(discordgo.PermissionManageServer)),
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "list",
+					Description: "List the threads the bot is listening to",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "forget",
+					Description: "Stop listening to a thread",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "thread",
+							Description: "The ID of the thread to forget",
+							Required:    true,
+						},
+					},
+				},
+			},
+		},
 	}
 }
 
-func (d *Discord) setupDiscordCommands(guildID string, zlog *zerolog.Logger) error {
+func (d *Discord) setupDiscordCommands(zlog *zerolog.Logger) error {
 	discordCommands := d.getDiscordCommands()
 
-	commandHandlers := make(map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate))
+	commandHandlers := make(map[string]func(s Session, i *discordgo.InteractionCreate, ctx context.Context, zlog *zerolog.Logger))
 	for _, discordCommand := range discordCommands {
 		commandHandlers[discordCommand.Name] = discordCommand.Handler
 	}
 
 	// Handle channel creation or deletion
 	d.discordClient.AddHandler(func(s *discordgo.Session, c *discordgo.ChannelCreate) {
-		err := d.updateChannels()
+		err := d.updateChannels(context.Background())
 		if err != nil {
 			zlog.Error().Err(err).Msg("Failed to update channels")
 		}
 	})
 
 	d.discordClient.AddHandler(func(s *discordgo.Session, c *discordgo.ChannelDelete) {
-		err := d.updateChannels()
+		err := d.updateChannels(context.Background())
 		if err != nil {
 			zlog.Error().Err(err).Msg("Failed to update channels")
 		}
 	})
 
 	d.discordClient.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
-		d.idsMap.RLock()
-		if _, ok := d.idsMap.channelIDs[ChannelID(i.ChannelID)]; !ok {
+		interactionLog := zlog.With().Str("channel", i.ChannelID).Str("interaction", i.ID).Logger()
+		ctx, zlog := tracing.NewRequest(context.Background(), &interactionLog)
+
+		// The interaction is acknowledged before it is queued, so that a backed-up queue does not make the bot miss
+		// Discord's deadline for the initial response.
+		release, ok := d.acknowledgeInteraction(s, i, commandHandlers, ctx, zlog)
+		if !ok {
 			return
 		}
-		d.idsMap.RUnlock()
-
-		if i.Type == discordgo.InteractionApplicationCommand {
-			if handler, ok := commandHandlers[i.ApplicationCommandData().Name]; ok {
 
-				// TODO track prompts in S3 for resumption
-				getPayloadFromIteraction(i)
-				lock, err := d.lockClient.Acquire(context.Background(), i.ID, "" /*data*/)
-
-				if err != nil {
-					zlog.Error().Err(err).Msg("Failed to acquire lock")
-					return
-				}
-				defer func() {
-					if err := d.lockClient.Release(context.Background(), lock.ID); err != nil {
-						zlog.Error().Err(err).Msg("Failed to release lock")
-					}
-				}()
-
-				if err := d.deferInteractionReply(s, i); err != nil {
-					return
-				}
-				handler(s, i)
-			}
+		queued := d.interactions.TryEnqueue(func() {
+			defer release()
+			d.handleInteraction(s, i, commandHandlers, ctx, zlog)
+		})
+		if !queued {
+			zlog.Warn().Msg("Rejected interaction because the queue is full")
+			metrics.InteractionsRejected.Inc()
+			d.respondBusy(s, i, zlog)
+			release()
 		}
 	})
 
+	return d.registerCommands(d.session, d.discordClient.State.User.ID, discordCommands, zlog)
+}
+
+// registerCommands registers discordCommands for the application appID in each configured guild, or globally if
+// GlobalCommands is set, and records them in registeredCommands so that Close can remove them.
+func (d *Discord) registerCommands(session Session, appID string, discordCommands []Command, zlog *zerolog.Logger) error {
+	// An empty guild ID registers a global command.
+	targetGuildIDs := d.guildIDs()
+	if d.config.GlobalCommands {
+		targetGuildIDs = []GuildID{""}
+	}
+
 	d.registeredCommands = make([]*discordgo.ApplicationCommand, 0)
-	for _, discordCommand := range discordCommands {
-		applicationCommand := discordgo.ApplicationCommand{
-			Name:        discordCommand.Name,
-			Description: discordCommand.Description,
-			Type:        discordCommand.Type,
-			Options:     discordCommand.Options,
-		}
-		zlog.Info().Interface("command", applicationCommand.Name).Msg("Registering command")
-		command, err := d.discordClient.ApplicationCommandCreate(d.discordClient.State.User.ID, guildID, &applicationCommand)
-		if err != nil {
-			zlog.Error().Err(err).Msg("Failed to create Discord command")
-			return err
+	for _, guildID := range targetGuildIDs {
+		for _, discordCommand := range discordCommands {
+			applicationCommand := discordgo.ApplicationCommand{
+				Name:                     discordCommand.Name,
+				Description:              discordCommand.Description,
+				Type:                     discordCommand.Type,
+				Options:                  discordCommand.Options,
+				DefaultMemberPermissions: discordCommand.DefaultMemberPermissions,
+			}
+			zlog.Info().
+				Interface("command", applicationCommand.Name).
+				Str("guildID", string(guildID)).
+				Msg("Registering command")
+			command, err := session.ApplicationCommandCreate(appID, string(guildID), &applicationCommand)
+			if err != nil {
+				zlog.Error().Err(err).Str("guildID", string(guildID)).Msg("Failed to create Discord command")
+				return err
+			}
+			d.registeredCommands = append(d.registeredCommands, command)
 		}
-		d.registeredCommands = append(d.registeredCommands, command)
 	}
 
 	return nil
 }
 
+// interactionQueueLimits returns the number of interaction workers and queue size in config, falling back to the
+// defaults for any that are not positive.
+func interactionQueueLimits(config Config) (workers int, capacity int) {
+	defaults := DefaultConfig()
+	workers, capacity = config.InteractionWorkers, config.InteractionQueueSize
+	if workers <= 0 {
+		workers = defaults.InteractionWorkers
+	}
+	if capacity <= 0 {
+		capacity = defaults.InteractionQueueSize
+	}
+	return workers, capacity
+}
+
+// acknowledgeInteraction rejects the interaction if it may not run, and otherwise takes its lock and defers its reply.
+// It returns whether the interaction should be handled, and if so a function that releases the lock once it has been.
+func (d *Discord) acknowledgeInteraction(
+	s Session,
+	i *discordgo.InteractionCreate,
+	commandHandlers map[string]func(s Session, i *discordgo.InteractionCreate, ctx context.Context, zlog *zerolog.Logger),
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) (func(), bool) {
+	snapshot := d.lookupChannel(i.ChannelID)
+	tracked := snapshot.isChannel || snapshot.isThread
+	switch i.Type {
+	case discordgo.InteractionApplicationCommand:
+		if _, ok := commandHandlers[i.ApplicationCommandData().Name]; !ok {
+			return nil, false
+		}
+	case discordgo.InteractionMessageComponent:
+		if !tracked {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+
+	// Unauthorized commands and commands on cooldown are rejected before the lock is taken, so that they cost no lock
+	// writes, and so that every instance records each use of a command towards its cooldown. Every instance sends the
+	// rejection, and Discord accepts only the first response to an interaction.
+	if i.Type == discordgo.InteractionApplicationCommand {
+		if !d.authorizeInteraction(s, i, zlog) {
+			zlog.Info().Str("command", i.ApplicationCommandData().Name).Msg("Rejected unauthorized command")
+			d.respondNotPermitted(s, i, zlog)
+			return nil, false
+		}
+		if !d.checkCooldown(s, i, zlog) {
+			return nil, false
+		}
+	}
+
+	// Only the instance holding the lock handles the interaction, so that the user is not sent one reply per instance.
+	lock, err := d.lockClient.Acquire(ctx, i.ID, "" /*data*/)
+	if err != nil {
+		logLockError(zlog, err, "acquire")
+		return nil, false
+	}
+	release := func() {
+		if err := d.lockClient.Release(ctx, lock.ID); err != nil {
+			logLockError(zlog, err, "release")
+		}
+	}
+
+	flags := discordgo.MessageFlagsEphemeral
+	if i.Type == discordgo.InteractionApplicationCommand {
+		// TODO track prompts in S3 for resumption
+		getPayloadFromIteraction(i)
+
+		if !tracked {
+			d.respondUntrackedChannel(s, i, zlog)
+			release()
+			return nil, false
+		}
+		flags = interactionReplyFlags(i)
+	}
+
+	if err := d.deferInteractionReply(s, i, flags, zlog); err != nil {
+		release()
+		return nil, false
+	}
+	return release, true
+}
+
+// handleInteraction runs the command or component handler for an interaction whose reply has been deferred.
+func (d *Discord) handleInteraction(
+	s Session,
+	i *discordgo.InteractionCreate,
+	commandHandlers map[string]func(s Session, i *discordgo.InteractionCreate, ctx context.Context, zlog *zerolog.Logger),
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) {
+	if i.Type == discordgo.InteractionApplicationCommand {
+		metrics.CommandsHandled.WithLabelValues(i.ApplicationCommandData().Name).Inc()
+		commandHandlers[i.ApplicationCommandData().Name](s, i, ctx, zlog)
+	} else if i.Type == discordgo.InteractionMessageComponent {
+		d.feedbackComponentHandler(s, i, ctx, zlog)
+	}
+}
+
+// respondUntrackedChannel tells the user, only visible to them, that commands only work in the bot's channels.
+func (d *Discord) respondUntrackedChannel(s Session, i *discordgo.InteractionCreate, zlog *zerolog.Logger) {
+	zlog.Info().Msg("Received command outside a tracked channel")
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: fmt.Sprintf(Localize(msgUntrackedChannel, i.Locale), d.config.ChannelPrefix),
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to respond to interaction outside a tracked channel")
+	}
+}
+
+// respondBusy tells the user, only visible to them, that the bot has too many interactions queued to take theirs.
+func (d *Discord) respondBusy(s Session, i *discordgo.InteractionCreate, zlog *zerolog.Logger) {
+	d.respondRefused(s, i, Localize(msgBusy, i.Locale), zlog)
+}
+
 func (d *Discord) DebugApplicationCommands() {
 	commands, err := d.discordClient.ApplicationCommands(d.discordClient.State.User.ID, "")
 	if err != nil {
@@ -211,40 +776,93 @@ func (d *Discord) DebugApplicationCommands() {
 	}
 }
 
-func (d *Discord) updateChannels() error {
-	d.idsMap.Lock()
-	defer d.idsMap.Unlock()
+func (d *Discord) lookupChannel(channelID string) channelSnapshot {
+	return d.idsMap.lookup(channelID)
+}
+
+// guildIDs returns the configured guild IDs in a stable order.
+func (d *Discord) guildIDs() []GuildID {
+	return d.idsMap.GuildIDs()
+}
 
+// updateChannels fetches the channels of each guild, retrying with backoff, without holding the IDsMap lock, and then
+// swaps in the ones matching the channel prefix under the write lock, so that handlers are not blocked on Discord API
+// calls. A guild whose channels could not be fetched does not discard the others: the previously tracked channels that
+// no fetched guild accounts for are kept until a later refresh succeeds, and the failures are returned.
+func (d *Discord) updateChannels(ctx context.Context) error {
+	var resultErr error
 	newChannelIDs := make(map[ChannelID]bool)
-	for guildID := range d.idsMap.guildIDs {
-		channels, err := d.discordClient.GuildChannels(string(guildID))
-		if err != nil {
-			d.zlog.Error().Err(err).Msg("Failed to get channels")
+	fetchedChannelIDs := make(map[ChannelID]bool)
+	for _, guildID := range d.guildIDs() {
+		var channels []*discordgo.Channel
+		err := withBackoffRetry(ctx, func() error {
+			var err error
+			channels, err = d.session.GuildChannels(string(guildID), discordgo.WithContext(ctx))
 			return err
+		}, refreshRetryAttempts, d.zlog)
+		if err != nil {
+			d.zlog.Error().Err(err).Str("guild", string(guildID)).Msg("Failed to get channels")
+			resultErr = multierror.Append(resultErr, err)
+			continue
 		}
 
-		// Find channels prefixed with the channel prefix
+		// Find channels prefixed with the channel prefix, except denied ones
 		for _, channel := range channels {
-			if strings.HasPrefix(channel.Name, d.config.ChannelPrefix) {
-				d.zlog.Info().Str("channel", channel.Name).Str("id", channel.ID).Msg("Found channel")
-				newChannelIDs[ChannelID(channel.ID)] = true
+			fetchedChannelIDs[ChannelID(channel.ID)] = true
+			if !tracksChannel(channel, d.config.ChannelPrefix, d.config.DeniedChannels) {
+				continue
+			}
+			d.zlog.Info().Str("channel", channel.Name).Str("id", channel.ID).Msg("Found channel")
+			newChannelIDs[ChannelID(channel.ID)] = true
+		}
+	}
+	if resultErr != nil {
+		for _, channelID := range d.idsMap.ChannelIDs() {
+			if !fetchedChannelIDs[channelID] {
+				newChannelIDs[channelID] = true
 			}
 		}
 	}
 
-	d.idsMap.channelIDs = newChannelIDs
+	d.idsMap.SetChannels(newChannelIDs)
 	d.zlog.Info().Interface("channelIDs", newChannelIDs).Msg("Updated channel IDs")
 
-	return nil
+	return resultErr
+}
+
+// tracksChannel returns whether the bot listens to channel: its name starts with prefix, and neither its name nor its
+// ID is in denied.
+func tracksChannel(channel *discordgo.Channel, prefix string, denied []string) bool {
+	if !strings.HasPrefix(channel.Name, prefix) {
+		return false
+	}
+	for _, entry := range denied {
+		if entry == channel.ID || strings.EqualFold(entry, channel.Name) {
+			return false
+		}
+	}
+	return true
 }
 
 func NewDiscord(
 	discordToken string,
-	openaiClient *openai.OpenAI,
+	openaiClient openai.OpenAIClient,
 	lockClient aws.LockClient,
-	guildID string,
+	transcripts aws.TranscriptWriter,
+	templates aws.TemplateStore,
+	guildIDs []GuildID,
+	config Config,
 	zlog *zerolog.Logger,
 ) (*Discord, error) {
+	var err error
+	for _, reaction := range []*string{&config.LoadingReaction, &config.SuccessReaction, &config.FailureReaction} {
+		*reaction, err = NormalizeEmoji(*reaction)
+		if err != nil {
+			zlog.Error().Err(err).Msg("Invalid reaction emoji in config")
+			return nil, err
+		}
+	}
+
 	discordClient, err := discordgo.New("Bot " + discordToken)
 
 	if err != nil {
@@ -252,22 +870,41 @@ func NewDiscord(
 		return nil, err
 	}
 
+	defaultChatOptions := openai.DefaultChatOptions()
+	defaultChatOptions.Seed = config.Seed
+	defaultChatOptions.LogProbs = config.LogProbs
+	defaultChatOptions.PresencePenalty = config.PresencePenalty
+	defaultChatOptions.FrequencyPenalty = config.FrequencyPenalty
+	defaultChatOptions.Language = config.Language
+	defaultChatOptions.Tools = config.Tools
+	defaultChatOptions.Stop = config.Stop
+	defaultChatOptions.FallbackModels = config.FallbackModels
+
 	discord := Discord{
 		discordClient: discordClient,
+		session:       discordClient,
 		openaiClient:  openaiClient,
 		lockClient:    lockClient,
-		config: Config{
-			RemoveCommands:    false,
-			ChannelPrefix:     "openai",
-			WatchdogThreshold: 30 * time.Second,
-			WatchdogInterval:  30 * time.Second,
-		},
-		idsMap: NewIDsMap([]GuildID{GuildID(guildID)}),
-		zlog:   zlog,
+		transcripts:   transcripts,
+		templates:     templates,
+		config:        config,
+		idsMap:        NewIDsMap(guildIDs),
+		settings:      NewSettingsStore(defaultChatOptions),
+		feedback:      NewFeedbackStore(),
+		usage:         NewUsageTracker(),
+		editDebouncer: newDebouncer(),
+		cooldowns:     NewCooldownTracker(),
+		interactions:  newInteractionQueue(interactionQueueLimits(config)),
+		completed:     NewCompletedInteractions(),
+		pins:          newPinCache(),
+		stopReconcile: make(chan struct{}),
+		reconcileDone: make(chan struct{}),
+		zlog:          zlog,
 	}
 
-	// Set intent to read message content
+	// Set intent to read message content, and to receive direct messages
 	discordClient.Identify.Intents |= discordgo.IntentsMessageContent
+	discordClient.Identify.Intents |= discordgo.IntentsDirectMessages
 
 	err = discordClient.Open()
 	if err != nil {
@@ -281,258 +918,271 @@ func NewDiscord(
 		return nil, err
 	}
 
-	err = discord.updateChannels()
+	err = discord.updateChannels(context.Background())
 	if err != nil {
 		zlog.Error().Err(err).Msg("Failed to update channels")
 		return nil, err
 	}
 
-	err = discord.updateThreads(zlog)
+	err = discord.updateThreads(context.Background(), zlog)
 	if err != nil {
 		zlog.Error().Err(err).Msg("Failed to update threads")
 		return nil, err
 	}
 
-	err = discord.setupDiscordCommands(guildID, zlog)
+	err = discord.ValidateConfig()
+	if err != nil {
+		zlog.Warn().Err(err).Msg("Configuration problems found, the bot may not work as expected")
+	}
+	discord.checkMessageContentIntent(zlog)
+
+	err = discord.setupDiscordCommands(zlog)
 	if err != nil {
 		zlog.Error().Err(err).Msg("Failed to setup Discord commands")
 		return nil, err
 	}
 
 	discordClient.AddHandler(func(s *discordgo.Session, m *discordgo.MessageCreate) {
-		_, err := lockClient.Acquire(context.Background(), m.Message.ID, "")
+		messageLog := zlog.With().Str("channel", m.ChannelID).Str("message", m.ID).Logger()
+		ctx, zlog := tracing.NewRequest(context.Background(), &messageLog)
+
+		_, err := lockClient.Acquire(ctx, m.Message.ID, "")
 		if err != nil {
-			zlog.Error().Err(err).Msg("Failed to acquire lock")
+			logLockError(zlog, err, "acquire")
 			return
 		}
 		defer func() {
-			if err := lockClient.Release(context.Background(), m.Message.ID); err != nil {
-				zlog.Error().Err(err).Msg("Failed to release lock")
+			if err := lockClient.Release(ctx, m.Message.ID); err != nil {
+				logLockError(zlog, err, "release")
 			}
 		}()
 
-		zlog := zlog.With().Str("channel", m.ChannelID).Str("message", m.ID).Logger()
+		discord.handleMessageCreate(s, m, ctx, zlog)
+	})
 
-		// If the message is in a channel and it is not creating a thread, use it to create a thread.
-		var maybeNewThread *discordgo.Channel = nil
-		if shouldCreateThread := func() bool {
-			discord.idsMap.RLock()
-			defer discord.idsMap.RUnlock()
+	discordClient.AddHandler(discord.feedbackReactionHandler)
+	discordClient.AddHandler(discord.messageUpdateHandler)
+	discordClient.AddHandler(discord.threadUpdateHandler)
+	discordClient.AddHandler(discord.channelPinsUpdateHandler)
 
-			if _, ok := discord.idsMap.channelIDs[ChannelID(m.ChannelID)]; !ok {
-				return false
-			}
+	discordClient.AddHandler(func(s *discordgo.Session, r *discordgo.Ready) {
+		zlog.Info().Interface("r", r).Msg("Discord client is now ready")
+	})
 
-			if m.Message.Flags&discordgo.MessageFlagsHasThread != 0 {
-				return false
-			}
+	discord.DebugApplicationCommands()
+	discord.startReconciliation()
 
-			return true
-		}(); shouldCreateThread {
-			// Use OpenAI to summarize the message into a short title with less than 10 words.
-			summary, err := discord.openaiClient.Summarize(m.Message.Content, 10, context.TODO(), &zlog)
-			if err != nil {
-				zlog.Error().Err(err).Msg("Failed to summarize message")
-				return
-			}
-			zlog.Info().Str("summary", summary).Msg("Summarized message")
-
-			// See: https://github.com/bwmarrin/discordgo/blob/master/examples/threads/main.go
-			maybeNewThread, err = s.MessageThreadStartComplex(m.ChannelID, m.ID, &discordgo.ThreadStart{
-				Name:                summary,
-				AutoArchiveDuration: 1440, /* 1 day */
-				Invitable:           false,
-				RateLimitPerUser:    1,
-			})
+	return &discord, nil
+}
 
-			if err != nil {
-				zlog.Error().Err(err).Msg("Failed to create thread")
-				return
-			}
+// handleMessageCreate responds to a new message: a direct message is answered inline, a message in a tracked channel
+// starts a thread, and a message in a tracked thread is answered in the thread.
+func (d *Discord) handleMessageCreate(s Session, m *discordgo.MessageCreate, ctx context.Context, zlog *zerolog.Logger) {
+	if d.isIgnored(m.Message) {
+		zlog.Debug().Msg("Message has the ignore prefix, not responding")
+		return
+	}
 
-			zlog.Debug().Str("thread", maybeNewThread.ID).Msg("Created thread")
+	// Direct messages have no guild, and the whole DM channel is treated as one conversation.
+	if m.GuildID == "" {
+		d.respondToDirectMessage(s, m.ChannelID, ctx, zlog)
+		return
+	}
 
+	// If the message is in a channel and it is not creating a thread, use it to create a thread.
+	var maybeNewThread *discordgo.Channel = nil
+	snapshot := d.lookupChannel(m.ChannelID)
+	if snapshot.isChannel && m.Message.Flags&discordgo.MessageFlagsHasThread == 0 {
+		// Use OpenAI to summarize the message into a short title.
+		summary, err := d.openaiClient.Summarize(m.Message.Content, d.config.ThreadTitleWords, ctx, zlog)
+		if err != nil {
+			zlog.Error().Err(err).Msg("Failed to summarize message")
 			return
 		}
+		zlog.Info().Str("summary", summary).Msg("Summarized message")
+
+		// See: https://github.com/bwmarrin/discordgo/blob/master/examples/threads/main.go
+		maybeNewThread, err = s.MessageThreadStartComplex(m.ChannelID, m.ID, &discordgo.ThreadStart{
+			Name:                threadName(summary),
+			AutoArchiveDuration: defaultAutoArchiveDuration,
+			Invitable:           false,
+			RateLimitPerUser:    1,
+		})
 
-		err = discord.updateThreads(&zlog)
 		if err != nil {
-			zlog.Error().Err(err).Msg("Failed to update thread IDs")
+			zlog.Error().Err(err).Msg("Failed to create thread")
+			return
 		}
 
-		if unknownThread := func(threadID ThreadID) bool {
-			discord.idsMap.RLock()
-			defer discord.idsMap.RUnlock()
+		zlog.Debug().Str("thread", maybeNewThread.ID).Msg("Created thread")
+		d.idsMap.AddThread(ThreadID(maybeNewThread.ID), ChannelID(m.ChannelID))
 
-			if _, okThread := discord.idsMap.threadIDs[threadID]; !okThread {
-				return true
-			}
-			return false
+		return
+	}
 
-		}(ThreadID(m.ChannelID)); unknownThread {
-			return
-		}
+	err := d.updateThreads(ctx, zlog)
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to update thread IDs")
+	}
 
-		// Get all messages in the thread. Use a limit of 100 and use pagination of beforeID and afterID
-		// to get all messages in the thread.
-		messages := make([]*discordgo.Message, 0)
-		beforeID := ""
-		afterID := ""
+	// Take a new snapshot now that the thread IDs have been refreshed.
+	snapshot = d.lookupChannel(m.ChannelID)
+	if !snapshot.isThread {
+		return
+	}
+	parentChannelID := snapshot.parentChannelID
 
-		var channelID string
-		if maybeNewThread != nil {
-			channelID = maybeNewThread.ID
-		} else {
-			channelID = m.ChannelID
-		}
-		zlog.Debug().Str("channel", channelID).Msg("Getting messages")
+	messages, starterMessage, err := d.gatherThreadMessages(s, m.ChannelID, zlog)
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to gather thread messages")
+		return
+	}
+	if len(messages) == 0 {
+		zlog.Info().Msg("No messages in thread, not responding")
+		return
+	}
 
-		for {
-			result, err := s.ChannelMessages(channelID, 100, beforeID, afterID, "")
-			if err != nil {
-				zlog.Error().Err(err).Msg("Failed to get messages")
-				return
-			}
+	lastMessage := messages[len(messages)-1]
 
-			// only append messages that have non-empty content
-			for _, message := range result {
-				if message.Content == "" {
-					continue
-				}
-				messages = append(messages, message)
-			}
+	// If there is only one message, assume this is from a human.
+	if len(messages) == 1 {
+		messages[0].Author.Bot = false
+	}
 
-			if len(result) < 100 {
-				break
-			}
+	// Never respond to our own messages, and stop answering other bots after a few replies to break loops.
+	if !shouldAnswerNewest(messages, d.discordClient.State.User.ID, d.config.MaxBotReplyDepth) {
+		zlog.Info().Str("author", lastMessage.Author.ID).Msg("Newest message is our own or from a bot in a loop, not responding")
+		return
+	}
 
-			beforeID = result[len(result)-1].ID
-		}
+	// The thread creator is the author of the starter message. If it could not be fetched, fall back to the
+	// author of the oldest message in the thread.
+	var creatorID string
+	if starterMessage != nil {
+		creatorID = starterMessage.Author.ID
+	} else {
+		creatorID = messages[0].Author.ID
+	}
+	if !d.shouldRespondTo(lastMessage.Author.ID, creatorID) {
+		zlog.Info().
+			Str("author", lastMessage.Author.ID).
+			Str("creator", creatorID).
+			Msg("Newest message is not from the thread creator, not responding")
+		return
+	}
 
-		// sort messages by id; since they are snowflakes this will be in chronological order
-		sort.Slice(messages, func(i, j int) bool {
-			return messages[i].ID < messages[j].ID
-		})
+	options := d.settings.Resolve(GuildID(m.GuildID), parentChannelID, ThreadID(m.ChannelID))
+	options = d.withPinnedSystemPrompt(s, parentChannelID, options, zlog)
+	d.respondToConversation(s, GuildID(m.GuildID), m.ChannelID, messages, options, ctx, zlog)
+}
 
-		// If a starter message exists, Discord re-uses the same ID for both this starter message and the thread itself.
-		// Hence, listing messages in a thread cannot return the first message (!!!). You have to get the parent of the
-		// thread, list messages in the thread, and find the message with the same ID at the thread (!!!).
-		starterMessage, err := discord.FetchStarterMessage(m.ChannelID, &zlog)
-		if err == nil {
-			zlog.Info().
-				Str("starter_message", starterMessage.ID).
-				Str("author", starterMessage.Author.ID).
-				Str("content", starterMessage.Content).
-				Msg("Starter message")
-			messages = append([]*discordgo.Message{starterMessage}, messages...)
-		}
+// respondToConversation replies in channelID, in guildID, to the conversation in messages, which are in chronological
+// order and end with the message being responded to. It reacts to that message to show progress.
+func (d *Discord) respondToConversation(
+	s Session,
+	guildID GuildID,
+	channelID string,
+	messages []*discordgo.Message,
+	options openai.ChatOptions,
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) {
+	lastMessage := messages[len(messages)-1]
+
+	// Set a loading reaction on the newest message.
+	err := withDiscordRetry(func() error {
+		return s.MessageReactionAdd(channelID, lastMessage.ID, d.config.LoadingReaction)
+	}, zlog)
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to add reaction")
+	}
 
-		for _, message := range messages {
-			zlog.Info().Str("sub_message", message.ID).Str("author", message.Author.ID).Str("content", m.Content).Msg("Message")
+	if ok, refusal := d.moderate(lastMessage.Content, ctx, zlog); !ok {
+		err = withDiscordRetry(func() error {
+			_, err := s.ChannelMessageSend(channelID, refusal)
+			return err
+		}, zlog)
+		if err != nil {
+			zlog.Error().Err(err).Msg("Failed to send refusal")
 		}
+		d.setReactionState(s, channelID, lastMessage.ID, d.config.LoadingReaction, d.config.FailureReaction, zlog)
+		return
+	}
 
-		lastMessage := messages[len(messages)-1]
+	stopTyping := startTyping(s, channelID, zlog)
+	defer stopTyping()
 
-		// If there is only one message, assume this is from a human.
-		if len(messages) == 1 {
-			messages[0].Author.Bot = false
-		}
+	// convert messages to []*ChatMessage, call openaiClient.CompleteChat, and send the response to the channel
+	chatMessages := d.buildChatMessages(messages, options, ctx, zlog)
+	completion, err := d.openaiClient.CompleteChat(chatMessages, options, ctx, zlog)
+	stopTyping()
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to complete chat")
+		d.setReactionState(s, channelID, lastMessage.ID, d.config.LoadingReaction, d.config.FailureReaction, zlog)
+		return
+	}
+	d.usage.Record(guildID, completion)
 
-		// If the newest message in the thread is from a bot, we don't need to respond.
-		if lastMessage.Author.Bot {
-			zlog.Info().Msg("Newest message is from a bot, not responding")
+	if d.config.ExtendReplies && !d.config.EmbedResponses {
+		previous, ok := extendableReply(messages, d.discordClient.State.User.ID)
+		if ok && extendReply(s, channelID, previous, completion.Text, zlog) {
+			d.setReactionState(s, channelID, lastMessage.ID, d.config.LoadingReaction, d.config.SuccessReaction, zlog)
+			d.uploadTranscript(channelID, chatMessages, completion.Text, zlog)
 			return
 		}
+	}
 
-		// Set a loading reaction on the newest message.
-		err = s.MessageReactionAdd(m.ChannelID, lastMessage.ID, "🤖")
-		if err != nil {
-			zlog.Error().Err(err).Msg("Failed to add reaction")
+	// The first message replies to the message being responded to, so that Discord shows which message it answers.
+	// Discord cannot reply across channels, which is where a thread's starter message lives.
+	messageSends := d.replyMessages(lastMessage.Content, completion)
+	for i, messageSend := range messageSends {
+		if i == 0 && lastMessage.ChannelID == channelID {
+			messageSend.Reference = replyReference(lastMessage)
 		}
-
-		// convert messages to []*ChatMessage, call openaiClient.CompleteChat, and send the response to the thread
-		chatMessages := make([]*openai.ChatMessage, 0)
-		for _, message := range messages {
-			fromHuman := !message.Author.Bot
-			chatMessages = append(chatMessages, &openai.ChatMessage{
-				FromHuman: fromHuman,
-				Text:      message.Content,
-			})
+		if i == len(messageSends)-1 {
+			messageSend.Components = feedbackComponents()
 		}
-		response, err := openaiClient.CompleteChat(chatMessages, context.TODO(), &zlog)
+		err = withSendRetry(func() error {
+			return sendReply(s, channelID, messageSend, zlog)
+		}, d.config.SendRetryAttempts, zlog)
 		if err != nil {
-			zlog.Error().Err(err).Msg("Failed to complete chat")
-			err = s.MessageReactionAdd(m.ChannelID, lastMessage.ID, "❌")
-			if err != nil {
-				zlog.Error().Err(err).Msg("Failed to add reaction")
-			}
+			zlog.Error().Err(err).Int("sentMessages", i).Msg("Failed to send message")
+			d.deadLetterReply(channelID, chatMessages, completion.Text, err, zlog)
+			d.setReactionState(s, channelID, lastMessage.ID, d.config.LoadingReaction, d.config.FailureReaction, zlog)
 			return
 		}
+	}
 
-		// split the message on full stops ("."). Send the message in 2000 character chunks, so join the chunks
-		// until the length of the message is less than 2000 characters.
-		responseChunks := make([]string, 0)
-		currentSize := 0
-		for _, chunk := range strings.Split(response, ".") {
-			if len(chunk) == 0 {
-				continue
-			}
-			if currentSize+len(chunk) > 2000 {
-				response := strings.Join(responseChunks, ".")
-				_, err = s.ChannelMessageSend(m.ChannelID, response)
-				if err != nil {
-					zlog.Error().Err(err).Msg("Failed to send message")
-					err = s.MessageReactionAdd(m.ChannelID, lastMessage.ID, "❌")
-					if err != nil {
-						zlog.Error().Err(err).Msg("Failed to add reaction")
-					}
-					return
-				}
-				responseChunks = []string{chunk}
-				currentSize = len(chunk)
-				continue
-			}
-			responseChunks = append(responseChunks, chunk)
-			currentSize += len(chunk)
-		}
-		response = strings.Join(responseChunks, ".")
-		if len(response) > 0 {
-			_, err = s.ChannelMessageSend(m.ChannelID, response)
-			if err != nil {
-				zlog.Error().Err(err).Msg("Failed to send message")
-				err = s.MessageReactionAdd(m.ChannelID, lastMessage.ID, "❌")
-				if err != nil {
-					zlog.Error().Err(err).Msg("Failed to add reaction")
-				}
-				return
-			}
-		}
+	d.setReactionState(s, channelID, lastMessage.ID, d.config.LoadingReaction, d.config.SuccessReaction, zlog)
+	d.uploadTranscript(channelID, chatMessages, completion.Text, zlog)
+}
 
-		err = s.MessageReactionAdd(m.ChannelID, lastMessage.ID, "✅")
-		if err != nil {
-			zlog.Error().Err(err).Msg("Failed to add reaction")
+// replyMessages renders a completion in response to prompt as messages, either as plain text or as embeds if
+// Config.EmbedResponses is set.
+func (d *Discord) replyMessages(prompt string, completion *openai.Completion) []*discordgo.MessageSend {
+	var messageSends []*discordgo.MessageSend
+	if d.config.EmbedResponses {
+		for _, embed := range completionEmbeds(prompt, completion) {
+			messageSends = append(messageSends, &discordgo.MessageSend{Embeds: []*discordgo.MessageEmbed{embed}})
 		}
-	})
-
-	discordClient.AddHandler(func(s *discordgo.Session, r *discordgo.Ready) {
-		zlog.Info().Interface("r", r).Msg("Discord client is now ready")
-	})
-
-	discord.DebugApplicationCommands()
-
-	return &discord, nil
+		return messageSends
+	}
+	for _, chunk := range splitResponse(completion.Text) {
+		messageSends = append(messageSends, &discordgo.MessageSend{Content: chunk})
+	}
+	return messageSends
 }
 
 // see: https://github.com/discordjs/discord.js/blob/f3fe3ced622676b406a62b43f085aedde7a621aa/packages/discord.js/src/structures/ThreadChannel.js#L303-L315
 func (d *Discord) FetchStarterMessage(threadID string, zlog *zerolog.Logger) (*discordgo.Message, error) {
-	channel, err := d.discordClient.Channel(threadID)
+	channel, err := d.session.Channel(threadID)
 	if err != nil {
 		zlog.Error().Err(err).Msg("Failed to get thread")
 		return nil, err
 	}
 
 	// Get the message whose ID is the same as the thread ID.
-	message, err := d.discordClient.ChannelMessage(channel.ParentID, threadID)
+	message, err := d.session.ChannelMessage(channel.ParentID, threadID)
 	if err != nil {
 		zlog.Error().Err(err).Msg("Failed to get parent message")
 		return nil, err
@@ -540,96 +1190,252 @@ func (d *Discord) FetchStarterMessage(threadID string, zlog *zerolog.Logger) (*d
 	return message, nil
 }
 
-func (d *Discord) updateThreads(zlog *zerolog.Logger) error {
-	d.idsMap.Lock()
-	defer d.idsMap.Unlock()
-
-	newThreadIDs := make(map[ThreadID]bool)
-
-	for channelID := range d.idsMap.channelIDs {
-		result, err := d.discordClient.ThreadsActive(string(channelID))
-		if err != nil {
-			zlog.Error().Err(err).Msg("Failed to get threads")
+// updateThreads fetches the active threads in each tracked channel, retrying with backoff, without holding the IDsMap
+// lock, and then swaps in the new thread IDs under the write lock. A channel whose threads could not be fetched keeps
+// its previously tracked threads, and the failures are returned.
+func (d *Discord) updateThreads(ctx context.Context, zlog *zerolog.Logger) error {
+	var resultErr error
+	channelIDs := d.idsMap.ChannelIDs()
+	previousThreadIDs := d.idsMap.Threads()
+	newThreadIDs := make(map[ThreadID]ChannelID)
+
+	for _, channelID := range channelIDs {
+		var result *discordgo.ThreadsList
+		err := withBackoffRetry(ctx, func() error {
+			var err error
+			result, err = d.session.ThreadsActive(string(channelID), discordgo.WithContext(ctx))
 			return err
+		}, refreshRetryAttempts, zlog)
+		if err != nil {
+			zlog.Error().Err(err).Str("channel", string(channelID)).Msg("Failed to get threads")
+			resultErr = multierror.Append(resultErr, err)
+			for threadID, parentChannelID := range previousThreadIDs {
+				if parentChannelID == channelID {
+					newThreadIDs[threadID] = parentChannelID
+				}
+			}
+			continue
 		}
 		for _, thread := range result.Threads {
-			newThreadIDs[ThreadID(thread.ID)] = true
+			// Skip any thread already archived, so that a refresh racing an archival does not track it again.
+			if thread.ThreadMetadata != nil && thread.ThreadMetadata.Archived {
+				continue
+			}
+			newThreadIDs[ThreadID(thread.ID)] = channelID
 		}
 	}
 
-	d.idsMap.threadIDs = newThreadIDs
+	d.idsMap.SetThreads(newThreadIDs)
 
-	return nil
+	return resultErr
+}
+
+// Healthy returns whether the Discord session is connected and its heartbeat latency is within the watchdog threshold.
+func (d *Discord) Healthy() bool {
+	d.discordClient.RLock()
+	ready := d.discordClient.DataReady
+	d.discordClient.RUnlock()
+	return ready && d.discordClient.HeartbeatLatency() <= d.config.WatchdogThreshold
 }
 
-func (d *Discord) deferInteractionReply(s *discordgo.Session, i *discordgo.InteractionCreate) error {
+// shouldRespondTo returns whether a message by authorID in a thread created by creatorID should trigger a response.
+func (d *Discord) shouldRespondTo(authorID string, creatorID string) bool {
+	if !d.config.RespondOnlyToCreator {
+		return true
+	}
+	return creatorID != "" && authorID == creatorID
+}
+
+// logLockError logs a failure to acquire or release a lock. Every instance receives every event, so a lock being held
+// by another instance is the normal way duplicate deliveries are skipped, and is not reported as an error.
+func logLockError(zlog *zerolog.Logger, err error, action string) {
+	var unavailable aws.LockCurrentlyUnavailableError
+	switch {
+	case errors.As(err, &unavailable):
+		zlog.Debug().Err(err).Msg("Lock is held by another instance, skipping event")
+	case errors.Is(err, aws.LockNotFoundError):
+		zlog.Debug().Err(err).Msgf("Lock is no longer held, could not %s it", action)
+	case errors.Is(err, aws.LockAbandonedError):
+		zlog.Warn().Err(err).Msgf("Lock was abandoned, could not %s it", action)
+	default:
+		zlog.Error().Err(err).Msgf("Failed to %s lock", action)
+	}
+}
+
+// deferInteractionReply acknowledges an interaction so that the handler can take longer than Discord's three second
+// deadline to reply. Whether the reply is ephemeral is decided here: a later InteractionResponseEdit keeps the flags
+// of the deferred response, and cannot change them.
+func (d *Discord) deferInteractionReply(
+	s Session,
+	i *discordgo.InteractionCreate,
+	flags discordgo.MessageFlags,
+	zlog *zerolog.Logger,
+) error {
 	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Flags: flags,
+		},
 	})
 	if err != nil {
-		d.zlog.Error().Err(err).Msg("Failed to defer interaction reply")
+		zlog.Error().Err(err).Msg("Failed to defer interaction reply")
 		return err
 	}
 	return nil
 }
 
-func (d *Discord) pingInteractionHandler(s *discordgo.Session, i *discordgo.InteractionCreate) {
+func (d *Discord) pingInteractionHandler(s Session, i *discordgo.InteractionCreate, ctx context.Context, zlog *zerolog.Logger) {
 	payload := i.ApplicationCommandData()
-	d.zlog.Info().Str("command", payload.Name).Interface("payload", payload).Msg("Received ping command")
+	zlog.Info().Str("command", payload.Name).Interface("payload", payload).Msg("Received ping command")
 
 	// Send the pong message by editing the original interaction response.
 	_, err := s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
-		Content: Ptr("Pong!"),
+		Content: Ptr(Localize(msgPong, i.Locale)),
 	})
 	if err != nil {
-		d.zlog.Error().Err(err).Msg("Failed to edit interaction response")
+		zlog.Error().Err(err).Msg("Failed to edit interaction response")
+	}
+}
+
+// whoAmIInteractionHandler replies with the owner of the lock client, i.e. the host and process that handled the
+// command, so that operators can trace which replica processes interactions.
+func (d *Discord) whoAmIInteractionHandler(s Session, i *discordgo.InteractionCreate, ctx context.Context, zlog *zerolog.Logger) {
+	zlog.Info().Str("command", i.ApplicationCommandData().Name).Msg("Received whoami command")
+
+	_, err := s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+		Content: Ptr(instanceDescription(d.lockClient.Owner())),
+	})
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to respond to interaction")
+	}
+}
+
+// instanceDescription describes the bot instance identified by owner, e.g. "Handled by instance `host-1234`".
+func instanceDescription(owner string) string {
+	if owner == "" {
+		owner = "unknown"
 	}
+	return fmt.Sprintf("Handled by instance `%s`", owner)
 }
 
-func (d *Discord) completeInteractionHandler(s *discordgo.Session, i *discordgo.InteractionCreate) {
+func (d *Discord) completeInteractionHandler(s Session, i *discordgo.InteractionCreate, ctx context.Context, zlog *zerolog.Logger) {
 	prompt := getPayloadFromIteraction(i)
+	if !d.checkPromptLength(s, i, prompt, zlog) {
+		return
+	}
 
 	// Get the completion from OpenAI.
-	ctx := context.Background()
-	completion, err := d.openaiClient.Complete(prompt, ctx, d.zlog)
+	if ok, refusal := d.moderate(prompt, ctx, zlog); !ok {
+		d.respondRefused(s, i, refusal, zlog)
+		return
+	}
+	if interactionJSON(i) {
+		d.completeJSONInteraction(s, i, prompt, ctx, zlog)
+		return
+	}
+	options := openai.CompleteOptions{Stop: d.config.Stop}
+	if stop, ok := interactionStopSequences(i); ok {
+		options.Stop = stop
+	}
+	options.N = interactionCount(i)
+	deadline := interactionDeadline(i.ID, time.Now(), d.config.InteractionExpiryMargin)
+	var completion *openai.Completion
+	var err error
+	// Streaming shows a single completion as it is generated, so several candidates are only shown once complete.
+	if d.config.StreamResponses && options.N == 1 {
+		completion, err = d.streamCompletion(s, i, prompt, options, deadline, ctx, zlog)
+	} else {
+		completion, err = d.openaiClient.Complete(prompt, options, ctx, zlog)
+	}
 	if err != nil {
-		d.zlog.Error().Err(err).Msg("Failed to get completion from OpenAI")
+		zlog.Error().Err(err).Msg("Failed to get completion from OpenAI")
 
-		// Respond failure to the interaction with the contents of the error message.
+		// Respond failure to the interaction without leaking the details of the error.
 		_, err = s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
-			Content: Ptr(err.Error()),
+			Content: Ptr(userErrorMessage(err, i.Locale)),
 		})
+		if err != nil {
+			zlog.Error().Err(err).Msg("Failed to respond to interaction")
+		}
 
 		return
 	}
-	completion = strings.TrimSpace(completion)
+	d.usage.Record(GuildID(i.GuildID), completion)
+	completion.Text = strings.TrimSpace(completion.Text)
+	if len(completion.Choices) > 1 {
+		completion.Text = formatCandidates(completion.Choices, maxMessageLength)
+	}
 
-	// Create a response string, which is the original prompt in a quote block, followed by the completion.
-	response := fmt.Sprintf("> %s\n\n%s", prompt, completion)
+	// Content is cleared when responding with embeds, to replace any streamed progress.
+	var content string
+	var embeds []*discordgo.MessageEmbed
+	attachPrompt := false
+	if d.config.EmbedResponses {
+		embeds = completionEmbeds(prompt, completion)
+	} else {
+		content, attachPrompt = completeResponse(prompt, completion.Text)
+	}
+	// A file's reader can only be sent once, so each attempt gets a fresh one.
+	files := func() []*discordgo.File {
+		if !attachPrompt {
+			return nil
+		}
+		return []*discordgo.File{promptFile(prompt)}
+	}
+
+	// A slow completion can outlive the interaction token, in which case the result is sent as a new message instead.
+	if !canEditInteraction(deadline, time.Now()) {
+		zlog.Warn().Msg("Interaction token expired while completing, sending completion as a new message")
+		err = withDiscordRetry(func() error {
+			_, err := s.ChannelMessageSendComplex(i.ChannelID, &discordgo.MessageSend{Content: content, Embeds: embeds, Files: files()})
+			return err
+		}, zlog)
+		if err != nil {
+			zlog.Error().Err(err).Msg("Failed to send completion")
+		}
+		return
+	}
 
 	// Respond to the interaction.
-	_, err = s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
-		Content: Ptr(response),
-	})
+	edit := &discordgo.WebhookEdit{Content: Ptr(content), Files: files()}
+	if embeds != nil {
+		edit.Embeds = Ptr(embeds)
+	}
+	_, err = s.InteractionResponseEdit(i.Interaction, edit)
 	if err != nil {
-		d.zlog.Error().Err(err).Msg("Failed to respond to interaction")
+		zlog.Error().Err(err).Msg("Failed to respond to interaction")
 		return
 	}
 }
 
-func (d *Discord) createImageInteractionHandler(s *discordgo.Session, i *discordgo.InteractionCreate) {
+func (d *Discord) createImageInteractionHandler(s Session, i *discordgo.InteractionCreate, ctx context.Context, zlog *zerolog.Logger) {
 	prompt := getPayloadFromIteraction(i)
+	if !d.checkPromptLength(s, i, prompt, zlog) {
+		return
+	}
+
+	if d.completed.IsComplete(i.ID, time.Now()) {
+		zlog.Info().Msg("Interaction already completed, not creating the image again")
+		return
+	}
 
 	// Get the image URLs from OpenAI.
-	ctx := context.Background()
-	resp, err := d.openaiClient.CreateImage(prompt, ctx, d.zlog)
+	if ok, refusal := d.moderateImagePrompt(prompt, ctx, zlog); !ok {
+		d.respondRefused(s, i, refusal, zlog)
+		return
+	}
+	ctx = openai.WithIdempotencyKey(ctx, openai.IdempotencyKey("image", i.ID))
+	resp, err := d.openaiClient.CreateImage(prompt, ctx, zlog)
 	if err != nil {
-		d.zlog.Error().Err(err).Msg("Failed to get completion from OpenAI")
+		zlog.Error().Err(err).Msg("Failed to get completion from OpenAI")
 
-		// Respond failure to the interaction with the contents of the error message.
+		// Respond failure to the interaction without leaking the details of the error.
 		_, err = s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
-			Content: Ptr(err.Error()),
+			Content: Ptr(userErrorMessage(err, i.Locale)),
 		})
+		if err != nil {
+			zlog.Error().Err(err).Msg("Failed to respond to interaction")
+		}
 
 		return
 	}
@@ -637,7 +1443,7 @@ func (d *Discord) createImageInteractionHandler(s *discordgo.Session, i *discord
 	response := fmt.Sprintf("> %s", prompt)
 	files := make([]*discordgo.File, 0)
 	for i := 0; i < len(resp.Images); i++ {
-		name := fmt.Sprintf("image%d.png", i)
+		name := imageFilename(prompt, "image", i)
 		files = append(files, &discordgo.File{
 			Name:   name,
 			Reader: bytes.NewReader(resp.Images[i].Data),
@@ -650,18 +1456,370 @@ func (d *Discord) createImageInteractionHandler(s *discordgo.Session, i *discord
 		Files:   files,
 	})
 	if err != nil {
-		d.zlog.Error().Err(err).Msg("Failed to respond to interaction")
+		zlog.Error().Err(err).Msg("Failed to respond to interaction")
 		return
 	}
+	d.completed.Complete(i.ID, time.Now())
+}
+
+// imageEditInteractionHandler edits the attached image if a prompt is given, and otherwise creates variations of it.
+func (d *Discord) imageEditInteractionHandler(s Session, i *discordgo.InteractionCreate, ctx context.Context, zlog *zerolog.Logger) {
+	zlog.Info().Msg("Received image-edit command")
+
+	respond := func(content string) {
+		_, err := s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+			Content: Ptr(content),
+		})
+		if err != nil {
+			zlog.Error().Err(err).Msg("Failed to respond to interaction")
+		}
+	}
+
+	data := i.ApplicationCommandData()
+	attachment := func(option *discordgo.ApplicationCommandInteractionDataOption) *discordgo.MessageAttachment {
+		if data.Resolved == nil {
+			return nil
+		}
+		id, _ := option.Value.(string)
+		return data.Resolved.Attachments[id]
+	}
+
+	var imageAttachment, maskAttachment *discordgo.MessageAttachment
+	prompt := ""
+	variations := 1
+	for _, option := range data.Options {
+		switch option.Name {
+		case "image":
+			imageAttachment = attachment(option)
+		case "mask":
+			maskAttachment = attachment(option)
+		case "prompt":
+			prompt = strings.TrimSpace(option.StringValue())
+		case "variations":
+			variations = int(option.IntValue())
+		}
+	}
+	if imageAttachment == nil {
+		respond(Localize(msgAttachImage, i.Locale))
+		return
+	}
+	if d.completed.IsComplete(i.ID, time.Now()) {
+		zlog.Info().Msg("Interaction already completed, not editing the image again")
+		return
+	}
+	if ok, refusal := d.moderateImagePrompt(prompt, ctx, zlog); !ok {
+		d.respondRefused(s, i, refusal, zlog)
+		return
+	}
+
+	imageData, err := downloadImageAttachment(ctx, imageAttachment)
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to download image")
+		respond(userErrorMessage(err, i.Locale))
+		return
+	}
+
+	ctx = openai.WithIdempotencyKey(ctx, openai.IdempotencyKey("image-edit", i.ID))
+	var resp *openai.CreateImageResponse
+	if prompt == "" {
+		resp, err = d.openaiClient.CreateImageVariation(imageData, variations, ctx, zlog)
+	} else {
+		var maskData []byte
+		if maskAttachment != nil {
+			maskData, err = downloadImageAttachment(ctx, maskAttachment)
+			if err != nil {
+				zlog.Error().Err(err).Msg("Failed to download mask")
+				respond(userErrorMessage(err, i.Locale))
+				return
+			}
+		}
+		resp, err = d.openaiClient.EditImage(imageData, maskData, prompt, ctx, zlog)
+	}
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to edit image")
+		respond(userErrorMessage(err, i.Locale))
+		return
+	}
+
+	response := "Variations of the image"
+	if prompt != "" {
+		response = fmt.Sprintf("> %s", prompt)
+	}
+	files := make([]*discordgo.File, 0, len(resp.Images))
+	for j, image := range resp.Images {
+		files = append(files, &discordgo.File{
+			Name:   imageFilename(prompt, "variation", j),
+			Reader: bytes.NewReader(image.Data),
+		})
+	}
+	_, err = s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+		Content: Ptr(response),
+		Files:   files,
+	})
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to respond to interaction")
+		return
+	}
+	d.completed.Complete(i.ID, time.Now())
+}
+
+// summarizeInteractionHandler summarizes the text option if it is given, and otherwise the conversation in the thread
+// the command was run in.
+func (d *Discord) summarizeInteractionHandler(s Session, i *discordgo.InteractionCreate, ctx context.Context, zlog *zerolog.Logger) {
+	zlog.Info().Msg("Received summarize command")
+
+	respond := func(content string) {
+		_, err := s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+			Content: Ptr(content),
+		})
+		if err != nil {
+			zlog.Error().Err(err).Msg("Failed to respond to interaction")
+		}
+	}
+
+	text := ""
+	sentences := defaultSummarySentences
+	for _, option := range i.ApplicationCommandData().Options {
+		switch option.Name {
+		case "text":
+			text = strings.TrimSpace(option.StringValue())
+		case "sentences":
+			sentences = int(option.IntValue())
+		}
+	}
+
+	var chatMessages []*openai.ChatMessage
+	if text != "" {
+		chatMessages = []*openai.ChatMessage{{FromHuman: true, Text: text}}
+	} else {
+		if !d.lookupChannel(i.ChannelID).isThread {
+			respond(Localize(msgSummarizeWhat, i.Locale))
+			return
+		}
+		messages, _, err := d.gatherThreadMessages(s, i.ChannelID, zlog)
+		if err != nil {
+			respond(userErrorMessage(err, i.Locale))
+			return
+		}
+		if len(messages) == 0 {
+			respond(Localize(msgNothingToSummarize, i.Locale))
+			return
+		}
+		chatMessages = toChatMessages(messages)
+	}
+
+	summary, err := d.openaiClient.SummarizeConversation(chatMessages, sentences, ctx, zlog)
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to summarize")
+		respond(userErrorMessage(err, i.Locale))
+		return
+	}
+	// The first chunk replaces the deferred interaction reply, and any remaining chunks are sent as follow-ups.
+	chunks := splitResponse(summary)
+	if len(chunks) == 0 {
+		respond(Localize(msgEmptySummary, i.Locale))
+		return
+	}
+	respond(chunks[0])
+	for _, chunk := range chunks[1:] {
+		err = withDiscordRetry(func() error {
+			_, err := s.FollowupMessageCreate(i.Interaction, true, &discordgo.WebhookParams{
+				Content: chunk,
+				Flags:   interactionReplyFlags(i),
+			})
+			return err
+		}, zlog)
+		if err != nil {
+			zlog.Error().Err(err).Msg("Failed to send summary follow-up")
+			return
+		}
+	}
+}
+
+func (d *Discord) regenerateInteractionHandler(s Session, i *discordgo.InteractionCreate, ctx context.Context, zlog *zerolog.Logger) {
+	zlog.Info().Msg("Received regenerate command")
+
+	respond := func(content string) {
+		_, err := s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+			Content: Ptr(content),
+		})
+		if err != nil {
+			zlog.Error().Err(err).Msg("Failed to respond to interaction")
+		}
+	}
+
+	snapshot := d.lookupChannel(i.ChannelID)
+	parentChannelID, inThread := snapshot.parentChannelID, snapshot.isThread
+	if !inThread {
+		respond(Localize(msgRegenerateInThread, i.Locale))
+		return
+	}
+
+	messages, _, err := d.gatherThreadMessages(s, i.ChannelID, zlog)
+	if err != nil {
+		respond(userErrorMessage(err, i.Locale))
+		return
+	}
+	messages = dropLastAssistant(messages)
+	if len(messages) == 0 {
+		respond(Localize(msgNothingToRegenerate, i.Locale))
+		return
+	}
+
+	options := d.settings.Resolve(GuildID(i.GuildID), parentChannelID, ThreadID(i.ChannelID))
+	options = d.withPinnedSystemPrompt(s, parentChannelID, options, zlog)
+	chatMessages := d.buildChatMessages(messages, options, ctx, zlog)
+	completion, err := d.openaiClient.CompleteChat(chatMessages, options, ctx, zlog)
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to complete chat")
+		respond(userErrorMessage(err, i.Locale))
+		return
+	}
+	d.usage.Record(GuildID(i.GuildID), completion)
+
+	// The first chunk replaces the deferred interaction reply, and any remaining chunks are sent as new messages.
+	chunks := splitResponse(completion.Text)
+	if len(chunks) == 0 {
+		respond(Localize(msgEmptyRegeneration, i.Locale))
+		return
+	}
+	if len(chunks) == 1 {
+		_, err = s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+			Content:    Ptr(chunks[0]),
+			Components: Ptr(feedbackComponents()),
+		})
+		if err != nil {
+			zlog.Error().Err(err).Msg("Failed to respond to interaction")
+		}
+		return
+	}
+	respond(chunks[0])
+	for j, chunk := range chunks[1:] {
+		messageSend := &discordgo.MessageSend{Content: chunk}
+		if j == len(chunks)-2 {
+			messageSend.Components = feedbackComponents()
+		}
+		err = withDiscordRetry(func() error {
+			_, err := s.ChannelMessageSendComplex(i.ChannelID, messageSend)
+			return err
+		}, zlog)
+		if err != nil {
+			zlog.Error().Err(err).Msg("Failed to send message")
+			return
+		}
+	}
+}
+
+func (d *Discord) settingsInteractionHandler(s Session, i *discordgo.InteractionCreate, ctx context.Context, zlog *zerolog.Logger) {
+	payload := i.ApplicationCommandData()
+	zlog.Info().Str("command", payload.Name).Interface("payload", payload).Msg("Received settings command")
+
+	var scope string
+	var settings Settings
+	changed := false
+	for _, option := range payload.Options {
+		switch option.Name {
+		case "scope":
+			scope = option.StringValue()
+		case "model":
+			settings.Model = Ptr(strings.TrimSpace(option.StringValue()))
+			changed = true
+		case "temperature":
+			settings.Temperature = Ptr(float32(option.FloatValue()))
+			changed = true
+		case "persona":
+			settings.Persona = Ptr(strings.TrimSpace(option.StringValue()))
+			changed = true
+		case "seed":
+			settings.Seed = Ptr(int(option.IntValue()))
+			changed = true
+		case "language":
+			// "none" is stored as empty, overriding any language set at a wider scope.
+			language := strings.TrimSpace(option.StringValue())
+			if strings.EqualFold(language, "none") {
+				language = ""
+			}
+			settings.Language = Ptr(language)
+			changed = true
+		}
+	}
+
+	// If the interaction is in a thread, settings resolve through its parent channel.
+	snapshot := d.lookupChannel(i.ChannelID)
+	parentChannelID, inThread := snapshot.parentChannelID, snapshot.isThread
+	var threadID ThreadID
+	channelID := ChannelID(i.ChannelID)
+	if inThread {
+		threadID = ThreadID(i.ChannelID)
+		channelID = parentChannelID
+	}
+
+	if scope == "" {
+		if inThread {
+			scope = settingsScopeThread
+		} else {
+			scope = settingsScopeChannel
+		}
+	}
+
+	var response string
+	if scope == settingsScopeThread && !inThread {
+		response = "The thread scope can only be used inside a thread."
+	} else if changed && scope == settingsScopeGuild && !canManageServer(i) {
+		zlog.Info().Msg("Rejected server settings change from a member without Manage Server")
+		response = "Changing server-wide settings requires the Manage Server permission."
+	} else {
+		if changed {
+			switch scope {
+			case settingsScopeThread:
+				d.settings.SetThreadSettings(threadID, settings)
+			case settingsScopeChannel:
+				d.settings.SetChannelSettings(channelID, settings)
+			case settingsScopeGuild:
+				d.settings.SetGuildSettings(GuildID(i.GuildID), settings)
+			}
+		}
+
+		options := d.settings.Resolve(GuildID(i.GuildID), channelID, threadID)
+		persona := options.Persona
+		if persona == "" {
+			persona = "(none)"
+		}
+		seed := "(none)"
+		if options.Seed != nil {
+			seed = strconv.Itoa(*options.Seed)
+		}
+		language := options.Language
+		if language == "" {
+			language = "(none)"
+		}
+		response = fmt.Sprintf(
+			"Model: %s\nTemperature: %.2f\nPersona: %s\nSeed: %s\nLanguage: %s",
+			options.Model,
+			options.Temperature,
+			persona,
+			seed,
+			language,
+		)
+	}
+
+	_, err := s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+		Content: Ptr(response),
+	})
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to respond to interaction")
+	}
 }
 
 func (d *Discord) Close(zlog *zerolog.Logger) error {
 	var resultError error
 
+	d.stopReconciliation()
+
 	if d.config.RemoveCommands {
 		for _, command := range d.registeredCommands {
 			zlog.Info().Interface("command", command).Msg("Deleting command")
-			err := d.discordClient.ApplicationCommandDelete(d.discordClient.State.User.ID, "", command.ID)
+			err := d.discordClient.ApplicationCommandDelete(d.discordClient.State.User.ID, command.GuildID, command.ID)
 			if err != nil {
 				zlog.Error().Err(err).Msg("Failed to delete command")
 				resultError = multierror.Append(resultError, err)
@@ -675,6 +1833,9 @@ func (d *Discord) Close(zlog *zerolog.Logger) error {
 		resultError = multierror.Append(resultError, err)
 	}
 
+	// Let interactions already accepted finish, now that no more can arrive.
+	d.interactions.Close()
+
 	return resultError
 }
 
@@ -696,10 +1857,217 @@ func (d *Discord) startWatchdog() error {
 
 func getPayloadFromIteraction(i *discordgo.InteractionCreate) string {
 	payload := i.ApplicationCommandData()
-	if len(payload.Options) == 0 {
-		return ""
+	for _, option := range payload.Options {
+		if option.Name == "prompt" {
+			return strings.TrimSpace(option.StringValue())
+		}
+	}
+	return ""
+}
+
+// promptFileName is the name of the file a /complete prompt is attached as when it is too long to quote.
+const promptFileName = "prompt.txt"
+
+// completeResponse returns the reply to /complete: prompt in a quote block, followed by completion. If that does not
+// fit in a Discord message, it returns only completion, truncated to fit, and true to attach prompt as a file instead.
+func completeResponse(prompt string, completion string) (string, bool) {
+	content := fmt.Sprintf("> %s\n\n%s", prompt, completion)
+	if len(content) <= maxMessageLength {
+		return content, false
+	}
+	return truncate(completion, maxMessageLength), true
+}
+
+// promptFile returns prompt as a plain text file attachment.
+func promptFile(prompt string) *discordgo.File {
+	return &discordgo.File{
+		Name:        promptFileName,
+		ContentType: "text/plain",
+		Reader:      strings.NewReader(prompt),
+	}
+}
+
+// promptTooLong returns whether prompt has more than maxLength characters. A maxLength that is not positive means no
+// limit.
+func promptTooLong(prompt string, maxLength int) bool {
+	return maxLength > 0 && utf8.RuneCountInString(prompt) > maxLength
+}
+
+// checkPromptLength returns whether prompt is within Config.MaxPromptLength, and if not tells the user, and only them,
+// what the limit is.
+func (d *Discord) checkPromptLength(s Session, i *discordgo.InteractionCreate, prompt string, zlog *zerolog.Logger) bool {
+	if !promptTooLong(prompt, d.config.MaxPromptLength) {
+		return true
+	}
+	length := utf8.RuneCountInString(prompt)
+	zlog.Info().Int("length", length).Int("maxLength", d.config.MaxPromptLength).Msg("Prompt is too long")
+	d.respondRefused(s, i, fmt.Sprintf(Localize(msgPromptTooLong, i.Locale), d.config.MaxPromptLength, length), zlog)
+	return false
+}
+
+// interactionStopSequences returns the stop sequences from the stop option of a command, and whether it was set. The
+// sequences are separated by commas and are not trimmed, since whitespace can be a meaningful stop sequence.
+func interactionStopSequences(i *discordgo.InteractionCreate) ([]string, bool) {
+	for _, option := range i.ApplicationCommandData().Options {
+		if option.Name == "stop" {
+			stop := make([]string, 0)
+			for _, sequence := range strings.Split(option.StringValue(), ",") {
+				if sequence != "" {
+					stop = append(stop, sequence)
+				}
+			}
+			return stop, len(stop) > 0
+		}
+	}
+	return nil, false
+}
+
+// interactionCount returns the count option of a command, clamped to between 1 and maxCompletionCandidates, or 1 if
+// it is not set.
+func interactionCount(i *discordgo.InteractionCreate) int {
+	for _, option := range i.ApplicationCommandData().Options {
+		if option.Name == "count" {
+			count := int(option.IntValue())
+			if count < 1 {
+				return 1
+			}
+			if count > maxCompletionCandidates {
+				return maxCompletionCandidates
+			}
+			return count
+		}
+	}
+	return 1
+}
+
+// interactionJSON returns whether the json option of a command is set.
+func interactionJSON(i *discordgo.InteractionCreate) bool {
+	for _, option := range i.ApplicationCommandData().Options {
+		if option.Name == "json" {
+			return option.BoolValue()
+		}
+	}
+	return false
+}
+
+// interactionChatOptions returns the chat settings for the channel of an interaction. In a thread, they resolve
+// through its parent channel.
+func (d *Discord) interactionChatOptions(i *discordgo.InteractionCreate) openai.ChatOptions {
+	snapshot := d.lookupChannel(i.ChannelID)
+	var threadID ThreadID
+	channelID := ChannelID(i.ChannelID)
+	if snapshot.isThread {
+		threadID = ThreadID(i.ChannelID)
+		channelID = snapshot.parentChannelID
+	}
+	return d.settings.Resolve(GuildID(i.GuildID), channelID, threadID)
+}
+
+// completeJSONInteraction responds to /complete with json set, replying with the JSON object the chat model returns
+// for prompt in a code block.
+func (d *Discord) completeJSONInteraction(s Session, i *discordgo.InteractionCreate, prompt string, ctx context.Context, zlog *zerolog.Logger) {
+	var content string
+	reply, err := d.openaiClient.CompleteChatJSON([]*openai.ChatMessage{{FromHuman: true, Text: prompt}}, nil, d.interactionChatOptions(i), ctx, zlog)
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to get JSON completion from OpenAI")
+		content = userErrorMessage(err, i.Locale)
+	} else {
+		var indented bytes.Buffer
+		if json.Indent(&indented, reply, "", "  ") != nil {
+			indented.Reset()
+			indented.Write(reply)
+		}
+		content = truncate("```json\n"+indented.String()+"\n```", maxMessageLength)
+	}
+
+	_, err = s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{Content: Ptr(content)})
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to respond to interaction")
+	}
+}
+
+// formatCandidates formats candidates as numbered sections, e.g. "**1.**\nfoo\n\n**2.**\nbar". If they do not fit
+// in maxLength, each candidate is truncated to an equal share of it, so that every one of them is still shown.
+func formatCandidates(candidates []string, maxLength int) string {
+	const separator = "\n\n"
+	headings := make([]string, 0, len(candidates))
+	texts := make([]string, 0, len(candidates))
+	length, overhead := 0, 0
+	for index, candidate := range candidates {
+		heading := fmt.Sprintf("**%d.**\n", index+1)
+		headings = append(headings, heading)
+		texts = append(texts, strings.TrimSpace(candidate))
+		overhead += len(heading)
+		if index > 0 {
+			overhead += len(separator)
+		}
+		length += len(texts[index])
+	}
+
+	if overhead+length > maxLength && len(candidates) > 0 {
+		share := (maxLength - overhead) / len(candidates)
+		if share < 1 {
+			share = 1
+		}
+		for index, text := range texts {
+			texts[index] = truncate(text, share)
+		}
+	}
+
+	sections := make([]string, 0, len(candidates))
+	for index, text := range texts {
+		sections = append(sections, headings[index]+text)
+	}
+	return strings.Join(sections, separator)
+}
+
+// maxOptionChoices is the most choices Discord allows for a command option.
+const maxOptionChoices = 25
+
+// modelChoices returns the choices for a model option, one per model in models, skipping blanks and duplicates and
+// keeping at most maxOptionChoices. It returns nil if there are no models, so that the option accepts free text.
+func modelChoices(models []string) []*discordgo.ApplicationCommandOptionChoice {
+	var choices []*discordgo.ApplicationCommandOptionChoice
+	seen := make(map[string]bool)
+	for _, model := range models {
+		model = strings.TrimSpace(model)
+		if model == "" || seen[model] {
+			continue
+		}
+		if len(choices) == maxOptionChoices {
+			break
+		}
+		seen[model] = true
+		choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: model, Value: model})
+	}
+	return choices
+}
+
+// canManageServer returns whether the member who created the interaction has the Manage Server permission, as needed
+// to change settings for the whole server.
+func canManageServer(i *discordgo.InteractionCreate) bool {
+	return i.Member != nil && i.Member.Permissions&discordgo.PermissionManageServer != 0
+}
+
+// privateCommands are the commands whose replies are always ephemeral. The reply to delete-last must be, or it would
+// itself be the bot's last message in the thread.
+var privateCommands = map[string]bool{
+	"config":      true,
+	"delete-last": true,
+}
+
+// interactionReplyFlags returns the flags for the reply to a command. The reply is ephemeral, i.e. only visible to the
+// user who ran the command, if the command is in privateCommands or has a private option set to true.
+func interactionReplyFlags(i *discordgo.InteractionCreate) discordgo.MessageFlags {
+	if privateCommands[i.ApplicationCommandData().Name] {
+		return discordgo.MessageFlagsEphemeral
+	}
+	for _, option := range i.ApplicationCommandData().Options {
+		if option.Name == "private" && option.BoolValue() {
+			return discordgo.MessageFlagsEphemeral
+		}
 	}
-	return strings.TrimSpace(payload.Options[0].StringValue())
+	return 0
 }
 
 func Ptr[T any](t T) *T {
@@ -0,0 +1,255 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"reflect"
+	"src/aws"
+	"testing"
+	"time"
+)
+
+func TestShouldRespondTo(t *testing.T) {
+	tests := []struct {
+		name                 string
+		respondOnlyToCreator bool
+		authorID             string
+		creatorID            string
+		want                 bool
+	}{
+		{name: "creator", respondOnlyToCreator: true, authorID: "creator", creatorID: "creator", want: true},
+		{name: "someone else", respondOnlyToCreator: true, authorID: "other", creatorID: "creator", want: false},
+		{name: "unknown creator", respondOnlyToCreator: true, authorID: "other", creatorID: "", want: false},
+		{name: "disabled, creator", authorID: "creator", creatorID: "creator", want: true},
+		{name: "disabled, someone else", authorID: "other", creatorID: "creator", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Discord{config: DefaultConfig()}
+			d.config.RespondOnlyToCreator = tt.respondOnlyToCreator
+			if got := d.shouldRespondTo(tt.authorID, tt.creatorID); got != tt.want {
+				t.Errorf("shouldRespondTo(%q, %q) = %v, want %v", tt.authorID, tt.creatorID, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	sent := time.Now()
+	tests := []struct {
+		name      string
+		dataReady bool
+		latency   time.Duration
+		want      bool
+	}{
+		{name: "connected", dataReady: true, latency: time.Second, want: true},
+		{name: "not connected", dataReady: false, latency: time.Second, want: false},
+		{name: "heartbeat too slow", dataReady: true, latency: time.Minute, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := &discordgo.Session{DataReady: tt.dataReady, LastHeartbeatSent: sent, LastHeartbeatAck: sent.Add(tt.latency)}
+			d := &Discord{discordClient: session, config: DefaultConfig()}
+			if got := d.Healthy(); got != tt.want {
+				t.Errorf("Healthy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogLockError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		wantLevel string
+	}{
+		{name: "held by another instance", err: aws.LockCurrentlyUnavailableError{}, wantLevel: "debug"},
+		{name: "wrapped held by another instance", err: fmt.Errorf("acquiring: %w", aws.LockCurrentlyUnavailableError{}), wantLevel: "debug"},
+		{name: "not found", err: aws.LockNotFoundError, wantLevel: "debug"},
+		{name: "abandoned", err: aws.LockAbandonedError, wantLevel: "warn"},
+		{name: "other error", err: errors.New("throttled"), wantLevel: "error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			zlog := zerolog.New(&buf)
+
+			logLockError(&zlog, tt.err, "acquire")
+
+			var entry struct {
+				Level string `json:"level"`
+			}
+			if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+				t.Fatalf("parsing log entry %q: %v", buf.String(), err)
+			}
+			if entry.Level != tt.wantLevel {
+				t.Errorf("logLockError() logged at %q, want %q", entry.Level, tt.wantLevel)
+			}
+		})
+	}
+}
+
+func TestRegisterCommandsPerGuild(t *testing.T) {
+	session := newFakeSession()
+	d := newTestDiscord(session, nil)
+	d.idsMap = NewIDsMap([]GuildID{"guild-b", "guild-a"})
+	zlog := zerolog.Nop()
+	commands := []Command{{Name: "complete"}, {Name: "import"}}
+
+	if err := d.registerCommands(session, "app", commands, &zlog); err != nil {
+		t.Fatalf("registerCommands() error = %v", err)
+	}
+
+	var got []string
+	for _, command := range session.commands {
+		if command.ApplicationID != "app" {
+			t.Errorf("registerCommands() registered %s for application %q, want app", command.Name, command.ApplicationID)
+		}
+		got = append(got, command.GuildID+"/"+command.Name)
+	}
+	want := []string{"guild-a/complete", "guild-a/import", "guild-b/complete", "guild-b/import"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("registerCommands() registered %v, want %v", got, want)
+	}
+	if !reflect.DeepEqual(d.registeredCommands, session.commands) {
+		t.Errorf("registeredCommands = %v, want the created commands %v", d.registeredCommands, session.commands)
+	}
+}
+
+func TestRegisterCommandsTarget(t *testing.T) {
+	tests := []struct {
+		name           string
+		globalCommands bool
+		wantGuildIDs   []string
+	}{
+		{name: "per guild", wantGuildIDs: []string{"guild-a", "guild-b"}},
+		{name: "global", globalCommands: true, wantGuildIDs: []string{""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newFakeSession()
+			d := newTestDiscord(session, nil)
+			d.idsMap = NewIDsMap([]GuildID{"guild-a", "guild-b"})
+			d.config.GlobalCommands = tt.globalCommands
+			zlog := zerolog.Nop()
+
+			if err := d.registerCommands(session, "app", []Command{{Name: "complete"}}, &zlog); err != nil {
+				t.Fatalf("registerCommands() error = %v", err)
+			}
+
+			var got []string
+			for _, command := range session.commands {
+				got = append(got, command.GuildID)
+			}
+			if !reflect.DeepEqual(got, tt.wantGuildIDs) {
+				t.Errorf("registerCommands() registered in guilds %q, want %q", got, tt.wantGuildIDs)
+			}
+		})
+	}
+}
+
+func TestInstanceDescription(t *testing.T) {
+	tests := []struct {
+		name  string
+		owner string
+		want  string
+	}{
+		{name: "owner", owner: "host-1234", want: "Handled by instance `host-1234`"},
+		{name: "no owner", want: "Handled by instance `unknown`"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := instanceDescription(tt.owner); got != tt.want {
+				t.Errorf("instanceDescription(%q) = %q, want %q", tt.owner, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWhoAmIInteractionHandler(t *testing.T) {
+	session := newFakeSession()
+	d := newTestDiscord(session, nil)
+	zlog := zerolog.Nop()
+	d.lockClient = aws.NewInMemoryLockClient("host-1234", &zlog)
+
+	d.whoAmIInteractionHandler(session, newCommandInteraction("channel", "user", "whoami"), context.Background(), &zlog)
+
+	if len(session.responseEdits) != 1 {
+		t.Fatalf("got %d response edits, want 1", len(session.responseEdits))
+	}
+	if got, want := *session.responseEdits[0].Content, "Handled by instance `host-1234`"; got != want {
+		t.Errorf("response = %q, want %q", got, want)
+	}
+}
+
+func TestModelChoices(t *testing.T) {
+	choice := func(model string) *discordgo.ApplicationCommandOptionChoice {
+		return &discordgo.ApplicationCommandOptionChoice{Name: model, Value: model}
+	}
+	many := make([]string, 30)
+	for i := range many {
+		many[i] = fmt.Sprintf("model-%d", i)
+	}
+	tests := []struct {
+		name   string
+		models []string
+		want   []*discordgo.ApplicationCommandOptionChoice
+	}{
+		{name: "no allowlist", models: nil, want: nil},
+		{name: "only blanks", models: []string{"", " "}, want: nil},
+		{name: "in order", models: []string{"gpt-4", "gpt-3.5-turbo"}, want: []*discordgo.ApplicationCommandOptionChoice{choice("gpt-4"), choice("gpt-3.5-turbo")}},
+		{name: "trims and skips blanks and duplicates", models: []string{" gpt-4 ", "", "gpt-4"}, want: []*discordgo.ApplicationCommandOptionChoice{choice("gpt-4")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := modelChoices(tt.models); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("modelChoices(%q) = %+v, want %+v", tt.models, got, tt.want)
+			}
+		})
+	}
+
+	got := modelChoices(many)
+	if len(got) != maxOptionChoices || got[maxOptionChoices-1].Name != many[maxOptionChoices-1] {
+		t.Errorf("modelChoices() of %d models = %d choices, want the first %d", len(many), len(got), maxOptionChoices)
+	}
+}
+
+func TestSettingsCommandModelChoices(t *testing.T) {
+	d := newTestDiscord(newFakeSession(), nil)
+	d.config.AllowedModels = []string{"gpt-4", "gpt-3.5-turbo"}
+	for _, command := range d.getDiscordCommands() {
+		if command.Name != "settings" {
+			continue
+		}
+		for _, option := range command.Options {
+			if option.Name == "model" {
+				if want := modelChoices(d.config.AllowedModels); !reflect.DeepEqual(option.Choices, want) {
+					t.Errorf("settings model option choices = %+v, want %+v", option.Choices, want)
+				}
+				return
+			}
+		}
+	}
+	t.Fatal("getDiscordCommands() has no settings command with a model option")
+}
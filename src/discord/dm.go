@@ -0,0 +1,50 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"github.com/rs/zerolog"
+)
+
+// maxDirectMessageHistory is roughly how many of the most recent messages in a direct message channel are used as the
+// conversation. DM channels never end, unlike threads, so older messages are not fetched.
+const maxDirectMessageHistory = 200
+
+// respondToDirectMessage replies inline in a direct message channel, treating the channel's recent history as a single
+// conversation. There is no channel prefix or thread in a DM, so every message from a human gets a response.
+func (d *Discord) respondToDirectMessage(s Session, channelID string, ctx context.Context, zlog *zerolog.Logger) {
+	messages, err := gatherChannelMessages(s, channelID, maxDirectMessageHistory, zlog)
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to gather direct messages")
+		return
+	}
+	messages = d.withoutIgnored(messages)
+	if len(messages) == 0 {
+		zlog.Info().Msg("No messages in direct message channel, not responding")
+		return
+	}
+
+	// If the newest message is from a bot, it is our own reply and we don't need to respond.
+	if messages[len(messages)-1].Author.Bot {
+		zlog.Info().Msg("Newest message is from a bot, not responding")
+		return
+	}
+
+	options := d.settings.Resolve("", ChannelID(channelID), "")
+	d.respondToConversation(s, "", channelID, messages, options, ctx, zlog)
+}
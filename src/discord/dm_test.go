@@ -0,0 +1,92 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"src/openai"
+	"testing"
+)
+
+func TestHandleMessageCreateDirectMessage(t *testing.T) {
+	tests := []struct {
+		name      string
+		guildID   string
+		channelID string
+		wantReply bool
+	}{
+		{name: "direct message", channelID: "dm", wantReply: true},
+		{name: "untracked guild channel", guildID: "guild", channelID: "channel"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newFakeSession()
+			session.messages[tt.channelID] = []*discordgo.Message{
+				{ID: "2", ChannelID: tt.channelID, Content: "And Rust?", Author: &discordgo.User{ID: "human"}},
+				{ID: "1", ChannelID: tt.channelID, Content: "Who made Go?", Author: &discordgo.User{ID: "human"}},
+			}
+			client := &fakeOpenAI{completion: &openai.Completion{Text: "Mozilla"}}
+			d := newTestDiscord(session, client)
+			zlog := zerolog.Nop()
+			m := &discordgo.MessageCreate{Message: &discordgo.Message{
+				ID:        "2",
+				GuildID:   tt.guildID,
+				ChannelID: tt.channelID,
+				Content:   "And Rust?",
+				Author:    &discordgo.User{ID: "human"},
+			}}
+
+			d.handleMessageCreate(session, m, context.Background(), &zlog)
+
+			sent := session.sentMessages()
+			if !tt.wantReply {
+				if len(sent) != 0 || len(client.chats) != 0 {
+					t.Errorf("sent %+v after %d chats, want no reply", sent, len(client.chats))
+				}
+				return
+			}
+			if len(sent) != 1 || sent[0].ChannelID != "dm" || sent[0].Message.Content != "Mozilla" {
+				t.Fatalf("sent %+v, want the reply inline in the DM channel", sent)
+			}
+			if len(session.threads) != 0 {
+				t.Errorf("started %d threads, want none for a direct message", len(session.threads))
+			}
+			if len(client.chats) != 1 || len(client.chats[0]) != 2 {
+				t.Errorf("completed chats %v, want the whole DM conversation", client.chats)
+			}
+		})
+	}
+}
+
+func TestRespondToDirectMessageIgnoresOwnReply(t *testing.T) {
+	session := newFakeSession()
+	session.messages["dm"] = []*discordgo.Message{
+		{ID: "2", ChannelID: "dm", Content: "Google.", Author: &discordgo.User{ID: "bot", Bot: true}},
+		{ID: "1", ChannelID: "dm", Content: "Who made Go?", Author: &discordgo.User{ID: "human"}},
+	}
+	client := &fakeOpenAI{completion: &openai.Completion{Text: "Google."}}
+	d := newTestDiscord(session, client)
+	zlog := zerolog.Nop()
+
+	d.respondToDirectMessage(session, "dm", context.Background(), &zlog)
+
+	if sent := session.sentMessages(); len(sent) != 0 || len(client.chats) != 0 {
+		t.Errorf("sent %+v, want no reply to our own message", sent)
+	}
+}
@@ -0,0 +1,200 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"src/tracing"
+	"time"
+)
+
+// editDebounce is how long the bot waits after the last edit to a message before regenerating its reply, so that a
+// user fixing several typos in quick succession only triggers one completion.
+const editDebounce = 3 * time.Second
+
+// messageUpdateHandler regenerates the reply to a message when it is edited, if it is the latest human message in a
+// tracked thread.
+func (d *Discord) messageUpdateHandler(s *discordgo.Session, m *discordgo.MessageUpdate) {
+	// Updates without an author are e.g. Discord adding link embeds, rather than the user editing the message.
+	if m.Author == nil || m.Author.Bot || m.GuildID == "" {
+		return
+	}
+	if !d.lookupChannel(m.ChannelID).isThread || d.isIgnored(m.Message) {
+		return
+	}
+
+	d.editDebouncer.Debounce(m.ID, editDebounce, func() {
+		messageLog := d.zlog.With().Str("channel", m.ChannelID).Str("message", m.ID).Logger()
+		ctx, zlog := tracing.NewRequest(context.Background(), &messageLog)
+		d.regenerateForEdit(s, m.GuildID, m.ChannelID, m.ID, ctx, zlog)
+	})
+}
+
+// editedMessageHistory decides whether an edit to editedID should regenerate a reply. It does if editedID is the latest
+// message from a human in messages, which are in chronological order. It then returns the conversation up to and
+// including the edited message, and the bot's reply to it, which is empty if the bot has not replied yet.
+func editedMessageHistory(
+	messages []*discordgo.Message,
+	editedID string,
+) (history []*discordgo.Message, reply []*discordgo.Message, ok bool) {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Author.Bot {
+			continue
+		}
+		if messages[i].ID != editedID {
+			return nil, nil, false
+		}
+		return messages[:i+1], messages[i+1:], true
+	}
+	return nil, nil, false
+}
+
+// regenerateForEdit replaces the bot's reply to the edited message with a new one, editing the previous reply in place
+// if there is one.
+func (d *Discord) regenerateForEdit(
+	s Session,
+	guildID string,
+	channelID string,
+	messageID string,
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) {
+	// Every instance sees the edit, so take a lock to regenerate only once.
+	lockID := messageID + "-edit"
+	_, err := d.lockClient.Acquire(ctx, lockID, "")
+	if err != nil {
+		logLockError(zlog, err, "acquire")
+		return
+	}
+	defer func() {
+		if err := d.lockClient.Release(ctx, lockID); err != nil {
+			logLockError(zlog, err, "release")
+		}
+	}()
+
+	snapshot := d.lookupChannel(channelID)
+	if !snapshot.isThread {
+		return
+	}
+	messages, starterMessage, err := d.gatherThreadMessages(s, channelID, zlog)
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to gather thread messages")
+		return
+	}
+	history, reply, ok := editedMessageHistory(messages, messageID)
+	if !ok {
+		zlog.Info().Msg("Edited message is not the latest human message, not regenerating")
+		return
+	}
+
+	creatorID := history[0].Author.ID
+	if starterMessage != nil {
+		creatorID = starterMessage.Author.ID
+	}
+	if !d.shouldRespondTo(history[len(history)-1].Author.ID, creatorID) {
+		zlog.Info().Msg("Edited message is not from the thread creator, not regenerating")
+		return
+	}
+	if len(reply) == 0 {
+		options := d.settings.Resolve(GuildID(guildID), snapshot.parentChannelID, ThreadID(channelID))
+		options = d.withPinnedSystemPrompt(s, snapshot.parentChannelID, options, zlog)
+		d.respondToConversation(s, GuildID(guildID), channelID, history, options, ctx, zlog)
+		return
+	}
+
+	zlog.Info().Int("replyMessages", len(reply)).Msg("Regenerating reply to edited message")
+	edited := history[len(history)-1]
+	d.setReactionState(s, channelID, edited.ID, d.config.SuccessReaction, d.config.LoadingReaction, zlog)
+	if ok, refusal := d.moderate(edited.Content, ctx, zlog); !ok {
+		d.replaceReply(s, channelID, reply, []string{refusal}, zlog)
+		d.setReactionState(s, channelID, edited.ID, d.config.LoadingReaction, d.config.FailureReaction, zlog)
+		return
+	}
+
+	stopTyping := startTyping(s, channelID, zlog)
+	defer stopTyping()
+
+	options := d.settings.Resolve(GuildID(guildID), snapshot.parentChannelID, ThreadID(channelID))
+	options = d.withPinnedSystemPrompt(s, snapshot.parentChannelID, options, zlog)
+	chatMessages := d.buildChatMessages(history, options, ctx, zlog)
+	completion, err := d.openaiClient.CompleteChat(chatMessages, options, ctx, zlog)
+	stopTyping()
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to complete chat")
+		d.setReactionState(s, channelID, edited.ID, d.config.LoadingReaction, d.config.FailureReaction, zlog)
+		return
+	}
+	d.usage.Record(GuildID(guildID), completion)
+
+	if !d.replaceReply(s, channelID, reply, splitResponse(completion.Text), zlog) {
+		d.setReactionState(s, channelID, edited.ID, d.config.LoadingReaction, d.config.FailureReaction, zlog)
+		return
+	}
+	d.setReactionState(s, channelID, edited.ID, d.config.LoadingReaction, d.config.SuccessReaction, zlog)
+	d.uploadTranscript(channelID, chatMessages, completion.Text, zlog)
+}
+
+// replaceReply edits the first message of the old reply to hold the first chunk, deletes the rest of the old reply,
+// and sends any remaining chunks as new messages. It returns whether the new reply was sent in full.
+func (d *Discord) replaceReply(
+	s Session,
+	channelID string,
+	oldReply []*discordgo.Message,
+	chunks []string,
+	zlog *zerolog.Logger,
+) bool {
+	if len(chunks) == 0 {
+		zlog.Warn().Msg("Regenerated reply is empty, keeping the old reply")
+		return false
+	}
+
+	err := withDiscordRetry(func() error {
+		_, err := s.ChannelMessageEdit(channelID, oldReply[0].ID, chunks[0])
+		return err
+	}, zlog)
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to edit reply")
+		return false
+	}
+
+	for _, message := range oldReply[1:] {
+		err := withDiscordRetry(func() error {
+			return s.ChannelMessageDelete(channelID, message.ID)
+		}, zlog)
+		if err != nil {
+			zlog.Warn().Err(err).Str("reply", message.ID).Msg("Failed to delete old reply message")
+		}
+	}
+
+	for i, chunk := range chunks[1:] {
+		messageSend := &discordgo.MessageSend{Content: chunk}
+		if i == len(chunks)-2 {
+			messageSend.Components = feedbackComponents()
+		}
+		err = withDiscordRetry(func() error {
+			_, err := s.ChannelMessageSendComplex(channelID, messageSend)
+			return err
+		}, zlog)
+		if err != nil {
+			zlog.Error().Err(err).Msg("Failed to send message")
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"reflect"
+	"src/openai"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEditedMessageHistory(t *testing.T) {
+	human := func(id string) *discordgo.Message {
+		return &discordgo.Message{ID: id, Author: &discordgo.User{ID: "user"}}
+	}
+	bot := func(id string) *discordgo.Message {
+		return &discordgo.Message{ID: id, Author: &discordgo.User{ID: "bot", Bot: true}}
+	}
+	messages := []*discordgo.Message{human("1"), bot("2"), human("3"), bot("4"), bot("5")}
+	tests := []struct {
+		name        string
+		messages    []*discordgo.Message
+		editedID    string
+		wantOK      bool
+		wantHistory []string
+		wantReply   []string
+	}{
+		{name: "latest human message", messages: messages, editedID: "3", wantOK: true, wantHistory: []string{"1", "2", "3"}, wantReply: []string{"4", "5"}},
+		{name: "latest human message without reply", messages: messages[:3], editedID: "3", wantOK: true, wantHistory: []string{"1", "2", "3"}, wantReply: []string{}},
+		{name: "earlier human message", messages: messages, editedID: "1"},
+		{name: "bot message", messages: messages, editedID: "4"},
+		{name: "only bot messages", messages: []*discordgo.Message{bot("1")}, editedID: "1"},
+	}
+	ids := func(messages []*discordgo.Message) []string {
+		result := make([]string, 0, len(messages))
+		for _, message := range messages {
+			result = append(result, message.ID)
+		}
+		return result
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			history, reply, ok := editedMessageHistory(tt.messages, tt.editedID)
+			if ok != tt.wantOK {
+				t.Fatalf("editedMessageHistory() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if got := ids(history); !reflect.DeepEqual(got, tt.wantHistory) {
+				t.Errorf("editedMessageHistory() history = %v, want %v", got, tt.wantHistory)
+			}
+			if got := ids(reply); !reflect.DeepEqual(got, tt.wantReply) {
+				t.Errorf("editedMessageHistory() reply = %v, want %v", got, tt.wantReply)
+			}
+		})
+	}
+}
+
+func TestRegenerateForEdit(t *testing.T) {
+	tests := []struct {
+		name        string
+		editedID    string
+		wantEdited  []string
+		wantDeleted []string
+	}{
+		{name: "latest message", editedID: "3", wantEdited: []string{"4"}, wantDeleted: []string{"5"}},
+		{name: "earlier message", editedID: "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newFakeSession()
+			session.channels["thread"] = &discordgo.Channel{ID: "thread", ParentID: "channel", Type: discordgo.ChannelTypeGuildPublicThread}
+			session.messages["thread"] = []*discordgo.Message{
+				{ID: "1", ChannelID: "thread", Content: "What is Go?", Author: &discordgo.User{ID: "human"}},
+				{ID: "2", ChannelID: "thread", Content: "A programming language.", Author: &discordgo.User{ID: "bot", Bot: true}},
+				{ID: "3", ChannelID: "thread", Content: "Who made Rust?", Author: &discordgo.User{ID: "human"}},
+				{ID: "4", ChannelID: "thread", Content: "Google", Author: &discordgo.User{ID: "bot", Bot: true}},
+				{ID: "5", ChannelID: "thread", Content: "and others", Author: &discordgo.User{ID: "bot", Bot: true}},
+			}
+			client := &fakeOpenAI{completion: &openai.Completion{Text: "Mozilla"}}
+			d := newTestDiscord(session, client)
+			d.idsMap.SetChannels(map[ChannelID]bool{"channel": true})
+			d.idsMap.AddThread("thread", "channel")
+			zlog := zerolog.Nop()
+
+			d.regenerateForEdit(session, "guild", "thread", tt.editedID, context.Background(), &zlog)
+
+			var edited []string
+			for _, message := range session.edited {
+				edited = append(edited, message.ID)
+				if message.Content != "Mozilla" {
+					t.Errorf("edited reply to %q, want %q", message.Content, "Mozilla")
+				}
+			}
+			if !reflect.DeepEqual(edited, tt.wantEdited) {
+				t.Errorf("edited messages %v, want %v", edited, tt.wantEdited)
+			}
+			if !reflect.DeepEqual(session.deleted, tt.wantDeleted) {
+				t.Errorf("deleted messages %v, want %v", session.deleted, tt.wantDeleted)
+			}
+			if sent := session.sentMessages(); len(sent) != 0 {
+				t.Errorf("sent %+v, want the old reply edited in place", sent)
+			}
+			if tt.wantEdited == nil && len(client.chats) != 0 {
+				t.Errorf("completed %d chats, want none for an earlier message", len(client.chats))
+			}
+		})
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	b := newDebouncer()
+	var calls atomic.Int32
+	done := make(chan struct{})
+	for i := 0; i < 5; i++ {
+		b.Debounce("message", 20*time.Millisecond, func() {
+			calls.Add(1)
+			close(done)
+		})
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Debounce() did not run the function")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := calls.Load(); got != 1 {
+		t.Errorf("Debounce() ran the function %d times, want 1", got)
+	}
+}
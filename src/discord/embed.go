@@ -0,0 +1,72 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"src/openai"
+)
+
+const (
+	// embedColor is the accent color of the bot's embeds, OpenAI's green.
+	embedColor = 0x10a37f
+
+	// maxEmbedTitleLength is the maximum number of characters Discord allows in an embed title.
+	maxEmbedTitleLength = 256
+)
+
+// completionEmbeds renders a completion as embeds, one per chunk of the response so each fits in a message. The
+// first embed is titled with the prompt, and the last has a footer with the model and token usage.
+func completionEmbeds(prompt string, completion *openai.Completion) []*discordgo.MessageEmbed {
+	chunks := splitResponse(completion.Text)
+	if len(chunks) == 0 {
+		chunks = []string{""}
+	}
+
+	embeds := make([]*discordgo.MessageEmbed, 0, len(chunks))
+	for _, chunk := range chunks {
+		embeds = append(embeds, &discordgo.MessageEmbed{
+			Description: chunk,
+			Color:       embedColor,
+		})
+	}
+	embeds[0].Title = truncate(prompt, maxEmbedTitleLength)
+	embeds[len(embeds)-1].Footer = &discordgo.MessageEmbedFooter{
+		Text: usageFooter(completion),
+	}
+	return embeds
+}
+
+// usageFooter describes the model and token usage of a completion, e.g. "gpt-4 · 120 prompt + 45 completion tokens".
+func usageFooter(completion *openai.Completion) string {
+	return fmt.Sprintf(
+		"%s · %d prompt + %d completion tokens",
+		completion.Model,
+		completion.Usage.PromptTokens,
+		completion.Usage.CompletionTokens,
+	)
+}
+
+// truncate shortens text to at most length characters, ending it with an ellipsis if it was cut.
+func truncate(text string, length int) string {
+	runes := []rune(text)
+	if len(runes) <= length {
+		return text
+	}
+	return string(runes[:length-1]) + "…"
+}
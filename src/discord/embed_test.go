@@ -0,0 +1,112 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"src/openai"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCompletionEmbeds(t *testing.T) {
+	usage := openai.Usage{PromptTokens: 120, CompletionTokens: 45, TotalTokens: 165}
+	tests := []struct {
+		name       string
+		prompt     string
+		text       string
+		wantEmbeds int
+		wantTitle  string
+	}{
+		{name: "short completion", prompt: "Who made Go?", text: "Google", wantEmbeds: 1, wantTitle: "Who made Go?"},
+		{name: "empty completion", prompt: "Say nothing", wantEmbeds: 1, wantTitle: "Say nothing"},
+		{
+			name:       "long completion",
+			prompt:     "Tell me a story",
+			text:       strings.Repeat(strings.Repeat("a", 99)+".", 30),
+			wantEmbeds: 2,
+			wantTitle:  "Tell me a story",
+		},
+		{
+			name:       "long prompt",
+			prompt:     strings.Repeat("p", 300),
+			text:       "Google",
+			wantEmbeds: 1,
+			wantTitle:  strings.Repeat("p", maxEmbedTitleLength-1) + "…",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			completion := &openai.Completion{Text: tt.text, Model: "gpt-4", Usage: usage}
+
+			embeds := completionEmbeds(tt.prompt, completion)
+
+			if len(embeds) != tt.wantEmbeds {
+				t.Fatalf("completionEmbeds() returned %d embeds, want %d", len(embeds), tt.wantEmbeds)
+			}
+			if embeds[0].Title != tt.wantTitle {
+				t.Errorf("completionEmbeds() title = %q, want %q", embeds[0].Title, tt.wantTitle)
+			}
+			var description strings.Builder
+			for i, embed := range embeds {
+				description.WriteString(embed.Description)
+				if embed.Color != embedColor {
+					t.Errorf("embed %d color = %#x, want %#x", i, embed.Color, embedColor)
+				}
+				if i > 0 && embed.Title != "" {
+					t.Errorf("embed %d title = %q, want only the first embed titled", i, embed.Title)
+				}
+				if i < len(embeds)-1 && embed.Footer != nil {
+					t.Errorf("embed %d has a footer, want only the last embed to have one", i)
+				}
+			}
+			if tt.wantEmbeds == 1 && description.String() != tt.text {
+				t.Errorf("completionEmbeds() description = %q, want %q", description.String(), tt.text)
+			}
+			footer := embeds[len(embeds)-1].Footer
+			want := "gpt-4 · 120 prompt + 45 completion tokens"
+			if footer == nil || footer.Text != want {
+				t.Errorf("completionEmbeds() footer = %+v, want %q", footer, want)
+			}
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		length int
+		want   string
+	}{
+		{name: "shorter", text: "Go", length: 5, want: "Go"},
+		{name: "exact", text: "Hello", length: 5, want: "Hello"},
+		{name: "longer", text: "Hello, world", length: 5, want: "Hell…"},
+		{name: "multibyte", text: "héllo wörld", length: 4, want: "hél…"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncate(tt.text, tt.length)
+			if got != tt.want {
+				t.Errorf("truncate(%q, %d) = %q, want %q", tt.text, tt.length, got, tt.want)
+			}
+			if utf8.RuneCountInString(got) > tt.length {
+				t.Errorf("truncate(%q, %d) has %d characters, want at most %d", tt.text, tt.length, utf8.RuneCountInString(got), tt.length)
+			}
+		})
+	}
+}
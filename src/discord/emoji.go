@@ -0,0 +1,187 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"errors"
+	"github.com/rs/zerolog"
+	"strings"
+)
+
+var (
+	InvalidEmojiError = errors.New("invalid emoji")
+)
+
+// NormalizeEmoji converts an emoji into the form expected by MessageReactionAdd. Unicode emoji are returned as-is, and
+// must be a single emoji, which may be a sequence such as a flag, keycap, or ZWJ sequence. Custom Discord emoji may be
+// given in message format, e.g. <:name:id> or <a:name:id>, or already in name:id form, and are returned as name:id.
+func NormalizeEmoji(emoji string) (string, error) {
+	emoji = strings.TrimSpace(emoji)
+	if emoji == "" {
+		return "", InvalidEmojiError
+	}
+
+	if strings.HasPrefix(emoji, "<") {
+		if !strings.HasSuffix(emoji, ">") {
+			return "", InvalidEmojiError
+		}
+		parts := strings.Split(emoji[1:len(emoji)-1], ":")
+		if len(parts) != 3 || (parts[0] != "" && parts[0] != "a") {
+			return "", InvalidEmojiError
+		}
+		emoji = parts[1] + ":" + parts[2]
+	}
+
+	if !strings.Contains(emoji, ":") {
+		if !isSingleEmoji(emoji) {
+			return "", InvalidEmojiError
+		}
+		return emoji, nil
+	}
+
+	// Custom emoji: name:id, where the ID is a snowflake.
+	parts := strings.Split(emoji, ":")
+	if len(parts) != 2 || parts[0] == "" || !isSnowflake(parts[1]) {
+		return "", InvalidEmojiError
+	}
+	return emoji, nil
+}
+
+// setReactionState replaces the bot's own oldReaction on a message with newReaction. If the old reaction cannot be
+// removed, e.g. because the message was deleted, the failure is logged and the new reaction is still added.
+func (d *Discord) setReactionState(
+	s Session,
+	channelID string,
+	messageID string,
+	oldReaction string,
+	newReaction string,
+	zlog *zerolog.Logger,
+) {
+	err := withDiscordRetry(func() error {
+		return s.MessageReactionRemove(channelID, messageID, oldReaction, "@me")
+	}, zlog)
+	if err != nil {
+		zlog.Warn().Err(err).Str("reaction", oldReaction).Msg("Failed to remove reaction")
+	}
+
+	err = withDiscordRetry(func() error {
+		return s.MessageReactionAdd(channelID, messageID, newReaction)
+	}, zlog)
+	if err != nil {
+		zlog.Error().Err(err).Str("reaction", newReaction).Msg("Failed to add reaction")
+	}
+}
+
+const (
+	variationSelector16 = '\uFE0F'
+	zeroWidthJoiner     = '\u200D'
+	combiningKeycap     = '\u20E3'
+	cancelTag           = '\U000E007F'
+)
+
+// isSingleEmoji returns whether text is exactly one emoji: a keycap such as 1️⃣, a flag made of two regional
+// indicators, or pictographs joined by zero width joiners, each optionally followed by a variation selector, a skin
+// tone modifier, or a tag sequence such as the one in the flag of Scotland.
+func isSingleEmoji(text string) bool {
+	runes := []rune(text)
+	if len(runes) == 0 {
+		return false
+	}
+
+	// Keycap: a digit, # or *, an optional variation selector, and the combining keycap.
+	if strings.ContainsRune("0123456789#*", runes[0]) {
+		rest := runes[1:]
+		if len(rest) > 0 && rest[0] == variationSelector16 {
+			rest = rest[1:]
+		}
+		return len(rest) == 1 && rest[0] == combiningKeycap
+	}
+
+	// Flag: exactly two regional indicators.
+	if isRegionalIndicator(runes[0]) {
+		return len(runes) == 2 && isRegionalIndicator(runes[1])
+	}
+
+	for i := 0; ; {
+		if i >= len(runes) || !isPictograph(runes[i]) {
+			return false
+		}
+		i++
+		if i < len(runes) && (runes[i] == variationSelector16 || isSkinToneModifier(runes[i])) {
+			i++
+		}
+		if i < len(runes) && isTag(runes[i]) {
+			for i < len(runes) && isTag(runes[i]) {
+				i++
+			}
+			if i >= len(runes) || runes[i] != cancelTag {
+				return false
+			}
+			i++
+		}
+		if i == len(runes) {
+			return true
+		}
+		if runes[i] != zeroWidthJoiner {
+			return false
+		}
+		i++
+	}
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+func isSkinToneModifier(r rune) bool {
+	return r >= 0x1F3FB && r <= 0x1F3FF
+}
+
+func isTag(r rune) bool {
+	return r >= 0xE0020 && r <= 0xE007E
+}
+
+// pictographRanges are the code points that are emoji on their own, as inclusive ranges.
+var pictographRanges = [][2]rune{
+	{0x00A9, 0x00A9}, {0x00AE, 0x00AE}, {0x203C, 0x203C}, {0x2049, 0x2049}, {0x2122, 0x2122}, {0x2139, 0x2139},
+	{0x2194, 0x2199}, {0x21A9, 0x21AA}, {0x231A, 0x231B}, {0x2328, 0x2328}, {0x23CF, 0x23CF}, {0x23E9, 0x23F3},
+	{0x23F8, 0x23FA}, {0x24C2, 0x24C2}, {0x25AA, 0x25AB}, {0x25B6, 0x25B6}, {0x25C0, 0x25C0}, {0x25FB, 0x25FE},
+	{0x2600, 0x27BF}, {0x2934, 0x2935}, {0x2B05, 0x2B07}, {0x2B1B, 0x2B1C}, {0x2B50, 0x2B50}, {0x2B55, 0x2B55},
+	{0x3030, 0x3030}, {0x303D, 0x303D}, {0x3297, 0x3297}, {0x3299, 0x3299}, {0x1F000, 0x1F1E5}, {0x1F200, 0x1F3FA},
+	{0x1F400, 0x1FAFF},
+}
+
+func isPictograph(r rune) bool {
+	for _, pictographRange := range pictographRanges {
+		if r >= pictographRange[0] && r <= pictographRange[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func isSnowflake(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, r := range id {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
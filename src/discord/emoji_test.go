@@ -0,0 +1,104 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"errors"
+	"github.com/rs/zerolog"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeEmoji(t *testing.T) {
+	tests := []struct {
+		name    string
+		emoji   string
+		want    string
+		wantErr error
+	}{
+		{name: "unicode emoji", emoji: "🤖", want: "🤖"},
+		{name: "surrounding whitespace", emoji: " ✅ ", want: "✅"},
+		{name: "variation selector", emoji: "❤️", want: "❤️"},
+		{name: "skin tone modifier", emoji: "👍🏽", want: "👍🏽"},
+		{name: "zwj sequence", emoji: "👨‍👩‍👧", want: "👨‍👩‍👧"},
+		{name: "flag", emoji: "🇺🇸", want: "🇺🇸"},
+		{name: "tag sequence", emoji: "🏴󠁧󠁢󠁳󠁣󠁴󠁿", want: "🏴󠁧󠁢󠁳󠁣󠁴󠁿"},
+		{name: "keycap", emoji: "1️⃣", want: "1️⃣"},
+		{name: "custom emoji in message format", emoji: "<:robot:123456789012345678>", want: "robot:123456789012345678"},
+		{name: "animated custom emoji", emoji: "<a:robot:123456789012345678>", want: "robot:123456789012345678"},
+		{name: "custom emoji in name:id form", emoji: "robot:123456789012345678", want: "robot:123456789012345678"},
+		{name: "empty", emoji: "", wantErr: InvalidEmojiError},
+		{name: "only whitespace", emoji: "  ", wantErr: InvalidEmojiError},
+		{name: "word", emoji: "hello", wantErr: InvalidEmojiError},
+		{name: "letter", emoji: "a", wantErr: InvalidEmojiError},
+		{name: "digit without keycap", emoji: "1", wantErr: InvalidEmojiError},
+		{name: "two emoji", emoji: "🤖🤖", wantErr: InvalidEmojiError},
+		{name: "emoji followed by text", emoji: "🤖 bot", wantErr: InvalidEmojiError},
+		{name: "single regional indicator", emoji: "🇺", wantErr: InvalidEmojiError},
+		{name: "trailing zero width joiner", emoji: "👨‍", wantErr: InvalidEmojiError},
+		{name: "unterminated tag sequence", emoji: "🏴󠁧󠁢", wantErr: InvalidEmojiError},
+		{name: "unclosed custom emoji", emoji: "<:robot:123456789012345678", wantErr: InvalidEmojiError},
+		{name: "unknown custom emoji prefix", emoji: "<b:robot:123456789012345678>", wantErr: InvalidEmojiError},
+		{name: "non-numeric custom emoji id", emoji: "robot:abc", wantErr: InvalidEmojiError},
+		{name: "custom emoji without name", emoji: ":123456789012345678", wantErr: InvalidEmojiError},
+		{name: "custom emoji without id", emoji: "robot:", wantErr: InvalidEmojiError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizeEmoji(tt.emoji)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("NormalizeEmoji(%q) error = %v, want %v", tt.emoji, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("NormalizeEmoji(%q) = %q, want %q", tt.emoji, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetReactionState(t *testing.T) {
+	tests := []struct {
+		name      string
+		removeErr error
+		want      []reaction
+	}{
+		{
+			name: "removes then adds",
+			want: []reaction{{MessageID: "message", Emoji: "🤖", Added: false}, {MessageID: "message", Emoji: "✅", Added: true}},
+		},
+		{
+			name:      "adds when removal fails",
+			removeErr: errors.New("unknown message"),
+			want:      []reaction{{MessageID: "message", Emoji: "✅", Added: true}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newFakeSession()
+			session.removeReactionErr = tt.removeErr
+			d := newTestDiscord(session, nil)
+			zlog := zerolog.Nop()
+
+			d.setReactionState(session, "channel", "message", "🤖", "✅", &zlog)
+
+			if got := session.reactionLog(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("reactions = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
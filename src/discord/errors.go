@@ -0,0 +1,85 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"errors"
+	"github.com/bwmarrin/discordgo"
+	goopenai "github.com/sashabaranov/go-openai"
+	"net"
+	"net/http"
+	"src/openai"
+)
+
+// userErrorMessages are errors with their own message in the catalog, because they are caused by the user's input.
+var userErrorMessages = map[error]messageKey{
+	AttachmentNotPNGError:            msgAttachmentNotPNG,
+	AttachmentTooLargeError:          msgAttachmentTooLarge,
+	InvalidConversationError:         msgInvalidConversation,
+	ConversationTooLargeError:        msgConversationTooLarge,
+	openai.TooManyStopSequencesError: msgTooManyStopSequences,
+}
+
+// userErrorMessage maps err to a message in locale that is safe to show to users. The raw error can contain internal
+// details, such as request URLs, so it is never shown; callers should log it instead.
+func userErrorMessage(err error, locale discordgo.Locale) string {
+	return Localize(userErrorKey(err), locale)
+}
+
+func userErrorKey(err error) messageKey {
+	for userError, key := range userErrorMessages {
+		if errors.Is(err, userError) {
+			return key
+		}
+	}
+
+	switch {
+	case errors.Is(err, openai.ServiceUnavailableError):
+		return msgUnavailable
+	case errors.Is(err, openai.PromptTooLongError),
+		errors.Is(err, openai.MessageTooLongError),
+		errors.Is(err, openai.SystemPromptTooLongError):
+		return msgTooLong
+	case errors.Is(err, context.DeadlineExceeded):
+		return msgTimeout
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return msgTimeout
+	}
+
+	var apiErr *goopenai.APIError
+	if errors.As(err, &apiErr) {
+		if apiErr.HTTPStatusCode == http.StatusTooManyRequests {
+			return msgRateLimited
+		}
+		if code, ok := apiErr.Code.(string); ok && code == "content_policy_violation" {
+			return msgContentFiltered
+		}
+		if apiErr.Type == "content_filter" {
+			return msgContentFiltered
+		}
+	}
+	var requestErr *goopenai.RequestError
+	if errors.As(err, &requestErr) && requestErr.HTTPStatusCode == http.StatusTooManyRequests {
+		return msgRateLimited
+	}
+
+	return msgGenericError
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	goopenai "github.com/sashabaranov/go-openai"
+	"net"
+	"net/http"
+	"src/openai"
+	"strings"
+	"testing"
+)
+
+func TestUserErrorKey(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want messageKey
+	}{
+		{name: "user input error", err: fmt.Errorf("decode: %w", AttachmentNotPNGError), want: msgAttachmentNotPNG},
+		{name: "too many stop sequences", err: openai.TooManyStopSequencesError, want: msgTooManyStopSequences},
+		{name: "service unavailable", err: openai.ServiceUnavailableError, want: msgUnavailable},
+		{name: "prompt too long", err: fmt.Errorf("complete: %w", openai.PromptTooLongError), want: msgTooLong},
+		{name: "deadline exceeded", err: fmt.Errorf("complete: %w", context.DeadlineExceeded), want: msgTimeout},
+		{name: "network timeout", err: &net.DNSError{Err: "i/o timeout", IsTimeout: true}, want: msgTimeout},
+		{
+			name: "rate limited",
+			err:  &goopenai.APIError{HTTPStatusCode: http.StatusTooManyRequests, Message: "Rate limit reached"},
+			want: msgRateLimited,
+		},
+		{
+			name: "rate limited request",
+			err:  &goopenai.RequestError{HTTPStatusCode: http.StatusTooManyRequests, Err: errors.New("429")},
+			want: msgRateLimited,
+		},
+		{
+			name: "content policy violation",
+			err:  &goopenai.APIError{HTTPStatusCode: http.StatusBadRequest, Code: "content_policy_violation"},
+			want: msgContentFiltered,
+		},
+		{name: "content filter", err: &goopenai.APIError{HTTPStatusCode: http.StatusBadRequest, Type: "content_filter"}, want: msgContentFiltered},
+		{name: "other API error", err: &goopenai.APIError{HTTPStatusCode: http.StatusInternalServerError}, want: msgGenericError},
+		{name: "unknown error", err: errors.New("boom"), want: msgGenericError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := userErrorKey(tt.err); got != tt.want {
+				t.Errorf("userErrorKey(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUserErrorMessageHidesDetails(t *testing.T) {
+	err := fmt.Errorf("POST https://api.openai.com/v1/chat/completions?key=sk-secret: %w", errors.New("connection reset"))
+	got := userErrorMessage(err, discordgo.EnglishUS)
+	if got == "" || strings.Contains(got, "sk-secret") || strings.Contains(got, "api.openai.com") {
+		t.Errorf("userErrorMessage() = %q, want a generic message without internal details", got)
+	}
+}
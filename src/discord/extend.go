@@ -0,0 +1,81 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"strings"
+)
+
+// continuationPhrases are messages that ask the bot to carry on with its previous reply, rather than start a new one.
+var continuationPhrases = map[string]bool{
+	"continue":   true,
+	"go on":      true,
+	"keep going": true,
+	"more":       true,
+	"and":        true,
+	"then":       true,
+}
+
+// isContinuation returns whether content, ignoring case and surrounding punctuation, is a continuation phrase.
+func isContinuation(content string) bool {
+	phrase := strings.ToLower(strings.Trim(strings.TrimSpace(content), ".!?,…"))
+	return continuationPhrases[strings.TrimSpace(phrase)]
+}
+
+// extendableReply decides whether the reply to messages, which are in chronological order, should extend the bot's
+// previous reply instead of being sent as a new message. It should if the newest message is a continuation phrase and
+// the message before it is a plain text reply by botUserID. It returns that reply.
+func extendableReply(messages []*discordgo.Message, botUserID string) (*discordgo.Message, bool) {
+	if len(messages) < 2 || !isContinuation(messages[len(messages)-1].Content) {
+		return nil, false
+	}
+	previous := messages[len(messages)-2]
+	if previous.Author == nil || previous.Author.ID != botUserID || previous.Content == "" || len(previous.Embeds) > 0 {
+		return nil, false
+	}
+	return previous, true
+}
+
+// extendedContent returns previous with addition appended, or false if the result does not fit in a Discord message.
+func extendedContent(previous string, addition string) (string, bool) {
+	content := strings.TrimRight(previous, " \n") + "\n\n" + strings.TrimSpace(addition)
+	if len(content) > maxMessageLength {
+		return "", false
+	}
+	return content, true
+}
+
+// extendReply appends text to the bot's reply in channelID, returning whether it did. It does not if the result would
+// not fit in one message, in which case the caller should send text as a new message instead.
+func extendReply(s Session, channelID string, reply *discordgo.Message, text string, zlog *zerolog.Logger) bool {
+	content, ok := extendedContent(reply.Content, text)
+	if !ok {
+		zlog.Info().Msg("Extended reply would be too long, sending a new message instead")
+		return false
+	}
+	err := withDiscordRetry(func() error {
+		_, err := s.ChannelMessageEdit(channelID, reply.ID, content)
+		return err
+	}, zlog)
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to extend reply, sending a new message instead")
+		return false
+	}
+	return true
+}
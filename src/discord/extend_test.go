@@ -0,0 +1,97 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"strings"
+	"testing"
+)
+
+func TestIsContinuation(t *testing.T) {
+	tests := []struct {
+		content string
+		want    bool
+	}{
+		{content: "continue", want: true},
+		{content: "  Go on...  ", want: true},
+		{content: "Keep going!", want: true},
+		{content: "more?", want: true},
+		{content: "continue with the Rust version"},
+		{content: "What about Rust?"},
+		{content: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.content, func(t *testing.T) {
+			if got := isContinuation(tt.content); got != tt.want {
+				t.Errorf("isContinuation(%q) = %v, want %v", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtendableReply(t *testing.T) {
+	human := func(content string) *discordgo.Message {
+		return &discordgo.Message{ID: "human", Content: content, Author: &discordgo.User{ID: "user"}}
+	}
+	bot := &discordgo.Message{ID: "reply", Content: "Go was created at Google", Author: &discordgo.User{ID: "bot", Bot: true}}
+	otherBot := &discordgo.Message{ID: "other", Content: "Beep", Author: &discordgo.User{ID: "other-bot", Bot: true}}
+	embed := &discordgo.Message{ID: "embed", Author: &discordgo.User{ID: "bot", Bot: true}, Embeds: []*discordgo.MessageEmbed{{Description: "Go"}}}
+	tests := []struct {
+		name     string
+		messages []*discordgo.Message
+		want     string
+	}{
+		{name: "continuation after own reply", messages: []*discordgo.Message{human("Who made Go?"), bot, human("go on")}, want: "reply"},
+		{name: "new question after own reply", messages: []*discordgo.Message{human("Who made Go?"), bot, human("And Rust?")}},
+		{name: "continuation after a human message", messages: []*discordgo.Message{bot, human("Hello"), human("continue")}},
+		{name: "continuation after another bot", messages: []*discordgo.Message{otherBot, human("continue")}},
+		{name: "continuation after an embed reply", messages: []*discordgo.Message{embed, human("continue")}},
+		{name: "only a continuation", messages: []*discordgo.Message{human("continue")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply, ok := extendableReply(tt.messages, "bot")
+			if ok != (tt.want != "") || (ok && reply.ID != tt.want) {
+				t.Errorf("extendableReply() = %v, %v, want %q", reply, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtendReply(t *testing.T) {
+	zlog := zerolog.Nop()
+	reply := &discordgo.Message{ID: "reply", ChannelID: "thread", Content: "Go was created at Google. \n"}
+
+	session := newFakeSession()
+	if !extendReply(session, "thread", reply, " In 2009. ", &zlog) {
+		t.Fatal("extendReply() = false, want the reply extended")
+	}
+	want := "Go was created at Google.\n\nIn 2009."
+	if len(session.edited) != 1 || session.edited[0].ID != "reply" || session.edited[0].Content != want {
+		t.Errorf("edited %+v, want reply edited to %q", session.edited, want)
+	}
+
+	session = newFakeSession()
+	if extendReply(session, "thread", reply, strings.Repeat("a", maxMessageLength), &zlog) {
+		t.Error("extendReply() = true, want a reply too long for one message sent anew")
+	}
+	if len(session.edited) != 0 {
+		t.Errorf("edited %+v, want no edits", session.edited)
+	}
+}
@@ -0,0 +1,406 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"src/aws"
+	"src/openai"
+	"sync"
+	"sync/atomic"
+)
+
+// sentMessage is a message the bot sent to a channel through a fakeSession.
+type sentMessage struct {
+	ChannelID string
+	Message   *discordgo.MessageSend
+}
+
+// reaction is a reaction the bot added to or removed from a message through a fakeSession.
+type reaction struct {
+	MessageID string
+	Emoji     string
+	Added     bool
+}
+
+// fakeSession is a Session that serves messages and channels from memory and records what the bot does, for tests.
+// Calls that send or edit succeed unless sendErr is set, and removing a reaction succeeds unless removeReactionErr is.
+type fakeSession struct {
+	mu sync.Mutex
+
+	messages          map[string][]*discordgo.Message
+	pinned            map[string][]*discordgo.Message
+	channels          map[string]*discordgo.Channel
+	members           map[string]*discordgo.Member
+	permissions       int64
+	sendErr           error
+	removeReactionErr error
+
+	fetched          int
+	pinFetches       int
+	typing           []string
+	sent             []sentMessage
+	edited           []*discordgo.Message
+	deleted          []string
+	reactions        []reaction
+	threads          []*discordgo.ThreadStart
+	channelEdits     []*discordgo.ChannelEdit
+	responses        []*discordgo.InteractionResponse
+	responseEdits    []*discordgo.WebhookEdit
+	responsesDeleted int
+	followups        []*discordgo.WebhookParams
+	commands         []*discordgo.ApplicationCommand
+	nextID           int
+}
+
+func newFakeSession() *fakeSession {
+	return &fakeSession{
+		messages: make(map[string][]*discordgo.Message),
+		channels: make(map[string]*discordgo.Channel),
+		members:  make(map[string]*discordgo.Member),
+	}
+}
+
+func (s *fakeSession) newID() string {
+	s.nextID++
+	return fmt.Sprintf("sent-%d", s.nextID)
+}
+
+func (s *fakeSession) ChannelMessages(channelID string, limit int, beforeID, afterID, aroundID string, options ...discordgo.RequestOption) ([]*discordgo.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if beforeID != "" || afterID != "" || aroundID != "" {
+		return nil, nil
+	}
+	return append([]*discordgo.Message(nil), s.messages[channelID]...), nil
+}
+
+func (s *fakeSession) ChannelMessage(channelID, messageID string, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fetched++
+	for _, message := range s.messages[channelID] {
+		if message.ID == messageID {
+			return message, nil
+		}
+	}
+	return nil, errors.New("unknown message")
+}
+
+func (s *fakeSession) ChannelMessagesPinned(channelID string, options ...discordgo.RequestOption) ([]*discordgo.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pinFetches++
+	return s.pinned[channelID], nil
+}
+
+func (s *fakeSession) ChannelMessageSend(channelID string, content string, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	return s.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{Content: content})
+}
+
+func (s *fakeSession) ChannelTyping(channelID string, options ...discordgo.RequestOption) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.typing = append(s.typing, channelID)
+	return nil
+}
+
+func (s *fakeSession) ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sendErr != nil {
+		return nil, s.sendErr
+	}
+	s.sent = append(s.sent, sentMessage{ChannelID: channelID, Message: data})
+	return &discordgo.Message{ID: s.newID(), ChannelID: channelID, Content: data.Content}, nil
+}
+
+func (s *fakeSession) ChannelMessageEdit(channelID, messageID, content string, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sendErr != nil {
+		return nil, s.sendErr
+	}
+	message := &discordgo.Message{ID: messageID, ChannelID: channelID, Content: content}
+	s.edited = append(s.edited, message)
+	return message, nil
+}
+
+func (s *fakeSession) ChannelMessageDelete(channelID, messageID string, options ...discordgo.RequestOption) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleted = append(s.deleted, messageID)
+	return nil
+}
+
+func (s *fakeSession) MessageReactionAdd(channelID, messageID, emojiID string, options ...discordgo.RequestOption) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reactions = append(s.reactions, reaction{MessageID: messageID, Emoji: emojiID, Added: true})
+	return nil
+}
+
+func (s *fakeSession) MessageReactionRemove(channelID, messageID, emojiID, userID string, options ...discordgo.RequestOption) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.removeReactionErr != nil {
+		return s.removeReactionErr
+	}
+	s.reactions = append(s.reactions, reaction{MessageID: messageID, Emoji: emojiID, Added: false})
+	return nil
+}
+
+func (s *fakeSession) MessageThreadStartComplex(channelID, messageID string, data *discordgo.ThreadStart, options ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.threads = append(s.threads, data)
+	return &discordgo.Channel{ID: messageID, ParentID: channelID, Name: data.Name}, nil
+}
+
+func (s *fakeSession) InteractionRespond(interaction *discordgo.Interaction, resp *discordgo.InteractionResponse, options ...discordgo.RequestOption) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses = append(s.responses, resp)
+	return nil
+}
+
+func (s *fakeSession) InteractionResponseEdit(interaction *discordgo.Interaction, newresp *discordgo.WebhookEdit, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responseEdits = append(s.responseEdits, newresp)
+	return &discordgo.Message{ID: s.newID(), ChannelID: interaction.ChannelID}, nil
+}
+
+func (s *fakeSession) InteractionResponseDelete(interaction *discordgo.Interaction, options ...discordgo.RequestOption) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responsesDeleted++
+	return nil
+}
+
+func (s *fakeSession) FollowupMessageCreate(interaction *discordgo.Interaction, wait bool, data *discordgo.WebhookParams, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.followups = append(s.followups, data)
+	return &discordgo.Message{ID: s.newID(), ChannelID: interaction.ChannelID, Content: data.Content}, nil
+}
+
+func (s *fakeSession) GuildChannels(guildID string, options ...discordgo.RequestOption) ([]*discordgo.Channel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	channels := make([]*discordgo.Channel, 0, len(s.channels))
+	for _, channel := range s.channels {
+		if channel.GuildID == guildID {
+			channels = append(channels, channel)
+		}
+	}
+	return channels, nil
+}
+
+func (s *fakeSession) GuildMember(guildID, userID string, options ...discordgo.RequestOption) (*discordgo.Member, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	member, ok := s.members[userID]
+	if !ok {
+		return nil, errors.New("unknown member")
+	}
+	return member, nil
+}
+
+func (s *fakeSession) ThreadsActive(channelID string, options ...discordgo.RequestOption) (*discordgo.ThreadsList, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	threads := make([]*discordgo.Channel, 0)
+	for _, channel := range s.channels {
+		if channel.ParentID == channelID && channel.IsThread() {
+			threads = append(threads, channel)
+		}
+	}
+	return &discordgo.ThreadsList{Threads: threads}, nil
+}
+
+func (s *fakeSession) Channel(channelID string, options ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	channel, ok := s.channels[channelID]
+	if !ok {
+		return nil, errors.New("unknown channel")
+	}
+	return channel, nil
+}
+
+func (s *fakeSession) ChannelEditComplex(channelID string, data *discordgo.ChannelEdit, options ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	channel, ok := s.channels[channelID]
+	if !ok {
+		return nil, errors.New("unknown channel")
+	}
+	s.channelEdits = append(s.channelEdits, data)
+	return channel, nil
+}
+
+func (s *fakeSession) UserChannelPermissions(userID, channelID string, fetchOptions ...discordgo.RequestOption) (int64, error) {
+	return s.permissions, nil
+}
+
+func (s *fakeSession) ApplicationCommandCreate(appID string, guildID string, cmd *discordgo.ApplicationCommand, options ...discordgo.RequestOption) (*discordgo.ApplicationCommand, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	command := *cmd
+	command.ID = s.newID()
+	command.ApplicationID = appID
+	command.GuildID = guildID
+	s.commands = append(s.commands, &command)
+	return &command, nil
+}
+
+// sentMessages returns the messages sent so far.
+func (s *fakeSession) sentMessages() []sentMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]sentMessage(nil), s.sent...)
+}
+
+// reactionLog returns the reactions added and removed so far, in order.
+func (s *fakeSession) reactionLog() []reaction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]reaction(nil), s.reactions...)
+}
+
+// fakeOpenAI is an OpenAIClient whose chat and text completions reply with completion, or jsonReply in JSON mode,
+// whose conversation summaries reply with summary, whose moderation checks reply with moderation, and whose image
+// requests reply with image, or all fail with err, and are recorded. Methods a test does not set up are left to the embedded nil client, and panic if called.
+type fakeOpenAI struct {
+	openai.OpenAIClient
+
+	mu         sync.Mutex
+	completion *openai.Completion
+	jsonReply  json.RawMessage
+	summary    string
+	err        error
+	chats      [][]*openai.ChatMessage
+	options    []openai.ChatOptions
+	prompts    []string
+	summarized [][]*openai.ChatMessage
+	sentences  []int
+	moderation *openai.ModerationResult
+	moderated  []string
+	image      *openai.CreateImageResponse
+	images     []string
+}
+
+func (f *fakeOpenAI) CompleteChat(messages []*openai.ChatMessage, options openai.ChatOptions, ctx context.Context, zlog *zerolog.Logger) (*openai.Completion, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.chats = append(f.chats, messages)
+	f.options = append(f.options, options)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.completion, nil
+}
+
+func (f *fakeOpenAI) Complete(prompt string, options openai.CompleteOptions, ctx context.Context, zlog *zerolog.Logger) (*openai.Completion, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.prompts = append(f.prompts, prompt)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.completion, nil
+}
+
+func (f *fakeOpenAI) CreateImage(prompt string, ctx context.Context, zlog *zerolog.Logger) (*openai.CreateImageResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.images = append(f.images, prompt)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.image, nil
+}
+
+func (f *fakeOpenAI) CompleteChatJSON(messages []*openai.ChatMessage, schema json.RawMessage, options openai.ChatOptions, ctx context.Context, zlog *zerolog.Logger) (json.RawMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.chats = append(f.chats, messages)
+	f.options = append(f.options, options)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.jsonReply, nil
+}
+
+func (f *fakeOpenAI) Moderate(text string, ctx context.Context, zlog *zerolog.Logger) (*openai.ModerationResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.moderated = append(f.moderated, text)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.moderation, nil
+}
+
+func (f *fakeOpenAI) SummarizeConversation(messages []*openai.ChatMessage, sentences int, ctx context.Context, zlog *zerolog.Logger) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.summarized = append(f.summarized, messages)
+	f.sentences = append(f.sentences, sentences)
+	if f.err != nil {
+		return "", f.err
+	}
+	return f.summary, nil
+}
+
+// countingLockClient is a LockClient that counts the locks acquired through it.
+type countingLockClient struct {
+	aws.LockClient
+	acquired int32
+}
+
+func (c *countingLockClient) Acquire(ctx context.Context, id string, data interface{}) (*aws.Lock, error) {
+	atomic.AddInt32(&c.acquired, 1)
+	return c.LockClient.Acquire(ctx, id, data)
+}
+
+// newTestDiscord returns a Discord with the default config that talks to session and openaiClient, with an in-memory
+// lock client and no gateway connection.
+func newTestDiscord(session Session, openaiClient openai.OpenAIClient) *Discord {
+	zlog := zerolog.Nop()
+	return &Discord{
+		session:       session,
+		openaiClient:  openaiClient,
+		lockClient:    aws.NewInMemoryLockClient("test", &zlog),
+		config:        DefaultConfig(),
+		idsMap:        NewIDsMap([]GuildID{"guild"}),
+		settings:      NewSettingsStore(openai.DefaultChatOptions()),
+		feedback:      NewFeedbackStore(),
+		usage:         NewUsageTracker(),
+		editDebouncer: newDebouncer(),
+		cooldowns:     NewCooldownTracker(),
+		completed:     NewCompletedInteractions(),
+		pins:          newPinCache(),
+		zlog:          &zlog,
+	}
+}
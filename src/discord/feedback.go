@@ -0,0 +1,256 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"errors"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"src/tracing"
+	"sync"
+)
+
+const (
+	feedbackPositiveEmoji = "👍"
+	feedbackNegativeEmoji = "👎"
+
+	// feedbackCustomIDPrefix prefixes the custom IDs of the feedback buttons attached to the bot's replies.
+	feedbackCustomIDPrefix   = "feedback:"
+	feedbackPositiveCustomID = feedbackCustomIDPrefix + "positive"
+	feedbackNegativeCustomID = feedbackCustomIDPrefix + "negative"
+)
+
+// maxFeedbackEntries bounds the number of ratings remembered for deduplication. Once it is reached, the oldest rating
+// is forgotten, so a user could rate a long-forgotten message again.
+const maxFeedbackEntries = 10000
+
+var (
+	DuplicateFeedbackError = errors.New("user has already rated this message")
+)
+
+type feedbackKey struct {
+	messageID string
+	userID    string
+}
+
+// FeedbackStore records user ratings of the bot's answers. Each user's rating of a message is only counted once;
+// later ratings by the same user of the same message are rejected with DuplicateFeedbackError. Only the most recent
+// maxFeedbackEntries ratings are remembered.
+type FeedbackStore struct {
+	ratings    map[feedbackKey]bool
+	order      []feedbackKey // keys of ratings, oldest first
+	maxEntries int
+	sync.Mutex // protects ratings and order
+}
+
+func NewFeedbackStore() *FeedbackStore {
+	return &FeedbackStore{
+		ratings:    make(map[feedbackKey]bool),
+		maxEntries: maxFeedbackEntries,
+	}
+}
+
+func (f *FeedbackStore) RecordFeedback(ctx context.Context, messageID string, positive bool, userID string) error {
+	f.Lock()
+	defer f.Unlock()
+
+	key := feedbackKey{messageID: messageID, userID: userID}
+	if _, ok := f.ratings[key]; ok {
+		return DuplicateFeedbackError
+	}
+	for len(f.order) >= f.maxEntries {
+		delete(f.ratings, f.order[0])
+		f.order = f.order[1:]
+	}
+	f.ratings[key] = positive
+	f.order = append(f.order, key)
+	return nil
+}
+
+// feedbackReactionHandler records 👍/👎 reactions on the bot's messages in tracked threads.
+func (d *Discord) feedbackReactionHandler(s *discordgo.Session, r *discordgo.MessageReactionAdd) {
+	var positive bool
+	switch r.Emoji.Name {
+	case feedbackPositiveEmoji:
+		positive = true
+	case feedbackNegativeEmoji:
+		positive = false
+	default:
+		return
+	}
+
+	if r.UserID == s.State.User.ID {
+		return
+	}
+
+	if !d.lookupChannel(r.ChannelID).isThread {
+		return
+	}
+
+	reactionLog := d.zlog.With().Str("channel", r.ChannelID).Str("message", r.MessageID).Str("user", r.UserID).Logger()
+	ctx, zlog := tracing.NewRequest(context.Background(), &reactionLog)
+	d.recordReactionFeedback(s, s.State.User.ID, r.MessageReaction, positive, ctx, zlog)
+}
+
+// recordReactionFeedback records a rating by reaction, if it is on one of the bot's messages. Every instance sees the
+// reaction, so only the one holding the lock fetches the message and records it.
+func (d *Discord) recordReactionFeedback(
+	s Session,
+	botUserID string,
+	r *discordgo.MessageReaction,
+	positive bool,
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) {
+	lockID := "feedback-" + r.MessageID + "-" + r.UserID
+	_, err := d.lockClient.Acquire(ctx, lockID, "")
+	if err != nil {
+		logLockError(zlog, err, "acquire")
+		return
+	}
+	defer func() {
+		if err := d.lockClient.Release(ctx, lockID); err != nil {
+			logLockError(zlog, err, "release")
+		}
+	}()
+
+	message, err := s.ChannelMessage(r.ChannelID, r.MessageID)
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to get rated message")
+		return
+	}
+	if message.Author == nil || message.Author.ID != botUserID {
+		return
+	}
+
+	err = d.recordFeedback(s, message, positive, r.UserID, ctx, zlog)
+	if err != nil && !errors.Is(err, DuplicateFeedbackError) {
+		zlog.Error().Err(err).Msg("Failed to record feedback")
+	}
+}
+
+// feedbackComponentHandler records clicks on the feedback buttons attached to the bot's replies, and acknowledges the
+// click by editing the deferred reply, which is only visible to the user who clicked.
+func (d *Discord) feedbackComponentHandler(s Session, i *discordgo.InteractionCreate, ctx context.Context, zlog *zerolog.Logger) {
+	positive, ok := parseFeedbackCustomID(i.MessageComponentData().CustomID)
+	if !ok || i.Message == nil {
+		if err := s.InteractionResponseDelete(i.Interaction); err != nil {
+			zlog.Error().Err(err).Msg("Failed to delete deferred reply to unknown component")
+		}
+		return
+	}
+
+	var userID string
+	if i.Member != nil && i.Member.User != nil {
+		userID = i.Member.User.ID
+	} else if i.User != nil {
+		userID = i.User.ID
+	}
+	feedbackLog := zlog.With().Str("message", i.Message.ID).Str("user", userID).Logger()
+	zlog = &feedbackLog
+
+	var content string
+	err := d.recordFeedback(s, i.Message, positive, userID, ctx, zlog)
+	switch {
+	case err == nil:
+		content = "Thanks for your feedback!"
+	case errors.Is(err, DuplicateFeedbackError):
+		content = "You have already rated this response."
+	default:
+		zlog.Error().Err(err).Msg("Failed to record feedback")
+		content = "Sorry, your feedback could not be recorded."
+	}
+
+	_, err = s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+		Content: &content,
+	})
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to respond to feedback interaction")
+	}
+}
+
+// recordFeedback records a user's rating of one of the bot's messages. The rating is logged along with the prompt,
+// i.e. the most recent human message before the rated answer, for later analysis.
+func (d *Discord) recordFeedback(
+	s Session,
+	message *discordgo.Message,
+	positive bool,
+	userID string,
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) error {
+	err := d.feedback.RecordFeedback(ctx, message.ID, positive, userID)
+	if err != nil {
+		if errors.Is(err, DuplicateFeedbackError) {
+			zlog.Debug().Msg("Ignoring duplicate feedback")
+		}
+		return err
+	}
+
+	var prompt string
+	previousMessages, err := s.ChannelMessages(message.ChannelID, 10, message.ID, "", "")
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to get prompt for rated message")
+	}
+	for _, previousMessage := range previousMessages {
+		if previousMessage.Author != nil && !previousMessage.Author.Bot {
+			prompt = previousMessage.Content
+			break
+		}
+	}
+
+	zlog.Info().
+		Bool("positive", positive).
+		Str("prompt", prompt).
+		Str("answer", message.Content).
+		Msg("Recorded feedback")
+	return nil
+}
+
+// feedbackComponents returns the row of 👍/👎 buttons attached to the bot's replies.
+func feedbackComponents() []discordgo.MessageComponent {
+	return []discordgo.MessageComponent{
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Emoji:    discordgo.ComponentEmoji{Name: feedbackPositiveEmoji},
+					Style:    discordgo.SecondaryButton,
+					CustomID: feedbackPositiveCustomID,
+				},
+				discordgo.Button{
+					Emoji:    discordgo.ComponentEmoji{Name: feedbackNegativeEmoji},
+					Style:    discordgo.SecondaryButton,
+					CustomID: feedbackNegativeCustomID,
+				},
+			},
+		},
+	}
+}
+
+// parseFeedbackCustomID returns whether a feedback button's custom ID is a positive rating, and false for ok if the
+// custom ID is not a feedback button.
+func parseFeedbackCustomID(customID string) (positive bool, ok bool) {
+	switch customID {
+	case feedbackPositiveCustomID:
+		return true, true
+	case feedbackNegativeCustomID:
+		return false, true
+	default:
+		return false, false
+	}
+}
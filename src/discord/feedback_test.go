@@ -0,0 +1,193 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"errors"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"testing"
+)
+
+func TestFeedbackStoreRecordFeedback(t *testing.T) {
+	store := NewFeedbackStore()
+	ctx := context.Background()
+	ratings := []struct {
+		messageID string
+		userID    string
+		positive  bool
+		wantErr   error
+	}{
+		{messageID: "m1", userID: "u1", positive: true},
+		{messageID: "m1", userID: "u1", positive: true, wantErr: DuplicateFeedbackError},
+		{messageID: "m1", userID: "u1", positive: false, wantErr: DuplicateFeedbackError},
+		{messageID: "m1", userID: "u2", positive: false},
+		{messageID: "m2", userID: "u1", positive: false},
+	}
+	for _, rating := range ratings {
+		err := store.RecordFeedback(ctx, rating.messageID, rating.positive, rating.userID)
+		if !errors.Is(err, rating.wantErr) {
+			t.Errorf("RecordFeedback(%s, %v, %s) error = %v, want %v",
+				rating.messageID, rating.positive, rating.userID, err, rating.wantErr)
+		}
+	}
+	if got := store.ratings[feedbackKey{messageID: "m1", userID: "u1"}]; !got {
+		t.Errorf("rating of m1 by u1 = %v, want the first rating, true", got)
+	}
+}
+
+func TestFeedbackStoreBounded(t *testing.T) {
+	store := NewFeedbackStore()
+	store.maxEntries = 2
+	ctx := context.Background()
+	for _, messageID := range []string{"m1", "m2", "m3"} {
+		if err := store.RecordFeedback(ctx, messageID, true, "user"); err != nil {
+			t.Fatalf("RecordFeedback(%s) error = %v", messageID, err)
+		}
+	}
+
+	if len(store.ratings) != 2 || len(store.order) != 2 {
+		t.Fatalf("store has %d ratings and %d ordered keys, want 2", len(store.ratings), len(store.order))
+	}
+	// The oldest rating was forgotten, so it can be recorded again, but the newer ones are still deduplicated.
+	if err := store.RecordFeedback(ctx, "m3", true, "user"); !errors.Is(err, DuplicateFeedbackError) {
+		t.Errorf("RecordFeedback(m3) error = %v, want %v", err, DuplicateFeedbackError)
+	}
+	if err := store.RecordFeedback(ctx, "m1", true, "user"); err != nil {
+		t.Errorf("RecordFeedback(m1) error = %v, want nil after it was forgotten", err)
+	}
+}
+
+func TestRecordReactionFeedback(t *testing.T) {
+	tests := []struct {
+		name      string
+		author    string
+		heldLock  bool
+		wantFetch int
+		wantRated bool
+	}{
+		{name: "bot message", author: "bot", wantFetch: 1, wantRated: true},
+		{name: "other message", author: "user", wantFetch: 1},
+		{name: "lock held by another instance", author: "bot", heldLock: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newFakeSession()
+			session.messages["thread"] = []*discordgo.Message{
+				{ID: "answer", ChannelID: "thread", Author: &discordgo.User{ID: tt.author}},
+			}
+			d := newTestDiscord(session, nil)
+			ctx := context.Background()
+			zlog := zerolog.Nop()
+			r := &discordgo.MessageReaction{UserID: "rater", MessageID: "answer", ChannelID: "thread"}
+			if tt.heldLock {
+				if _, err := d.lockClient.Acquire(ctx, "feedback-answer-rater", ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			d.recordReactionFeedback(session, "bot", r, true, ctx, &zlog)
+
+			if session.fetched != tt.wantFetch {
+				t.Errorf("fetched the message %d times, want %d", session.fetched, tt.wantFetch)
+			}
+			err := d.feedback.RecordFeedback(ctx, "answer", true, "rater")
+			if rated := errors.Is(err, DuplicateFeedbackError); rated != tt.wantRated {
+				t.Errorf("rating recorded = %v, want %v", rated, tt.wantRated)
+			}
+		})
+	}
+}
+
+func TestFeedbackComponents(t *testing.T) {
+	components := feedbackComponents()
+	if len(components) != 1 {
+		t.Fatalf("feedbackComponents() has %d rows, want 1", len(components))
+	}
+	row, ok := components[0].(discordgo.ActionsRow)
+	if !ok {
+		t.Fatalf("feedbackComponents()[0] is %T, want an ActionsRow", components[0])
+	}
+	want := []struct {
+		emoji    string
+		customID string
+	}{
+		{emoji: feedbackPositiveEmoji, customID: "feedback:positive"},
+		{emoji: feedbackNegativeEmoji, customID: "feedback:negative"},
+	}
+	if len(row.Components) != len(want) {
+		t.Fatalf("row has %d buttons, want %d", len(row.Components), len(want))
+	}
+	for index, component := range row.Components {
+		button, ok := component.(discordgo.Button)
+		if !ok {
+			t.Fatalf("component %d is %T, want a Button", index, component)
+		}
+		if button.Emoji.Name != want[index].emoji || button.CustomID != want[index].customID {
+			t.Errorf("button %d = %s %s, want %s %s",
+				index, button.Emoji.Name, button.CustomID, want[index].emoji, want[index].customID)
+		}
+	}
+}
+
+func TestParseFeedbackCustomID(t *testing.T) {
+	tests := []struct {
+		customID     string
+		wantPositive bool
+		wantOK       bool
+	}{
+		{customID: "feedback:positive", wantPositive: true, wantOK: true},
+		{customID: "feedback:negative", wantPositive: false, wantOK: true},
+		{customID: "feedback:", wantOK: false},
+		{customID: "feedback:neutral", wantOK: false},
+		{customID: "positive", wantOK: false},
+		{customID: "", wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.customID, func(t *testing.T) {
+			positive, ok := parseFeedbackCustomID(tt.customID)
+			if positive != tt.wantPositive || ok != tt.wantOK {
+				t.Errorf("parseFeedbackCustomID(%q) = %v, %v, want %v, %v", tt.customID, positive, ok, tt.wantPositive, tt.wantOK)
+			}
+		})
+	}
+}
+
+// TestFeedbackComponentHandlerDuplicate clicks a feedback button twice, which only records the first rating.
+func TestFeedbackComponentHandlerDuplicate(t *testing.T) {
+	session := newFakeSession()
+	d := newTestDiscord(session, nil)
+	zlog := zerolog.Nop()
+	answer := &discordgo.Message{ID: "answer", ChannelID: "thread", Author: &discordgo.User{ID: "bot", Bot: true}}
+
+	d.feedbackComponentHandler(session, newButtonInteraction("thread", feedbackPositiveCustomID, answer), context.Background(), &zlog)
+	d.feedbackComponentHandler(session, newButtonInteraction("thread", feedbackNegativeCustomID, answer), context.Background(), &zlog)
+
+	want := []string{"Thanks for your feedback!", "You have already rated this response."}
+	if len(session.responseEdits) != len(want) {
+		t.Fatalf("got %d reply edits, want %d", len(session.responseEdits), len(want))
+	}
+	for index, edit := range session.responseEdits {
+		if *edit.Content != want[index] {
+			t.Errorf("reply %d = %q, want %q", index, *edit.Content, want[index])
+		}
+	}
+	if !d.feedback.ratings[feedbackKey{messageID: "answer", userID: "user"}] {
+		t.Error("recorded rating = negative, want the first, positive rating")
+	}
+}
@@ -0,0 +1,60 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"sync"
+	"time"
+)
+
+// completedInteractionTTL is how long an interaction is remembered as completed. Discord stops redelivering an
+// interaction long before its token expires.
+const completedInteractionTTL = interactionTokenLifetime
+
+// CompletedInteractions remembers which interactions have already been answered, so that a retried interaction does
+// not redo expensive work such as generating images.
+type CompletedInteractions struct {
+	completed  map[string]time.Time
+	sync.Mutex // protects completed
+}
+
+func NewCompletedInteractions() *CompletedInteractions {
+	return &CompletedInteractions{completed: make(map[string]time.Time)}
+}
+
+// Complete records that interactionID was answered at now. Interactions completed more than completedInteractionTTL
+// ago are forgotten.
+func (c *CompletedInteractions) Complete(interactionID string, now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	for id, completed := range c.completed {
+		if now.Sub(completed) >= completedInteractionTTL {
+			delete(c.completed, id)
+		}
+	}
+	c.completed[interactionID] = now
+}
+
+// IsComplete returns whether interactionID was answered within completedInteractionTTL of now.
+func (c *CompletedInteractions) IsComplete(interactionID string, now time.Time) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	completed, ok := c.completed[interactionID]
+	return ok && now.Sub(completed) < completedInteractionTTL
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"github.com/rs/zerolog"
+	"src/openai"
+	"testing"
+	"time"
+)
+
+func TestCompletedInteractions(t *testing.T) {
+	completed := NewCompletedInteractions()
+	now := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	if completed.IsComplete("interaction", now) {
+		t.Error("IsComplete() before Complete() = true, want false")
+	}
+	completed.Complete("interaction", now)
+	if !completed.IsComplete("interaction", now.Add(completedInteractionTTL-time.Second)) {
+		t.Error("IsComplete() within the TTL = false, want true")
+	}
+	if completed.IsComplete("other", now) {
+		t.Error("IsComplete() of another interaction = true, want false")
+	}
+	if completed.IsComplete("interaction", now.Add(completedInteractionTTL)) {
+		t.Error("IsComplete() after the TTL = true, want false")
+	}
+
+	// Completing another interaction later forgets the expired one.
+	completed.Complete("later", now.Add(completedInteractionTTL))
+	if _, ok := completed.completed["interaction"]; ok {
+		t.Error("Complete() kept an expired interaction, want it forgotten")
+	}
+}
+
+func TestCreateImageSkipsCompletedInteraction(t *testing.T) {
+	session := newFakeSession()
+	client := &fakeOpenAI{image: &openai.CreateImageResponse{Images: []openai.Image{{Data: []byte("png")}}}}
+	d := newTestDiscord(session, client)
+	i := newCommandInteraction("channel", "user", "image", promptOption("a cat"))
+	zlog := zerolog.Nop()
+
+	d.createImageInteractionHandler(session, i, context.Background(), &zlog)
+	d.createImageInteractionHandler(session, i, context.Background(), &zlog)
+
+	if len(client.images) != 1 {
+		t.Errorf("created %d images for one interaction, want 1", len(client.images))
+	}
+	if len(session.responseEdits) != 1 || len(session.responseEdits[0].Files) != 1 {
+		t.Errorf("responseEdits = %+v, want one reply with the image", session.responseEdits)
+	}
+}
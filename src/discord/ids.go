@@ -0,0 +1,188 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"sort"
+	"sync"
+)
+
+// IDsMap stores which guildIDs, channelIDs, and threadIDs the bot is listening to. threadIDs maps each thread to its
+// parent channel. forgottenThreadIDs are threads an operator has asked the bot to stop tracking, which are skipped when
+// threads are refreshed. Use its methods rather than the fields, since they handle the locking.
+type IDsMap struct {
+	guildIDs           map[GuildID]bool
+	channelIDs         map[ChannelID]bool
+	threadIDs          map[ThreadID]ChannelID
+	forgottenThreadIDs map[ThreadID]bool
+	mu                 sync.RWMutex // protects guildIDs, channelIDs, threadIDs, and forgottenThreadIDs
+}
+
+func NewIDsMap(guildIDs []GuildID) *IDsMap {
+	guildIDsMap := make(map[GuildID]bool)
+	for _, guildID := range guildIDs {
+		guildIDsMap[guildID] = true
+	}
+
+	return &IDsMap{
+		guildIDs:           guildIDsMap,
+		channelIDs:         make(map[ChannelID]bool),
+		threadIDs:          make(map[ThreadID]ChannelID),
+		forgottenThreadIDs: make(map[ThreadID]bool),
+	}
+}
+
+// GuildIDs returns the configured guild IDs in a stable order.
+func (m *IDsMap) GuildIDs() []GuildID {
+	m.mu.RLock()
+	guildIDs := make([]GuildID, 0, len(m.guildIDs))
+	for guildID := range m.guildIDs {
+		guildIDs = append(guildIDs, guildID)
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(guildIDs, func(i, j int) bool { return guildIDs[i] < guildIDs[j] })
+	return guildIDs
+}
+
+// ChannelIDs returns the tracked channel IDs in a stable order.
+func (m *IDsMap) ChannelIDs() []ChannelID {
+	m.mu.RLock()
+	channelIDs := make([]ChannelID, 0, len(m.channelIDs))
+	for channelID := range m.channelIDs {
+		channelIDs = append(channelIDs, channelID)
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(channelIDs, func(i, j int) bool { return channelIDs[i] < channelIDs[j] })
+	return channelIDs
+}
+
+// HasChannel returns whether channelID is a tracked channel.
+func (m *IDsMap) HasChannel(channelID ChannelID) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.channelIDs[channelID]
+}
+
+// HasThread returns whether threadID is a tracked thread.
+func (m *IDsMap) HasThread(threadID ThreadID) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, ok := m.threadIDs[threadID]
+	return ok
+}
+
+// SetChannels replaces the tracked channels with channelIDs. The map is owned by the IDsMap afterwards.
+func (m *IDsMap) SetChannels(channelIDs map[ChannelID]bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.channelIDs = channelIDs
+}
+
+// SetThreads replaces the tracked threads with threadIDs, skipping any that have been forgotten. The map is owned by
+// the IDsMap afterwards.
+func (m *IDsMap) SetThreads(threadIDs map[ThreadID]ChannelID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for threadID := range m.forgottenThreadIDs {
+		delete(threadIDs, threadID)
+	}
+	m.threadIDs = threadIDs
+}
+
+// AddThread starts tracking threadID, e.g. one the bot has just created, without waiting for threads to be refreshed.
+func (m *IDsMap) AddThread(threadID ThreadID, parentChannelID ChannelID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.forgottenThreadIDs, threadID)
+	m.threadIDs[threadID] = parentChannelID
+}
+
+// ArchiveThread stops tracking threadID until it is unarchived. It returns whether the thread was being tracked.
+func (m *IDsMap) ArchiveThread(threadID ThreadID) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, tracked := m.threadIDs[threadID]
+	delete(m.threadIDs, threadID)
+	return tracked
+}
+
+// UnarchiveThread resumes tracking threadID if its parent channel is tracked and the thread has not been forgotten. It
+// returns whether the thread is now tracked.
+func (m *IDsMap) UnarchiveThread(threadID ThreadID, parentChannelID ChannelID) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.channelIDs[parentChannelID] || m.forgottenThreadIDs[threadID] {
+		return false
+	}
+	m.threadIDs[threadID] = parentChannelID
+	return true
+}
+
+// Threads returns a copy of the tracked threads, mapped to their parent channels.
+func (m *IDsMap) Threads() map[ThreadID]ChannelID {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	threads := make(map[ThreadID]ChannelID, len(m.threadIDs))
+	for threadID, channelID := range m.threadIDs {
+		threads[threadID] = channelID
+	}
+	return threads
+}
+
+// ForgetThread stops tracking threadID, including after threads are next refreshed. It returns whether the thread was
+// being tracked.
+func (m *IDsMap) ForgetThread(threadID ThreadID) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, tracked := m.threadIDs[threadID]
+	delete(m.threadIDs, threadID)
+	m.forgottenThreadIDs[threadID] = true
+	return tracked
+}
+
+// channelSnapshot is a consistent view of whether a channel ID is a tracked channel or thread, taken under a single
+// read lock of the IDsMap.
+type channelSnapshot struct {
+	isChannel       bool
+	isThread        bool
+	parentChannelID ChannelID
+}
+
+// lookup returns whether channelID is a tracked channel or thread, and the thread's parent channel.
+func (m *IDsMap) lookup(channelID string) channelSnapshot {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	isChannel := m.channelIDs[ChannelID(channelID)]
+	parentChannelID, isThread := m.threadIDs[ThreadID(channelID)]
+	return channelSnapshot{
+		isChannel:       isChannel,
+		isThread:        isThread,
+		parentChannelID: parentChannelID,
+	}
+}
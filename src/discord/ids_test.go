@@ -0,0 +1,148 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// TestIDsMapConcurrentAccess calls every IDsMap method from several goroutines at once. Run with -race to check that
+// the methods lock the fields they touch.
+func TestIDsMapConcurrentAccess(t *testing.T) {
+	m := NewIDsMap([]GuildID{"guild"})
+	m.SetChannels(map[ChannelID]bool{"channel": true})
+
+	const iterations = 200
+	var wg sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(2)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				threadID := ThreadID(fmt.Sprintf("thread-%d-%d", worker, i))
+				m.SetChannels(map[ChannelID]bool{"channel": true})
+				m.SetThreads(map[ThreadID]ChannelID{"thread": "channel"})
+				m.AddThread(threadID, "channel")
+				m.ArchiveThread(threadID)
+				m.UnarchiveThread(threadID, "channel")
+				m.ForgetThread(threadID)
+			}
+		}(worker)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				m.GuildIDs()
+				m.ChannelIDs()
+				m.HasChannel("channel")
+				m.HasThread("thread")
+				m.Threads()
+				m.lookup("thread")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if !m.HasChannel("channel") {
+		t.Error("HasChannel(channel) = false, want true")
+	}
+	threads := m.Threads()
+	if len(threads) != 1 || threads["thread"] != "channel" {
+		t.Errorf("Threads() = %v, want only thread in channel", threads)
+	}
+}
+
+func TestIDsMapThreadsIsCopy(t *testing.T) {
+	m := NewIDsMap([]GuildID{"guild"})
+	m.SetThreads(map[ThreadID]ChannelID{"thread-1": "channel", "thread-2": "other"})
+
+	threads := m.Threads()
+	want := map[ThreadID]ChannelID{"thread-1": "channel", "thread-2": "other"}
+	if !reflect.DeepEqual(threads, want) {
+		t.Fatalf("Threads() = %v, want %v", threads, want)
+	}
+	delete(threads, "thread-1")
+	threads["thread-3"] = "channel"
+
+	if got := m.Threads(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Threads() = %v after changing a copy, want %v", got, want)
+	}
+}
+
+func TestIDsMapForgetThread(t *testing.T) {
+	m := NewIDsMap([]GuildID{"guild"})
+	m.SetChannels(map[ChannelID]bool{"channel": true})
+	m.SetThreads(map[ThreadID]ChannelID{"thread-1": "channel", "thread-2": "channel"})
+
+	if !m.ForgetThread("thread-1") {
+		t.Error("ForgetThread(thread-1) = false, want true for a tracked thread")
+	}
+	if m.ForgetThread("thread-1") {
+		t.Error("second ForgetThread(thread-1) = true, want false")
+	}
+	if m.HasThread("thread-1") {
+		t.Error("HasThread(thread-1) = true after forgetting it")
+	}
+
+	// A forgotten thread stays forgotten when threads are refreshed or it is unarchived, but the rest are kept.
+	m.SetThreads(map[ThreadID]ChannelID{"thread-1": "channel", "thread-2": "channel"})
+	if m.UnarchiveThread("thread-1", "channel") {
+		t.Error("UnarchiveThread(thread-1) = true for a forgotten thread, want false")
+	}
+	if want := map[ThreadID]ChannelID{"thread-2": "channel"}; !reflect.DeepEqual(m.Threads(), want) {
+		t.Errorf("Threads() = %v after refreshing, want %v", m.Threads(), want)
+	}
+
+	// The bot creating the thread again tracks it again.
+	m.AddThread("thread-1", "channel")
+	if !m.HasThread("thread-1") {
+		t.Error("HasThread(thread-1) = false after adding it again")
+	}
+}
+
+func TestIDsMapArchiveThread(t *testing.T) {
+	m := NewIDsMap([]GuildID{"guild"})
+	m.SetChannels(map[ChannelID]bool{"channel": true})
+	m.AddThread("thread", "channel")
+
+	steps := []struct {
+		name        string
+		do          func() bool
+		want        bool
+		wantTracked bool
+	}{
+		{name: "archive tracked thread", do: func() bool { return m.ArchiveThread("thread") }, want: true},
+		{name: "archive again", do: func() bool { return m.ArchiveThread("thread") }},
+		{name: "unarchive", do: func() bool { return m.UnarchiveThread("thread", "channel") }, want: true, wantTracked: true},
+		{name: "unarchive into untracked channel", do: func() bool { return m.UnarchiveThread("other", "untracked") }, wantTracked: true},
+		{name: "forget", do: func() bool { return m.ForgetThread("thread") }, want: true},
+		{name: "unarchive forgotten thread", do: func() bool { return m.UnarchiveThread("thread", "channel") }},
+	}
+	for _, step := range steps {
+		if got := step.do(); got != step.want {
+			t.Errorf("%s = %v, want %v", step.name, got, step.want)
+		}
+		if got := m.HasThread("thread"); got != step.wantTracked {
+			t.Errorf("after %s, HasThread(thread) = %v, want %v", step.name, got, step.wantTracked)
+		}
+	}
+	if m.HasThread("other") {
+		t.Error("HasThread(other) = true, want a thread in an untracked channel not tracked")
+	}
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"src/openai"
+	"strings"
+)
+
+// maxConversationBytes is the largest conversation file the import command accepts.
+const maxConversationBytes = 256 * 1024
+
+var (
+	InvalidConversationError  = errors.New("the conversation file is invalid")
+	ConversationTooLargeError = errors.New("the conversation file must be smaller than 256 KB")
+)
+
+// conversationRoles maps the roles of a conversation file to whether the message is from a human and from the system.
+var conversationRoles = map[string]struct{ fromHuman, fromSystem bool }{
+	"user":      {fromHuman: true},
+	"assistant": {},
+	"system":    {fromSystem: true},
+}
+
+// conversationEntry is one message of a conversation file in JSON format.
+type conversationEntry struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// parseConversation parses a conversation file for the import command. It is either a JSON array of messages, e.g.
+//
+//	[{"role": "user", "content": "Hi"}, {"role": "assistant", "content": "Hello!"}]
+//
+// or text where each message starts with a line prefixed with its role, followed by a colon, e.g.
+//
+//	User: Hi
+//	Assistant: Hello!
+//	How can I help?
+//
+// Roles are user, assistant, and system, in any case. Lines before the first role prefix are not allowed, and later
+// lines without one continue the previous message. The conversation must end with a message from the user, for the
+// bot to reply to. Every error wraps InvalidConversationError.
+func parseConversation(data []byte) ([]*openai.ChatMessage, error) {
+	var entries []conversationEntry
+	if trimmed := bytes.TrimSpace(data); bytes.HasPrefix(trimmed, []byte("[")) {
+		if err := json.Unmarshal(trimmed, &entries); err != nil {
+			return nil, fmt.Errorf("%w: %v", InvalidConversationError, err)
+		}
+	} else {
+		var err error
+		entries, err = parseConversationText(string(data))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	messages := make([]*openai.ChatMessage, 0, len(entries))
+	for index, entry := range entries {
+		role, ok := conversationRoles[strings.ToLower(strings.TrimSpace(entry.Role))]
+		if !ok {
+			return nil, fmt.Errorf("%w: message %d has unknown role %q", InvalidConversationError, index+1, entry.Role)
+		}
+		text := strings.TrimSpace(entry.Content)
+		if text == "" {
+			return nil, fmt.Errorf("%w: message %d is empty", InvalidConversationError, index+1)
+		}
+		messages = append(messages, &openai.ChatMessage{FromHuman: role.fromHuman, FromSystem: role.fromSystem, Text: text})
+	}
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("%w: it has no messages", InvalidConversationError)
+	}
+	if !messages[len(messages)-1].FromHuman {
+		return nil, fmt.Errorf("%w: the last message must be from the user", InvalidConversationError)
+	}
+	return messages, nil
+}
+
+// parseConversationText parses the text format of parseConversation into entries, leaving roles to be validated.
+func parseConversationText(text string) ([]conversationEntry, error) {
+	var entries []conversationEntry
+	for number, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		if prefix, rest, found := strings.Cut(line, ":"); found {
+			if _, ok := conversationRoles[strings.ToLower(strings.TrimSpace(prefix))]; ok {
+				entries = append(entries, conversationEntry{Role: prefix, Content: rest})
+				continue
+			}
+		}
+		if len(entries) == 0 {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			return nil, fmt.Errorf("%w: line %d does not start with a role such as \"User:\"", InvalidConversationError, number+1)
+		}
+		entries[len(entries)-1].Content += "\n" + line
+	}
+	return entries, nil
+}
+
+// importInteractionHandler continues a conversation uploaded as a file, replying with the bot's next message.
+func (d *Discord) importInteractionHandler(s Session, i *discordgo.InteractionCreate, ctx context.Context, zlog *zerolog.Logger) {
+	data := i.ApplicationCommandData()
+	zlog.Info().Str("command", data.Name).Msg("Received import command")
+
+	respond := func(content string) {
+		_, err := s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+			Content: Ptr(content),
+		})
+		if err != nil {
+			zlog.Error().Err(err).Msg("Failed to respond to interaction")
+		}
+	}
+
+	var attachment *discordgo.MessageAttachment
+	for _, option := range data.Options {
+		if option.Name == "conversation" && data.Resolved != nil {
+			id, _ := option.Value.(string)
+			attachment = data.Resolved.Attachments[id]
+		}
+	}
+	if attachment == nil {
+		respond(Localize(msgInvalidConversation, i.Locale))
+		return
+	}
+
+	content, err := downloadAttachment(ctx, attachment, maxConversationBytes, ConversationTooLargeError)
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to download conversation")
+		respond(userErrorMessage(err, i.Locale))
+		return
+	}
+	messages, err := parseConversation(content)
+	if err != nil {
+		zlog.Info().Err(err).Msg("Invalid conversation file")
+		respond(userErrorMessage(err, i.Locale))
+		return
+	}
+	zlog.Info().Int("messages", len(messages)).Msg("Imported conversation")
+
+	if ok, refusal := d.moderate(messages[len(messages)-1].Text, ctx, zlog); !ok {
+		respond(refusal)
+		return
+	}
+
+	snapshot := d.lookupChannel(i.ChannelID)
+	channelID, threadID := ChannelID(i.ChannelID), ThreadID("")
+	if snapshot.isThread {
+		channelID, threadID = snapshot.parentChannelID, ThreadID(i.ChannelID)
+	}
+	options := d.settings.Resolve(GuildID(i.GuildID), channelID, threadID)
+	options = d.withPinnedSystemPrompt(s, channelID, options, zlog)
+	completion, err := d.openaiClient.CompleteChat(messages, options, ctx, zlog)
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to complete chat")
+		respond(userErrorMessage(err, i.Locale))
+		return
+	}
+	d.usage.Record(GuildID(i.GuildID), completion)
+
+	// The first chunk replaces the deferred interaction reply, and any remaining chunks are sent as new messages.
+	chunks := splitResponse(completion.Text)
+	if len(chunks) == 0 {
+		respond(Localize(msgEmptyImportReply, i.Locale))
+		return
+	}
+	respond(chunks[0])
+	for _, chunk := range chunks[1:] {
+		err = withDiscordRetry(func() error {
+			_, err := s.ChannelMessageSend(i.ChannelID, chunk)
+			return err
+		}, zlog)
+		if err != nil {
+			zlog.Error().Err(err).Msg("Failed to send message")
+			return
+		}
+	}
+}
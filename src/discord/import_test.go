@@ -0,0 +1,75 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"errors"
+	"reflect"
+	"src/openai"
+	"testing"
+)
+
+func TestParseConversation(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []*openai.ChatMessage
+		wantErr error
+	}{
+		{
+			name: "JSON",
+			data: `[{"role": "system", "content": "Be brief."}, {"role": "user", "content": "Hi"},
+				{"role": "assistant", "content": "Hello!"}, {"role": "User", "content": " Bye "}]`,
+			want: []*openai.ChatMessage{
+				{FromSystem: true, Text: "Be brief."},
+				{FromHuman: true, Text: "Hi"},
+				{Text: "Hello!"},
+				{FromHuman: true, Text: "Bye"},
+			},
+		},
+		{
+			name: "text",
+			data: "\nSystem: Be brief.\r\nuser: Hi\nASSISTANT: Hello!\nHow can I help?\n\nUser: Explain: briefly\n",
+			want: []*openai.ChatMessage{
+				{FromSystem: true, Text: "Be brief."},
+				{FromHuman: true, Text: "Hi"},
+				{Text: "Hello!\nHow can I help?"},
+				{FromHuman: true, Text: "Explain: briefly"},
+			},
+		},
+		{name: "malformed JSON", data: `[{"role": "user", "content": "Hi"}`, wantErr: InvalidConversationError},
+		{name: "JSON with unknown role", data: `[{"role": "bot", "content": "Hi"}]`, wantErr: InvalidConversationError},
+		{name: "JSON with empty message", data: `[{"role": "user", "content": " "}]`, wantErr: InvalidConversationError},
+		{name: "empty JSON", data: `[]`, wantErr: InvalidConversationError},
+		{name: "empty text", data: "\n\n", wantErr: InvalidConversationError},
+		{name: "text before the first role", data: "Hello\nUser: Hi", wantErr: InvalidConversationError},
+		{name: "text with unknown role", data: "Bot: Hi", wantErr: InvalidConversationError},
+		{name: "ends with the assistant", data: "User: Hi\nAssistant: Hello!", wantErr: InvalidConversationError},
+		{name: "ends with the system", data: `[{"role": "system", "content": "Be brief."}]`, wantErr: InvalidConversationError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseConversation([]byte(tt.data))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseConversation() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseConversation() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
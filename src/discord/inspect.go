@@ -0,0 +1,150 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"sort"
+	"strings"
+	"time"
+)
+
+// redacted replaces the value of settings whose names suggest a secret.
+const redacted = "[redacted]"
+
+// secretNameWords mark setting names whose values must never be shown, e.g. discord_token or openai_api_key.
+var secretNameWords = map[string]bool{
+	"token":      true,
+	"secret":     true,
+	"password":   true,
+	"key":        true,
+	"credential": true,
+}
+
+// isSecretSetting returns whether name, a snake_case or kebab-case setting name, contains a word that marks a secret.
+// Words are matched whole, so that e.g. max_tokens is not mistaken for a secret.
+func isSecretSetting(name string) bool {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return r == '_' || r == '-' || r == '.' || r == ' '
+	})
+	for _, word := range words {
+		if secretNameWords[word] {
+			return true
+		}
+	}
+	return false
+}
+
+// effectiveConfig returns the configuration the bot is running with, by setting name. It includes the
+// ComponentSettings of other components, such as the lock and OpenAI clients. Secrets are redacted.
+func (d *Discord) effectiveConfig() map[string]string {
+	options := d.settings.global
+	settings := map[string]string{
+		"channel_prefix":          d.config.ChannelPrefix,
+		"denied_channels":         strings.Join(d.config.DeniedChannels, ", "),
+		"global_commands":         fmt.Sprint(d.config.GlobalCommands),
+		"model":                   options.Model,
+		"allowed_models":          strings.Join(d.config.AllowedModels, ", "),
+		"fallback_models":         strings.Join(options.FallbackModels, ", "),
+		"language":                options.Language,
+		"temperature":             fmt.Sprintf("%.2f", options.Temperature),
+		"presence_penalty":        fmt.Sprintf("%.2f", options.PresencePenalty),
+		"frequency_penalty":       fmt.Sprintf("%.2f", options.FrequencyPenalty),
+		"max_tokens":              fmt.Sprint(options.MaxTokens),
+		"max_history_messages":    fmt.Sprint(d.config.MaxHistoryMessages),
+		"max_prompt_length":       fmt.Sprint(d.config.MaxPromptLength),
+		"thread_title_words":      fmt.Sprint(d.config.ThreadTitleWords),
+		"thread_archive_minutes":  fmt.Sprint(defaultAutoArchiveDuration),
+		"respond_only_to_creator": fmt.Sprint(d.config.RespondOnlyToCreator),
+		"max_bot_reply_depth":     fmt.Sprint(d.config.MaxBotReplyDepth),
+		"ignore_prefix":           d.config.IgnorePrefix,
+		"moderation":              fmt.Sprint(d.config.EnableModeration),
+		"image_prompt_blocklist":  fmt.Sprintf("%d patterns", len(d.config.ImagePromptBlocklist)),
+		"stream_responses":        fmt.Sprint(d.config.StreamResponses),
+		"embed_responses":         fmt.Sprint(d.config.EmbedResponses),
+		"extend_replies":          fmt.Sprint(d.config.ExtendReplies),
+		"send_retry_attempts":     fmt.Sprint(d.config.SendRetryAttempts),
+		"interaction_workers":     fmt.Sprint(d.config.InteractionWorkers),
+		"interaction_queue_size":  fmt.Sprint(d.config.InteractionQueueSize),
+		"watchdog_threshold":      d.config.WatchdogThreshold.String(),
+		"allowed_users":           fmt.Sprintf("%d users", len(d.config.AllowedUserIDs)),
+		"allowed_roles":           fmt.Sprintf("%d roles", len(d.config.AllowedRoleIDs)),
+		"instance":                d.lockClient.Owner(),
+	}
+	if options.Seed != nil {
+		settings["seed"] = fmt.Sprint(*options.Seed)
+	}
+	tools := make([]string, 0, len(options.Tools))
+	for _, tool := range options.Tools {
+		tools = append(tools, tool.Name)
+	}
+	settings["tools"] = strings.Join(tools, ", ")
+	cooldowns := make([]string, 0, len(d.config.CommandCooldowns))
+	for command, cooldown := range d.config.CommandCooldowns {
+		cooldowns = append(cooldowns, fmt.Sprintf("%s=%s", command, cooldown.Round(time.Second)))
+	}
+	sort.Strings(cooldowns)
+	settings["command_cooldowns"] = strings.Join(cooldowns, ", ")
+
+	for name, value := range d.config.ComponentSettings {
+		settings[name] = value
+	}
+	for name := range settings {
+		if isSecretSetting(name) {
+			settings[name] = redacted
+		}
+	}
+	return settings
+}
+
+// formatConfig lists settings one per line, in order of name, in a code block.
+func formatConfig(settings map[string]string) string {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var builder strings.Builder
+	builder.WriteString("```\n")
+	for _, name := range names {
+		line := fmt.Sprintf("%s: %s\n", name, settings[name])
+		if builder.Len()+len(line) > maxMessageLength-8 {
+			builder.WriteString("...\n")
+			break
+		}
+		builder.WriteString(line)
+	}
+	builder.WriteString("```")
+	return builder.String()
+}
+
+// configInteractionHandler replies with the bot's effective configuration, for operators to check which settings took
+// effect. The reply is always ephemeral.
+func (d *Discord) configInteractionHandler(s Session, i *discordgo.InteractionCreate, ctx context.Context, zlog *zerolog.Logger) {
+	zlog.Info().Msg("Received config command")
+
+	_, err := s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+		Content: Ptr(formatConfig(d.effectiveConfig())),
+	})
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to respond to interaction")
+	}
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"strings"
+	"testing"
+)
+
+func TestIsSecretSetting(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "discord_token", want: true},
+		{name: "OPENAI_API_KEY", want: true},
+		{name: "client-secret", want: true},
+		{name: "db.password", want: true},
+		{name: "aws credential", want: true},
+		{name: "max_tokens", want: false},
+		{name: "keyboard_layout", want: false},
+		{name: "model", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isSecretSetting(tt.name); got != tt.want {
+				t.Errorf("isSecretSetting(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigInteractionHandler(t *testing.T) {
+	session := newFakeSession()
+	d := newTestDiscord(session, nil)
+	d.config.ChannelPrefix = "chat-"
+	d.config.ComponentSettings = map[string]string{
+		"openai_token":      "sk-openai-secret",
+		"discord_token":     "discord-secret",
+		"aws_secret_key":    "aws-secret",
+		"lock_table":        "locks",
+		"openai_max_tokens": "512",
+	}
+	zlog := zerolog.Nop()
+
+	i := newCommandInteraction("channel", "user", "config")
+	if flags := interactionReplyFlags(i); flags != discordgo.MessageFlagsEphemeral {
+		t.Errorf("interactionReplyFlags() = %v, want ephemeral", flags)
+	}
+	d.configInteractionHandler(session, i, context.Background(), &zlog)
+
+	if len(session.responseEdits) != 1 {
+		t.Fatalf("configInteractionHandler() sent %d replies, want 1", len(session.responseEdits))
+	}
+	reply := *session.responseEdits[0].Content
+	for _, secret := range []string{"sk-openai-secret", "discord-secret", "aws-secret"} {
+		if strings.Contains(reply, secret) {
+			t.Errorf("configInteractionHandler() reply = %q, want no %q", reply, secret)
+		}
+	}
+	for _, want := range []string{"openai_token: " + redacted, "channel_prefix: chat-", "lock_table: locks", "openai_max_tokens: 512", "max_tokens: "} {
+		if !strings.Contains(reply, want) {
+			t.Errorf("configInteractionHandler() reply = %q, want %q", reply, want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// contentIntentSampleMessages is how many recent messages are read from each tracked channel at startup to check
+	// that the bot can see message content.
+	contentIntentSampleMessages = 10
+
+	// contentIntentMinMessages is the fewest messages from other users needed to judge whether content is visible.
+	contentIntentMinMessages = 3
+)
+
+// checkMessageContentIntent reads a few recent messages from the tracked channels and logs a warning if none of them
+// have content. Without the privileged message content intent Discord sends every message, other than ones mentioning
+// the bot, with empty content, and the bot would otherwise silently never respond.
+func (d *Discord) checkMessageContentIntent(zlog *zerolog.Logger) {
+	botUserID := d.discordClient.State.User.ID
+	sample := make([]*discordgo.Message, 0)
+	for _, channelID := range d.idsMap.ChannelIDs() {
+		messages, err := d.session.ChannelMessages(string(channelID), contentIntentSampleMessages, "", "", "")
+		if err != nil {
+			zlog.Debug().Err(err).Str("channel", string(channelID)).Msg("Failed to read messages to check content intent")
+			continue
+		}
+		sample = append(sample, messages...)
+	}
+
+	if likelyMissingContentIntent(sample, botUserID) {
+		zlog.Warn().
+			Int("messages", len(sample)).
+			Msg("Recent messages in tracked channels all have empty content, so the bot cannot read messages. " +
+				"Enable the Message Content Intent for this bot under Privileged Gateway Intents in the Discord " +
+				"Developer Portal; bots in 100 or more servers also need Discord to approve it")
+	}
+}
+
+// likelyMissingContentIntent returns whether messages suggest the bot lacks the message content intent: there are at
+// least contentIntentMinMessages messages from other users, and all of them are empty. Messages from bots and messages
+// mentioning botUserID are skipped, since Discord sends those with content even without the intent.
+func likelyMissingContentIntent(messages []*discordgo.Message, botUserID string) bool {
+	considered := 0
+	for _, message := range messages {
+		if message.Author == nil || message.Author.Bot || mentionsUser(message, botUserID) {
+			continue
+		}
+		if message.Content != "" || len(message.Attachments) > 0 || len(message.Embeds) > 0 {
+			return false
+		}
+		considered++
+	}
+	return considered >= contentIntentMinMessages
+}
+
+// mentionsUser returns whether message mentions userID.
+func mentionsUser(message *discordgo.Message, userID string) bool {
+	for _, user := range message.Mentions {
+		if user.ID == userID {
+			return true
+		}
+	}
+	return false
+}
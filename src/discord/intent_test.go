@@ -0,0 +1,51 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"testing"
+)
+
+func TestLikelyMissingContentIntent(t *testing.T) {
+	empty := &discordgo.Message{Author: &discordgo.User{ID: "user"}}
+	withContent := &discordgo.Message{Author: &discordgo.User{ID: "user"}, Content: "Who made Go?"}
+	withAttachment := &discordgo.Message{Author: &discordgo.User{ID: "user"}, Attachments: []*discordgo.MessageAttachment{{ID: "a"}}}
+	fromBot := &discordgo.Message{Author: &discordgo.User{ID: "other-bot", Bot: true}}
+	mentioningBot := &discordgo.Message{Author: &discordgo.User{ID: "user"}, Content: "@bot hi", Mentions: []*discordgo.User{{ID: "bot"}}}
+	tests := []struct {
+		name     string
+		messages []*discordgo.Message
+		want     bool
+	}{
+		{name: "no messages"},
+		{name: "all empty", messages: []*discordgo.Message{empty, empty, empty}, want: true},
+		{name: "too few to judge", messages: []*discordgo.Message{empty, empty}},
+		{name: "one with content", messages: []*discordgo.Message{empty, empty, empty, withContent}},
+		{name: "attachment only", messages: []*discordgo.Message{empty, empty, withAttachment}},
+		{name: "bot messages are skipped", messages: []*discordgo.Message{empty, empty, fromBot, fromBot}},
+		{name: "mentions are skipped", messages: []*discordgo.Message{empty, empty, empty, mentioningBot}, want: true},
+		{name: "messages without authors are skipped", messages: []*discordgo.Message{empty, empty, {}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := likelyMissingContentIntent(tt.messages, "bot"); got != tt.want {
+				t.Errorf("likelyMissingContentIntent() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"src/openai"
+	"testing"
+)
+
+// interactionHandlers are command handlers for tests, keyed by command name.
+type interactionHandlers = map[string]func(s Session, i *discordgo.InteractionCreate, ctx context.Context, zlog *zerolog.Logger)
+
+// newCommandInteraction returns the command name run by user in channelID, with options.
+func newCommandInteraction(channelID string, user string, name string, options ...*discordgo.ApplicationCommandInteractionDataOption) *discordgo.InteractionCreate {
+	return &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{
+		ID:        "interaction",
+		Type:      discordgo.InteractionApplicationCommand,
+		GuildID:   "guild",
+		ChannelID: channelID,
+		Data:      discordgo.ApplicationCommandInteractionData{Name: name, Options: options},
+		Member:    &discordgo.Member{User: &discordgo.User{ID: user}, Roles: []string{}},
+	}}
+}
+
+// newButtonInteraction returns a click on the button with customID, attached to message, in channelID.
+func newButtonInteraction(channelID string, customID string, message *discordgo.Message) *discordgo.InteractionCreate {
+	return &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{
+		ID:        "interaction",
+		Type:      discordgo.InteractionMessageComponent,
+		ChannelID: channelID,
+		Data:      discordgo.MessageComponentInteractionData{CustomID: customID},
+		Message:   message,
+		Member:    &discordgo.Member{User: &discordgo.User{ID: "user"}},
+	}}
+}
+
+// TestAcknowledgeMessageComponent clicks a feedback button: the click is deferred ephemerally before it is handled,
+// and the handler then edits the deferred reply.
+func TestAcknowledgeMessageComponent(t *testing.T) {
+	session := newFakeSession()
+	d := newTestDiscord(session, &fakeOpenAI{})
+	d.idsMap.SetThreads(map[ThreadID]ChannelID{"thread": "channel"})
+	zlog := zerolog.Nop()
+	answer := &discordgo.Message{ID: "answer", ChannelID: "thread", Content: "42", Author: &discordgo.User{ID: "bot", Bot: true}}
+	i := newButtonInteraction("thread", feedbackPositiveCustomID, answer)
+
+	release, ok := d.acknowledgeInteraction(session, i, interactionHandlers{}, context.Background(), &zlog)
+	if !ok {
+		t.Fatalf("acknowledgeInteraction() = false, want the click to be handled")
+	}
+	if len(session.responses) != 1 {
+		t.Fatalf("sent %d initial responses, want 1", len(session.responses))
+	}
+	response := session.responses[0]
+	if response.Type != discordgo.InteractionResponseDeferredChannelMessageWithSource ||
+		response.Data.Flags != discordgo.MessageFlagsEphemeral {
+		t.Errorf("initial response = %+v, want an ephemeral deferred reply", response)
+	}
+
+	d.handleInteraction(session, i, interactionHandlers{}, context.Background(), &zlog)
+	release()
+	if len(session.responseEdits) != 1 || *session.responseEdits[0].Content != "Thanks for your feedback!" {
+		t.Errorf("reply edits = %+v, want the thanks message", session.responseEdits)
+	}
+	if _, err := d.lockClient.Acquire(context.Background(), i.ID, ""); err != nil {
+		t.Errorf("lock was not released: %v", err)
+	}
+}
+
+func TestAcknowledgeMessageComponentOutsideTrackedChannels(t *testing.T) {
+	session := newFakeSession()
+	d := newTestDiscord(session, &fakeOpenAI{})
+	zlog := zerolog.Nop()
+	i := newButtonInteraction("elsewhere", feedbackPositiveCustomID, &discordgo.Message{ID: "answer"})
+
+	if _, ok := d.acknowledgeInteraction(session, i, interactionHandlers{}, context.Background(), &zlog); ok {
+		t.Errorf("acknowledgeInteraction() = true for a click outside the tracked channels")
+	}
+	if len(session.responses) != 0 {
+		t.Errorf("sent %d responses, want none", len(session.responses))
+	}
+}
+
+// TestAcknowledgeCommandOutsideTrackedChannels checks that a command run outside the tracked channels is answered,
+// only to the user who ran it, with where the bot works, rather than with silence.
+func TestAcknowledgeCommandOutsideTrackedChannels(t *testing.T) {
+	session := newFakeSession()
+	d := newTestDiscord(session, &fakeOpenAI{})
+	d.config.ChannelPrefix = "openai"
+	zlog := zerolog.Nop()
+	handled := false
+	handlers := interactionHandlers{"ping": func(Session, *discordgo.InteractionCreate, context.Context, *zerolog.Logger) { handled = true }}
+	i := newCommandInteraction("elsewhere", "user", "ping")
+
+	if _, ok := d.acknowledgeInteraction(session, i, handlers, context.Background(), &zlog); ok || handled {
+		t.Errorf("acknowledgeInteraction() = true for a command outside the tracked channels")
+	}
+	if len(session.responses) != 1 {
+		t.Fatalf("sent %d responses, want the guidance", len(session.responses))
+	}
+	response := session.responses[0]
+	want := "This bot only works in channels prefixed with `openai`."
+	if response.Type != discordgo.InteractionResponseChannelMessageWithSource ||
+		response.Data.Flags != discordgo.MessageFlagsEphemeral || response.Data.Content != want {
+		t.Errorf("response = %+v, want the ephemeral guidance %q", response, want)
+	}
+	if _, err := d.lockClient.Acquire(context.Background(), i.ID, ""); err != nil {
+		t.Errorf("lock was not released: %v", err)
+	}
+}
+
+// TestUnknownComponentDeletesDeferredReply checks that a click on a button that is not a feedback button does not
+// leave the deferred reply loading forever.
+func TestUnknownComponentDeletesDeferredReply(t *testing.T) {
+	session := newFakeSession()
+	d := newTestDiscord(session, &fakeOpenAI{})
+	zlog := zerolog.Nop()
+	i := newButtonInteraction("thread", "other", &discordgo.Message{ID: "answer"})
+
+	d.feedbackComponentHandler(session, i, context.Background(), &zlog)
+	if session.responsesDeleted != 1 {
+		t.Errorf("deleted %d deferred replies, want 1", session.responsesDeleted)
+	}
+}
+
+// TestPrivateCompleteIsEphemeral checks that /complete defers an ephemeral reply only when private is set.
+func TestPrivateCompleteIsEphemeral(t *testing.T) {
+	private := func(value bool) *discordgo.ApplicationCommandInteractionDataOption {
+		return &discordgo.ApplicationCommandInteractionDataOption{Name: "private", Type: discordgo.ApplicationCommandOptionBoolean, Value: value}
+	}
+	tests := []struct {
+		name      string
+		options   []*discordgo.ApplicationCommandInteractionDataOption
+		wantFlags discordgo.MessageFlags
+	}{
+		{name: "private", options: []*discordgo.ApplicationCommandInteractionDataOption{promptOption("Hi"), private(true)}, wantFlags: discordgo.MessageFlagsEphemeral},
+		{name: "not private", options: []*discordgo.ApplicationCommandInteractionDataOption{promptOption("Hi"), private(false)}},
+		{name: "unset", options: []*discordgo.ApplicationCommandInteractionDataOption{promptOption("Hi")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newFakeSession()
+			d := newTestDiscord(session, openai.NewMockOpenAI())
+			d.idsMap.SetChannels(map[ChannelID]bool{"channel": true})
+			zlog := zerolog.Nop()
+			handlers := interactionHandlers{"complete": d.completeInteractionHandler}
+			i := newCommandInteraction("channel", "user", "complete", tt.options...)
+
+			release, ok := d.acknowledgeInteraction(session, i, handlers, context.Background(), &zlog)
+			if !ok {
+				t.Fatalf("acknowledgeInteraction() = false, want the command to be handled")
+			}
+			release()
+			if len(session.responses) != 1 {
+				t.Fatalf("sent %d initial responses, want 1", len(session.responses))
+			}
+			response := session.responses[0]
+			if response.Type != discordgo.InteractionResponseDeferredChannelMessageWithSource || response.Data.Flags != tt.wantFlags {
+				t.Errorf("initial response = %+v with flags %d, want a deferred reply with flags %d", response, response.Data.Flags, tt.wantFlags)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"strings"
+)
+
+// messageKey identifies a user-facing string in the message catalog.
+type messageKey string
+
+const (
+	msgPong                 messageKey = "pong"
+	msgNotPermitted         messageKey = "not_permitted"
+	msgCooldown             messageKey = "cooldown"
+	msgAttachImage          messageKey = "attach_image"
+	msgSummarizeWhat        messageKey = "summarize_what"
+	msgNothingToSummarize   messageKey = "nothing_to_summarize"
+	msgEmptySummary         messageKey = "empty_summary"
+	msgRegenerateInThread   messageKey = "regenerate_in_thread"
+	msgNothingToRegenerate  messageKey = "nothing_to_regenerate"
+	msgEmptyRegeneration    messageKey = "empty_regeneration"
+	msgAttachmentNotPNG     messageKey = "attachment_not_png"
+	msgAttachmentTooLarge   messageKey = "attachment_too_large"
+	msgTooManyStopSequences messageKey = "too_many_stop_sequences"
+	msgRateLimited          messageKey = "rate_limited"
+	msgContentFiltered      messageKey = "content_filtered"
+	msgTimeout              messageKey = "timeout"
+	msgUnavailable          messageKey = "unavailable"
+	msgTooLong              messageKey = "too_long"
+	msgGenericError         messageKey = "generic_error"
+	msgKeepInThread         messageKey = "keep_in_thread"
+	msgThreadKept           messageKey = "thread_kept"
+	msgThreadUnkept         messageKey = "thread_unkept"
+
+	msgPromptTooLong messageKey = "prompt_too_long"
+	msgBusy          messageKey = "busy"
+
+	msgUntrackedChannel messageKey = "untracked_channel"
+
+	msgDeleteInThread     messageKey = "delete_in_thread"
+	msgNothingToDelete    messageKey = "nothing_to_delete"
+	msgLastMessageDeleted messageKey = "last_message_deleted"
+
+	msgInvalidConversation  messageKey = "invalid_conversation"
+	msgConversationTooLarge messageKey = "conversation_too_large"
+	msgEmptyImportReply     messageKey = "empty_import_reply"
+
+	msgTemplatesDisabled     messageKey = "templates_disabled"
+	msgTemplateSaved         messageKey = "template_saved"
+	msgTemplateNotFound      messageKey = "template_not_found"
+	msgTemplateInvalidValues messageKey = "template_invalid_values"
+	msgTemplateMissingValues messageKey = "template_missing_values"
+)
+
+// defaultLocale is the locale every message has a translation in, used when the user's locale has none.
+const defaultLocale = discordgo.EnglishUS
+
+// messageCatalog holds the user-facing strings in each supported locale. Strings with a verb, such as msgCooldown,
+// are fmt format strings. Locales may translate only some messages; the rest fall back to defaultLocale.
+var messageCatalog = map[discordgo.Locale]map[messageKey]string{
+	discordgo.EnglishUS: {
+		msgPong:                 "Pong!",
+		msgNotPermitted:         "You are not permitted to use this command.",
+		msgCooldown:             "You can use /%s again in %d seconds.",
+		msgAttachImage:          "Attach an image to edit.",
+		msgSummarizeWhat:        "Provide text to summarize, or run this command inside a thread.",
+		msgNothingToSummarize:   "There is nothing to summarize in this thread.",
+		msgEmptySummary:         "The summary was empty.",
+		msgRegenerateInThread:   "Responses can only be regenerated inside a thread.",
+		msgNothingToRegenerate:  "There is nothing to regenerate in this thread.",
+		msgEmptyRegeneration:    "The regenerated response was empty.",
+		msgAttachmentNotPNG:     "The image must be a PNG.",
+		msgAttachmentTooLarge:   "The image must be smaller than 4 MB.",
+		msgTooManyStopSequences: "OpenAI allows at most 4 stop sequences.",
+		msgRateLimited:          "OpenAI is busy right now, please try again in a minute.",
+		msgContentFiltered:      "OpenAI declined this request because it may violate its content policy.",
+		msgTimeout:              "The request took too long, please try again.",
+		msgUnavailable:          "OpenAI is temporarily unavailable, please try again later.",
+		msgTooLong:              "The conversation is too long for the model, please start a new thread or shorten your message.",
+		msgGenericError:         "Something went wrong, please try again later.",
+		msgKeepInThread:         "Auto-archive can only be changed inside a thread.",
+		msgThreadKept:           "This thread will now stay open for 7 days without activity.",
+		msgThreadUnkept:         "This thread will now be archived after 1 day without activity.",
+
+		msgPromptTooLong: "Prompts can be at most %d characters long, but yours is %d.",
+		msgBusy:          "The bot is busy right now, please try again in a moment.",
+
+		msgUntrackedChannel: "This bot only works in channels prefixed with `%s`.",
+
+		msgDeleteInThread:     "Messages can only be deleted inside a thread.",
+		msgNothingToDelete:    "There is no message from the bot to delete in this thread.",
+		msgLastMessageDeleted: "Deleted the bot's last message.",
+
+		msgInvalidConversation:  "Attach a conversation as a JSON array of {\"role\": \"user\", \"content\": \"...\"} messages, or as text with each message starting with \"User:\", \"Assistant:\", or \"System:\". The last message must be from the user.",
+		msgConversationTooLarge: "The conversation file must be smaller than 256 KB.",
+		msgEmptyImportReply:     "The reply to the imported conversation was empty.",
+
+		msgTemplatesDisabled:     "Templates are not enabled for this bot.",
+		msgTemplateSaved:         "Saved template %q. Placeholders: %s",
+		msgTemplateNotFound:      "There is no template called %q. Templates in this server: %s",
+		msgTemplateInvalidValues: "Give values as key=value pairs separated by spaces, quoting values that contain spaces, e.g. topic=\"error handling\".",
+		msgTemplateMissingValues: "Missing values for the placeholders %s.",
+	},
+	discordgo.French: {
+		msgPong:               "Pong !",
+		msgNotPermitted:       "Vous n'êtes pas autorisé à utiliser cette commande.",
+		msgCooldown:           "Vous pourrez utiliser /%s à nouveau dans %d secondes.",
+		msgRegenerateInThread: "Les réponses ne peuvent être régénérées que dans un fil.",
+		msgRateLimited:        "OpenAI est très sollicité en ce moment, veuillez réessayer dans une minute.",
+		msgTimeout:            "La requête a pris trop de temps, veuillez réessayer.",
+		msgUnavailable:        "OpenAI est temporairement indisponible, veuillez réessayer plus tard.",
+		msgGenericError:       "Une erreur s'est produite, veuillez réessayer plus tard.",
+	},
+	discordgo.SpanishES: {
+		msgPong:               "¡Pong!",
+		msgNotPermitted:       "No tienes permiso para usar este comando.",
+		msgCooldown:           "Podrás usar /%s de nuevo en %d segundos.",
+		msgRegenerateInThread: "Las respuestas solo se pueden regenerar dentro de un hilo.",
+		msgRateLimited:        "OpenAI está ocupado ahora mismo, inténtalo de nuevo en un minuto.",
+		msgTimeout:            "La solicitud tardó demasiado, inténtalo de nuevo.",
+		msgUnavailable:        "OpenAI no está disponible temporalmente, inténtalo más tarde.",
+		msgGenericError:       "Algo salió mal, inténtalo más tarde.",
+	},
+	discordgo.German: {
+		msgPong:               "Pong!",
+		msgNotPermitted:       "Du darfst diesen Befehl nicht verwenden.",
+		msgCooldown:           "Du kannst /%s in %d Sekunden wieder verwenden.",
+		msgRegenerateInThread: "Antworten können nur in einem Thread neu generiert werden.",
+		msgRateLimited:        "OpenAI ist gerade ausgelastet, bitte versuche es in einer Minute erneut.",
+		msgTimeout:            "Die Anfrage hat zu lange gedauert, bitte versuche es erneut.",
+		msgUnavailable:        "OpenAI ist vorübergehend nicht verfügbar, bitte versuche es später erneut.",
+		msgGenericError:       "Etwas ist schiefgelaufen, bitte versuche es später erneut.",
+	},
+}
+
+// Localize returns the message for key in locale. If locale has no translation, it falls back to another locale of
+// the same language, e.g. es-419 to es-ES, and then to English.
+func Localize(key messageKey, locale discordgo.Locale) string {
+	if message, ok := messageCatalog[locale][key]; ok {
+		return message
+	}
+	language, _, _ := strings.Cut(string(locale), "-")
+	for catalogLocale, messages := range messageCatalog {
+		catalogLanguage, _, _ := strings.Cut(string(catalogLocale), "-")
+		if catalogLanguage != language {
+			continue
+		}
+		if message, ok := messages[key]; ok {
+			return message
+		}
+	}
+	return messageCatalog[defaultLocale][key]
+}
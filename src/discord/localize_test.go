@@ -0,0 +1,58 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"testing"
+)
+
+func TestLocalize(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    messageKey
+		locale discordgo.Locale
+		want   string
+	}{
+		{name: "default locale", key: msgPong, locale: discordgo.EnglishUS, want: "Pong!"},
+		{name: "translated", key: msgPong, locale: discordgo.French, want: "Pong !"},
+		{name: "same language", key: msgPong, locale: "es-419", want: "¡Pong!"},
+		{name: "other English locale", key: msgPong, locale: discordgo.EnglishGB, want: "Pong!"},
+		{name: "untranslated message", key: msgNothingToDelete, locale: discordgo.French, want: "There is no message from the bot to delete in this thread."},
+		{name: "unknown locale", key: msgGenericError, locale: discordgo.Japanese, want: "Something went wrong, please try again later."},
+		{name: "no locale", key: msgGenericError, locale: "", want: "Something went wrong, please try again later."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Localize(tt.key, tt.locale); got != tt.want {
+				t.Errorf("Localize(%q, %q) = %q, want %q", tt.key, tt.locale, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestMessageCatalogHasDefaults checks that every translated message also exists in the default locale, which is
+// what Localize falls back to.
+func TestMessageCatalogHasDefaults(t *testing.T) {
+	for locale, messages := range messageCatalog {
+		for key := range messages {
+			if _, ok := messageCatalog[defaultLocale][key]; !ok {
+				t.Errorf("message %q in %s has no %s translation", key, locale, defaultLocale)
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"github.com/bwmarrin/discordgo"
+)
+
+// botReplyDepth returns how many of the trailing run of bot messages in messages, which are in chronological order,
+// are from bots other than botUserID, i.e. how many times in a row the bot would have been answering another bot.
+func botReplyDepth(messages []*discordgo.Message, botUserID string) int {
+	depth := 0
+	for index := len(messages) - 1; index >= 0; index-- {
+		author := messages[index].Author
+		if author == nil || !author.Bot {
+			break
+		}
+		if author.ID != botUserID {
+			depth++
+		}
+	}
+	return depth
+}
+
+// shouldAnswerNewest returns whether the bot, botUserID, should reply to the newest of messages. It never replies to
+// itself, and replies to other bots only until they have posted more than maxDepth messages in a row between its
+// replies, so that two bots cannot reply to each other forever.
+func shouldAnswerNewest(messages []*discordgo.Message, botUserID string, maxDepth int) bool {
+	if len(messages) == 0 {
+		return false
+	}
+	newest := messages[len(messages)-1].Author
+	if newest == nil || newest.ID == botUserID {
+		return false
+	}
+	if !newest.Bot {
+		return true
+	}
+	return botReplyDepth(messages, botUserID) <= maxDepth
+}
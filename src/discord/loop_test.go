@@ -0,0 +1,74 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"testing"
+)
+
+func TestShouldAnswerNewest(t *testing.T) {
+	// Each letter is a message: h from a human, s from this bot (self), and o from another bot.
+	conversation := func(authors string) []*discordgo.Message {
+		messages := make([]*discordgo.Message, 0, len(authors))
+		for _, author := range authors {
+			switch author {
+			case 'h':
+				messages = append(messages, &discordgo.Message{Author: &discordgo.User{ID: "human"}})
+			case 's':
+				messages = append(messages, &discordgo.Message{Author: &discordgo.User{ID: "self", Bot: true}})
+			case 'o':
+				messages = append(messages, &discordgo.Message{Author: &discordgo.User{ID: "other", Bot: true}})
+			}
+		}
+		return messages
+	}
+	tests := []struct {
+		authors  string
+		maxDepth int
+		want     bool
+	}{
+		{authors: "", maxDepth: 1, want: false},
+		{authors: "h", maxDepth: 1, want: true},
+		{authors: "hsh", maxDepth: 1, want: true},
+		{authors: "hs", maxDepth: 1, want: false},
+		{authors: "s", maxDepth: 5, want: false},
+		{authors: "ho", maxDepth: 1, want: true},
+		{authors: "ho", maxDepth: 0, want: false},
+		{authors: "hoso", maxDepth: 1, want: false},
+		{authors: "hoso", maxDepth: 2, want: true},
+		{authors: "hosos", maxDepth: 2, want: false},
+		{authors: "hosoh", maxDepth: 0, want: true},
+		{authors: "hosohso", maxDepth: 1, want: true},
+		{authors: "oo", maxDepth: 1, want: false},
+		{authors: "oo", maxDepth: 2, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.authors, func(t *testing.T) {
+			if got := shouldAnswerNewest(conversation(tt.authors), "self", tt.maxDepth); got != tt.want {
+				t.Errorf("shouldAnswerNewest(%q, maxDepth %d) = %v, want %v", tt.authors, tt.maxDepth, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShouldAnswerNewestWithoutAuthor(t *testing.T) {
+	messages := []*discordgo.Message{{Author: &discordgo.User{ID: "human"}}, {}}
+	if shouldAnswerNewest(messages, "self", 1) {
+		t.Error("shouldAnswerNewest() = true for a message without an author, want false")
+	}
+}
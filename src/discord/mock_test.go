@@ -0,0 +1,100 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"src/openai"
+	"testing"
+)
+
+// promptOption returns the prompt option of a command.
+func promptOption(prompt string) *discordgo.ApplicationCommandInteractionDataOption {
+	return &discordgo.ApplicationCommandInteractionDataOption{
+		Name:  "prompt",
+		Type:  discordgo.ApplicationCommandOptionString,
+		Value: prompt,
+	}
+}
+
+// TestThreadReplyWithMockOpenAI replies in a thread using the mock client that OPENAI_MOCK=1 enables.
+func TestThreadReplyWithMockOpenAI(t *testing.T) {
+	session := newFakeSession()
+	d := newTestDiscord(session, openai.NewMockOpenAI())
+	zlog := zerolog.Nop()
+	messages := []*discordgo.Message{
+		{ID: "1", ChannelID: "thread", Content: "Who made Go?", Author: &discordgo.User{ID: "human"}},
+	}
+	options := openai.DefaultChatOptions()
+
+	d.respondToConversation(session, "guild", "thread", messages, options, context.Background(), &zlog)
+
+	sent := session.sentMessages()
+	want := "Mock response from " + options.Model + " to: Who made Go?"
+	if len(sent) != 1 || sent[0].Message.Content != want {
+		t.Fatalf("sent %+v, want one message %q", sent, want)
+	}
+}
+
+// TestCompleteWithMockOpenAI runs /complete, with and without the count and json options, using the mock client.
+func TestCompleteWithMockOpenAI(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []*discordgo.ApplicationCommandInteractionDataOption
+		want    string
+	}{
+		{
+			name:    "completion",
+			options: []*discordgo.ApplicationCommandInteractionDataOption{promptOption("Say hi")},
+			want:    "> Say hi\n\nMock completion.",
+		},
+		{
+			name: "candidates",
+			options: []*discordgo.ApplicationCommandInteractionDataOption{
+				promptOption("Say hi"),
+				{Name: "count", Type: discordgo.ApplicationCommandOptionInteger, Value: float64(2)},
+			},
+			want: "> Say hi\n\n**1.**\nMock completion.\n\n**2.**\nMock completion 2.",
+		},
+		{
+			name: "json",
+			options: []*discordgo.ApplicationCommandInteractionDataOption{
+				promptOption("Say hi"),
+				{Name: "json", Type: discordgo.ApplicationCommandOptionBoolean, Value: true},
+			},
+			want: "```json\n{\n  \"response\": \"Mock response.\"\n}\n```",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newFakeSession()
+			d := newTestDiscord(session, openai.NewMockOpenAI())
+			zlog := zerolog.Nop()
+
+			d.completeInteractionHandler(session, newCommandInteraction("channel", "user", "complete", tt.options...), context.Background(), &zlog)
+
+			if len(session.responseEdits) != 1 {
+				t.Fatalf("got %d response edits, want 1", len(session.responseEdits))
+			}
+			if got := *session.responseEdits[0].Content; got != tt.want {
+				t.Errorf("response = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
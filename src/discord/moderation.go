@@ -0,0 +1,101 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"regexp"
+	"strings"
+)
+
+// CompilePromptBlocklist compiles patterns into a blocklist for Config.ImagePromptBlocklist. Patterns are matched
+// case-insensitively anywhere in the prompt, unless anchored with ^ or $. Empty patterns are skipped.
+func CompilePromptBlocklist(patterns []string) ([]*regexp.Regexp, error) {
+	blocklist := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		if strings.TrimSpace(pattern) == "" {
+			continue
+		}
+		compiled, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid blocklist pattern %q: %w", pattern, err)
+		}
+		blocklist = append(blocklist, compiled)
+	}
+	return blocklist, nil
+}
+
+// blockedPattern returns the first pattern in blocklist that matches prompt, or nil if none do.
+func blockedPattern(prompt string, blocklist []*regexp.Regexp) *regexp.Regexp {
+	for _, pattern := range blocklist {
+		if pattern.MatchString(prompt) {
+			return pattern
+		}
+	}
+	return nil
+}
+
+// moderateImagePrompt is moderate for image prompts, which are first checked against Config.ImagePromptBlocklist.
+func (d *Discord) moderateImagePrompt(prompt string, ctx context.Context, zlog *zerolog.Logger) (bool, string) {
+	if prompt != "" {
+		if pattern := blockedPattern(prompt, d.config.ImagePromptBlocklist); pattern != nil {
+			zlog.Info().Str("pattern", pattern.String()).Msg("Image prompt matches the blocklist")
+			return false, "Sorry, this prompt is not allowed on this server."
+		}
+	}
+	return d.moderate(prompt, ctx, zlog)
+}
+
+// moderate checks text against OpenAI's usage policies if Config.EnableModeration is set. It returns whether the bot
+// may respond, and if not, a message explaining why. If the check itself fails the text is refused, since it could
+// not be shown to be compliant.
+func (d *Discord) moderate(text string, ctx context.Context, zlog *zerolog.Logger) (bool, string) {
+	if !d.config.EnableModeration || strings.TrimSpace(text) == "" {
+		return true, ""
+	}
+	result, err := d.openaiClient.Moderate(text, ctx, zlog)
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to moderate prompt, refusing it")
+		return false, "Sorry, your prompt could not be checked against the content policy. Please try again later."
+	}
+	if result.Flagged {
+		zlog.Info().Strs("categories", result.Categories).Msg("Prompt flagged by moderation")
+		return false, fmt.Sprintf(
+			"Sorry, your prompt was flagged by the content policy (%s) and will not be answered.",
+			strings.Join(result.Categories, ", "),
+		)
+	}
+	return true, ""
+}
+
+// respondRefused replaces the deferred reply to an interaction with a message only the user can see. The deferred
+// reply may be public, so it is deleted and the message is sent as an ephemeral follow-up.
+func (d *Discord) respondRefused(s Session, i *discordgo.InteractionCreate, message string, zlog *zerolog.Logger) {
+	if err := s.InteractionResponseDelete(i.Interaction); err != nil {
+		zlog.Error().Err(err).Msg("Failed to delete deferred interaction response")
+	}
+	_, err := s.FollowupMessageCreate(i.Interaction, true, &discordgo.WebhookParams{
+		Content: message,
+		Flags:   discordgo.MessageFlagsEphemeral,
+	})
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to send refusal")
+	}
+}
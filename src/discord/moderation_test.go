@@ -0,0 +1,166 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"errors"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"src/openai"
+	"strings"
+	"testing"
+)
+
+func TestModerate(t *testing.T) {
+	tests := []struct {
+		name          string
+		disabled      bool
+		text          string
+		moderation    *openai.ModerationResult
+		err           error
+		wantOK        bool
+		wantRefusal   string
+		wantModerated bool
+	}{
+		{name: "disabled", disabled: true, text: "hello", wantOK: true},
+		{name: "blank text", text: "  ", wantOK: true},
+		{name: "unflagged", text: "hello", moderation: &openai.ModerationResult{}, wantOK: true, wantModerated: true},
+		{
+			name:          "flagged",
+			text:          "something bad",
+			moderation:    &openai.ModerationResult{Flagged: true, Categories: []string{"hate", "violence"}},
+			wantRefusal:   "flagged by the content policy (hate, violence)",
+			wantModerated: true,
+		},
+		{name: "check fails", text: "hello", err: errors.New("HTTP 503"), wantRefusal: "could not be checked", wantModerated: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeOpenAI{moderation: tt.moderation, err: tt.err}
+			d := newTestDiscord(newFakeSession(), client)
+			d.config.EnableModeration = !tt.disabled
+			zlog := zerolog.Nop()
+
+			ok, refusal := d.moderate(tt.text, context.Background(), &zlog)
+
+			if ok != tt.wantOK {
+				t.Errorf("moderate() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !strings.Contains(refusal, tt.wantRefusal) || (tt.wantRefusal == "" && refusal != "") {
+				t.Errorf("moderate() refusal = %q, want %q", refusal, tt.wantRefusal)
+			}
+			if moderated := len(client.moderated) > 0; moderated != tt.wantModerated {
+				t.Errorf("moderate() checked with OpenAI = %v, want %v", moderated, tt.wantModerated)
+			}
+		})
+	}
+}
+
+// TestCompleteRefusedByModeration checks that a flagged /complete prompt is refused with an ephemeral message, without
+// being completed.
+func TestCompleteRefusedByModeration(t *testing.T) {
+	session := newFakeSession()
+	client := &fakeOpenAI{moderation: &openai.ModerationResult{Flagged: true, Categories: []string{"hate"}}}
+	d := newTestDiscord(session, client)
+	d.config.EnableModeration = true
+	zlog := zerolog.Nop()
+
+	d.completeInteractionHandler(session, newCommandInteraction("channel", "user", "complete", promptOption("something bad")), context.Background(), &zlog)
+
+	if session.responsesDeleted != 1 {
+		t.Errorf("deleted %d deferred responses, want 1", session.responsesDeleted)
+	}
+	if len(session.followups) != 1 {
+		t.Fatalf("got %d follow-ups, want 1", len(session.followups))
+	}
+	followup := session.followups[0]
+	if followup.Flags != discordgo.MessageFlagsEphemeral || !strings.Contains(followup.Content, "hate") {
+		t.Errorf("follow-up = %+v, want an ephemeral refusal naming the category", followup)
+	}
+	if len(session.responseEdits) != 0 {
+		t.Errorf("got %d response edits, want none", len(session.responseEdits))
+	}
+}
+
+// TestThreadReplyRefusedByModeration checks that a flagged thread message is answered with a refusal rather than a
+// completion.
+func TestThreadReplyRefusedByModeration(t *testing.T) {
+	session := newFakeSession()
+	client := &fakeOpenAI{moderation: &openai.ModerationResult{Flagged: true, Categories: []string{"violence"}}}
+	d := newTestDiscord(session, client)
+	d.config.EnableModeration = true
+	zlog := zerolog.Nop()
+	messages := []*discordgo.Message{
+		{ID: "1", ChannelID: "thread", Content: "something bad", Author: &discordgo.User{ID: "human"}},
+	}
+
+	d.respondToConversation(session, "guild", "thread", messages, openai.DefaultChatOptions(), context.Background(), &zlog)
+
+	if len(client.chats) != 0 {
+		t.Errorf("completed %d chats, want none", len(client.chats))
+	}
+	sent := session.sentMessages()
+	if len(sent) != 1 || !strings.Contains(sent[0].Message.Content, "violence") {
+		t.Errorf("sent %+v, want a refusal naming the category", sent)
+	}
+}
+
+func TestCompilePromptBlocklist(t *testing.T) {
+	blocklist, err := CompilePromptBlocklist([]string{"", "  ", "gore"})
+	if err != nil || len(blocklist) != 1 {
+		t.Errorf("CompilePromptBlocklist() = %v, %v, want empty patterns skipped", blocklist, err)
+	}
+	if _, err := CompilePromptBlocklist([]string{"gore", "(unclosed"}); err == nil {
+		t.Error("CompilePromptBlocklist() error = nil, want an error for an invalid pattern")
+	}
+}
+
+func TestBlockedPattern(t *testing.T) {
+	blocklist, err := CompilePromptBlocklist([]string{`\bgore\b`, "^nsfw", "explicit$"})
+	if err != nil {
+		t.Fatalf("CompilePromptBlocklist() error = %v", err)
+	}
+	tests := []struct {
+		name   string
+		prompt string
+		want   string
+	}{
+		{name: "no match", prompt: "a cat in a hat"},
+		{name: "match anywhere", prompt: "a scene full of gore at night", want: `(?i)\bgore\b`},
+		{name: "case-insensitive", prompt: "A GORE scene", want: `(?i)\bgore\b`},
+		{name: "word boundary", prompt: "an Edward Gorey illustration"},
+		{name: "anchored at the start", prompt: "NSFW drawing", want: "(?i)^nsfw"},
+		{name: "start anchor not matched mid-prompt", prompt: "a drawing that is not nsfw"},
+		{name: "anchored at the end", prompt: "a drawing, explicit", want: "(?i)explicit$"},
+		{name: "end anchor not matched mid-prompt", prompt: "explicit instructions for a cake"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := blockedPattern(tt.prompt, blocklist)
+			if tt.want == "" {
+				if got != nil {
+					t.Errorf("blockedPattern(%q) = %v, want no match", tt.prompt, got)
+				}
+				return
+			}
+			if got == nil || got.String() != tt.want {
+				t.Errorf("blockedPattern(%q) = %v, want %s", tt.prompt, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"src/openai"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// systemPromptMarker starts a pinned message whose remaining content is the system prompt for the channel's
+	// threads. Only members who can manage messages can pin, so only moderators can set it.
+	systemPromptMarker = "SYSTEM:"
+
+	// pinCacheTTL is how long a channel's pinned system prompt is reused before the pins are fetched again. Pin
+	// changes are also picked up immediately through ChannelPinsUpdate events.
+	pinCacheTTL = 5 * time.Minute
+)
+
+// pinnedSystemPrompt returns the system prompt in the first of pinned that starts with systemPromptMarker, ignoring
+// case, or false if none does. Discord lists pinned messages newest first, so the most recently pinned prompt wins.
+func pinnedSystemPrompt(pinned []*discordgo.Message) (string, bool) {
+	for _, message := range pinned {
+		content := strings.TrimSpace(message.Content)
+		if len(content) < len(systemPromptMarker) || !strings.EqualFold(content[:len(systemPromptMarker)], systemPromptMarker) {
+			continue
+		}
+		if prompt := strings.TrimSpace(content[len(systemPromptMarker):]); prompt != "" {
+			return prompt, true
+		}
+	}
+	return "", false
+}
+
+type pinCacheEntry struct {
+	prompt  string
+	fetched time.Time
+}
+
+// pinCache holds each channel's pinned system prompt, which is empty if it has none, for pinCacheTTL.
+type pinCache struct {
+	entries    map[ChannelID]pinCacheEntry
+	sync.Mutex // protects entries
+}
+
+func newPinCache() *pinCache {
+	return &pinCache{entries: make(map[ChannelID]pinCacheEntry)}
+}
+
+// get returns the cached system prompt for channelID, or false if there is none or it is older than pinCacheTTL.
+func (c *pinCache) get(channelID ChannelID, now time.Time) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	entry, ok := c.entries[channelID]
+	if !ok || now.Sub(entry.fetched) >= pinCacheTTL {
+		return "", false
+	}
+	return entry.prompt, true
+}
+
+func (c *pinCache) set(channelID ChannelID, prompt string, now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.entries[channelID] = pinCacheEntry{prompt: prompt, fetched: now}
+}
+
+// invalidate drops the cached system prompt for channelID, so that the pins are fetched again on next use.
+func (c *pinCache) invalidate(channelID ChannelID) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.entries, channelID)
+}
+
+// channelSystemPrompt returns the system prompt pinned in channelID, or "" if there is none or the pins could not be
+// fetched.
+func (d *Discord) channelSystemPrompt(s Session, channelID ChannelID, zlog *zerolog.Logger) string {
+	now := time.Now()
+	if prompt, ok := d.pins.get(channelID, now); ok {
+		return prompt
+	}
+
+	var pinned []*discordgo.Message
+	err := withDiscordRetry(func() error {
+		var err error
+		pinned, err = s.ChannelMessagesPinned(string(channelID))
+		return err
+	}, zlog)
+	if err != nil {
+		// Cache the failure too, so that a channel the bot cannot read pins in is not refetched on every message.
+		zlog.Warn().Err(err).Str("channel", string(channelID)).Msg("Failed to get pinned messages")
+		d.pins.set(channelID, "", now)
+		return ""
+	}
+	prompt, _ := pinnedSystemPrompt(pinned)
+	d.pins.set(channelID, prompt, now)
+	return prompt
+}
+
+// withPinnedSystemPrompt returns options with the system prompt pinned in the thread's parent channel as its persona,
+// unless a persona is already set for the thread, channel, or guild.
+func (d *Discord) withPinnedSystemPrompt(
+	s Session,
+	parentChannelID ChannelID,
+	options openai.ChatOptions,
+	zlog *zerolog.Logger,
+) openai.ChatOptions {
+	if options.Persona != "" {
+		return options
+	}
+	if prompt := d.channelSystemPrompt(s, parentChannelID, zlog); prompt != "" {
+		zlog.Debug().Msg("Using system prompt pinned in channel")
+		options.Persona = prompt
+	}
+	return options
+}
+
+// channelPinsUpdateHandler forgets the cached system prompt of a channel when its pins change.
+func (d *Discord) channelPinsUpdateHandler(s *discordgo.Session, p *discordgo.ChannelPinsUpdate) {
+	d.pins.invalidate(ChannelID(p.ChannelID))
+}
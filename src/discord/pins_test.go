@@ -0,0 +1,99 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"src/openai"
+	"testing"
+	"time"
+)
+
+func TestPinnedSystemPrompt(t *testing.T) {
+	pin := func(content string) *discordgo.Message {
+		return &discordgo.Message{Content: content}
+	}
+	tests := []struct {
+		name   string
+		pinned []*discordgo.Message
+		want   string
+		wantOK bool
+	}{
+		{name: "no pins"},
+		{name: "no marker", pinned: []*discordgo.Message{pin("Welcome to the channel!")}},
+		{name: "marker", pinned: []*discordgo.Message{pin("SYSTEM: You are a pirate.")}, want: "You are a pirate.", wantOK: true},
+		{name: "marker in any case", pinned: []*discordgo.Message{pin("  system:\nYou are a pirate.\n")}, want: "You are a pirate.", wantOK: true},
+		{name: "marker not at the start", pinned: []*discordgo.Message{pin("Note the SYSTEM: prompt")}},
+		{name: "marker alone is skipped", pinned: []*discordgo.Message{pin("SYSTEM:"), pin("SYSTEM: Be brief.")}, want: "Be brief.", wantOK: true},
+		{name: "newest pin wins", pinned: []*discordgo.Message{pin("Rules"), pin("SYSTEM: new"), pin("SYSTEM: old")}, want: "new", wantOK: true},
+		{name: "shorter than the marker", pinned: []*discordgo.Message{pin("SYS")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := pinnedSystemPrompt(tt.pinned)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("pinnedSystemPrompt() = %q, %v, want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestPinCache(t *testing.T) {
+	cache := newPinCache()
+	now := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	if _, ok := cache.get("channel", now); ok {
+		t.Error("get() on an empty cache = true, want false")
+	}
+	cache.set("channel", "Be brief.", now)
+	if got, ok := cache.get("channel", now.Add(pinCacheTTL-time.Second)); !ok || got != "Be brief." {
+		t.Errorf("get() within the TTL = %q, %v, want the prompt", got, ok)
+	}
+	if _, ok := cache.get("channel", now.Add(pinCacheTTL)); ok {
+		t.Error("get() after the TTL = true, want false")
+	}
+	cache.invalidate("channel")
+	if _, ok := cache.get("channel", now); ok {
+		t.Error("get() after invalidate() = true, want false")
+	}
+}
+
+func TestWithPinnedSystemPrompt(t *testing.T) {
+	session := newFakeSession()
+	session.pinned = map[string][]*discordgo.Message{"channel": {{Content: "SYSTEM: You are a pirate."}}}
+	d := newTestDiscord(session, nil)
+	zlog := zerolog.Nop()
+
+	got := d.withPinnedSystemPrompt(session, "channel", openai.ChatOptions{}, &zlog)
+	if got.Persona != "You are a pirate." {
+		t.Errorf("withPinnedSystemPrompt() Persona = %q, want the pinned prompt", got.Persona)
+	}
+	got = d.withPinnedSystemPrompt(session, "channel", openai.ChatOptions{Persona: "Be brief."}, &zlog)
+	if got.Persona != "Be brief." {
+		t.Errorf("withPinnedSystemPrompt() Persona = %q, want the configured persona kept", got.Persona)
+	}
+	if session.pinFetches != 1 {
+		t.Errorf("fetched pins %d times, want once and then cached", session.pinFetches)
+	}
+
+	// A pins update refetches them.
+	session.pinned["channel"] = nil
+	d.channelPinsUpdateHandler(nil, &discordgo.ChannelPinsUpdate{ChannelID: "channel"})
+	if got := d.withPinnedSystemPrompt(session, "channel", openai.ChatOptions{}, &zlog); got.Persona != "" {
+		t.Errorf("withPinnedSystemPrompt() after unpinning Persona = %q, want none", got.Persona)
+	}
+}
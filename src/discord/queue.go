@@ -0,0 +1,73 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"sync"
+)
+
+// interactionQueue runs interactions on a fixed number of workers, holding at most a fixed number waiting, so that a
+// burst of interactions does not start an unbounded number of goroutines that all block on OpenAI's rate limit.
+type interactionQueue struct {
+	jobs   chan func()
+	wg     sync.WaitGroup
+	mu     sync.RWMutex // protects closed, and sending to jobs against it being closed
+	closed bool
+}
+
+// newInteractionQueue starts workers workers, with room for capacity jobs waiting for a free worker.
+func newInteractionQueue(workers int, capacity int) *interactionQueue {
+	q := &interactionQueue{jobs: make(chan func(), capacity)}
+	q.wg.Add(workers)
+	for n := 0; n < workers; n++ {
+		go func() {
+			defer q.wg.Done()
+			for job := range q.jobs {
+				job()
+			}
+		}()
+	}
+	return q
+}
+
+// TryEnqueue queues job to run on the next free worker. It returns false, without queueing job, if the queue is full
+// or closed.
+func (q *interactionQueue) TryEnqueue(job func()) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		return false
+	}
+	select {
+	case q.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops accepting jobs and waits for the queued and running jobs to finish.
+func (q *interactionQueue) Close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+	q.wg.Wait()
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInteractionQueueRejectsWhenFull(t *testing.T) {
+	q := newInteractionQueue(1, 2)
+	defer q.Close()
+
+	// Block the only worker, so that further jobs wait in the queue.
+	running := make(chan struct{})
+	unblock := make(chan struct{})
+	if !q.TryEnqueue(func() {
+		close(running)
+		<-unblock
+	}) {
+		t.Fatalf("TryEnqueue() rejected a job with a free worker")
+	}
+	<-running
+
+	var ran int32
+	job := func() { atomic.AddInt32(&ran, 1) }
+	for n := 0; n < 2; n++ {
+		if !q.TryEnqueue(job) {
+			t.Fatalf("TryEnqueue() rejected job %d with room in the queue", n)
+		}
+	}
+	if q.TryEnqueue(job) {
+		t.Errorf("TryEnqueue() accepted a job with the queue full")
+	}
+
+	close(unblock)
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&ran) != 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := atomic.LoadInt32(&ran); got != 2 {
+		t.Fatalf("ran %d queued jobs, want 2", got)
+	}
+	if !q.TryEnqueue(job) {
+		t.Errorf("TryEnqueue() rejected a job after the queue drained")
+	}
+}
+
+func TestInteractionQueueClose(t *testing.T) {
+	q := newInteractionQueue(2, 4)
+
+	var ran int32
+	for n := 0; n < 4; n++ {
+		q.TryEnqueue(func() {
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&ran, 1)
+		})
+	}
+	q.Close()
+
+	if got := atomic.LoadInt32(&ran); got != 4 {
+		t.Errorf("Close() returned after %d of 4 jobs ran, want all", got)
+	}
+	if q.TryEnqueue(func() {}) {
+		t.Errorf("TryEnqueue() accepted a job after Close()")
+	}
+	q.Close()
+}
+
+func TestInteractionQueueLimits(t *testing.T) {
+	defaults := DefaultConfig()
+	workers, capacity := interactionQueueLimits(Config{})
+	if workers != defaults.InteractionWorkers || capacity != defaults.InteractionQueueSize {
+		t.Errorf("interactionQueueLimits(zero) = %d, %d, want the defaults", workers, capacity)
+	}
+	workers, capacity = interactionQueueLimits(Config{InteractionWorkers: 3, InteractionQueueSize: 7})
+	if workers != 3 || capacity != 7 {
+		t.Errorf("interactionQueueLimits() = %d, %d, want 3, 7", workers, capacity)
+	}
+}
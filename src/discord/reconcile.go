@@ -0,0 +1,110 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// diffKeys returns the keys in after but not before, and in before but not after, each in sorted order.
+func diffKeys[K ~string, V any, W any](before map[K]V, after map[K]W) (added []K, removed []K) {
+	for key := range after {
+		if _, ok := before[key]; !ok {
+			added = append(added, key)
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+	sort.Slice(added, func(i, j int) bool { return added[i] < added[j] })
+	sort.Slice(removed, func(i, j int) bool { return removed[i] < removed[j] })
+	return added, removed
+}
+
+// reconcile refetches the tracked channels and threads, so that the bot catches up on any it missed, e.g. threads
+// created while no messages arrived or events Discord dropped, and logs what changed. A failure to fetch some channels
+// or threads still reconciles the rest.
+func (d *Discord) reconcile(ctx context.Context) {
+	channelsBefore := make(map[ChannelID]bool)
+	for _, channelID := range d.idsMap.ChannelIDs() {
+		channelsBefore[channelID] = true
+	}
+	threadsBefore := d.idsMap.Threads()
+
+	if err := d.updateChannels(ctx); err != nil {
+		d.zlog.Error().Err(err).Msg("Failed to reconcile some channels")
+	}
+	if err := d.updateThreads(ctx, d.zlog); err != nil {
+		d.zlog.Error().Err(err).Msg("Failed to reconcile some threads")
+	}
+
+	channelsAfter := make(map[ChannelID]bool)
+	for _, channelID := range d.idsMap.ChannelIDs() {
+		channelsAfter[channelID] = true
+	}
+	addedChannels, removedChannels := diffKeys(channelsBefore, channelsAfter)
+	addedThreads, removedThreads := diffKeys(threadsBefore, d.idsMap.Threads())
+	if len(addedChannels)+len(removedChannels)+len(addedThreads)+len(removedThreads) == 0 {
+		d.zlog.Debug().Msg("Reconciled channels and threads, nothing changed")
+		return
+	}
+	d.zlog.Info().
+		Interface("addedChannels", addedChannels).
+		Interface("removedChannels", removedChannels).
+		Interface("addedThreads", addedThreads).
+		Interface("removedThreads", removedThreads).
+		Msg("Reconciled channels and threads")
+}
+
+// startReconciliation starts a goroutine that reconciles the tracked channels and threads every
+// Config.ReconcileInterval, until stopReconciliation is called, which also cancels a reconciliation in progress. It
+// does nothing if the interval is not positive.
+func (d *Discord) startReconciliation() {
+	if d.config.ReconcileInterval <= 0 {
+		close(d.reconcileDone)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-d.stopReconcile
+		cancel()
+	}()
+	go func() {
+		defer close(d.reconcileDone)
+		ticker := time.NewTicker(d.config.ReconcileInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.reconcile(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// stopReconciliation stops the reconciliation goroutine, cancelling a reconciliation in progress and waiting for it to
+// return.
+func (d *Discord) stopReconciliation() {
+	close(d.stopReconcile)
+	<-d.reconcileDone
+}
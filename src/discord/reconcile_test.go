@@ -0,0 +1,143 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffKeys(t *testing.T) {
+	tests := []struct {
+		name        string
+		before      map[ChannelID]bool
+		after       map[ChannelID]bool
+		wantAdded   []ChannelID
+		wantRemoved []ChannelID
+	}{
+		{name: "both empty"},
+		{name: "unchanged", before: map[ChannelID]bool{"a": true}, after: map[ChannelID]bool{"a": true}},
+		{name: "added in order", after: map[ChannelID]bool{"c": true, "a": true, "b": true}, wantAdded: []ChannelID{"a", "b", "c"}},
+		{name: "removed in order", before: map[ChannelID]bool{"b": true, "a": true}, wantRemoved: []ChannelID{"a", "b"}},
+		{
+			name:        "added and removed",
+			before:      map[ChannelID]bool{"a": true, "b": true},
+			after:       map[ChannelID]bool{"b": true, "c": true},
+			wantAdded:   []ChannelID{"c"},
+			wantRemoved: []ChannelID{"a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			added, removed := diffKeys(tt.before, tt.after)
+			if !reflect.DeepEqual(added, tt.wantAdded) || !reflect.DeepEqual(removed, tt.wantRemoved) {
+				t.Errorf("diffKeys() = %v, %v, want %v, %v", added, removed, tt.wantAdded, tt.wantRemoved)
+			}
+		})
+	}
+}
+
+// reconcileLog is the log entry reconcile writes when the tracked channels or threads changed.
+type reconcileLog struct {
+	Message         string   `json:"message"`
+	AddedChannels   []string `json:"addedChannels"`
+	RemovedChannels []string `json:"removedChannels"`
+	AddedThreads    []string `json:"addedThreads"`
+	RemovedThreads  []string `json:"removedThreads"`
+}
+
+// findReconcileLog returns the reconcile log entry in logs, one JSON entry per line, if any.
+func findReconcileLog(t *testing.T, logs *bytes.Buffer) (reconcileLog, bool) {
+	t.Helper()
+	scanner := bufio.NewScanner(logs)
+	for scanner.Scan() {
+		var entry reconcileLog
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("parsing log entry %q: %v", scanner.Text(), err)
+		}
+		if entry.Message == "Reconciled channels and threads" {
+			return entry, true
+		}
+	}
+	return reconcileLog{}, false
+}
+
+func TestReconcile(t *testing.T) {
+	session := newFakeSession()
+	session.channels["new"] = &discordgo.Channel{ID: "new", GuildID: "guild", Name: "openai-new", Type: discordgo.ChannelTypeGuildText}
+	session.channels["kept"] = &discordgo.Channel{ID: "kept", GuildID: "guild", Name: "openai-kept", Type: discordgo.ChannelTypeGuildText}
+	session.channels["missed-thread"] = &discordgo.Channel{ID: "missed-thread", GuildID: "guild", ParentID: "kept", Type: discordgo.ChannelTypeGuildPublicThread}
+	d := newTestDiscord(session, nil)
+	d.idsMap.SetChannels(map[ChannelID]bool{"kept": true, "deleted": true})
+	d.idsMap.AddThread("deleted-thread", "deleted")
+
+	var logs bytes.Buffer
+	zlog := zerolog.New(&logs)
+	d.zlog = &zlog
+	d.reconcile(context.Background())
+
+	got, ok := findReconcileLog(t, &logs)
+	if !ok {
+		t.Fatalf("reconcile() logged %q, want the changes", logs.String())
+	}
+	want := reconcileLog{
+		Message:         "Reconciled channels and threads",
+		AddedChannels:   []string{"new"},
+		RemovedChannels: []string{"deleted"},
+		AddedThreads:    []string{"missed-thread"},
+		RemovedThreads:  []string{"deleted-thread"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("reconcile() logged %+v, want %+v", got, want)
+	}
+
+	// Reconciling again finds nothing new.
+	logs.Reset()
+	d.reconcile(context.Background())
+	if got, ok := findReconcileLog(t, &logs); ok {
+		t.Errorf("reconcile() with nothing changed logged %+v, want no changes", got)
+	}
+}
+
+func TestStopReconciliation(t *testing.T) {
+	for _, interval := range []time.Duration{0, time.Millisecond} {
+		d := newTestDiscord(newFakeSession(), nil)
+		d.config.ReconcileInterval = interval
+		d.stopReconcile = make(chan struct{})
+		d.reconcileDone = make(chan struct{})
+		d.startReconciliation()
+		time.Sleep(5 * time.Millisecond)
+
+		stopped := make(chan struct{})
+		go func() {
+			d.stopReconciliation()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Fatalf("stopReconciliation() with interval %v did not return", interval)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"errors"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// refreshSession is a Session that serves a fixed set of channels and threads. Methods the refresh does not call are
+// left to the embedded nil Session, and panic if called.
+type refreshSession struct {
+	Session
+	channels []*discordgo.Channel
+	threads  map[string][]*discordgo.Channel
+}
+
+func (s *refreshSession) GuildChannels(guildID string, options ...discordgo.RequestOption) ([]*discordgo.Channel, error) {
+	return s.channels, nil
+}
+
+func (s *refreshSession) ThreadsActive(channelID string, options ...discordgo.RequestOption) (*discordgo.ThreadsList, error) {
+	return &discordgo.ThreadsList{Threads: s.threads[channelID]}, nil
+}
+
+// TestRefreshConcurrentWithLookups refreshes the tracked channels and threads while other goroutines look them up, as
+// the message handler does. Run with -race to check that the IDsMap is never read while it is being replaced.
+func TestRefreshConcurrentWithLookups(t *testing.T) {
+	zlog := zerolog.Nop()
+	session := &refreshSession{
+		channels: []*discordgo.Channel{
+			{ID: "1", Name: "openai-chat"},
+			{ID: "2", Name: "general"},
+		},
+		threads: map[string][]*discordgo.Channel{
+			"1": {{ID: "10"}, {ID: "11"}},
+		},
+	}
+	d := &Discord{
+		session: session,
+		idsMap:  NewIDsMap([]GuildID{"guild"}),
+		config:  DefaultConfig(),
+		zlog:    &zlog,
+	}
+
+	const iterations = 200
+	var wg sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				if err := d.updateChannels(context.Background()); err != nil {
+					t.Errorf("updateChannels() error = %v", err)
+					return
+				}
+				if err := d.updateThreads(context.Background(), &zlog); err != nil {
+					t.Errorf("updateThreads() error = %v", err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				d.lookupChannel("1")
+				d.lookupChannel("10")
+				d.idsMap.ChannelIDs()
+				d.idsMap.Threads()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if snapshot := d.lookupChannel("1"); !snapshot.isChannel {
+		t.Errorf("channel 1 is not tracked")
+	}
+	if snapshot := d.lookupChannel("2"); snapshot.isChannel {
+		t.Errorf("channel 2 is tracked, but does not match the prefix")
+	}
+	for _, threadID := range []string{"10", "11"} {
+		if snapshot := d.lookupChannel(threadID); !snapshot.isThread || snapshot.parentChannelID != "1" {
+			t.Errorf("thread %s snapshot = %+v, want a thread of channel 1", threadID, snapshot)
+		}
+	}
+}
+
+func TestTracksChannel(t *testing.T) {
+	denied := []string{"openai-announcements", "42"}
+	tests := []struct {
+		name    string
+		channel *discordgo.Channel
+		want    bool
+	}{
+		{name: "prefix", channel: &discordgo.Channel{ID: "1", Name: "openai-chat"}, want: true},
+		{name: "no prefix", channel: &discordgo.Channel{ID: "2", Name: "general"}},
+		{name: "denied by name", channel: &discordgo.Channel{ID: "3", Name: "openai-announcements"}},
+		{name: "denied by name in any case", channel: &discordgo.Channel{ID: "3", Name: "OpenAI-Announcements"}},
+		{name: "denied by ID", channel: &discordgo.Channel{ID: "42", Name: "openai-renamed"}},
+		{name: "denied but no prefix", channel: &discordgo.Channel{ID: "42", Name: "general"}},
+		{name: "denied name is not a prefix", channel: &discordgo.Channel{ID: "4", Name: "openai-announcements-chat"}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tracksChannel(tt.channel, "openai", denied); got != tt.want {
+				t.Errorf("tracksChannel(%+v) = %v, want %v", tt.channel, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateChannelsDenied(t *testing.T) {
+	zlog := zerolog.Nop()
+	session := &refreshSession{
+		channels: []*discordgo.Channel{
+			{ID: "1", Name: "openai-chat"},
+			{ID: "2", Name: "openai-announcements"},
+			{ID: "3", Name: "openai-rules"},
+			{ID: "4", Name: "general"},
+		},
+	}
+	d := &Discord{
+		session: session,
+		idsMap:  NewIDsMap([]GuildID{"guild"}),
+		config:  DefaultConfig(),
+		zlog:    &zlog,
+	}
+	d.config.DeniedChannels = []string{"openai-announcements", "3"}
+	// A channel denied after it was tracked is removed.
+	d.idsMap.SetChannels(map[ChannelID]bool{"2": true})
+
+	if err := d.updateChannels(context.Background()); err != nil {
+		t.Fatalf("updateChannels() error = %v", err)
+	}
+	if got := d.idsMap.ChannelIDs(); !reflect.DeepEqual(got, []ChannelID{"1"}) {
+		t.Errorf("ChannelIDs() = %v, want only the undenied channel with the prefix", got)
+	}
+}
+
+// errFlaky is a transient failure for retry tests.
+var errFlaky = errors.New("503 Service Unavailable")
+
+// flakyRefreshSession is a Session that serves channels by guild and threads by channel, and fails to fetch those of
+// the guilds and channels in failures as many times as given, or always if negative. Methods the refresh does not call
+// are left to the embedded nil Session, and panic if called.
+type flakyRefreshSession struct {
+	Session
+	channels map[string][]*discordgo.Channel
+	threads  map[string][]*discordgo.Channel
+	failures map[string]int
+	calls    map[string]int
+}
+
+func (s *flakyRefreshSession) fail(id string) error {
+	if s.calls == nil {
+		s.calls = make(map[string]int)
+	}
+	s.calls[id]++
+	if remaining := s.failures[id]; remaining != 0 {
+		s.failures[id] = remaining - 1
+		return errFlaky
+	}
+	return nil
+}
+
+func (s *flakyRefreshSession) GuildChannels(guildID string, options ...discordgo.RequestOption) ([]*discordgo.Channel, error) {
+	if err := s.fail(guildID); err != nil {
+		return nil, err
+	}
+	return s.channels[guildID], nil
+}
+
+func (s *flakyRefreshSession) ThreadsActive(channelID string, options ...discordgo.RequestOption) (*discordgo.ThreadsList, error) {
+	if err := s.fail(channelID); err != nil {
+		return nil, err
+	}
+	return &discordgo.ThreadsList{Threads: s.threads[channelID]}, nil
+}
+
+func newFlakyRefreshDiscord(session *flakyRefreshSession) *Discord {
+	zlog := zerolog.Nop()
+	return &Discord{
+		session: session,
+		idsMap:  NewIDsMap([]GuildID{"guild-1", "guild-2"}),
+		config:  DefaultConfig(),
+		zlog:    &zlog,
+	}
+}
+
+func TestWithBackoffRetry(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name      string
+		ctx       context.Context
+		failures  int
+		attempts  int
+		wantErr   error
+		wantCalls int
+	}{
+		{name: "success", ctx: context.Background(), attempts: 3, wantCalls: 1},
+		{name: "fails then succeeds", ctx: context.Background(), failures: 1, attempts: 3, wantCalls: 2},
+		{name: "gives up after the attempts", ctx: context.Background(), failures: 1, attempts: 1, wantErr: errFlaky, wantCalls: 1},
+		{name: "cancelled while waiting", ctx: cancelled, failures: 1, attempts: 3, wantErr: context.Canceled, wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			zlog := zerolog.Nop()
+			calls := 0
+			err := withBackoffRetry(tt.ctx, func() error {
+				calls++
+				if calls <= tt.failures {
+					return errFlaky
+				}
+				return nil
+			}, tt.attempts, &zlog)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("withBackoffRetry() error = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("withBackoffRetry() made %d calls, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestUpdateChannelsRetries(t *testing.T) {
+	session := &flakyRefreshSession{
+		channels: map[string][]*discordgo.Channel{
+			"guild-1": {{ID: "1", Name: "openai-chat"}},
+			"guild-2": {{ID: "2", Name: "openai-help"}},
+		},
+		failures: map[string]int{"guild-2": 1},
+	}
+	d := newFlakyRefreshDiscord(session)
+
+	if err := d.updateChannels(context.Background()); err != nil {
+		t.Fatalf("updateChannels() error = %v, want the failure retried", err)
+	}
+	if session.calls["guild-2"] != 2 {
+		t.Errorf("fetched guild-2 %d times, want 2", session.calls["guild-2"])
+	}
+	if got := d.idsMap.ChannelIDs(); !reflect.DeepEqual(got, []ChannelID{"1", "2"}) {
+		t.Errorf("ChannelIDs() = %v, want both guilds' channels", got)
+	}
+}
+
+// TestUpdateChannelsPartialProgress fails to fetch one guild's channels: the other guild's are still updated, and the
+// failing guild's previously tracked channels are kept. A cancelled context stops the retries right away.
+func TestUpdateChannelsPartialProgress(t *testing.T) {
+	session := &flakyRefreshSession{
+		channels: map[string][]*discordgo.Channel{
+			"guild-1": {{ID: "1", Name: "openai-chat"}, {ID: "3", Name: "openai-new"}},
+		},
+		failures: map[string]int{"guild-2": -1},
+	}
+	d := newFlakyRefreshDiscord(session)
+	// Channel 4 was in guild-1, and has since been deleted. Channel 2 is in guild-2.
+	d.idsMap.SetChannels(map[ChannelID]bool{"1": true, "2": true, "4": true})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := d.updateChannels(ctx); err == nil {
+		t.Error("updateChannels() error = nil, want guild-2's failure")
+	}
+	// Channel 4 is kept too, since the failed guild may still have it.
+	if got := d.idsMap.ChannelIDs(); !reflect.DeepEqual(got, []ChannelID{"1", "2", "3", "4"}) {
+		t.Errorf("ChannelIDs() = %v, want guild-1's fetched channels and the unaccounted ones kept", got)
+	}
+
+	// Once guild-2 can be fetched again, the deleted channel is dropped.
+	session.failures["guild-2"] = 0
+	session.channels["guild-2"] = []*discordgo.Channel{{ID: "2", Name: "openai-help"}}
+	if err := d.updateChannels(context.Background()); err != nil {
+		t.Fatalf("updateChannels() error = %v", err)
+	}
+	if got := d.idsMap.ChannelIDs(); !reflect.DeepEqual(got, []ChannelID{"1", "2", "3"}) {
+		t.Errorf("ChannelIDs() = %v, want the deleted channel dropped", got)
+	}
+}
+
+func TestUpdateThreadsPartialProgress(t *testing.T) {
+	session := &flakyRefreshSession{
+		threads: map[string][]*discordgo.Channel{
+			"1": {{ID: "10"}, {ID: "12"}},
+		},
+		failures: map[string]int{"2": -1},
+	}
+	d := newFlakyRefreshDiscord(session)
+	d.idsMap.SetChannels(map[ChannelID]bool{"1": true, "2": true})
+	d.idsMap.SetThreads(map[ThreadID]ChannelID{"10": "1", "11": "1", "20": "2"})
+	zlog := zerolog.Nop()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := d.updateThreads(ctx, &zlog); err == nil {
+		t.Error("updateThreads() error = nil, want channel 2's failure")
+	}
+	want := map[ThreadID]ChannelID{"10": "1", "12": "1", "20": "2"}
+	if got := d.idsMap.Threads(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Threads() = %v, want %v", got, want)
+	}
+}
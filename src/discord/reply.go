@@ -0,0 +1,72 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"bytes"
+	"errors"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"net/http"
+)
+
+// replyReference returns the reference that makes a message a reply to message, shown in Discord as a quote of it.
+func replyReference(message *discordgo.Message) *discordgo.MessageReference {
+	return &discordgo.MessageReference{
+		MessageID: message.ID,
+		ChannelID: message.ChannelID,
+		GuildID:   message.GuildID,
+	}
+}
+
+// isAlreadyAcknowledgedError returns whether err is Discord rejecting a response to an interaction that has already
+// been responded to, e.g. by another instance of the bot.
+func isAlreadyAcknowledgedError(err error) bool {
+	var restErr *discordgo.RESTError
+	return errors.As(err, &restErr) &&
+		restErr.Message != nil &&
+		restErr.Message.Code == discordgo.ErrCodeInteractionHasAlreadyBeenAcknowledged
+}
+
+// isUnknownReferenceError returns whether err is Discord rejecting a reply because the message it references no
+// longer exists, e.g. because its author deleted it while the bot was generating the reply.
+func isUnknownReferenceError(err error) bool {
+	var restErr *discordgo.RESTError
+	if !errors.As(err, &restErr) {
+		return false
+	}
+	if restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeUnknownMessage {
+		return true
+	}
+	return restErr.Response != nil &&
+		restErr.Response.StatusCode == http.StatusBadRequest &&
+		bytes.Contains(restErr.ResponseBody, []byte("message_reference"))
+}
+
+// sendReply sends messageSend to channelID. If it is a reply to a message that has since been deleted, it is sent as a
+// plain message instead.
+func sendReply(s Session, channelID string, messageSend *discordgo.MessageSend, zlog *zerolog.Logger) error {
+	_, err := s.ChannelMessageSendComplex(channelID, messageSend)
+	if err == nil || messageSend.Reference == nil || !isUnknownReferenceError(err) {
+		return err
+	}
+
+	zlog.Info().Str("reference", messageSend.Reference.MessageID).Msg("Replied-to message is gone, sending without reply")
+	messageSend.Reference = nil
+	_, err = s.ChannelMessageSendComplex(channelID, messageSend)
+	return err
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"errors"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestReplyReference(t *testing.T) {
+	message := &discordgo.Message{ID: "message", ChannelID: "thread", GuildID: "guild", Content: "Who made Go?"}
+	want := &discordgo.MessageReference{MessageID: "message", ChannelID: "thread", GuildID: "guild"}
+	if got := replyReference(message); !reflect.DeepEqual(got, want) {
+		t.Errorf("replyReference() = %+v, want %+v", got, want)
+	}
+}
+
+// unknownMessageError returns the error Discord returns when a message does not exist.
+func unknownMessageError() error {
+	return &discordgo.RESTError{
+		Response: &http.Response{StatusCode: http.StatusNotFound},
+		Message:  &discordgo.APIErrorMessage{Code: discordgo.ErrCodeUnknownMessage},
+	}
+}
+
+func TestIsUnknownReferenceError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "unknown message", err: unknownMessageError(), want: true},
+		{
+			name: "invalid message reference",
+			err: &discordgo.RESTError{
+				Response:     &http.Response{StatusCode: http.StatusBadRequest},
+				ResponseBody: []byte(`{"errors": {"message_reference": {"_errors": [{"code": "REPLIES_UNKNOWN_MESSAGE"}]}}}`),
+			},
+			want: true,
+		},
+		{
+			name: "other bad request",
+			err:  &discordgo.RESTError{Response: &http.Response{StatusCode: http.StatusBadRequest}, ResponseBody: []byte(`{"content": "too long"}`)},
+		},
+		{name: "other error", err: errors.New("connection reset")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isUnknownReferenceError(tt.err); got != tt.want {
+				t.Errorf("isUnknownReferenceError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// deletedReferenceSession is a fakeSession on which replies fail because the replied-to message has been deleted.
+type deletedReferenceSession struct {
+	*fakeSession
+	rejected int
+}
+
+func (s *deletedReferenceSession) ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	if data.Reference != nil {
+		s.rejected++
+		return nil, unknownMessageError()
+	}
+	return s.fakeSession.ChannelMessageSendComplex(channelID, data, options...)
+}
+
+func TestSendReply(t *testing.T) {
+	zlog := zerolog.Nop()
+	reference := &discordgo.MessageReference{MessageID: "message", ChannelID: "thread"}
+
+	session := newFakeSession()
+	if err := sendReply(session, "thread", &discordgo.MessageSend{Content: "Google", Reference: reference}, &zlog); err != nil {
+		t.Fatalf("sendReply() error = %v", err)
+	}
+	if sent := session.sentMessages(); len(sent) != 1 || sent[0].Message.Reference != reference {
+		t.Errorf("sent %+v, want a reply to the message", sent)
+	}
+
+	deleted := &deletedReferenceSession{fakeSession: newFakeSession()}
+	if err := sendReply(deleted, "thread", &discordgo.MessageSend{Content: "Google", Reference: reference}, &zlog); err != nil {
+		t.Fatalf("sendReply() error = %v, want the reply sent without the reference", err)
+	}
+	sent := deleted.sentMessages()
+	if deleted.rejected != 1 || len(sent) != 1 || sent[0].Message.Reference != nil || sent[0].Message.Content != "Google" {
+		t.Errorf("sent %+v after %d rejected replies, want a plain message", sent, deleted.rejected)
+	}
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"errors"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// discordRetryAttempts is the total number of attempts made for a Discord API call that is rate limited.
+	discordRetryAttempts = 3
+
+	// defaultRetryAfter is used when a rate-limited response doesn't say how long to wait.
+	defaultRetryAfter = 1 * time.Second
+
+	// maxRetryAfter caps how long we wait before retrying, so that a handler is never stuck for long.
+	maxRetryAfter = 10 * time.Second
+)
+
+// withDiscordRetry calls op, retrying up to discordRetryAttempts times in total if Discord responds that the call was
+// rate limited. Any other error is returned immediately.
+func withDiscordRetry(op func() error, zlog *zerolog.Logger) error {
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil {
+			return nil
+		}
+
+		retryAfter, rateLimited := rateLimitRetryAfter(err)
+		if !rateLimited || attempt >= discordRetryAttempts {
+			return err
+		}
+		if retryAfter > maxRetryAfter {
+			retryAfter = maxRetryAfter
+		}
+		zlog.Warn().Err(err).Int("attempt", attempt).Dur("retryAfter", retryAfter).Msg("Rate limited by Discord, retrying")
+		time.Sleep(retryAfter)
+	}
+}
+
+// sendRetryBackoff is how long to wait before retrying a failed send, multiplied by the number of attempts so far.
+const sendRetryBackoff = 500 * time.Millisecond
+
+// withSendRetry calls op up to attempts times in total, retrying after any error, not just rate limits, since a reply
+// that fails to send would otherwise be lost. Rate limits are additionally retried as in withDiscordRetry.
+func withSendRetry(op func() error, attempts int, zlog *zerolog.Logger) error {
+	for attempt := 1; ; attempt++ {
+		err := withDiscordRetry(op, zlog)
+		if err == nil || attempt >= attempts {
+			return err
+		}
+		backoff := time.Duration(attempt) * sendRetryBackoff
+		zlog.Warn().Err(err).Int("attempt", attempt).Dur("backoff", backoff).Msg("Failed to send, retrying")
+		time.Sleep(backoff)
+	}
+}
+
+const (
+	// refreshRetryAttempts is the total number of attempts made to fetch channels or threads while refreshing them.
+	refreshRetryAttempts = 4
+
+	// refreshRetryBackoff is how long to wait before the first retry of a refresh, doubling after each attempt.
+	refreshRetryBackoff = 500 * time.Millisecond
+)
+
+// withBackoffRetry calls op up to attempts times in total, retrying after any error with a backoff that starts at
+// refreshRetryBackoff and doubles after each attempt, capped at maxRetryAfter. Rate limits are additionally retried as
+// in withDiscordRetry. It gives up early, returning the context's error, if ctx is done while waiting.
+func withBackoffRetry(ctx context.Context, op func() error, attempts int, zlog *zerolog.Logger) error {
+	backoff := refreshRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := withDiscordRetry(op, zlog)
+		if err == nil || attempt >= attempts {
+			return err
+		}
+		zlog.Warn().Err(err).Int("attempt", attempt).Dur("backoff", backoff).Msg("Discord call failed, retrying")
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+		if backoff > maxRetryAfter {
+			backoff = maxRetryAfter
+		}
+	}
+}
+
+// rateLimitRetryAfter returns how long to wait before retrying if err is a Discord rate limit error.
+func rateLimitRetryAfter(err error) (time.Duration, bool) {
+	var rateLimitErr *discordgo.RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		if rateLimitErr.RateLimit != nil && rateLimitErr.TooManyRequests != nil && rateLimitErr.RetryAfter > 0 {
+			return rateLimitErr.RetryAfter, true
+		}
+		return defaultRetryAfter, true
+	}
+
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) && restErr.Response != nil && restErr.Response.StatusCode == http.StatusTooManyRequests {
+		if seconds, err := strconv.ParseFloat(restErr.Response.Header.Get("Retry-After"), 64); err == nil && seconds > 0 {
+			return time.Duration(seconds * float64(time.Second)), true
+		}
+		return defaultRetryAfter, true
+	}
+
+	return 0, false
+}
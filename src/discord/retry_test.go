@@ -0,0 +1,213 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"net/http"
+	"reflect"
+	"src/aws"
+	"src/openai"
+	"testing"
+	"time"
+)
+
+// rateLimitError returns the error discordgo returns when a call is rate limited for retryAfter.
+func rateLimitError(retryAfter time.Duration) error {
+	return &discordgo.RateLimitError{RateLimit: &discordgo.RateLimit{
+		TooManyRequests: &discordgo.TooManyRequests{RetryAfter: retryAfter},
+		URL:             "https://discord.com/api/v9/channels",
+	}}
+}
+
+func TestRateLimitRetryAfter(t *testing.T) {
+	tooManyRequests := func(retryAfter string) error {
+		response := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}}
+		if retryAfter != "" {
+			response.Header.Set("Retry-After", retryAfter)
+		}
+		return &discordgo.RESTError{Response: response}
+	}
+	tests := []struct {
+		name            string
+		err             error
+		wantRetryAfter  time.Duration
+		wantRateLimited bool
+	}{
+		{name: "rate limit error", err: rateLimitError(2 * time.Second), wantRetryAfter: 2 * time.Second, wantRateLimited: true},
+		{name: "rate limit error without retry after", err: rateLimitError(0), wantRetryAfter: defaultRetryAfter, wantRateLimited: true},
+		{name: "wrapped rate limit error", err: fmt.Errorf("sending: %w", rateLimitError(time.Second)), wantRetryAfter: time.Second, wantRateLimited: true},
+		{name: "429 with Retry-After", err: tooManyRequests("1.5"), wantRetryAfter: 1500 * time.Millisecond, wantRateLimited: true},
+		{name: "429 without Retry-After", err: tooManyRequests(""), wantRetryAfter: defaultRetryAfter, wantRateLimited: true},
+		{name: "other REST error", err: &discordgo.RESTError{Response: &http.Response{StatusCode: http.StatusForbidden}}},
+		{name: "other error", err: errors.New("connection reset")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retryAfter, rateLimited := rateLimitRetryAfter(tt.err)
+			if retryAfter != tt.wantRetryAfter || rateLimited != tt.wantRateLimited {
+				t.Errorf("rateLimitRetryAfter() = %v, %v, want %v, %v", retryAfter, rateLimited, tt.wantRetryAfter, tt.wantRateLimited)
+			}
+		})
+	}
+}
+
+func TestWithDiscordRetry(t *testing.T) {
+	otherErr := errors.New("forbidden")
+	tests := []struct {
+		name      string
+		errs      []error // returned by successive calls, after which calls succeed
+		wantErr   bool
+		wantCalls int
+	}{
+		{name: "success", wantCalls: 1},
+		{name: "rate limited then success", errs: []error{rateLimitError(time.Millisecond)}, wantCalls: 2},
+		{name: "other error is not retried", errs: []error{otherErr}, wantErr: true, wantCalls: 1},
+		{
+			name:      "gives up after the attempts",
+			errs:      []error{rateLimitError(time.Millisecond), rateLimitError(time.Millisecond), rateLimitError(time.Millisecond), nil},
+			wantErr:   true,
+			wantCalls: discordRetryAttempts,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			zlog := zerolog.Nop()
+			calls := 0
+			err := withDiscordRetry(func() error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			}, &zlog)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("withDiscordRetry() error = %v, want error %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("withDiscordRetry() made %d calls, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+// rateLimitedSession is a fakeSession whose first reaction is rate limited.
+type rateLimitedSession struct {
+	*fakeSession
+	limited bool
+}
+
+func (s *rateLimitedSession) MessageReactionAdd(channelID, messageID, emojiID string, options ...discordgo.RequestOption) error {
+	if !s.limited {
+		s.limited = true
+		return rateLimitError(time.Millisecond)
+	}
+	return s.fakeSession.MessageReactionAdd(channelID, messageID, emojiID, options...)
+}
+
+// TestReactionRetriedWhenRateLimited checks that a rate-limited reaction is added once the rate limit has passed.
+func TestReactionRetriedWhenRateLimited(t *testing.T) {
+	session := &rateLimitedSession{fakeSession: newFakeSession()}
+	d := newTestDiscord(session, nil)
+	zlog := zerolog.Nop()
+
+	d.setReactionState(session, "channel", "message", "🤖", "✅", &zlog)
+
+	want := []reaction{{MessageID: "message", Emoji: "🤖", Added: false}, {MessageID: "message", Emoji: "✅", Added: true}}
+	if got := session.reactionLog(); !reflect.DeepEqual(got, want) {
+		t.Errorf("reactions = %+v, want %+v", got, want)
+	}
+}
+
+func TestWithSendRetry(t *testing.T) {
+	sendErr := errors.New("connection reset")
+	tests := []struct {
+		name      string
+		attempts  int
+		failures  int // calls that fail before calls succeed
+		wantErr   bool
+		wantCalls int
+	}{
+		{name: "success", attempts: 3, wantCalls: 1},
+		{name: "failure then success", attempts: 3, failures: 1, wantCalls: 2},
+		{name: "gives up after the attempts", attempts: 2, failures: 5, wantErr: true, wantCalls: 2},
+		{name: "single attempt", attempts: 1, failures: 1, wantErr: true, wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			zlog := zerolog.Nop()
+			calls := 0
+			err := withSendRetry(func() error {
+				calls++
+				if calls <= tt.failures {
+					return sendErr
+				}
+				return nil
+			}, tt.attempts, &zlog)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("withSendRetry() error = %v, want error %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("withSendRetry() made %d calls, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+// recordingTranscriptWriter sends each transcript it is asked to write on written.
+type recordingTranscriptWriter struct {
+	written chan aws.Transcript
+}
+
+func (w *recordingTranscriptWriter) Write(ctx context.Context, transcript aws.Transcript) error {
+	w.written <- transcript
+	return nil
+}
+
+// TestUndeliveredReplyIsDeadLettered checks that a reply that still fails to send after the retries is recorded as an
+// undelivered transcript, so the generated response is not lost.
+func TestUndeliveredReplyIsDeadLettered(t *testing.T) {
+	session := newFakeSession()
+	session.sendErr = errors.New("connection reset")
+	session.messages["thread"] = []*discordgo.Message{
+		{ID: "1", ChannelID: "thread", Content: "Who made Go?", Author: &discordgo.User{ID: "human"}},
+	}
+	client := &fakeOpenAI{completion: &openai.Completion{Text: "Google"}}
+	d := newTestDiscord(session, client)
+	d.config.SendRetryAttempts = 1
+	transcripts := &recordingTranscriptWriter{written: make(chan aws.Transcript, 1)}
+	d.transcripts = transcripts
+	zlog := zerolog.Nop()
+
+	d.respondToConversation(session, "guild", "thread", session.messages["thread"], openai.DefaultChatOptions(), context.Background(), &zlog)
+
+	select {
+	case transcript := <-transcripts.written:
+		if !transcript.Undelivered || transcript.Response != "Google" || transcript.ThreadID != "thread" {
+			t.Errorf("transcript = %+v, want the undelivered reply", transcript)
+		}
+		if len(transcript.Messages) != 1 || transcript.Messages[0].Text != "Who made Go?" {
+			t.Errorf("transcript messages = %+v, want the conversation", transcript.Messages)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no transcript written for the undelivered reply")
+	}
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"src/openai"
+	"sync"
+)
+
+const (
+	settingsScopeThread  = "thread"
+	settingsScopeChannel = "channel"
+	settingsScopeGuild   = "guild"
+)
+
+// Settings are the per-scope overrides for chat completions. A nil field means the setting is not configured at this
+// scope and is inherited from the next scope in the resolution chain.
+type Settings struct {
+	Model       *string
+	Temperature *float32
+	Persona     *string
+	Seed        *int
+	Language    *string
+}
+
+// merge returns s with any unset fields filled in from fallback.
+func (s Settings) merge(fallback Settings) Settings {
+	if s.Model == nil {
+		s.Model = fallback.Model
+	}
+	if s.Temperature == nil {
+		s.Temperature = fallback.Temperature
+	}
+	if s.Persona == nil {
+		s.Persona = fallback.Persona
+	}
+	if s.Seed == nil {
+		s.Seed = fallback.Seed
+	}
+	if s.Language == nil {
+		s.Language = fallback.Language
+	}
+	return s
+}
+
+// SettingsStore stores settings keyed by thread, channel, and guild. Settings are resolved by checking the thread, then
+// its parent channel, then the guild, and finally the global defaults, so new threads inherit the settings of the
+// channel they were created in.
+//
+// Settings are held in memory only: they are lost on restart, and are local to this instance. Every instance receives
+// every event and the lock decides which one responds, so when several instances run, a change made through one of
+// them only applies to the conversations that instance happens to handle. Run a single instance to rely on settings.
+type SettingsStore struct {
+	global       openai.ChatOptions
+	guilds       map[GuildID]Settings
+	channels     map[ChannelID]Settings
+	threads      map[ThreadID]Settings
+	sync.RWMutex // protects guilds, channels, and threads
+}
+
+func NewSettingsStore(global openai.ChatOptions) *SettingsStore {
+	return &SettingsStore{
+		global:   global,
+		guilds:   make(map[GuildID]Settings),
+		channels: make(map[ChannelID]Settings),
+		threads:  make(map[ThreadID]Settings),
+	}
+}
+
+// SetGuildSettings merges settings into the existing settings for the guild.
+func (s *SettingsStore) SetGuildSettings(guildID GuildID, settings Settings) {
+	s.Lock()
+	defer s.Unlock()
+	s.guilds[guildID] = settings.merge(s.guilds[guildID])
+}
+
+// SetChannelSettings merges settings into the existing settings for the channel.
+func (s *SettingsStore) SetChannelSettings(channelID ChannelID, settings Settings) {
+	s.Lock()
+	defer s.Unlock()
+	s.channels[channelID] = settings.merge(s.channels[channelID])
+}
+
+// SetThreadSettings merges settings into the existing settings for the thread.
+func (s *SettingsStore) SetThreadSettings(threadID ThreadID, settings Settings) {
+	s.Lock()
+	defer s.Unlock()
+	s.threads[threadID] = settings.merge(s.threads[threadID])
+}
+
+// Resolve returns the effective chat options for a thread in a channel in a guild. threadID may be empty if the
+// conversation is not in a thread.
+func (s *SettingsStore) Resolve(guildID GuildID, channelID ChannelID, threadID ThreadID) openai.ChatOptions {
+	s.RLock()
+	defer s.RUnlock()
+
+	var resolved Settings
+	if threadID != "" {
+		resolved = resolved.merge(s.threads[threadID])
+	}
+	resolved = resolved.merge(s.channels[channelID])
+	resolved = resolved.merge(s.guilds[guildID])
+
+	options := s.global
+	if resolved.Model != nil {
+		options.Model = *resolved.Model
+	}
+	if resolved.Temperature != nil {
+		options.Temperature = *resolved.Temperature
+	}
+	if resolved.Persona != nil {
+		options.Persona = *resolved.Persona
+	}
+	if resolved.Seed != nil {
+		options.Seed = resolved.Seed
+	}
+	if resolved.Language != nil {
+		options.Language = *resolved.Language
+	}
+	return options
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"src/openai"
+	"testing"
+)
+
+func TestSettingsStoreResolve(t *testing.T) {
+	global := openai.ChatOptions{Model: "gpt-3.5-turbo", Temperature: 1, Persona: "global"}
+	store := NewSettingsStore(global)
+	store.SetGuildSettings("guild", Settings{Model: Ptr("gpt-4"), Persona: Ptr("guild")})
+	store.SetChannelSettings("channel", Settings{Temperature: Ptr(float32(0.5)), Persona: Ptr("channel")})
+	store.SetThreadSettings("thread", Settings{Persona: Ptr("thread")})
+	// Settings are merged, so a later change at the same scope keeps the fields it does not set.
+	store.SetChannelSettings("channel", Settings{Language: Ptr("French")})
+
+	tests := []struct {
+		name      string
+		guildID   GuildID
+		channelID ChannelID
+		threadID  ThreadID
+		want      openai.ChatOptions
+	}{
+		{
+			name:      "thread overrides channel, guild, and global",
+			guildID:   "guild",
+			channelID: "channel",
+			threadID:  "thread",
+			want:      openai.ChatOptions{Model: "gpt-4", Temperature: 0.5, Persona: "thread", Language: "French"},
+		},
+		{
+			name:      "new thread inherits its channel",
+			guildID:   "guild",
+			channelID: "channel",
+			threadID:  "new-thread",
+			want:      openai.ChatOptions{Model: "gpt-4", Temperature: 0.5, Persona: "channel", Language: "French"},
+		},
+		{
+			name:      "not in a thread",
+			guildID:   "guild",
+			channelID: "channel",
+			want:      openai.ChatOptions{Model: "gpt-4", Temperature: 0.5, Persona: "channel", Language: "French"},
+		},
+		{
+			name:      "unconfigured channel inherits the guild",
+			guildID:   "guild",
+			channelID: "other-channel",
+			want:      openai.ChatOptions{Model: "gpt-4", Temperature: 1, Persona: "guild"},
+		},
+		{
+			name:      "unconfigured guild falls back to global",
+			guildID:   "other-guild",
+			channelID: "other-channel",
+			threadID:  "other-thread",
+			want:      global,
+		},
+		{
+			name:      "thread settings apply wherever the thread is",
+			guildID:   "other-guild",
+			channelID: "other-channel",
+			threadID:  "thread",
+			want:      openai.ChatOptions{Model: "gpt-3.5-turbo", Temperature: 1, Persona: "thread"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := store.Resolve(tt.guildID, tt.channelID, tt.threadID)
+			if got.Model != tt.want.Model || got.Temperature != tt.want.Temperature ||
+				got.Persona != tt.want.Persona || got.Language != tt.want.Language {
+				t.Errorf("Resolve() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSettingsStoreResolveSeed(t *testing.T) {
+	store := NewSettingsStore(openai.ChatOptions{})
+	if got := store.Resolve("guild", "channel", ""); got.Seed != nil {
+		t.Errorf("Resolve() Seed = %v, want nil", *got.Seed)
+	}
+	store.SetGuildSettings("guild", Settings{Seed: Ptr(1)})
+	store.SetChannelSettings("channel", Settings{Seed: Ptr(2)})
+	if got := store.Resolve("guild", "channel", ""); got.Seed == nil || *got.Seed != 2 {
+		t.Errorf("Resolve() Seed = %v, want 2 from the channel", got.Seed)
+	}
+}
+
+func TestSettingsStoreResolveLanguage(t *testing.T) {
+	store := NewSettingsStore(openai.ChatOptions{Language: openai.LanguageMatchUser})
+	if got := store.Resolve("guild", "channel", ""); got.Language != openai.LanguageMatchUser {
+		t.Errorf("Resolve() Language = %q, want the default %q", got.Language, openai.LanguageMatchUser)
+	}
+	store.SetGuildSettings("guild", Settings{Language: Ptr("French")})
+	if got := store.Resolve("guild", "channel", ""); got.Language != "French" {
+		t.Errorf("Resolve() Language = %q, want French from the guild", got.Language)
+	}
+	// An empty language, set with "none", overrides the guild's.
+	store.SetChannelSettings("channel", Settings{Language: Ptr("")})
+	if got := store.Resolve("guild", "channel", ""); got.Language != "" {
+		t.Errorf("Resolve() Language = %q, want none from the channel", got.Language)
+	}
+}
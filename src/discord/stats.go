@@ -0,0 +1,169 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"sort"
+	"src/openai"
+	"strings"
+	"sync"
+)
+
+// ModelPrice is what OpenAI charges for a model, in US dollars per thousand tokens.
+type ModelPrice struct {
+	PromptPer1K     float64
+	CompletionPer1K float64
+}
+
+// DefaultModelPrices returns OpenAI's list prices for the chat models the bot uses by default.
+func DefaultModelPrices() map[string]ModelPrice {
+	return map[string]ModelPrice{
+		"gpt-4":              {PromptPer1K: 0.03, CompletionPer1K: 0.06},
+		"gpt-4-32k":          {PromptPer1K: 0.06, CompletionPer1K: 0.12},
+		"gpt-4-1106-preview": {PromptPer1K: 0.01, CompletionPer1K: 0.03},
+		"gpt-3.5-turbo":      {PromptPer1K: 0.001, CompletionPer1K: 0.002},
+		"text-davinci-003":   {PromptPer1K: 0.02, CompletionPer1K: 0.02},
+	}
+}
+
+// ModelUsage is the usage of one model, summed over requests.
+type ModelUsage struct {
+	Requests         int
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// UsageTracker sums the tokens used by completions in each guild, by model, since the bot started.
+type UsageTracker struct {
+	usage      map[GuildID]map[string]ModelUsage
+	sync.Mutex // protects usage
+}
+
+func NewUsageTracker() *UsageTracker {
+	return &UsageTracker{usage: make(map[GuildID]map[string]ModelUsage)}
+}
+
+// Record adds the usage of completion to guildID. Completions outside a guild, e.g. in direct messages, and failed
+// completions, which are nil, are not recorded.
+func (t *UsageTracker) Record(guildID GuildID, completion *openai.Completion) {
+	if guildID == "" || completion == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+
+	models, ok := t.usage[guildID]
+	if !ok {
+		models = make(map[string]ModelUsage)
+		t.usage[guildID] = models
+	}
+	usage := models[completion.Model]
+	usage.Requests++
+	usage.PromptTokens += completion.Usage.PromptTokens
+	usage.CompletionTokens += completion.Usage.CompletionTokens
+	models[completion.Model] = usage
+}
+
+// Usage returns a copy of the usage in guildID, by model.
+func (t *UsageTracker) Usage(guildID GuildID) map[string]ModelUsage {
+	t.Lock()
+	defer t.Unlock()
+
+	models := make(map[string]ModelUsage, len(t.usage[guildID]))
+	for model, usage := range t.usage[guildID] {
+		models[model] = usage
+	}
+	return models
+}
+
+// modelPrice returns the price of model in prices. OpenAI reports the dated snapshot that served a request, e.g.
+// gpt-4-0613, so if model has no price of its own, the price of the longest model name it starts with is used.
+func modelPrice(model string, prices map[string]ModelPrice) (ModelPrice, bool) {
+	if price, ok := prices[model]; ok {
+		return price, true
+	}
+	var best string
+	for name := range prices {
+		if strings.HasPrefix(model, name+"-") && len(name) > len(best) {
+			best = name
+		}
+	}
+	if best == "" {
+		return ModelPrice{}, false
+	}
+	return prices[best], true
+}
+
+// estimateCost returns the cost in US dollars of usage of model, or false if prices has no price for model.
+func estimateCost(model string, usage ModelUsage, prices map[string]ModelPrice) (float64, bool) {
+	price, ok := modelPrice(model, prices)
+	if !ok {
+		return 0, false
+	}
+	return float64(usage.PromptTokens)/1000*price.PromptPer1K + float64(usage.CompletionTokens)/1000*price.CompletionPer1K, true
+}
+
+// formatStats describes the usage of each model in models, and the total estimated cost, in order of model name.
+func formatStats(models map[string]ModelUsage, prices map[string]ModelPrice) string {
+	if len(models) == 0 {
+		return "No OpenAI usage has been recorded in this server since the bot started."
+	}
+	names := make([]string, 0, len(models))
+	for model := range models {
+		names = append(names, model)
+	}
+	sort.Strings(names)
+
+	var builder strings.Builder
+	builder.WriteString("OpenAI usage in this server since the bot started:")
+	var total float64
+	unpriced := false
+	for _, model := range names {
+		usage := models[model]
+		fmt.Fprintf(&builder, "\n%s: %d requests, %d prompt tokens, %d completion tokens",
+			model, usage.Requests, usage.PromptTokens, usage.CompletionTokens)
+		if cost, ok := estimateCost(model, usage, prices); ok {
+			fmt.Fprintf(&builder, ", ~$%.2f", cost)
+			total += cost
+		} else {
+			builder.WriteString(", cost unknown")
+			unpriced = true
+		}
+	}
+	fmt.Fprintf(&builder, "\nEstimated cost: ~$%.2f", total)
+	if unpriced {
+		builder.WriteString(" (excluding models without a configured price)")
+	}
+	return builder.String()
+}
+
+// statsInteractionHandler replies with the tokens used, requests made, and estimated cost of OpenAI in this guild.
+func (d *Discord) statsInteractionHandler(s Session, i *discordgo.InteractionCreate, ctx context.Context, zlog *zerolog.Logger) {
+	zlog.Info().Msg("Received stats command")
+
+	response := formatStats(d.usage.Usage(GuildID(i.GuildID)), d.config.ModelPrices)
+	_, err := s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+		Content: Ptr(response),
+	})
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to respond to interaction")
+	}
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"math"
+	"src/openai"
+	"testing"
+)
+
+func TestEstimateCost(t *testing.T) {
+	prices := map[string]ModelPrice{
+		"gpt-4":         {PromptPer1K: 0.03, CompletionPer1K: 0.06},
+		"gpt-4-32k":     {PromptPer1K: 0.06, CompletionPer1K: 0.12},
+		"gpt-3.5-turbo": {PromptPer1K: 0.001, CompletionPer1K: 0.002},
+	}
+	tests := []struct {
+		name   string
+		model  string
+		usage  ModelUsage
+		want   float64
+		wantOK bool
+	}{
+		{name: "no tokens", model: "gpt-4", wantOK: true},
+		{name: "prompt and completion", model: "gpt-4", usage: ModelUsage{PromptTokens: 1000, CompletionTokens: 500}, want: 0.06, wantOK: true},
+		{name: "partial thousand", model: "gpt-3.5-turbo", usage: ModelUsage{PromptTokens: 1500, CompletionTokens: 250}, want: 0.002, wantOK: true},
+		{name: "dated snapshot", model: "gpt-4-0613", usage: ModelUsage{PromptTokens: 2000}, want: 0.06, wantOK: true},
+		{name: "longest matching prefix", model: "gpt-4-32k-0613", usage: ModelUsage{CompletionTokens: 1000}, want: 0.12, wantOK: true},
+		{name: "prefix without a separator", model: "gpt-4o", usage: ModelUsage{PromptTokens: 1000}},
+		{name: "unknown model", model: "claude", usage: ModelUsage{PromptTokens: 1000}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := estimateCost(tt.model, tt.usage, prices)
+			if ok != tt.wantOK || math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("estimateCost(%q, %+v) = %v, %v, want %v, %v", tt.model, tt.usage, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestUsageTracker(t *testing.T) {
+	tracker := NewUsageTracker()
+	completion := func(model string, prompt, completion int) *openai.Completion {
+		return &openai.Completion{Model: model, Usage: openai.Usage{PromptTokens: prompt, CompletionTokens: completion}}
+	}
+	tracker.Record("guild", completion("gpt-4", 100, 50))
+	tracker.Record("guild", completion("gpt-4", 200, 25))
+	tracker.Record("guild", completion("gpt-3.5-turbo", 10, 5))
+	tracker.Record("other", completion("gpt-4", 1000, 1000))
+	tracker.Record("", completion("gpt-4", 1000, 1000))
+	tracker.Record("guild", nil)
+
+	usage := tracker.Usage("guild")
+	if got, want := usage["gpt-4"], (ModelUsage{Requests: 2, PromptTokens: 300, CompletionTokens: 75}); got != want {
+		t.Errorf("Usage()[gpt-4] = %+v, want %+v", got, want)
+	}
+	if got, want := usage["gpt-3.5-turbo"], (ModelUsage{Requests: 1, PromptTokens: 10, CompletionTokens: 5}); got != want {
+		t.Errorf("Usage()[gpt-3.5-turbo] = %+v, want %+v", got, want)
+	}
+	if len(usage) != 2 {
+		t.Errorf("Usage() = %+v, want only this guild's two models", usage)
+	}
+}
+
+func TestFormatStats(t *testing.T) {
+	prices := map[string]ModelPrice{"gpt-4": {PromptPer1K: 0.03, CompletionPer1K: 0.06}}
+	tests := []struct {
+		name   string
+		models map[string]ModelUsage
+		want   string
+	}{
+		{name: "no usage", want: "No OpenAI usage has been recorded in this server since the bot started."},
+		{
+			name:   "priced models",
+			models: map[string]ModelUsage{"gpt-4": {Requests: 3, PromptTokens: 10000, CompletionTokens: 5000}},
+			want: "OpenAI usage in this server since the bot started:\n" +
+				"gpt-4: 3 requests, 10000 prompt tokens, 5000 completion tokens, ~$0.60\n" +
+				"Estimated cost: ~$0.60",
+		},
+		{
+			name: "unpriced model",
+			models: map[string]ModelUsage{
+				"gpt-4":  {Requests: 1, PromptTokens: 1000},
+				"custom": {Requests: 2, PromptTokens: 20, CompletionTokens: 30},
+			},
+			want: "OpenAI usage in this server since the bot started:\n" +
+				"custom: 2 requests, 20 prompt tokens, 30 completion tokens, cost unknown\n" +
+				"gpt-4: 1 requests, 1000 prompt tokens, 0 completion tokens, ~$0.03\n" +
+				"Estimated cost: ~$0.03 (excluding models without a configured price)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatStats(tt.models, prices); got != tt.want {
+				t.Errorf("formatStats() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"src/openai"
+	"strings"
+	"time"
+)
+
+const (
+	// streamEditInterval is the least time between edits showing a streamed completion's progress, to stay well under
+	// Discord's rate limit on editing an interaction response.
+	streamEditInterval = 1 * time.Second
+
+	// interactionTokenLifetime is how long after an interaction Discord accepts edits to its response.
+	interactionTokenLifetime = 15 * time.Minute
+)
+
+// interactionDeadline returns when the bot stops relying on the token of an interaction with ID id, margin before
+// the token expires. The interaction's creation time is read from its snowflake ID, so time spent queued counts; if
+// the ID cannot be parsed, received is used instead.
+func interactionDeadline(id string, received time.Time, margin time.Duration) time.Time {
+	created, err := discordgo.SnowflakeTimestamp(id)
+	if err != nil || created.After(received) {
+		created = received
+	}
+	return created.Add(interactionTokenLifetime - margin)
+}
+
+// canEditInteraction returns whether the response to an interaction can still be edited at now, given its deadline
+// from interactionDeadline. Past the deadline, results should be sent as a new channel message instead.
+func canEditInteraction(deadline time.Time, now time.Time) bool {
+	return now.Before(deadline)
+}
+
+// streamedReply accumulates a streamed completion to a prompt, and decides when to show its progress by editing the
+// interaction response. It is not safe for concurrent use.
+type streamedReply struct {
+	prompt       string
+	text         strings.Builder
+	deadline     time.Time
+	lastEdit     time.Time
+	editedLength int
+}
+
+// newStreamedReply starts a reply to an interaction whose response can be edited until deadline.
+func newStreamedReply(prompt string, deadline time.Time) *streamedReply {
+	return &streamedReply{prompt: prompt, deadline: deadline}
+}
+
+func (r *streamedReply) append(text string) {
+	r.text.WriteString(text)
+}
+
+// canEdit returns whether the interaction token is still valid at now, with a margin, so the response can be edited.
+func (r *streamedReply) canEdit(now time.Time) bool {
+	return canEditInteraction(r.deadline, now)
+}
+
+// shouldEdit returns whether the response should be edited at now: there is new text, at least streamEditInterval
+// has passed since the last edit, and the interaction token is still valid.
+func (r *streamedReply) shouldEdit(now time.Time) bool {
+	return r.text.Len() != r.editedLength && now.Sub(r.lastEdit) >= streamEditInterval && r.canEdit(now)
+}
+
+// markEdited records that the response was edited at now to show the text so far.
+func (r *streamedReply) markEdited(now time.Time) {
+	r.lastEdit = now
+	r.editedLength = r.text.Len()
+}
+
+// content returns the prompt in a quote block followed by the text so far, truncated to fit in a Discord message.
+func (r *streamedReply) content() string {
+	return truncate(fmt.Sprintf("> %s\n\n%s", r.prompt, r.text.String()), maxMessageLength)
+}
+
+// streamCompletion completes prompt, editing the deferred interaction response to show the completion as it is
+// generated, until deadline.
+func (d *Discord) streamCompletion(
+	s Session,
+	i *discordgo.InteractionCreate,
+	prompt string,
+	options openai.CompleteOptions,
+	deadline time.Time,
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) (*openai.Completion, error) {
+	reply := newStreamedReply(prompt, deadline)
+	completion, err := d.openaiClient.CompleteStream(prompt, options, func(text string) {
+		reply.append(text)
+		now := time.Now()
+		if !reply.shouldEdit(now) {
+			return
+		}
+		reply.markEdited(now)
+		_, err := s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+			Content: Ptr(reply.content()),
+		})
+		if err != nil {
+			zlog.Warn().Err(err).Msg("Failed to show streamed completion")
+		}
+	}, ctx, zlog)
+	return completion, err
+}
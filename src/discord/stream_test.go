@@ -0,0 +1,144 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"github.com/rs/zerolog"
+	"src/openai"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestStreamedReplyEdits feeds a streamed reply pieces of text over time and checks which arrivals edit the response.
+func TestStreamedReplyEdits(t *testing.T) {
+	start := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	reply := newStreamedReply("Count to five", start.Add(time.Minute))
+	steps := []struct {
+		after    time.Duration
+		text     string
+		wantEdit bool
+	}{
+		{after: 0, text: "One", wantEdit: true},
+		{after: 200 * time.Millisecond, text: ", two"},
+		{after: 500 * time.Millisecond, text: ", three"},
+		{after: streamEditInterval, text: ", four", wantEdit: true},
+		{after: streamEditInterval + 100*time.Millisecond, text: ""},
+		{after: 3 * streamEditInterval, text: ""},
+		{after: 3 * streamEditInterval, text: ", five", wantEdit: true},
+		{after: 2 * time.Minute, text: ", six"},
+	}
+	for _, step := range steps {
+		now := start.Add(step.after)
+		reply.append(step.text)
+		edit := reply.shouldEdit(now)
+		if edit != step.wantEdit {
+			t.Errorf("shouldEdit() after %v and %q = %v, want %v", step.after, step.text, edit, step.wantEdit)
+		}
+		if edit {
+			reply.markEdited(now)
+		}
+	}
+
+	want := "> Count to five\n\nOne, two, three, four, five, six"
+	if got := reply.content(); got != want {
+		t.Errorf("content() = %q, want %q", got, want)
+	}
+}
+
+func TestStreamedReplyContentTruncated(t *testing.T) {
+	reply := newStreamedReply("Write a novel", time.Now().Add(time.Minute))
+	for i := 0; i < 500; i++ {
+		reply.append("words ")
+	}
+	got := reply.content()
+	if len([]rune(got)) > maxMessageLength || !strings.HasPrefix(got, "> Write a novel\n\nwords") || !strings.HasSuffix(got, "…") {
+		t.Errorf("content() = %q, want the start of the text truncated to %d characters", got, maxMessageLength)
+	}
+}
+
+// snowflakeAt returns a Discord snowflake ID created at t.
+func snowflakeAt(t time.Time) string {
+	const discordEpochMillis = 1420070400000
+	return strconv.FormatInt((t.UnixMilli()-discordEpochMillis)<<22, 10)
+}
+
+func TestInteractionDeadline(t *testing.T) {
+	received := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	margin := 30 * time.Second
+	tests := []struct {
+		name string
+		id   string
+		want time.Time
+	}{
+		{name: "created when received", id: snowflakeAt(received), want: received.Add(15*time.Minute - margin)},
+		{name: "queued before received", id: snowflakeAt(received.Add(-time.Minute)), want: received.Add(14*time.Minute - margin)},
+		{name: "created after received", id: snowflakeAt(received.Add(time.Minute)), want: received.Add(15*time.Minute - margin)},
+		{name: "unparseable ID", id: "interaction", want: received.Add(15*time.Minute - margin)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := interactionDeadline(tt.id, received, margin); !got.Equal(tt.want) {
+				t.Errorf("interactionDeadline() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanEditInteraction(t *testing.T) {
+	received := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	deadline := interactionDeadline(snowflakeAt(received), received, 30*time.Second)
+	tests := []struct {
+		name  string
+		after time.Duration
+		want  bool
+	}{
+		{name: "right away", after: 0, want: true},
+		{name: "well within the margin", after: 14 * time.Minute, want: true},
+		{name: "just before the margin", after: 14*time.Minute + 29*time.Second, want: true},
+		{name: "at the margin", after: 14*time.Minute + 30*time.Second, want: false},
+		{name: "after the token expired", after: 16 * time.Minute, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := canEditInteraction(deadline, received.Add(tt.after)); got != tt.want {
+				t.Errorf("canEditInteraction() after %v = %v, want %v", tt.after, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompleteAfterInteractionExpires(t *testing.T) {
+	session := newFakeSession()
+	client := &fakeOpenAI{completion: &openai.Completion{Text: "done"}}
+	d := newTestDiscord(session, client)
+	i := newCommandInteraction("channel", "user", "complete", promptOption("Count to five"))
+	i.ID = snowflakeAt(time.Now().Add(-15 * time.Minute))
+	zlog := zerolog.Nop()
+
+	d.completeInteractionHandler(session, i, context.Background(), &zlog)
+
+	if len(session.responseEdits) != 0 {
+		t.Errorf("responseEdits = %+v, want none once the interaction expired", session.responseEdits)
+	}
+	sent := session.sentMessages()
+	if len(sent) != 1 || sent[0].ChannelID != "channel" || !strings.Contains(sent[0].Message.Content, "done") {
+		t.Errorf("sent = %+v, want the completion sent to the channel", sent)
+	}
+}
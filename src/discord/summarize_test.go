@@ -0,0 +1,111 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"reflect"
+	"src/openai"
+	"testing"
+)
+
+func TestSummarizeInteractionHandler(t *testing.T) {
+	textOption := &discordgo.ApplicationCommandInteractionDataOption{
+		Name:  "text",
+		Type:  discordgo.ApplicationCommandOptionString,
+		Value: "  Go was designed at Google.  ",
+	}
+	sentencesOption := &discordgo.ApplicationCommandInteractionDataOption{
+		Name:  "sentences",
+		Type:  discordgo.ApplicationCommandOptionInteger,
+		Value: float64(1),
+	}
+	threadMessages := []*openai.ChatMessage{
+		{FromHuman: true, Text: "Who made Go?"},
+		{Text: "Google."},
+	}
+
+	tests := []struct {
+		name          string
+		channelID     string
+		options       []*discordgo.ApplicationCommandInteractionDataOption
+		wantSummaries [][]*openai.ChatMessage
+		wantSentences []int
+		wantResponse  string
+	}{
+		{
+			name:          "text",
+			channelID:     "channel",
+			options:       []*discordgo.ApplicationCommandInteractionDataOption{textOption},
+			wantSummaries: [][]*openai.ChatMessage{{{FromHuman: true, Text: "Go was designed at Google."}}},
+			wantSentences: []int{defaultSummarySentences},
+			wantResponse:  "The summary",
+		},
+		{
+			name:          "text in a thread summarizes the text",
+			channelID:     "thread",
+			options:       []*discordgo.ApplicationCommandInteractionDataOption{textOption, sentencesOption},
+			wantSummaries: [][]*openai.ChatMessage{{{FromHuman: true, Text: "Go was designed at Google."}}},
+			wantSentences: []int{1},
+			wantResponse:  "The summary",
+		},
+		{
+			name:          "thread",
+			channelID:     "thread",
+			options:       []*discordgo.ApplicationCommandInteractionDataOption{sentencesOption},
+			wantSummaries: [][]*openai.ChatMessage{threadMessages},
+			wantSentences: []int{1},
+			wantResponse:  "The summary",
+		},
+		{
+			name:         "no text outside a thread",
+			channelID:    "channel",
+			wantResponse: Localize(msgSummarizeWhat, ""),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newFakeSession()
+			session.messages["thread"] = []*discordgo.Message{
+				{ID: "2", ChannelID: "thread", Content: "Google.", Author: &discordgo.User{ID: "bot", Bot: true}},
+				{ID: "1", ChannelID: "thread", Content: "Who made Go?", Author: &discordgo.User{ID: "human"}},
+			}
+			client := &fakeOpenAI{summary: "The summary"}
+			d := newTestDiscord(session, client)
+			d.idsMap.SetChannels(map[ChannelID]bool{"channel": true})
+			d.idsMap.AddThread("thread", "channel")
+			zlog := zerolog.Nop()
+
+			d.summarizeInteractionHandler(session, newCommandInteraction(tt.channelID, "user", "summarize", tt.options...), context.Background(), &zlog)
+
+			if !reflect.DeepEqual(client.summarized, tt.wantSummaries) {
+				t.Errorf("summarized %v, want %v", client.summarized, tt.wantSummaries)
+			}
+			if !reflect.DeepEqual(client.sentences, tt.wantSentences) {
+				t.Errorf("summarized in %v sentences, want %v", client.sentences, tt.wantSentences)
+			}
+			if len(session.responseEdits) != 1 {
+				t.Fatalf("got %d response edits, want 1", len(session.responseEdits))
+			}
+			if got := *session.responseEdits[0].Content; got != tt.wantResponse {
+				t.Errorf("response = %q, want %q", got, tt.wantResponse)
+			}
+		})
+	}
+}
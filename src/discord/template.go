@@ -0,0 +1,223 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"regexp"
+	"sort"
+	"src/aws"
+	"src/openai"
+	"strings"
+	"time"
+)
+
+// maxTemplateNameLength bounds template names, which are also shown in lists of templates.
+const maxTemplateNameLength = 32
+
+var (
+	InvalidTemplateValuesError = errors.New("template values must be key=value pairs")
+
+	// templatePlaceholder matches a {placeholder} in a template.
+	templatePlaceholder = regexp.MustCompile(`\{([A-Za-z0-9_-]+)\}`)
+
+	// templateValue matches a key=value pair, where the value may be double-quoted to include spaces.
+	templateValue = regexp.MustCompile(`^([A-Za-z0-9_-]+)=(?:"([^"]*)"|(\S*))(?:\s+|$)`)
+)
+
+// MissingPlaceholdersError is returned when a template is used without a value for some of its placeholders.
+type MissingPlaceholdersError struct {
+	Names []string
+}
+
+func (e MissingPlaceholdersError) Error() string {
+	return "missing values for template placeholders: " + strings.Join(e.Names, ", ")
+}
+
+// substituteTemplate replaces each {placeholder} in template with its value. It returns MissingPlaceholdersError,
+// listing each missing name once in order of appearance, if any placeholder has no value. Values that match no
+// placeholder are ignored.
+func substituteTemplate(template string, values map[string]string) (string, error) {
+	var missing []string
+	seen := make(map[string]bool)
+	result := templatePlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		value, ok := values[name]
+		if !ok {
+			if !seen[name] {
+				seen[name] = true
+				missing = append(missing, name)
+			}
+			return placeholder
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", MissingPlaceholdersError{Names: missing}
+	}
+	return result, nil
+}
+
+// parseTemplateValues parses space-separated key=value pairs, e.g. `lang=Go topic="error handling"`. A later value
+// for the same key replaces an earlier one.
+func parseTemplateValues(text string) (map[string]string, error) {
+	values := make(map[string]string)
+	rest := strings.TrimSpace(text)
+	for rest != "" {
+		match := templateValue.FindStringSubmatch(rest)
+		if match == nil {
+			return nil, fmt.Errorf("%w: cannot parse %q", InvalidTemplateValuesError, rest)
+		}
+		values[match[1]] = match[2] + match[3]
+		rest = rest[len(match[0]):]
+	}
+	return values, nil
+}
+
+// templateInteractionHandler saves a prompt template for the guild.
+func (d *Discord) templateInteractionHandler(s Session, i *discordgo.InteractionCreate, ctx context.Context, zlog *zerolog.Logger) {
+	respond := func(content string) {
+		_, err := s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+			Content: Ptr(content),
+		})
+		if err != nil {
+			zlog.Error().Err(err).Msg("Failed to respond to interaction")
+		}
+	}
+	if d.templates == nil {
+		respond(Localize(msgTemplatesDisabled, i.Locale))
+		return
+	}
+
+	var name, text string
+	for _, option := range i.ApplicationCommandData().Options {
+		switch option.Name {
+		case "name":
+			name = strings.ToLower(strings.TrimSpace(option.StringValue()))
+		case "prompt":
+			text = strings.TrimSpace(option.StringValue())
+		}
+	}
+	zlog.Info().Str("template", name).Msg("Received template command")
+
+	var userID string
+	if i.Member != nil && i.Member.User != nil {
+		userID = i.Member.User.ID
+	} else if i.User != nil {
+		userID = i.User.ID
+	}
+	err := d.templates.SaveTemplate(ctx, aws.PromptTemplate{
+		GuildID:   i.GuildID,
+		Name:      name,
+		Text:      text,
+		CreatedBy: userID,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		respond(userErrorMessage(err, i.Locale))
+		return
+	}
+
+	placeholders := templatePlaceholder.FindAllString(text, -1)
+	respond(fmt.Sprintf(Localize(msgTemplateSaved, i.Locale), name, strings.Join(placeholders, " ")))
+}
+
+// useInteractionHandler fills in a saved template with the given values and replies with the completion of the
+// resulting prompt.
+func (d *Discord) useInteractionHandler(s Session, i *discordgo.InteractionCreate, ctx context.Context, zlog *zerolog.Logger) {
+	respond := func(content string) {
+		_, err := s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+			Content: Ptr(content),
+		})
+		if err != nil {
+			zlog.Error().Err(err).Msg("Failed to respond to interaction")
+		}
+	}
+	if d.templates == nil {
+		respond(Localize(msgTemplatesDisabled, i.Locale))
+		return
+	}
+
+	var name, valuesText string
+	for _, option := range i.ApplicationCommandData().Options {
+		switch option.Name {
+		case "name":
+			name = strings.ToLower(strings.TrimSpace(option.StringValue()))
+		case "values":
+			valuesText = option.StringValue()
+		}
+	}
+	zlog.Info().Str("template", name).Msg("Received use command")
+
+	template, err := d.templates.GetTemplate(ctx, i.GuildID, name)
+	if errors.Is(err, aws.TemplateNotFoundError) {
+		respond(fmt.Sprintf(Localize(msgTemplateNotFound, i.Locale), name, d.templateNames(ctx, i.GuildID, zlog)))
+		return
+	}
+	if err != nil {
+		respond(userErrorMessage(err, i.Locale))
+		return
+	}
+
+	values, err := parseTemplateValues(valuesText)
+	if err != nil {
+		zlog.Info().Err(err).Msg("Invalid template values")
+		respond(Localize(msgTemplateInvalidValues, i.Locale))
+		return
+	}
+	prompt, err := substituteTemplate(template.Text, values)
+	var missing MissingPlaceholdersError
+	if errors.As(err, &missing) {
+		respond(fmt.Sprintf(Localize(msgTemplateMissingValues, i.Locale), strings.Join(missing.Names, ", ")))
+		return
+	}
+
+	if ok, refusal := d.moderate(prompt, ctx, zlog); !ok {
+		d.respondRefused(s, i, refusal, zlog)
+		return
+	}
+	options := d.interactionChatOptions(i)
+	completion, err := d.openaiClient.CompleteChat([]*openai.ChatMessage{{FromHuman: true, Text: prompt}}, options, ctx, zlog)
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to complete chat")
+		respond(userErrorMessage(err, i.Locale))
+		return
+	}
+	d.usage.Record(GuildID(i.GuildID), completion)
+
+	response := fmt.Sprintf("> %s\n\n%s", prompt, strings.TrimSpace(completion.Text))
+	respond(truncate(response, maxMessageLength))
+}
+
+// templateNames returns the names of the templates in guildID, for suggesting one when a name is not found.
+func (d *Discord) templateNames(ctx context.Context, guildID string, zlog *zerolog.Logger) string {
+	templates, err := d.templates.ListTemplates(ctx, guildID)
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to list templates")
+		return ""
+	}
+	names := make([]string, 0, len(templates))
+	for _, template := range templates {
+		names = append(names, template.Name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"errors"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"reflect"
+	"src/aws"
+	"src/openai"
+	"strings"
+	"testing"
+)
+
+// memoryTemplateStore is a TemplateStore that keeps templates in memory, keyed by guild and then by name.
+type memoryTemplateStore struct {
+	templates map[string]map[string]aws.PromptTemplate
+}
+
+func newMemoryTemplateStore() *memoryTemplateStore {
+	return &memoryTemplateStore{templates: make(map[string]map[string]aws.PromptTemplate)}
+}
+
+func (m *memoryTemplateStore) SaveTemplate(ctx context.Context, template aws.PromptTemplate) error {
+	if m.templates[template.GuildID] == nil {
+		m.templates[template.GuildID] = make(map[string]aws.PromptTemplate)
+	}
+	m.templates[template.GuildID][template.Name] = template
+	return nil
+}
+
+func (m *memoryTemplateStore) GetTemplate(ctx context.Context, guildID string, name string) (*aws.PromptTemplate, error) {
+	template, ok := m.templates[guildID][name]
+	if !ok {
+		return nil, aws.TemplateNotFoundError
+	}
+	return &template, nil
+}
+
+func (m *memoryTemplateStore) ListTemplates(ctx context.Context, guildID string) ([]aws.PromptTemplate, error) {
+	templates := make([]aws.PromptTemplate, 0)
+	for _, template := range m.templates[guildID] {
+		templates = append(templates, template)
+	}
+	return templates, nil
+}
+
+func TestSubstituteTemplate(t *testing.T) {
+	tests := []struct {
+		name        string
+		template    string
+		values      map[string]string
+		want        string
+		wantMissing []string
+	}{
+		{name: "no placeholders", template: "Explain Go.", want: "Explain Go."},
+		{
+			name:     "placeholders",
+			template: "Explain {topic} in {lang}.",
+			values:   map[string]string{"topic": "error handling", "lang": "Go"},
+			want:     "Explain error handling in Go.",
+		},
+		{name: "repeated placeholder", template: "{x} and {x}", values: map[string]string{"x": "y"}, want: "y and y"},
+		{name: "unused value", template: "Hi {name}", values: map[string]string{"name": "Ada", "extra": "z"}, want: "Hi Ada"},
+		{name: "empty value", template: "[{x}]", values: map[string]string{"x": ""}, want: "[]"},
+		{name: "braces that are not placeholders", template: "func() { return }", want: "func() { return }"},
+		{
+			name:        "missing placeholders",
+			template:    "Explain {topic} in {lang}, like {topic} for {audience}.",
+			values:      map[string]string{"lang": "Go"},
+			wantMissing: []string{"topic", "audience"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := substituteTemplate(tt.template, tt.values)
+			var missing MissingPlaceholdersError
+			if tt.wantMissing != nil {
+				if !errors.As(err, &missing) || !reflect.DeepEqual(missing.Names, tt.wantMissing) {
+					t.Errorf("substituteTemplate() error = %v, want missing %v", err, tt.wantMissing)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("substituteTemplate() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("substituteTemplate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTemplateValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "empty", text: "  ", want: map[string]string{}},
+		{name: "pairs", text: "lang=Go level=beginner", want: map[string]string{"lang": "Go", "level": "beginner"}},
+		{name: "quoted value", text: `topic="error handling" lang=Go`, want: map[string]string{"topic": "error handling", "lang": "Go"}},
+		{name: "empty value", text: "x=", want: map[string]string{"x": ""}},
+		{name: "later value wins", text: "x=1 x=2", want: map[string]string{"x": "2"}},
+		{name: "missing equals", text: "lang Go", wantErr: true},
+		{name: "unterminated quote", text: `topic="error handling`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTemplateValues(tt.text)
+			if tt.wantErr {
+				if !errors.Is(err, InvalidTemplateValuesError) {
+					t.Errorf("parseTemplateValues(%q) error = %v, want InvalidTemplateValuesError", tt.text, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTemplateValues(%q) error = %v", tt.text, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTemplateValues(%q) = %v, want %v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestTemplateAndUse saves a template with the template command and runs it with the use command.
+func TestTemplateAndUse(t *testing.T) {
+	stringOption := func(name string, value string) *discordgo.ApplicationCommandInteractionDataOption {
+		return &discordgo.ApplicationCommandInteractionDataOption{Name: name, Type: discordgo.ApplicationCommandOptionString, Value: value}
+	}
+	tests := []struct {
+		name       string
+		useName    string
+		values     string
+		wantPrompt string
+		wantReply  string
+	}{
+		{name: "all values", useName: "Explain", values: `topic="error handling" lang=Go`, wantPrompt: "Explain error handling in Go."},
+		{name: "missing values", useName: "explain", values: "lang=Go", wantReply: "Missing values for the placeholders topic."},
+		{name: "unknown template", useName: "summarize", wantReply: "There is no template called \"summarize\". Templates in this server: explain"},
+		{name: "invalid values", useName: "explain", values: "lang", wantReply: Localize(msgTemplateInvalidValues, "")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newFakeSession()
+			client := &fakeOpenAI{completion: &openai.Completion{Text: "Return errors as values."}}
+			d := newTestDiscord(session, client)
+			store := newMemoryTemplateStore()
+			d.templates = store
+			zlog := zerolog.Nop()
+
+			save := newCommandInteraction("channel", "user", "template",
+				stringOption("name", " Explain "), stringOption("prompt", "Explain {topic} in {lang}."))
+			d.templateInteractionHandler(session, save, context.Background(), &zlog)
+			saved, err := store.GetTemplate(context.Background(), "guild", "explain")
+			if err != nil || saved.Text != "Explain {topic} in {lang}." || saved.CreatedBy != "user" {
+				t.Fatalf("saved template = %+v, %v, want the explain template", saved, err)
+			}
+
+			use := newCommandInteraction("channel", "user", "use", stringOption("name", tt.useName), stringOption("values", tt.values))
+			d.useInteractionHandler(session, use, context.Background(), &zlog)
+
+			if len(session.responseEdits) != 2 {
+				t.Fatalf("got %d response edits, want 2", len(session.responseEdits))
+			}
+			reply := *session.responseEdits[1].Content
+			if tt.wantPrompt == "" {
+				if reply != tt.wantReply || len(client.chats) != 0 {
+					t.Errorf("reply = %q after %d chats, want %q", reply, len(client.chats), tt.wantReply)
+				}
+				return
+			}
+			if len(client.chats) != 1 || client.chats[0][0].Text != tt.wantPrompt {
+				t.Fatalf("completed chats %v, want the prompt %q", client.chats, tt.wantPrompt)
+			}
+			if !strings.Contains(reply, tt.wantPrompt) || !strings.Contains(reply, "Return errors as values.") {
+				t.Errorf("reply = %q, want the prompt and its completion", reply)
+			}
+		})
+	}
+}
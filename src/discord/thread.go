@@ -0,0 +1,248 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"sort"
+	"src/openai"
+	"strings"
+)
+
+// maxMessageLength is the maximum number of characters Discord allows in a message.
+const maxMessageLength = 2000
+
+// gatherThreadMessages returns all messages with non-empty content in a thread in chronological order, starting with
+// the thread's starter message if it has one. The starter message is also returned separately, and is nil if it could
+// not be fetched.
+func (d *Discord) gatherThreadMessages(
+	s Session,
+	channelID string,
+	zlog *zerolog.Logger,
+) ([]*discordgo.Message, *discordgo.Message, error) {
+	messages, err := gatherChannelMessages(s, channelID, 0, zlog)
+	if err != nil {
+		return nil, nil, err
+	}
+	messages = d.withoutIgnored(messages)
+
+	// If a starter message exists, Discord re-uses the same ID for both this starter message and the thread itself.
+	// Hence, listing messages in a thread cannot return the first message (!!!). You have to get the parent of the
+	// thread, list messages in the thread, and find the message with the same ID at the thread (!!!).
+	starterMessage, err := d.FetchStarterMessage(channelID, zlog)
+	if err == nil {
+		zlog.Info().
+			Str("starter_message", starterMessage.ID).
+			Str("author", starterMessage.Author.ID).
+			Str("content", starterMessage.Content).
+			Msg("Starter message")
+		if !d.isIgnored(starterMessage) {
+			messages = append([]*discordgo.Message{starterMessage}, messages...)
+		}
+	}
+
+	for _, message := range messages {
+		zlog.Info().Str("sub_message", message.ID).Str("author", message.Author.ID).Str("content", message.Content).Msg("Message")
+	}
+
+	return messages, starterMessage, nil
+}
+
+// gatherChannelMessages returns the messages with non-empty content in a channel in chronological order. If
+// maxMessages is positive, only about the most recent maxMessages messages are fetched.
+func gatherChannelMessages(
+	s Session,
+	channelID string,
+	maxMessages int,
+	zlog *zerolog.Logger,
+) ([]*discordgo.Message, error) {
+	// Get all messages in the channel. Use a limit of 100 and use pagination of beforeID and afterID
+	// to get all messages in the channel.
+	messages := make([]*discordgo.Message, 0)
+	beforeID := ""
+	afterID := ""
+	zlog.Debug().Str("channel", channelID).Msg("Getting messages")
+
+	for {
+		var result []*discordgo.Message
+		err := withDiscordRetry(func() error {
+			var err error
+			result, err = s.ChannelMessages(channelID, 100, beforeID, afterID, "")
+			return err
+		}, zlog)
+		if err != nil {
+			zlog.Error().Err(err).Msg("Failed to get messages")
+			return nil, err
+		}
+
+		// only append messages that have non-empty content or an image attachment
+		for _, message := range result {
+			if message.Content == "" && len(imageAttachmentURLs(message)) == 0 {
+				continue
+			}
+			messages = append(messages, message)
+		}
+
+		if len(result) < 100 || (maxMessages > 0 && len(messages) >= maxMessages) {
+			break
+		}
+
+		beforeID = result[len(result)-1].ID
+	}
+
+	// sort messages by id; since they are snowflakes this will be in chronological order
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].ID < messages[j].ID
+	})
+
+	return messages, nil
+}
+
+// isIgnored returns whether message starts with Config.IgnorePrefix, marking it as not meant for the bot.
+func (d *Discord) isIgnored(message *discordgo.Message) bool {
+	return d.config.IgnorePrefix != "" && strings.HasPrefix(strings.TrimSpace(message.Content), d.config.IgnorePrefix)
+}
+
+// withoutIgnored returns messages without the ones that start with Config.IgnorePrefix.
+func (d *Discord) withoutIgnored(messages []*discordgo.Message) []*discordgo.Message {
+	if d.config.IgnorePrefix == "" {
+		return messages
+	}
+	result := make([]*discordgo.Message, 0, len(messages))
+	for _, message := range messages {
+		if !d.isIgnored(message) {
+			result = append(result, message)
+		}
+	}
+	return result
+}
+
+// dropLastAssistant removes the most recent assistant response, i.e. the trailing run of bot messages, since a long
+// response is sent as several messages. Messages are expected in chronological order.
+func dropLastAssistant(messages []*discordgo.Message) []*discordgo.Message {
+	end := len(messages)
+	for end > 0 && messages[end-1].Author.Bot {
+		end--
+	}
+	return messages[:end]
+}
+
+// toChatMessages converts Discord messages to OpenAI chat messages. Messages from bots are treated as the assistant.
+func toChatMessages(messages []*discordgo.Message) []*openai.ChatMessage {
+	chatMessages := make([]*openai.ChatMessage, 0, len(messages))
+	for _, message := range messages {
+		fromHuman := !message.Author.Bot
+		chatMessages = append(chatMessages, &openai.ChatMessage{
+			FromHuman: fromHuman,
+			Text:      message.Content,
+			ImageURLs: imageAttachmentURLs(message),
+		})
+	}
+	return chatMessages
+}
+
+// imageAttachmentURLs returns the URLs of the images attached to message.
+func imageAttachmentURLs(message *discordgo.Message) []string {
+	var urls []string
+	for _, attachment := range message.Attachments {
+		if strings.HasPrefix(attachment.ContentType, "image/") {
+			urls = append(urls, attachment.URL)
+		}
+	}
+	return urls
+}
+
+// partitionHistory splits messages into the older messages that should be summarized and the most recent maxMessages
+// messages that should be sent verbatim. If maxMessages is not positive, all messages are recent.
+func partitionHistory(messages []*discordgo.Message, maxMessages int) ([]*discordgo.Message, []*discordgo.Message) {
+	if maxMessages <= 0 || len(messages) <= maxMessages {
+		return nil, messages
+	}
+	split := len(messages) - maxMessages
+	return messages[:split], messages[split:]
+}
+
+// historyReserveTokens is held back from the prompt budget when choosing which messages to send verbatim, to leave
+// room for the system prompt and the summary of older messages.
+const historyReserveTokens = 1024
+
+// buildChatMessages converts a thread's messages to chat messages, keeping as many of the most recent messages
+// verbatim as fit in the prompt budget of options' model, up to Config.MaxHistoryMessages. Any older messages are
+// summarized into a single system message at the start. If the summary fails, the older messages are dropped.
+func (d *Discord) buildChatMessages(
+	messages []*discordgo.Message,
+	options openai.ChatOptions,
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) []*openai.ChatMessage {
+	older, recent := partitionHistory(messages, d.config.MaxHistoryMessages)
+	chatMessages := toChatMessages(recent)
+
+	// Always keep the newest message, even if it alone is over budget, so that the error surfaces when completing.
+	fit := openai.FitRecentMessages(chatMessages, options.Model, options.PromptTokenBudget()-historyReserveTokens)
+	if fit < 1 {
+		fit = 1
+	}
+	if fit < len(recent) {
+		split := len(recent) - fit
+		older = append(older[:len(older):len(older)], recent[:split]...)
+		chatMessages = chatMessages[split:]
+	}
+	if len(older) == 0 {
+		return chatMessages
+	}
+
+	zlog.Info().Int("older", len(older)).Int("recent", len(recent)).Msg("Summarizing older thread history")
+	summary, err := d.openaiClient.SummarizeConversation(toChatMessages(older), 0, ctx, zlog)
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to summarize older thread history, dropping it")
+		return chatMessages
+	}
+
+	return append([]*openai.ChatMessage{{
+		FromSystem: true,
+		Text:       "Summary of the earlier conversation: " + summary,
+	}}, chatMessages...)
+}
+
+// splitResponse splits the response on full stops (".") and joins the sentences back into chunks that fit in a
+// Discord message.
+func splitResponse(response string) []string {
+	result := make([]string, 0)
+	responseChunks := make([]string, 0)
+	currentSize := 0
+	for _, chunk := range strings.Split(response, ".") {
+		if len(chunk) == 0 {
+			continue
+		}
+		// Account for the full stop that joins this chunk to the previous one.
+		if currentSize+len(chunk)+1 > maxMessageLength {
+			result = append(result, strings.Join(responseChunks, "."))
+			responseChunks = []string{chunk}
+			currentSize = len(chunk)
+			continue
+		}
+		responseChunks = append(responseChunks, chunk)
+		currentSize += len(chunk) + 1
+	}
+	if last := strings.Join(responseChunks, "."); len(last) > 0 {
+		result = append(result, last)
+	}
+	return result
+}
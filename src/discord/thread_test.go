@@ -0,0 +1,383 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"errors"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"reflect"
+	"src/openai"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestRespondToConversation drives a thread reply end to end against a fake session: the thread's messages are
+// gathered, the conversation is sent to the chat model, and the reply is sent as a reply to the newest message.
+func TestRespondToConversation(t *testing.T) {
+	session := newFakeSession()
+	session.channels["thread"] = &discordgo.Channel{ID: "thread", ParentID: "channel", Type: discordgo.ChannelTypeGuildPublicThread}
+	session.messages["channel"] = []*discordgo.Message{
+		{ID: "thread", ChannelID: "channel", Content: "What is Go?", Author: &discordgo.User{ID: "human"}},
+	}
+	session.messages["thread"] = []*discordgo.Message{
+		{ID: "2", ChannelID: "thread", Content: "A programming language.", Author: &discordgo.User{ID: "bot", Bot: true}},
+		{ID: "3", ChannelID: "thread", Content: "Who made it?", Author: &discordgo.User{ID: "human"}},
+	}
+	openaiClient := &fakeOpenAI{completion: &openai.Completion{Text: "Google", Model: "gpt-4"}}
+	d := newTestDiscord(session, openaiClient)
+	zlog := zerolog.Nop()
+
+	messages, _, err := d.gatherThreadMessages(session, "thread", &zlog)
+	if err != nil {
+		t.Fatalf("gatherThreadMessages() error = %v", err)
+	}
+	d.respondToConversation(session, "guild", "thread", messages, openai.DefaultChatOptions(), context.Background(), &zlog)
+
+	if len(openaiClient.chats) != 1 {
+		t.Fatalf("CompleteChat called %d times, want 1", len(openaiClient.chats))
+	}
+	var got []string
+	for _, message := range openaiClient.chats[0] {
+		got = append(got, message.Text)
+	}
+	want := []string{"What is Go?", "A programming language.", "Who made it?"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("chat messages = %q, want %q", got, want)
+	}
+
+	sent := session.sentMessages()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(sent))
+	}
+	if sent[0].ChannelID != "thread" || sent[0].Message.Content != "Google" {
+		t.Errorf("sent %q to %s, want %q to thread", sent[0].Message.Content, sent[0].ChannelID, "Google")
+	}
+	if sent[0].Message.Reference == nil || sent[0].Message.Reference.MessageID != "3" {
+		t.Errorf("reply reference = %+v, want message 3", sent[0].Message.Reference)
+	}
+	if !reflect.DeepEqual(sent[0].Message.Components, feedbackComponents()) {
+		t.Errorf("reply components = %+v, want the feedback buttons", sent[0].Message.Components)
+	}
+}
+
+// TestRespondToConversationReactions checks that the newest message shows the loading reaction while the reply is
+// generated, and then the success or failure reaction in its place.
+func TestRespondToConversationReactions(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		sendErr  error
+		outcome  string
+		wantSent int
+	}{
+		{name: "success", outcome: "✅", wantSent: 1},
+		{name: "completion fails", err: errors.New("overloaded"), outcome: "❌"},
+		{name: "send fails", sendErr: errors.New("forbidden"), outcome: "❌"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newFakeSession()
+			session.sendErr = tt.sendErr
+			openaiClient := &fakeOpenAI{completion: &openai.Completion{Text: "Hello."}, err: tt.err}
+			d := newTestDiscord(session, openaiClient)
+			d.config.SendRetryAttempts = 1
+			zlog := zerolog.Nop()
+			messages := []*discordgo.Message{
+				{ID: "1", ChannelID: "thread", Content: "Hi", Author: &discordgo.User{ID: "human"}},
+			}
+
+			d.respondToConversation(session, "guild", "thread", messages, openai.DefaultChatOptions(), context.Background(), &zlog)
+
+			want := []reaction{
+				{MessageID: "1", Emoji: "🤖", Added: true},
+				{MessageID: "1", Emoji: "🤖", Added: false},
+				{MessageID: "1", Emoji: tt.outcome, Added: true},
+			}
+			if got := session.reactionLog(); !reflect.DeepEqual(got, want) {
+				t.Errorf("reactions = %+v, want %+v", got, want)
+			}
+			if got := len(session.sentMessages()); got != tt.wantSent {
+				t.Errorf("sent %d messages, want %d", got, tt.wantSent)
+			}
+		})
+	}
+}
+
+func TestDropLastAssistant(t *testing.T) {
+	human := func(id string) *discordgo.Message {
+		return &discordgo.Message{ID: id, Author: &discordgo.User{ID: "user"}}
+	}
+	bot := func(id string) *discordgo.Message {
+		return &discordgo.Message{ID: id, Author: &discordgo.User{ID: "bot", Bot: true}}
+	}
+	tests := []struct {
+		name     string
+		messages []*discordgo.Message
+		want     []string
+	}{
+		{name: "empty", want: []string{}},
+		{name: "no assistant message", messages: []*discordgo.Message{human("1"), human("2")}, want: []string{"1", "2"}},
+		{name: "assistant message not last", messages: []*discordgo.Message{human("1"), bot("2"), human("3")}, want: []string{"1", "2", "3"}},
+		{name: "last assistant message", messages: []*discordgo.Message{human("1"), bot("2"), human("3"), bot("4")}, want: []string{"1", "2", "3"}},
+		{name: "reply split across messages", messages: []*discordgo.Message{human("1"), bot("2"), bot("3")}, want: []string{"1"}},
+		{name: "only assistant messages", messages: []*discordgo.Message{bot("1"), bot("2")}, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make([]string, 0, len(tt.messages))
+			for _, message := range dropLastAssistant(tt.messages) {
+				got = append(got, message.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dropLastAssistant() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPartitionHistory(t *testing.T) {
+	messages := make([]*discordgo.Message, 5)
+	for index := range messages {
+		messages[index] = &discordgo.Message{ID: strconv.Itoa(index + 1)}
+	}
+	ids := func(messages []*discordgo.Message) []string {
+		result := []string{}
+		for _, message := range messages {
+			result = append(result, message.ID)
+		}
+		return result
+	}
+	tests := []struct {
+		name        string
+		maxMessages int
+		wantOlder   []string
+		wantRecent  []string
+	}{
+		{name: "no cap", maxMessages: 0, wantOlder: []string{}, wantRecent: []string{"1", "2", "3", "4", "5"}},
+		{name: "under the cap", maxMessages: 10, wantOlder: []string{}, wantRecent: []string{"1", "2", "3", "4", "5"}},
+		{name: "at the cap", maxMessages: 5, wantOlder: []string{}, wantRecent: []string{"1", "2", "3", "4", "5"}},
+		{name: "over the cap", maxMessages: 2, wantOlder: []string{"1", "2", "3"}, wantRecent: []string{"4", "5"}},
+		{name: "cap of one", maxMessages: 1, wantOlder: []string{"1", "2", "3", "4"}, wantRecent: []string{"5"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			older, recent := partitionHistory(messages, tt.maxMessages)
+			if got := ids(older); !reflect.DeepEqual(got, tt.wantOlder) {
+				t.Errorf("partitionHistory() older = %v, want %v", got, tt.wantOlder)
+			}
+			if got := ids(recent); !reflect.DeepEqual(got, tt.wantRecent) {
+				t.Errorf("partitionHistory() recent = %v, want %v", got, tt.wantRecent)
+			}
+		})
+	}
+}
+
+func TestBuildChatMessagesSummarizesOlder(t *testing.T) {
+	messages := []*discordgo.Message{
+		{ID: "1", Content: "first", Author: &discordgo.User{ID: "human"}},
+		{ID: "2", Content: "second", Author: &discordgo.User{ID: "bot", Bot: true}},
+		{ID: "3", Content: "third", Author: &discordgo.User{ID: "human"}},
+	}
+	tests := []struct {
+		name           string
+		err            error
+		want           []string
+		wantSummarized []string
+	}{
+		{
+			name:           "summary",
+			want:           []string{"Summary of the earlier conversation: they said hello", "third"},
+			wantSummarized: []string{"first", "second"},
+		},
+		{
+			name:           "summary fails",
+			err:            errors.New("overloaded"),
+			want:           []string{"third"},
+			wantSummarized: []string{"first", "second"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openaiClient := &fakeOpenAI{summary: "they said hello", err: tt.err}
+			d := newTestDiscord(newFakeSession(), openaiClient)
+			d.config.MaxHistoryMessages = 1
+			zlog := zerolog.Nop()
+
+			chatMessages := d.buildChatMessages(messages, openai.DefaultChatOptions(), context.Background(), &zlog)
+
+			var got []string
+			for _, message := range chatMessages {
+				got = append(got, message.Text)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildChatMessages() = %q, want %q", got, tt.want)
+			}
+			if len(chatMessages) == 2 && !chatMessages[0].FromSystem {
+				t.Error("summary is not a system message")
+			}
+			if len(openaiClient.summarized) != 1 {
+				t.Fatalf("summarized %d times, want 1", len(openaiClient.summarized))
+			}
+			var summarized []string
+			for _, message := range openaiClient.summarized[0] {
+				summarized = append(summarized, message.Text)
+			}
+			if !reflect.DeepEqual(summarized, tt.wantSummarized) {
+				t.Errorf("summarized %q, want %q", summarized, tt.wantSummarized)
+			}
+		})
+	}
+}
+
+func TestImageAttachmentURLs(t *testing.T) {
+	message := &discordgo.Message{Attachments: []*discordgo.MessageAttachment{
+		{URL: "https://cdn.example.com/screenshot.png", ContentType: "image/png"},
+		{URL: "https://cdn.example.com/notes.txt", ContentType: "text/plain; charset=utf-8"},
+		{URL: "https://cdn.example.com/photo.jpg", ContentType: "image/jpeg"},
+	}}
+	want := []string{"https://cdn.example.com/screenshot.png", "https://cdn.example.com/photo.jpg"}
+	if got := imageAttachmentURLs(message); !reflect.DeepEqual(got, want) {
+		t.Errorf("imageAttachmentURLs() = %v, want %v", got, want)
+	}
+}
+
+// TestBuildChatMessagesFitsModelContext checks that a large-context model gets more of the same history verbatim than
+// a small one, with the rest summarized.
+func TestBuildChatMessagesFitsModelContext(t *testing.T) {
+	messages := make([]*discordgo.Message, 300)
+	for i := range messages {
+		messages[i] = &discordgo.Message{
+			ID:      strconv.Itoa(i),
+			Content: strings.Repeat("word ", 80),
+			Author:  &discordgo.User{ID: "human"},
+		}
+	}
+	tests := []struct {
+		model          string
+		wantAll        bool
+		wantSummarized bool
+	}{
+		{model: "gpt-4", wantSummarized: true},
+		{model: "gpt-4-turbo", wantAll: true},
+	}
+	verbatim := make(map[string]int)
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			openaiClient := &fakeOpenAI{summary: "they talked"}
+			d := newTestDiscord(newFakeSession(), openaiClient)
+			d.config.MaxHistoryMessages = 0
+			zlog := zerolog.Nop()
+			options := openai.DefaultChatOptions()
+			options.Model = tt.model
+			options.MaxTokens = 1024
+
+			chatMessages := d.buildChatMessages(messages, options, context.Background(), &zlog)
+
+			for _, message := range chatMessages {
+				if !message.FromSystem {
+					verbatim[tt.model]++
+				}
+			}
+			if tt.wantAll && verbatim[tt.model] != len(messages) {
+				t.Errorf("buildChatMessages() kept %d messages verbatim, want all %d", verbatim[tt.model], len(messages))
+			}
+			if summarized := len(openaiClient.summarized) > 0; summarized != tt.wantSummarized {
+				t.Errorf("buildChatMessages() summarized = %v, want %v", summarized, tt.wantSummarized)
+			}
+		})
+	}
+	if small, large := verbatim["gpt-4"], verbatim["gpt-4-turbo"]; small < 1 || small >= large {
+		t.Errorf("kept %d messages verbatim for gpt-4 and %d for gpt-4-turbo, want fewer but some for gpt-4", small, large)
+	}
+}
+
+func TestWithoutIgnored(t *testing.T) {
+	message := func(id, content string) *discordgo.Message {
+		return &discordgo.Message{ID: id, Content: content, Author: &discordgo.User{ID: "user"}}
+	}
+	messages := []*discordgo.Message{message("1", "Who made Go?"), message("2", "// lunch?"), message("3", "  // brb"), message("4", "a // b")}
+	tests := []struct {
+		name   string
+		prefix string
+		want   []string
+	}{
+		{name: "no prefix", want: []string{"1", "2", "3", "4"}},
+		{name: "prefix", prefix: "//", want: []string{"1", "4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTestDiscord(newFakeSession(), &fakeOpenAI{})
+			d.config.IgnorePrefix = tt.prefix
+			got := make([]string, 0, len(messages))
+			for _, message := range d.withoutIgnored(messages) {
+				got = append(got, message.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("withoutIgnored() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleMessageCreateIgnorePrefix(t *testing.T) {
+	tests := []struct {
+		name      string
+		newest    string
+		wantReply bool
+	}{
+		{name: "newest message ignored", newest: "// not for the bot"},
+		{name: "older message ignored", newest: "And Rust?", wantReply: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newFakeSession()
+			session.messages["dm"] = []*discordgo.Message{
+				{ID: "3", ChannelID: "dm", Content: tt.newest, Author: &discordgo.User{ID: "human"}},
+				{ID: "2", ChannelID: "dm", Content: "// side conversation", Author: &discordgo.User{ID: "human"}},
+				{ID: "1", ChannelID: "dm", Content: "Who made Go?", Author: &discordgo.User{ID: "human"}},
+			}
+			client := &fakeOpenAI{completion: &openai.Completion{Text: "Mozilla"}}
+			d := newTestDiscord(session, client)
+			d.config.IgnorePrefix = "//"
+			zlog := zerolog.Nop()
+			m := &discordgo.MessageCreate{Message: session.messages["dm"][0]}
+
+			d.handleMessageCreate(session, m, context.Background(), &zlog)
+
+			if !tt.wantReply {
+				if sent := session.sentMessages(); len(sent) != 0 || len(client.chats) != 0 {
+					t.Errorf("sent %+v, want no reply to an ignored message", sent)
+				}
+				return
+			}
+			if len(client.chats) != 1 {
+				t.Fatalf("completed %d chats, want 1", len(client.chats))
+			}
+			for _, message := range client.chats[0] {
+				if strings.HasPrefix(message.Text, "//") {
+					t.Errorf("prompt includes ignored message %q", message.Text)
+				}
+			}
+			if len(client.chats[0]) != 2 {
+				t.Errorf("prompt has %d messages, want 2", len(client.chats[0]))
+			}
+		})
+	}
+}
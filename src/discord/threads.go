@@ -0,0 +1,83 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"sort"
+	"strings"
+)
+
+// threadsInteractionHandler lists the threads the bot is listening to, or forgets one, for debugging.
+func (d *Discord) threadsInteractionHandler(s Session, i *discordgo.InteractionCreate, ctx context.Context, zlog *zerolog.Logger) {
+	payload := i.ApplicationCommandData()
+	zlog.Info().Str("command", payload.Name).Interface("payload", payload).Msg("Received threads command")
+
+	var response string
+	if len(payload.Options) > 0 && payload.Options[0].Name == "forget" {
+		var threadID ThreadID
+		for _, option := range payload.Options[0].Options {
+			if option.Name == "thread" {
+				threadID = ThreadID(strings.TrimSpace(option.StringValue()))
+			}
+		}
+		if d.idsMap.ForgetThread(threadID) {
+			zlog.Info().Str("thread", string(threadID)).Msg("Forgot thread")
+			response = fmt.Sprintf("No longer listening to thread %s.", threadID)
+		} else {
+			response = fmt.Sprintf("Thread %s was not being tracked; it will be ignored if it is created later.", threadID)
+		}
+	} else {
+		response = formatThreads(d.idsMap.Threads())
+	}
+
+	_, err := s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+		Content: Ptr(response),
+	})
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to respond to interaction")
+	}
+}
+
+// formatThreads describes threads, one per line with its parent channel, truncated to fit in a Discord message.
+func formatThreads(threads map[ThreadID]ChannelID) string {
+	if len(threads) == 0 {
+		return "Not listening to any threads."
+	}
+
+	threadIDs := make([]ThreadID, 0, len(threads))
+	for threadID := range threads {
+		threadIDs = append(threadIDs, threadID)
+	}
+	sort.Slice(threadIDs, func(i, j int) bool { return threadIDs[i] < threadIDs[j] })
+
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "Listening to %d threads:", len(threadIDs))
+	for n, threadID := range threadIDs {
+		line := fmt.Sprintf("\n<#%s> (%s) in <#%s>", threadID, threadID, threads[threadID])
+		// Leave room for the "...and N more" line.
+		if builder.Len()+len(line) > maxMessageLength-32 {
+			fmt.Fprintf(&builder, "\n...and %d more", len(threadIDs)-n)
+			break
+		}
+		builder.WriteString(line)
+	}
+	return builder.String()
+}
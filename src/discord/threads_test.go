@@ -0,0 +1,59 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestFormatThreads(t *testing.T) {
+	many := make(map[ThreadID]ChannelID)
+	for i := 0; i < 100; i++ {
+		many[ThreadID(fmt.Sprintf("%020d", i))] = "channel"
+	}
+
+	tests := []struct {
+		name       string
+		threads    map[ThreadID]ChannelID
+		want       string
+		wantSuffix string
+	}{
+		{name: "none", threads: map[ThreadID]ChannelID{}, want: "Not listening to any threads."},
+		{
+			name:    "sorted",
+			threads: map[ThreadID]ChannelID{"2": "channel", "1": "other"},
+			want:    "Listening to 2 threads:\n<#1> (1) in <#other>\n<#2> (2) in <#channel>",
+		},
+		{name: "truncated", threads: many, wantSuffix: " more"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := formatThreads(tt.threads)
+			if tt.want != "" && got != tt.want {
+				t.Errorf("formatThreads() = %q, want %q", got, tt.want)
+			}
+			if !strings.HasSuffix(got, tt.wantSuffix) {
+				t.Errorf("formatThreads() = %q, want suffix %q", got, tt.wantSuffix)
+			}
+			if len(got) > maxMessageLength {
+				t.Errorf("formatThreads() is %d characters, want at most %d", len(got), maxMessageLength)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+	"strings"
+)
+
+// maxThreadNameLength is the most characters Discord allows in a thread name.
+const maxThreadNameLength = 100
+
+// threadName turns a summary of a message into a thread name: title-cased, without surrounding quotes or a trailing
+// full stop, which the model sometimes adds, and truncated to fit Discord's limit.
+func threadName(summary string) string {
+	name := strings.TrimSpace(summary)
+	name = strings.Trim(name, "\"'")
+	name = strings.TrimSuffix(name, ".")
+	name = cases.Title(language.English).String(strings.TrimSpace(name))
+	return truncate(name, maxThreadNameLength)
+}
@@ -0,0 +1,50 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestThreadName(t *testing.T) {
+	tests := []struct {
+		name    string
+		summary string
+		want    string
+	}{
+		{name: "lower case", summary: "history of the go language", want: "History Of The Go Language"},
+		{name: "upper case", summary: "RUST VERSUS GO", want: "Rust Versus Go"},
+		{name: "quotes and full stop", summary: ` "Sorting a list." `, want: "Sorting A List"},
+		{name: "single quotes", summary: "'cats'", want: "Cats"},
+		{name: "unicode", summary: "élan vital", want: "Élan Vital"},
+		{name: "empty", summary: "", want: ""},
+		{name: "long", summary: strings.Repeat("word ", 30), want: strings.Repeat("Word ", 19) + "Word…"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := threadName(tt.summary)
+			if got != tt.want {
+				t.Errorf("threadName(%q) = %q, want %q", tt.summary, got, tt.want)
+			}
+			if utf8.RuneCountInString(got) > maxThreadNameLength {
+				t.Errorf("threadName(%q) has %d characters, want at most %d", tt.summary, utf8.RuneCountInString(got), maxThreadNameLength)
+			}
+		})
+	}
+}
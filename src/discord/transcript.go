@@ -0,0 +1,78 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"context"
+	"github.com/rs/zerolog"
+	"src/aws"
+	"src/metrics"
+	"src/openai"
+	"time"
+)
+
+// transcriptUploadTimeout bounds how long a background transcript upload may take.
+const transcriptUploadTimeout = 30 * time.Second
+
+// uploadTranscript records the conversation and the bot's reply in the background, if a transcript writer is
+// configured. Failures are logged and otherwise ignored so they never hold up a reply.
+func (d *Discord) uploadTranscript(threadID string, messages []*openai.ChatMessage, response string, zlog *zerolog.Logger) {
+	if d.transcripts == nil {
+		return
+	}
+	d.writeTranscript(aws.Transcript{
+		ThreadID:  threadID,
+		Timestamp: time.Now(),
+		Messages:  messages,
+		Response:  response,
+	}, zlog)
+}
+
+// deadLetterReply records a reply that could not be sent to Discord, so that the generated response is not lost. It
+// is logged in full, and also recorded as an undelivered transcript if a transcript writer is configured.
+func (d *Discord) deadLetterReply(
+	threadID string,
+	messages []*openai.ChatMessage,
+	response string,
+	sendErr error,
+	zlog *zerolog.Logger,
+) {
+	zlog.Warn().Err(sendErr).Str("threadID", threadID).Str("response", response).Msg("Failed to deliver reply")
+	metrics.Errors.WithLabelValues("undelivered_reply").Inc()
+	if d.transcripts == nil {
+		return
+	}
+	d.writeTranscript(aws.Transcript{
+		ThreadID:    threadID,
+		Timestamp:   time.Now(),
+		Messages:    messages,
+		Response:    response,
+		Undelivered: true,
+	}, zlog)
+}
+
+// writeTranscript writes transcript in the background.
+func (d *Discord) writeTranscript(transcript aws.Transcript, zlog *zerolog.Logger) {
+	threadID := transcript.ThreadID
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), transcriptUploadTimeout)
+		defer cancel()
+		if err := d.transcripts.Write(ctx, transcript); err != nil {
+			zlog.Warn().Err(err).Str("threadID", threadID).Msg("Failed to record transcript")
+		}
+	}()
+}
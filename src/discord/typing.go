@@ -0,0 +1,63 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"github.com/rs/zerolog"
+	"sync"
+	"time"
+)
+
+// typingInterval is how often the typing indicator is refreshed. Discord shows it for about 10 seconds.
+const typingInterval = 8 * time.Second
+
+// startTyping shows the typing indicator in channelID, refreshing it until the returned stop function is called. stop
+// may be called more than once.
+func startTyping(s Session, channelID string, zlog *zerolog.Logger) (stop func()) {
+	return startTypingEvery(s, channelID, typingInterval, zlog)
+}
+
+// startTypingEvery is startTyping with the typing indicator refreshed every interval.
+func startTypingEvery(s Session, channelID string, interval time.Duration, zlog *zerolog.Logger) (stop func()) {
+	done := make(chan struct{})
+	var once sync.Once
+	stop = func() {
+		once.Do(func() { close(done) })
+	}
+
+	typing := func() {
+		if err := s.ChannelTyping(channelID); err != nil {
+			zlog.Warn().Err(err).Msg("Failed to show typing indicator")
+		}
+	}
+	typing()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				typing()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
@@ -0,0 +1,63 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"github.com/rs/zerolog"
+	"testing"
+	"time"
+)
+
+// typingCount returns the number of typing indicators shown so far.
+func (s *fakeSession) typingCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.typing)
+}
+
+func TestStartTyping(t *testing.T) {
+	session := newFakeSession()
+	zlog := zerolog.Nop()
+
+	stop := startTypingEvery(session, "thread", 5*time.Millisecond, &zlog)
+	if got := session.typingCount(); got != 1 {
+		t.Fatalf("typing indicators = %d right after starting, want 1", got)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for session.typingCount() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("typing indicators = %d, want it refreshed", session.typingCount())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	stop()
+	stop()
+	// A refresh already in progress when stop was called may still finish, but no more start afterwards.
+	time.Sleep(20 * time.Millisecond)
+	stopped := session.typingCount()
+	time.Sleep(50 * time.Millisecond)
+	if got := session.typingCount(); got != stopped {
+		t.Errorf("typing indicators = %d after stopping, want %d", got, stopped)
+	}
+	for _, channelID := range session.typing {
+		if channelID != "thread" {
+			t.Errorf("typing indicator shown in %q, want thread", channelID)
+		}
+	}
+}
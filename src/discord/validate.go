@@ -0,0 +1,76 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/hashicorp/go-multierror"
+)
+
+// requiredChannelPermissions are the permissions the bot needs in each tracked channel to create threads and reply in
+// them.
+var requiredChannelPermissions = []struct {
+	permission int64
+	name       string
+}{
+	{discordgo.PermissionViewChannel, "View Channel"},
+	{discordgo.PermissionSendMessages, "Send Messages"},
+	{discordgo.PermissionSendMessagesInThreads, "Send Messages in Threads"},
+	{discordgo.PermissionCreatePublicThreads, "Create Public Threads"},
+	{discordgo.PermissionReadMessageHistory, "Read Message History"},
+	{discordgo.PermissionAddReactions, "Add Reactions"},
+}
+
+// ValidateConfig checks that the bot can do its job with the current configuration. It returns an error describing
+// every problem found, such as being unable to list channels in a guild or missing permissions in a tracked channel.
+// It logs a warning, rather than failing, if no channels match the channel prefix, since channels may be created
+// later.
+func (d *Discord) ValidateConfig() error {
+	var resultError error
+
+	guildIDs := d.idsMap.GuildIDs()
+	channelIDs := d.idsMap.ChannelIDs()
+
+	for _, guildID := range guildIDs {
+		if _, err := d.session.GuildChannels(string(guildID)); err != nil {
+			resultError = multierror.Append(resultError, fmt.Errorf("cannot list channels in guild %s: %w", guildID, err))
+		}
+	}
+
+	if len(channelIDs) == 0 {
+		d.zlog.Warn().
+			Str("prefix", d.config.ChannelPrefix).
+			Interface("guildIDs", guildIDs).
+			Msgf("No channels match the prefix %q, the bot will not respond until one is created", d.config.ChannelPrefix)
+	}
+
+	for _, channelID := range channelIDs {
+		permissions, err := d.session.UserChannelPermissions(d.discordClient.State.User.ID, string(channelID))
+		if err != nil {
+			resultError = multierror.Append(resultError, fmt.Errorf("cannot get permissions in channel %s: %w", channelID, err))
+			continue
+		}
+		for _, required := range requiredChannelPermissions {
+			if permissions&required.permission != required.permission {
+				resultError = multierror.Append(resultError, fmt.Errorf("missing %s permission in channel %s", required.name, channelID))
+			}
+		}
+	}
+
+	return resultError
+}
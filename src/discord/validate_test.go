@@ -0,0 +1,101 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package discord
+
+import (
+	"bytes"
+	"errors"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"strings"
+	"testing"
+)
+
+// unlistableSession is a fakeSession that cannot list the channels in any guild.
+type unlistableSession struct {
+	*fakeSession
+}
+
+func (s *unlistableSession) GuildChannels(guildID string, options ...discordgo.RequestOption) ([]*discordgo.Channel, error) {
+	return nil, errors.New("HTTP 403 Forbidden, Missing Access")
+}
+
+func TestValidateConfig(t *testing.T) {
+	allPermissions := int64(0)
+	for _, required := range requiredChannelPermissions {
+		allPermissions |= required.permission
+	}
+
+	tests := []struct {
+		name        string
+		unlistable  bool
+		channelIDs  []ChannelID
+		permissions int64
+		wantErrs    []string
+		wantWarning bool
+	}{
+		{name: "no channels match", wantWarning: true},
+		{name: "valid", channelIDs: []ChannelID{"channel"}, permissions: allPermissions},
+		{name: "cannot list channels", unlistable: true, wantErrs: []string{"cannot list channels in guild guild"}, wantWarning: true},
+		{
+			name:        "missing permissions",
+			channelIDs:  []ChannelID{"channel"},
+			permissions: allPermissions &^ (discordgo.PermissionSendMessagesInThreads | discordgo.PermissionAddReactions),
+			wantErrs: []string{
+				"missing Send Messages in Threads permission in channel channel",
+				"missing Add Reactions permission in channel channel",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeSession()
+			fake.permissions = tt.permissions
+			var session Session = fake
+			if tt.unlistable {
+				session = &unlistableSession{fakeSession: fake}
+			}
+
+			d := newTestDiscord(session, nil)
+			var buf bytes.Buffer
+			zlog := zerolog.New(&buf)
+			d.zlog = &zlog
+			d.discordClient = &discordgo.Session{State: discordgo.NewState()}
+			d.discordClient.State.User = &discordgo.User{ID: "bot"}
+			channelIDs := make(map[ChannelID]bool)
+			for _, channelID := range tt.channelIDs {
+				channelIDs[channelID] = true
+			}
+			d.idsMap.SetChannels(channelIDs)
+
+			err := d.ValidateConfig()
+
+			if len(tt.wantErrs) == 0 && err != nil {
+				t.Errorf("ValidateConfig() error = %v, want nil", err)
+			}
+			for _, want := range tt.wantErrs {
+				if err == nil || !strings.Contains(err.Error(), want) {
+					t.Errorf("ValidateConfig() error = %v, want it to contain %q", err, want)
+				}
+			}
+			warned := strings.Contains(buf.String(), `"level":"warn"`) && strings.Contains(buf.String(), "No channels match")
+			if warned != tt.wantWarning {
+				t.Errorf("ValidateConfig() logged %q, want no channels warning %v", buf.String(), tt.wantWarning)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server serves liveness and readiness probes over HTTP. /healthz returns 200 when every liveness check passes, and
+// /readyz returns 200 when the server has been marked ready and every liveness and readiness check passes.
+type Server struct {
+	httpServer      *http.Server
+	mux             *http.ServeMux
+	checks          map[string]func() bool
+	readinessChecks map[string]func() bool
+	mu              sync.RWMutex // protects checks and readinessChecks
+	ready           atomic.Bool
+	zlog            *zerolog.Logger
+}
+
+func NewServer(port string, zlog *zerolog.Logger) *Server {
+	s := &Server{
+		checks:          make(map[string]func() bool),
+		readinessChecks: make(map[string]func() bool),
+		zlog:            zlog,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.healthzHandler)
+	mux.HandleFunc("/readyz", s.readyzHandler)
+	s.mux = mux
+	s.httpServer = &http.Server{
+		Addr:              net.JoinHostPort("", port),
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	return s
+}
+
+// Handle serves an additional endpoint, e.g. /metrics, from the same server.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// AddLivenessCheck registers a named check that must return true for the process to be considered healthy.
+func (s *Server) AddLivenessCheck(name string, check func() bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checks[name] = check
+}
+
+// AddReadinessCheck registers a named check that must return true for the process to be considered ready. Unlike a
+// liveness check, a failing readiness check does not mean the process should be restarted, e.g. a dependency is
+// temporarily unavailable.
+func (s *Server) AddReadinessCheck(name string, check func() bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readinessChecks[name] = check
+}
+
+// SetReady marks whether the process has finished starting up and is ready to handle events.
+func (s *Server) SetReady(ready bool) {
+	s.ready.Store(ready)
+}
+
+// Start serves probes in a background goroutine until Close is called.
+func (s *Server) Start() {
+	go func() {
+		s.zlog.Info().Str("addr", s.httpServer.Addr).Msg("Starting health check server")
+		err := s.httpServer.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.zlog.Error().Err(err).Msg("Health check server failed")
+		}
+	}()
+}
+
+func (s *Server) Close(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
+// failingChecks returns the names of the given checks that currently fail, in sorted order.
+func (s *Server) failingChecks(checks map[string]func() bool) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	failing := make([]string, 0)
+	for name, check := range checks {
+		if !check() {
+			failing = append(failing, name)
+		}
+	}
+	sort.Strings(failing)
+	return failing
+}
+
+func (s *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeStatus(w, s.failingChecks(s.checks))
+}
+
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	failing := append(s.failingChecks(s.checks), s.failingChecks(s.readinessChecks)...)
+	if !s.ready.Load() {
+		failing = append(failing, "startup")
+	}
+	writeStatus(w, failing)
+}
+
+func writeStatus(w http.ResponseWriter, failing []string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(failing) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = fmt.Fprintf(w, "failing: %s\n", strings.Join(failing, ", "))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package health
+
+import (
+	"github.com/rs/zerolog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProbes(t *testing.T) {
+	tests := []struct {
+		name        string
+		lockHealthy bool
+		discordUp   bool
+		dependency  bool
+		ready       bool
+		path        string
+		wantStatus  int
+		wantBody    string
+	}{
+		{name: "healthy", lockHealthy: true, discordUp: true, path: "/healthz", wantStatus: http.StatusOK, wantBody: "ok\n"},
+		{
+			name:        "lock job stopped",
+			lockHealthy: false,
+			discordUp:   true,
+			path:        "/healthz",
+			wantStatus:  http.StatusServiceUnavailable,
+			wantBody:    "failing: lock\n",
+		},
+		{
+			name:       "everything failing",
+			path:       "/healthz",
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   "failing: discord, lock\n",
+		},
+		{
+			name:        "healthy but dependency down",
+			lockHealthy: true,
+			discordUp:   true,
+			path:        "/healthz",
+			wantStatus:  http.StatusOK,
+			wantBody:    "ok\n",
+		},
+		{
+			name:        "ready",
+			lockHealthy: true,
+			discordUp:   true,
+			dependency:  true,
+			ready:       true,
+			path:        "/readyz",
+			wantStatus:  http.StatusOK,
+			wantBody:    "ok\n",
+		},
+		{
+			name:        "still starting",
+			lockHealthy: true,
+			discordUp:   true,
+			dependency:  true,
+			path:        "/readyz",
+			wantStatus:  http.StatusServiceUnavailable,
+			wantBody:    "failing: startup\n",
+		},
+		{
+			name:        "dependency down",
+			lockHealthy: true,
+			discordUp:   true,
+			ready:       true,
+			path:        "/readyz",
+			wantStatus:  http.StatusServiceUnavailable,
+			wantBody:    "failing: dependency\n",
+		},
+		{
+			name:       "unhealthy is not ready",
+			dependency: true,
+			ready:      true,
+			path:       "/readyz",
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   "failing: discord, lock\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			zlog := zerolog.Nop()
+			server := NewServer("0", &zlog)
+			server.AddLivenessCheck("lock", func() bool { return tt.lockHealthy })
+			server.AddLivenessCheck("discord", func() bool { return tt.discordUp })
+			server.AddReadinessCheck("dependency", func() bool { return tt.dependency })
+			server.SetReady(tt.ready)
+
+			recorder := httptest.NewRecorder()
+			server.mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("GET %s status = %d, want %d", tt.path, recorder.Code, tt.wantStatus)
+			}
+			if body := recorder.Body.String(); body != tt.wantBody {
+				t.Errorf("GET %s body = %q, want %q", tt.path, body, tt.wantBody)
+			}
+		})
+	}
+}
@@ -17,27 +17,105 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/pkgerrors"
+	"io"
+	"net/http"
 	"os"
 	"os/signal"
 	"src/aws"
 	"src/discord"
+	"src/health"
 	"src/openai"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
 
 const (
-	discordTokenEnvName  = "DISCORD_TOKEN"
-	openaiTokenEnvName   = "OPENAI_TOKEN"
-	guildIDTokenEnvName  = "DISCORD_GUILD_ID"
-	lockTableNameEnvName = "LOCK_TABLE_NAME"
-	awsRegionEnvName     = "AWS_REGION"
+	discordTokenEnvName    = "DISCORD_TOKEN"
+	openaiTokenEnvName     = "OPENAI_TOKEN"
+	openaiOrgIDEnvName     = "OPENAI_ORG_ID"
+	openaiProjectEnvName   = "OPENAI_PROJECT_ID"
+	openaiMockEnvName      = "OPENAI_MOCK"
+	guildIDTokenEnvName    = "DISCORD_GUILD_ID"
+	guildIDsEnvName        = "DISCORD_GUILD_IDS"
+	lockTableNameEnvName   = "LOCK_TABLE_NAME"
+	lockLeaseEnvName       = "LOCK_LEASE_SECONDS"
+	lockHeartbeatEnvName   = "LOCK_HEARTBEAT_SECONDS"
+	lockRequiredEnvName    = "LOCK_REQUIRED"
+	createLockTableEnvName = "CREATE_LOCK_TABLE"
+	awsRegionEnvName       = "AWS_REGION"
+	healthPortEnvName      = "HEALTH_PORT"
+	logLevelEnvName        = "LOG_LEVEL"
+	logFormatEnvName       = "LOG_FORMAT"
+
+	transcriptBucketEnvName  = "TRANSCRIPT_BUCKET"
+	templateTableNameEnvName = "TEMPLATE_TABLE_NAME"
+
+	initialPromptEnvName     = "INITIAL_PROMPT"
+	initialPromptFileEnvName = "INITIAL_PROMPT_FILE"
+
+	completeMaxTokensEnvName            = "OPENAI_COMPLETE_MAX_TOKENS"
+	chatMaxTokensEnvName                = "OPENAI_CHAT_MAX_TOKENS"
+	titleMaxTokensEnvName               = "OPENAI_TITLE_MAX_TOKENS"
+	conversationSummaryMaxTokensEnvName = "OPENAI_CONVERSATION_SUMMARY_MAX_TOKENS"
+
+	maxConcurrentCompletionsEnvName = "OPENAI_MAX_CONCURRENT_COMPLETIONS"
+
+	breakerFailureThresholdEnvName = "OPENAI_BREAKER_FAILURE_THRESHOLD"
+	breakerCooldownEnvName         = "OPENAI_BREAKER_COOLDOWN"
+
+	httpTimeoutEnvName               = "OPENAI_HTTP_TIMEOUT"
+	httpResponseHeaderTimeoutEnvName = "OPENAI_HTTP_RESPONSE_HEADER_TIMEOUT"
+	httpIdleConnTimeoutEnvName       = "OPENAI_HTTP_IDLE_CONN_TIMEOUT"
+
+	loadingReactionEnvName = "DISCORD_LOADING_REACTION"
+	successReactionEnvName = "DISCORD_SUCCESS_REACTION"
+	failureReactionEnvName = "DISCORD_FAILURE_REACTION"
+
+	respondOnlyToCreatorEnvName = "DISCORD_RESPOND_ONLY_TO_CREATOR"
+	maxHistoryMessagesEnvName   = "DISCORD_MAX_HISTORY_MESSAGES"
+	ignorePrefixEnvName         = "DISCORD_IGNORE_PREFIX"
+	commandCooldownsEnvName     = "DISCORD_COMMAND_COOLDOWNS"
+	modelPricesEnvName          = "DISCORD_MODEL_PRICES"
+	embedResponsesEnvName       = "DISCORD_EMBED_RESPONSES"
+	streamResponsesEnvName      = "DISCORD_STREAM_RESPONSES"
+	extendRepliesEnvName        = "DISCORD_EXTEND_REPLIES"
+	sendRetryAttemptsEnvName    = "DISCORD_SEND_RETRY_ATTEMPTS"
+	threadTitleWordsEnvName     = "DISCORD_THREAD_TITLE_WORDS"
+	maxPromptLengthEnvName      = "DISCORD_MAX_PROMPT_LENGTH"
+	interactionWorkersEnvName   = "DISCORD_INTERACTION_WORKERS"
+	interactionQueueSizeEnvName = "DISCORD_INTERACTION_QUEUE_SIZE"
+	imagePromptBlocklistEnvName = "DISCORD_IMAGE_PROMPT_BLOCKLIST"
+	allowedUserIDsEnvName       = "DISCORD_ALLOWED_USER_IDS"
+	allowedRoleIDsEnvName       = "DISCORD_ALLOWED_ROLE_IDS"
+	globalCommandsEnvName       = "GLOBAL_COMMANDS"
+	seedEnvName                 = "OPENAI_SEED"
+	logProbsEnvName             = "OPENAI_LOGPROBS"
+	presencePenaltyEnvName      = "OPENAI_PRESENCE_PENALTY"
+	frequencyPenaltyEnvName     = "OPENAI_FREQUENCY_PENALTY"
+	maxBotReplyDepthEnvName     = "DISCORD_MAX_BOT_REPLY_DEPTH"
+	languageEnvName             = "DISCORD_LANGUAGE"
+	allowedModelsEnvName        = "DISCORD_ALLOWED_MODELS"
+	deniedChannelsEnvName       = "DISCORD_DENIED_CHANNELS"
+	reconcileIntervalEnvName    = "DISCORD_RECONCILE_INTERVAL"
+	expiryMarginEnvName         = "DISCORD_INTERACTION_EXPIRY_MARGIN"
+	stopSequencesEnvName        = "OPENAI_STOP_SEQUENCES"
+	fallbackModelsEnvName       = "OPENAI_FALLBACK_MODELS"
+	enableModerationEnvName     = "ENABLE_MODERATION"
+	toolsEnvName                = "OPENAI_TOOLS"
 )
 
 var (
+	defaultHealthPort = "8080"
+
 	lockMaxShards                = 2
 	lockLeaseDurationSeconds     = 10
 	lockHeartbeatIntervalSeconds = 3
@@ -67,8 +145,12 @@ func getLockClient(zlog *zerolog.Logger) (aws.LockClient, error) {
 	config := aws.DynamoDBLockConfig{
 		Owner:                    hostIdentifier,
 		MaxShards:                lockMaxShards,
-		LeaseDurationSeconds:     lockLeaseDurationSeconds,
-		HeartbeatIntervalSeconds: lockHeartbeatIntervalSeconds,
+		LeaseDurationSeconds:     getPositiveInt(lockLeaseEnvName, lockLeaseDurationSeconds, zlog),
+		HeartbeatIntervalSeconds: getPositiveInt(lockHeartbeatEnvName, lockHeartbeatIntervalSeconds, zlog),
+		CreateTable:              os.Getenv(createLockTableEnvName) == "true",
+	}
+	if err := config.Validate(); err != nil {
+		zlog.Fatal().Err(err).Msgf("Invalid %s or %s environment variable", lockLeaseEnvName, lockHeartbeatEnvName)
 	}
 
 	dynamodbLockClient, err := aws.NewDynamoDBLockClient(
@@ -78,23 +160,533 @@ func getLockClient(zlog *zerolog.Logger) (aws.LockClient, error) {
 		zlog,
 	)
 	if err != nil {
-		return nil, err
+		if !shouldFallBackToInMemoryLock(err, getLockRequired(zlog)) {
+			return nil, err
+		}
+		zlog.Warn().Err(err).Msgf(
+			"DynamoDB lock table is unavailable and %s=false, falling back to in-memory locks. "+
+				"ONLY RUN ONE INSTANCE OF THE BOT: several instances would each respond to every interaction.",
+			lockRequiredEnvName)
+		return aws.NewInMemoryLockClient(hostIdentifier, zlog), nil
 	}
 	return dynamodbLockClient, nil
 }
 
+// getLockRequired returns LOCK_REQUIRED, which defaults to true.
+func getLockRequired(zlog *zerolog.Logger) bool {
+	value, ok := os.LookupEnv(lockRequiredEnvName)
+	if !ok {
+		return true
+	}
+	required, err := strconv.ParseBool(value)
+	if err != nil {
+		zlog.Fatal().Err(err).Msgf("Invalid %s environment variable, must be true or false", lockRequiredEnvName)
+	}
+	return required
+}
+
+// shouldFallBackToInMemoryLock returns whether the bot should use in-memory locks after creating the DynamoDB lock
+// client failed with err. It only does if locks are not required and the table is unavailable; other errors, such as
+// invalid config, are still fatal.
+func shouldFallBackToInMemoryLock(err error, lockRequired bool) bool {
+	return !lockRequired && errors.Is(err, aws.LockTableUnavailableError)
+}
+
+// getComponentSettings returns the non-secret settings of the OpenAI and lock clients and the AWS resources, for the
+// config command. Secrets such as OPENAI_TOKEN must never be added.
+func getComponentSettings(zlog *zerolog.Logger) map[string]string {
+	budgets := getTokenBudgets(zlog)
+	maxConcurrentCompletions := getMaxConcurrentCompletions(zlog)
+	httpConfig := getHTTPConfig(maxConcurrentCompletions, zlog)
+	breakerConfig := getCircuitBreakerConfig(zlog)
+	if maxConcurrentCompletions <= 0 {
+		maxConcurrentCompletions = openai.DefaultMaxConcurrentCompletions
+	}
+	return map[string]string{
+		"openai_mock":              fmt.Sprint(os.Getenv(openaiMockEnvName) == "1"),
+		"openai_organization":      os.Getenv(openaiOrgIDEnvName),
+		"openai_project":           os.Getenv(openaiProjectEnvName),
+		"openai_budget_complete":   strconv.Itoa(budgets.Complete),
+		"openai_budget_chat":       strconv.Itoa(budgets.Chat),
+		"openai_budget_title":      strconv.Itoa(budgets.Title),
+		"openai_budget_summary":    strconv.Itoa(budgets.ConversationSummary),
+		"openai_max_concurrent":    strconv.Itoa(maxConcurrentCompletions),
+		"openai_http_timeout":      httpConfig.Timeout.String(),
+		"openai_http_idle_timeout": httpConfig.IdleConnTimeout.String(),
+		"openai_breaker_threshold": strconv.Itoa(breakerConfig.FailureThreshold),
+		"openai_breaker_cooldown":  breakerConfig.Cooldown.String(),
+		"lock_table":               os.Getenv(lockTableNameEnvName),
+		"lock_lease_seconds":       strconv.Itoa(getPositiveInt(lockLeaseEnvName, lockLeaseDurationSeconds, zlog)),
+		"lock_heartbeat_seconds":   strconv.Itoa(getPositiveInt(lockHeartbeatEnvName, lockHeartbeatIntervalSeconds, zlog)),
+		"lock_required":            fmt.Sprint(getLockRequired(zlog)),
+		"aws_region":               os.Getenv(awsRegionEnvName),
+		"transcript_bucket":        os.Getenv(transcriptBucketEnvName),
+		"template_table":           os.Getenv(templateTableNameEnvName),
+	}
+}
+
+// getOrganization returns the OpenAI organization and project to attribute usage to, which are empty if not set.
+func getOrganization() openai.Organization {
+	return openai.Organization{
+		OrgID:     os.Getenv(openaiOrgIDEnvName),
+		ProjectID: os.Getenv(openaiProjectEnvName),
+	}
+}
+
+// getTokenBudgets returns the default token budgets, overridden by any budget environment variables that are set.
+func getTokenBudgets(zlog *zerolog.Logger) openai.TokenBudgets {
+	budgets := openai.DefaultTokenBudgets()
+	for envName, budget := range map[string]*int{
+		completeMaxTokensEnvName:            &budgets.Complete,
+		chatMaxTokensEnvName:                &budgets.Chat,
+		titleMaxTokensEnvName:               &budgets.Title,
+		conversationSummaryMaxTokensEnvName: &budgets.ConversationSummary,
+	} {
+		value, ok := os.LookupEnv(envName)
+		if !ok {
+			continue
+		}
+		maxTokens, err := strconv.Atoi(value)
+		if err != nil || maxTokens <= 0 {
+			zlog.Fatal().Err(err).Msgf("Invalid %s environment variable, must be a positive integer", envName)
+		}
+		*budget = maxTokens
+	}
+	return budgets
+}
+
+// getPositiveInt returns the environment variable envName as a positive integer, or defaultValue if it is not set.
+func getPositiveInt(envName string, defaultValue int, zlog *zerolog.Logger) int {
+	value, ok := os.LookupEnv(envName)
+	if !ok {
+		return defaultValue
+	}
+	result, err := strconv.Atoi(value)
+	if err != nil || result <= 0 {
+		zlog.Fatal().Err(err).Msgf("Invalid %s environment variable, must be a positive integer", envName)
+	}
+	return result
+}
+
+// getPenalty returns the OpenAI penalty in envName, or zero if it is not set.
+func getPenalty(envName string, zlog *zerolog.Logger) float32 {
+	value, ok := os.LookupEnv(envName)
+	if !ok {
+		return 0
+	}
+	penalty, err := strconv.ParseFloat(value, 32)
+	if err == nil {
+		err = openai.ValidatePenalties(float32(penalty))
+	}
+	if err != nil {
+		zlog.Fatal().Err(err).Msgf("Invalid %s environment variable, must be between -2.0 and 2.0", envName)
+	}
+	return float32(penalty)
+}
+
+// getMaxConcurrentCompletions returns OPENAI_MAX_CONCURRENT_COMPLETIONS, or zero to use the default if it is not set.
+func getMaxConcurrentCompletions(zlog *zerolog.Logger) int {
+	value, ok := os.LookupEnv(maxConcurrentCompletionsEnvName)
+	if !ok {
+		return 0
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 {
+		zlog.Fatal().Err(err).Msgf("Invalid %s environment variable, must be a positive integer", maxConcurrentCompletionsEnvName)
+	}
+	return limit
+}
+
+// getHTTPConfig returns the default OpenAI HTTP client config, overridden by OPENAI_HTTP_TIMEOUT,
+// OPENAI_HTTP_RESPONSE_HEADER_TIMEOUT, and OPENAI_HTTP_IDLE_CONN_TIMEOUT (durations, e.g. 2m) if set. The idle
+// connection pool is sized to the number of concurrent completions.
+func getHTTPConfig(maxConcurrentCompletions int, zlog *zerolog.Logger) openai.HTTPConfig {
+	config := openai.DefaultHTTPConfig()
+	for envName, timeout := range map[string]*time.Duration{
+		httpTimeoutEnvName:               &config.Timeout,
+		httpResponseHeaderTimeoutEnvName: &config.ResponseHeaderTimeout,
+		httpIdleConnTimeoutEnvName:       &config.IdleConnTimeout,
+	} {
+		value, ok := os.LookupEnv(envName)
+		if !ok {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			zlog.Fatal().Err(err).Msgf("Invalid %s environment variable, must be a positive duration", envName)
+		}
+		*timeout = duration
+	}
+	if maxConcurrentCompletions > 0 {
+		config.MaxIdleConnsPerHost = maxConcurrentCompletions
+	}
+	return config
+}
+
+// getCircuitBreakerConfig returns the default circuit breaker config, overridden by OPENAI_BREAKER_FAILURE_THRESHOLD and
+// OPENAI_BREAKER_COOLDOWN (a duration, e.g. 30s) if set.
+func getCircuitBreakerConfig(zlog *zerolog.Logger) openai.CircuitBreakerConfig {
+	config := openai.DefaultCircuitBreakerConfig()
+	if value, ok := os.LookupEnv(breakerFailureThresholdEnvName); ok {
+		threshold, err := strconv.Atoi(value)
+		if err != nil || threshold <= 0 {
+			zlog.Fatal().Err(err).Msgf("Invalid %s environment variable, must be a positive integer", breakerFailureThresholdEnvName)
+		}
+		config.FailureThreshold = threshold
+	}
+	if value, ok := os.LookupEnv(breakerCooldownEnvName); ok {
+		cooldown, err := time.ParseDuration(value)
+		if err != nil || cooldown <= 0 {
+			zlog.Fatal().Err(err).Msgf("Invalid %s environment variable, must be a positive duration", breakerCooldownEnvName)
+		}
+		config.Cooldown = cooldown
+	}
+	return config
+}
+
+// getInitialPrompt returns the initial prompt from INITIAL_PROMPT, or else read from the file at INITIAL_PROMPT_FILE.
+// It returns an empty string if neither is set, meaning the embedded default is used.
+func getInitialPrompt(zlog *zerolog.Logger) (string, error) {
+	if prompt, ok := os.LookupEnv(initialPromptEnvName); ok && strings.TrimSpace(prompt) != "" {
+		zlog.Info().Msgf("Using initial prompt from %s", initialPromptEnvName)
+		return prompt, nil
+	}
+	path, ok := os.LookupEnv(initialPromptFileEnvName)
+	if !ok || path == "" {
+		return "", nil
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read %s %q: %w", initialPromptFileEnvName, path, err)
+	}
+	if strings.TrimSpace(string(contents)) == "" {
+		return "", fmt.Errorf("%s %q is empty", initialPromptFileEnvName, path)
+	}
+	zlog.Info().Str("path", path).Msgf("Using initial prompt from %s", initialPromptFileEnvName)
+	return string(contents), nil
+}
+
+// locksHandler serves the locks this process holds as JSON, for debugging stuck work.
+func locksHandler(lockClient aws.LockClient) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"owner": lockClient.Owner(),
+			"locks": lockClient.ListOwnedLocks(),
+		})
+	})
+}
+
+// getTranscriptWriter returns an S3 transcript writer if TRANSCRIPT_BUCKET is set, otherwise nil, which disables
+// transcripts.
+func getTranscriptWriter(zlog *zerolog.Logger) (aws.TranscriptWriter, error) {
+	bucket, ok := os.LookupEnv(transcriptBucketEnvName)
+	if !ok || bucket == "" {
+		zlog.Info().Msg("Transcripts disabled")
+		return nil, nil
+	}
+	awsRegion, ok := os.LookupEnv(awsRegionEnvName)
+	if !ok {
+		zlog.Fatal().Msgf("Missing %s environment variable", awsRegionEnvName)
+	}
+	zlog.Info().Str("bucket", bucket).Msg("Uploading transcripts to S3")
+	return aws.NewS3TranscriptWriter(bucket, awsRegion, zlog)
+}
+
+// getTemplateStore returns a DynamoDB template store if TEMPLATE_TABLE_NAME is set, otherwise nil, which disables the
+// template and use commands.
+func getTemplateStore(zlog *zerolog.Logger) (aws.TemplateStore, error) {
+	tableName, ok := os.LookupEnv(templateTableNameEnvName)
+	if !ok || tableName == "" {
+		zlog.Info().Msg("Prompt templates disabled")
+		return nil, nil
+	}
+	awsRegion, ok := os.LookupEnv(awsRegionEnvName)
+	if !ok {
+		zlog.Fatal().Msgf("Missing %s environment variable", awsRegionEnvName)
+	}
+	zlog.Info().Str("table", tableName).Msg("Storing prompt templates in DynamoDB")
+	return aws.NewDynamoDBTemplateStore(tableName, awsRegion, zlog)
+}
+
+func getDiscordConfig(componentSettings map[string]string, zlog *zerolog.Logger) discord.Config {
+	config := discord.DefaultConfig()
+	config.ComponentSettings = componentSettings
+	if reaction, ok := os.LookupEnv(loadingReactionEnvName); ok {
+		config.LoadingReaction = reaction
+	}
+	if reaction, ok := os.LookupEnv(successReactionEnvName); ok {
+		config.SuccessReaction = reaction
+	}
+	if reaction, ok := os.LookupEnv(failureReactionEnvName); ok {
+		config.FailureReaction = reaction
+	}
+	config.RespondOnlyToCreator = os.Getenv(respondOnlyToCreatorEnvName) == "1"
+	if value, ok := os.LookupEnv(maxBotReplyDepthEnvName); ok {
+		depth, err := strconv.Atoi(value)
+		if err != nil || depth < 0 {
+			zlog.Fatal().Err(err).Msgf("Invalid %s environment variable, must be a non-negative integer", maxBotReplyDepthEnvName)
+		}
+		config.MaxBotReplyDepth = depth
+	}
+	if value, ok := os.LookupEnv(maxHistoryMessagesEnvName); ok {
+		maxHistoryMessages, err := strconv.Atoi(value)
+		if err != nil {
+			zlog.Fatal().Err(err).Msgf("Invalid %s environment variable", maxHistoryMessagesEnvName)
+		}
+		config.MaxHistoryMessages = maxHistoryMessages
+	}
+	if value, ok := os.LookupEnv(sendRetryAttemptsEnvName); ok {
+		attempts, err := strconv.Atoi(value)
+		if err != nil || attempts <= 0 {
+			zlog.Fatal().Err(err).Msgf("Invalid %s environment variable, must be a positive integer", sendRetryAttemptsEnvName)
+		}
+		config.SendRetryAttempts = attempts
+	}
+	config.ThreadTitleWords = getPositiveInt(threadTitleWordsEnvName, config.ThreadTitleWords, zlog)
+	if value, ok := os.LookupEnv(maxPromptLengthEnvName); ok {
+		maxPromptLength, err := strconv.Atoi(value)
+		if err != nil {
+			zlog.Fatal().Err(err).Msgf("Invalid %s environment variable", maxPromptLengthEnvName)
+		}
+		config.MaxPromptLength = maxPromptLength
+	}
+	config.InteractionWorkers = getPositiveInt(interactionWorkersEnvName, config.InteractionWorkers, zlog)
+	config.InteractionQueueSize = getPositiveInt(interactionQueueSizeEnvName, config.InteractionQueueSize, zlog)
+	config.IgnorePrefix = os.Getenv(ignorePrefixEnvName)
+	config.EmbedResponses = os.Getenv(embedResponsesEnvName) == "1"
+	config.StreamResponses = os.Getenv(streamResponsesEnvName) == "1"
+	config.ExtendReplies = os.Getenv(extendRepliesEnvName) == "1"
+	config.AllowedUserIDs = splitList(os.Getenv(allowedUserIDsEnvName))
+	config.AllowedRoleIDs = splitList(os.Getenv(allowedRoleIDsEnvName))
+	config.GlobalCommands = os.Getenv(globalCommandsEnvName) == "1"
+	config.EnableModeration = os.Getenv(enableModerationEnvName) == "1"
+	if value, ok := os.LookupEnv(seedEnvName); ok {
+		seed, err := strconv.Atoi(value)
+		if err != nil {
+			zlog.Fatal().Err(err).Msgf("Invalid %s environment variable", seedEnvName)
+		}
+		config.Seed = &seed
+	}
+	config.LogProbs = os.Getenv(logProbsEnvName) == "1"
+	config.PresencePenalty = getPenalty(presencePenaltyEnvName, zlog)
+	config.FrequencyPenalty = getPenalty(frequencyPenaltyEnvName, zlog)
+	config.Language = strings.TrimSpace(os.Getenv(languageEnvName))
+	if value, ok := os.LookupEnv(reconcileIntervalEnvName); ok {
+		interval, err := time.ParseDuration(value)
+		if err != nil {
+			zlog.Fatal().Err(err).Msgf("Invalid %s environment variable, must be a duration, or 0 to disable", reconcileIntervalEnvName)
+		}
+		config.ReconcileInterval = interval
+	}
+	if value, ok := os.LookupEnv(expiryMarginEnvName); ok {
+		margin, err := time.ParseDuration(value)
+		if err != nil || margin < 0 || margin >= 15*time.Minute {
+			zlog.Fatal().Err(err).Msgf("Invalid %s environment variable, must be a duration under 15m", expiryMarginEnvName)
+		}
+		config.InteractionExpiryMargin = margin
+	}
+	config.DeniedChannels = splitList(os.Getenv(deniedChannelsEnvName))
+	if value, ok := os.LookupEnv(allowedModelsEnvName); ok {
+		config.AllowedModels = splitList(value)
+	}
+	if value, ok := os.LookupEnv(commandCooldownsEnvName); ok {
+		config.CommandCooldowns = getCommandCooldowns(value, zlog)
+	}
+	if value, ok := os.LookupEnv(modelPricesEnvName); ok {
+		for model, price := range getModelPrices(value, zlog) {
+			config.ModelPrices[model] = price
+		}
+	}
+	if value, ok := os.LookupEnv(stopSequencesEnvName); ok {
+		config.Stop = splitList(value)
+		if err := openai.ValidateStopSequences(config.Stop); err != nil {
+			zlog.Fatal().Err(err).Msgf("Invalid %s environment variable", stopSequencesEnvName)
+		}
+	}
+	config.FallbackModels = splitList(os.Getenv(fallbackModelsEnvName))
+	for _, name := range splitList(os.Getenv(toolsEnvName)) {
+		tool, ok := openai.BuiltinTool(name)
+		if !ok {
+			zlog.Fatal().Str("tool", name).Msgf("Invalid %s environment variable, unknown tool", toolsEnvName)
+		}
+		config.Tools = append(config.Tools, tool)
+	}
+	if value, ok := os.LookupEnv(imagePromptBlocklistEnvName); ok {
+		// Patterns are one per line, since regular expressions often contain commas.
+		blocklist, err := discord.CompilePromptBlocklist(strings.Split(value, "\n"))
+		if err != nil {
+			zlog.Fatal().Err(err).Msgf("Invalid %s environment variable", imagePromptBlocklistEnvName)
+		}
+		config.ImagePromptBlocklist = blocklist
+	}
+	return config
+}
+
+// getCommandCooldowns parses DISCORD_COMMAND_COOLDOWNS, a comma-separated list of command=seconds pairs, e.g.
+// "image=30,image-edit=60". A command with zero seconds has no cooldown.
+func getCommandCooldowns(value string, zlog *zerolog.Logger) map[string]time.Duration {
+	cooldowns := make(map[string]time.Duration)
+	for _, entry := range splitList(value) {
+		command, secondsValue, found := strings.Cut(entry, "=")
+		seconds, err := strconv.Atoi(strings.TrimSpace(secondsValue))
+		if !found || err != nil || seconds < 0 {
+			zlog.Fatal().Err(err).Str("entry", entry).Msgf(
+				"Invalid %s environment variable, must be comma-separated command=seconds pairs", commandCooldownsEnvName)
+		}
+		cooldowns[strings.TrimSpace(command)] = time.Duration(seconds) * time.Second
+	}
+	return cooldowns
+}
+
+// getModelPrices parses comma-separated model=prompt:completion entries, where prompt and completion are US dollars
+// per thousand tokens, e.g. gpt-4=0.03:0.06.
+func getModelPrices(value string, zlog *zerolog.Logger) map[string]discord.ModelPrice {
+	prices := make(map[string]discord.ModelPrice)
+	for _, entry := range splitList(value) {
+		model, priceValue, found := strings.Cut(entry, "=")
+		promptValue, completionValue, hasCompletion := strings.Cut(priceValue, ":")
+		prompt, promptErr := strconv.ParseFloat(strings.TrimSpace(promptValue), 64)
+		completion, completionErr := strconv.ParseFloat(strings.TrimSpace(completionValue), 64)
+		err := promptErr
+		if err == nil {
+			err = completionErr
+		}
+		if !found || !hasCompletion || err != nil || prompt < 0 || completion < 0 {
+			zlog.Fatal().Err(err).Str("entry", entry).Msgf(
+				"Invalid %s environment variable, must be comma-separated model=prompt:completion prices", modelPricesEnvName)
+		}
+		prices[strings.TrimSpace(model)] = discord.ModelPrice{PromptPer1K: prompt, CompletionPer1K: completion}
+	}
+	return prices
+}
+
+// getGuildIDs returns the comma-separated guild IDs in DISCORD_GUILD_IDS, falling back to the single DISCORD_GUILD_ID.
+func getGuildIDs() []discord.GuildID {
+	value, ok := os.LookupEnv(guildIDsEnvName)
+	if !ok {
+		value = os.Getenv(guildIDTokenEnvName)
+	}
+	guildIDs := make([]discord.GuildID, 0)
+	for _, guildID := range splitList(value) {
+		guildIDs = append(guildIDs, discord.GuildID(guildID))
+	}
+	return guildIDs
+}
+
+// splitList splits a comma-separated list, dropping empty entries.
+func splitList(value string) []string {
+	result := make([]string, 0)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry != "" {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// parseLogLevel parses one of trace, debug, info, warn, or error, case-insensitively.
+func parseLogLevel(value string) (zerolog.Level, bool) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "trace":
+		return zerolog.TraceLevel, true
+	case "debug":
+		return zerolog.DebugLevel, true
+	case "info":
+		return zerolog.InfoLevel, true
+	case "warn":
+		return zerolog.WarnLevel, true
+	case "error":
+		return zerolog.ErrorLevel, true
+	default:
+		return zerolog.InfoLevel, false
+	}
+}
+
+// parseLogFormat parses json or console, case-insensitively, and returns whether the format is console.
+func parseLogFormat(value string) (bool, bool) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "json":
+		return false, true
+	case "console":
+		return true, true
+	default:
+		return false, false
+	}
+}
+
+// newLogger returns a logger writing to out with the given level and format. Empty values use the defaults of info and
+// json; invalid values log a warning and fall back to the defaults.
+func newLogger(levelName string, formatName string, out io.Writer) zerolog.Logger {
+	level, validLevel := parseLogLevel(levelName)
+	console, validFormat := parseLogFormat(formatName)
+
+	if console {
+		out = zerolog.ConsoleWriter{Out: out, TimeFormat: time.RFC3339}
+	}
+	zlog := zerolog.New(out).Level(level).With().Timestamp().Caller().Logger()
+
+	if levelName != "" && !validLevel {
+		zlog.Warn().Str("value", levelName).Msgf("Invalid %s, falling back to info", logLevelEnvName)
+	}
+	if formatName != "" && !validFormat {
+		zlog.Warn().Str("value", formatName).Msgf("Invalid %s, falling back to json", logFormatEnvName)
+	}
+	return zlog
+}
+
 func main() {
-	zlog := zerolog.New(os.Stdout).With().Timestamp().Logger()
 	zerolog.TimeFieldFormat = time.RFC3339Nano
 	zerolog.ErrorStackMarshaler = pkgerrors.MarshalStack
-	zlog = zlog.Level(zerolog.DebugLevel).With().Caller().Logger()
+	zlog := newLogger(os.Getenv(logLevelEnvName), os.Getenv(logFormatEnvName), os.Stdout)
 
-	openaiToken, ok := os.LookupEnv(openaiTokenEnvName)
+	healthPort, ok := os.LookupEnv(healthPortEnvName)
 	if !ok {
-		zlog.Fatal().Msgf("Missing %s environment variable", openaiTokenEnvName)
+		healthPort = defaultHealthPort
+	}
+	healthServer := health.NewServer(healthPort, &zlog)
+	healthServer.Handle("/metrics", promhttp.Handler())
+	healthServer.Start()
+	defer func(healthServer *health.Server) {
+		zlog.Info().Msg("Closing health check server")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := healthServer.Close(ctx)
+		if err != nil {
+			zlog.Error().Err(err).Msg("Failed to close health check server")
+		}
+	}(healthServer)
+
+	var openaiClient openai.OpenAIClient
+	if os.Getenv(openaiMockEnvName) == "1" {
+		zlog.Warn().Msg("Using mock OpenAI client, responses are canned")
+		openaiClient = openai.NewMockOpenAI()
+	} else {
+		openaiToken, ok := os.LookupEnv(openaiTokenEnvName)
+		if !ok {
+			zlog.Fatal().Msgf("Missing %s environment variable", openaiTokenEnvName)
+		}
+		initialPrompt, err := getInitialPrompt(&zlog)
+		if err != nil {
+			zlog.Fatal().Err(err).Msg("Failed to load initial prompt")
+		}
+		organization := getOrganization()
+		maxConcurrentCompletions := getMaxConcurrentCompletions(&zlog)
+		openaiClient = openai.NewOpenAI(
+			openaiToken,
+			initialPrompt,
+			getTokenBudgets(&zlog),
+			organization,
+			maxConcurrentCompletions,
+			getHTTPConfig(maxConcurrentCompletions, &zlog),
+			&zlog,
+		)
 	}
-	openaiClient := openai.NewOpenAI(openaiToken)
-	defer func(openaiClient *openai.OpenAI) {
+	breaker := openai.NewCircuitBreaker(openaiClient, getCircuitBreakerConfig(&zlog), &zlog)
+	healthServer.AddReadinessCheck("openai", breaker.Healthy)
+	openaiClient = breaker
+	defer func(openaiClient openai.OpenAIClient) {
 		err := openaiClient.Close(&zlog)
 		if err != nil {
 			zlog.Error().Err(err).Msg("Failed to close openai client")
@@ -112,21 +704,35 @@ func main() {
 			zlog.Error().Err(err).Msg("Failed to close lock client")
 		}
 	}(lockClient)
+	healthServer.AddLivenessCheck("lock", lockClient.Healthy)
+	healthServer.Handle("/debug/locks", locksHandler(lockClient))
 
 	discordToken, ok := os.LookupEnv(discordTokenEnvName)
 	if !ok {
 		zlog.Fatal().Msgf("Missing %s environment variable", discordTokenEnvName)
 	}
-	guildID, ok := os.LookupEnv(guildIDTokenEnvName)
-	if !ok {
-		zlog.Fatal().Msgf("Missing %s environment variable", guildIDTokenEnvName)
+	guildIDs := getGuildIDs()
+	if len(guildIDs) == 0 {
+		zlog.Fatal().Msgf("Missing %s environment variable", guildIDsEnvName)
+	}
+
+	transcripts, err := getTranscriptWriter(&zlog)
+	if err != nil {
+		zlog.Fatal().Err(err).Msg("Failed to create transcript writer")
+	}
+	templates, err := getTemplateStore(&zlog)
+	if err != nil {
+		zlog.Fatal().Err(err).Msg("Failed to create template store")
 	}
 
 	discordBot, err := discord.NewDiscord(
 		discordToken,
 		openaiClient,
 		lockClient,
-		guildID,
+		transcripts,
+		templates,
+		guildIDs,
+		getDiscordConfig(getComponentSettings(&zlog), &zlog),
 		&zlog)
 	if err != nil {
 		fmt.Println(err)
@@ -139,6 +745,8 @@ func main() {
 			zlog.Error().Err(err).Msg("Failed to close discord bot")
 		}
 	}(discordBot)
+	healthServer.AddLivenessCheck("discord", discordBot.Healthy)
+	healthServer.SetReady(true)
 
 	zlog.Info().Msg("Bot is now running. Press CTRL-C to exit.")
 	sc := make(chan os.Signal, 1)
@@ -146,4 +754,5 @@ func main() {
 	<-sc
 
 	zlog.Info().Msg("Bot is now exiting.")
+	healthServer.SetReady(false)
 }
@@ -0,0 +1,312 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"src/aws"
+	"src/discord"
+	"src/openai"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		value     string
+		wantLevel zerolog.Level
+		wantOK    bool
+	}{
+		{value: "trace", wantLevel: zerolog.TraceLevel, wantOK: true},
+		{value: "debug", wantLevel: zerolog.DebugLevel, wantOK: true},
+		{value: "info", wantLevel: zerolog.InfoLevel, wantOK: true},
+		{value: "warn", wantLevel: zerolog.WarnLevel, wantOK: true},
+		{value: "error", wantLevel: zerolog.ErrorLevel, wantOK: true},
+		{value: " DEBUG ", wantLevel: zerolog.DebugLevel, wantOK: true},
+		{value: "", wantLevel: zerolog.InfoLevel, wantOK: false},
+		{value: "verbose", wantLevel: zerolog.InfoLevel, wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			level, ok := parseLogLevel(tt.value)
+			if level != tt.wantLevel || ok != tt.wantOK {
+				t.Errorf("parseLogLevel(%q) = %v, %v, want %v, %v", tt.value, level, ok, tt.wantLevel, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestParseLogFormat(t *testing.T) {
+	tests := []struct {
+		value       string
+		wantConsole bool
+		wantOK      bool
+	}{
+		{value: "json", wantConsole: false, wantOK: true},
+		{value: "console", wantConsole: true, wantOK: true},
+		{value: "Console", wantConsole: true, wantOK: true},
+		{value: "", wantConsole: false, wantOK: false},
+		{value: "text", wantConsole: false, wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			console, ok := parseLogFormat(tt.value)
+			if console != tt.wantConsole || ok != tt.wantOK {
+				t.Errorf("parseLogFormat(%q) = %v, %v, want %v, %v", tt.value, console, ok, tt.wantConsole, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	tests := []struct {
+		name        string
+		level       string
+		format      string
+		wantLevel   zerolog.Level
+		wantWarning string
+		wantJSON    bool
+	}{
+		{name: "defaults", wantLevel: zerolog.InfoLevel, wantJSON: true},
+		{name: "debug console", level: "debug", format: "console", wantLevel: zerolog.DebugLevel},
+		{name: "invalid level", level: "verbose", wantLevel: zerolog.InfoLevel, wantWarning: logLevelEnvName, wantJSON: true},
+		{name: "invalid format", format: "text", wantLevel: zerolog.InfoLevel, wantWarning: logFormatEnvName, wantJSON: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			zlog := newLogger(tt.level, tt.format, &buf)
+
+			if got := zlog.GetLevel(); got != tt.wantLevel {
+				t.Errorf("newLogger() level = %v, want %v", got, tt.wantLevel)
+			}
+			if tt.wantWarning != "" && !strings.Contains(buf.String(), tt.wantWarning) {
+				t.Errorf("newLogger() logged %q, want a warning about %s", buf.String(), tt.wantWarning)
+			}
+			if tt.wantWarning == "" && buf.Len() != 0 {
+				t.Errorf("newLogger() logged %q, want nothing", buf.String())
+			}
+
+			buf.Reset()
+			zlog.Info().Msg("hello")
+			if isJSON := strings.HasPrefix(buf.String(), "{"); isJSON != tt.wantJSON {
+				t.Errorf("newLogger() wrote %q, want JSON %v", buf.String(), tt.wantJSON)
+			}
+		})
+	}
+}
+
+func TestGetGuildIDs(t *testing.T) {
+	tests := []struct {
+		name     string
+		guildIDs *string // DISCORD_GUILD_IDS, unset if nil
+		guildID  string  // DISCORD_GUILD_ID
+		want     []discord.GuildID
+	}{
+		{name: "list", guildIDs: stringPointer("1, 2,,3 "), want: []discord.GuildID{"1", "2", "3"}},
+		{name: "list takes precedence", guildIDs: stringPointer("1"), guildID: "9", want: []discord.GuildID{"1"}},
+		{name: "single guild fallback", guildID: "9", want: []discord.GuildID{"9"}},
+		{name: "neither set", want: []discord.GuildID{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(guildIDTokenEnvName, tt.guildID)
+			t.Setenv(guildIDsEnvName, "")
+			if tt.guildIDs != nil {
+				t.Setenv(guildIDsEnvName, *tt.guildIDs)
+			} else if err := os.Unsetenv(guildIDsEnvName); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := getGuildIDs(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getGuildIDs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func stringPointer(s string) *string {
+	return &s
+}
+
+func TestGetInitialPrompt(t *testing.T) {
+	dir := t.TempDir()
+	promptFile := filepath.Join(dir, "prompt.txt")
+	if err := os.WriteFile(promptFile, []byte("You are a pirate."), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	emptyFile := filepath.Join(dir, "empty.txt")
+	if err := os.WriteFile(emptyFile, []byte(" \n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		prompt  string
+		file    string
+		want    string
+		wantErr bool
+	}{
+		{name: "env takes precedence over file", prompt: "You are a poet.", file: promptFile, want: "You are a poet."},
+		{name: "file", file: promptFile, want: "You are a pirate."},
+		{name: "blank env falls back to file", prompt: "  ", file: promptFile, want: "You are a pirate."},
+		{name: "neither uses the embedded default", want: ""},
+		{name: "missing file", file: filepath.Join(dir, "missing.txt"), wantErr: true},
+		{name: "empty file", file: emptyFile, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(initialPromptEnvName, tt.prompt)
+			t.Setenv(initialPromptFileEnvName, tt.file)
+			zlog := zerolog.Nop()
+
+			got, err := getInitialPrompt(&zlog)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getInitialPrompt() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("getInitialPrompt() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetTokenBudgets(t *testing.T) {
+	t.Setenv(completeMaxTokensEnvName, "100")
+	t.Setenv(titleMaxTokensEnvName, "10")
+	zlog := zerolog.Nop()
+
+	want := openai.DefaultTokenBudgets()
+	want.Complete = 100
+	want.Title = 10
+	if got := getTokenBudgets(&zlog); got != want {
+		t.Errorf("getTokenBudgets() = %+v, want %+v", got, want)
+	}
+}
+
+func TestGetOrganization(t *testing.T) {
+	t.Setenv(openaiOrgIDEnvName, "org-123")
+	t.Setenv(openaiProjectEnvName, "proj_456")
+
+	want := openai.Organization{OrgID: "org-123", ProjectID: "proj_456"}
+	if got := getOrganization(); got != want {
+		t.Errorf("getOrganization() = %+v, want %+v", got, want)
+	}
+}
+
+func TestGetPositiveInt(t *testing.T) {
+	zlog := zerolog.Nop()
+	t.Setenv(lockLeaseEnvName, "30")
+	if got := getPositiveInt(lockLeaseEnvName, lockLeaseDurationSeconds, &zlog); got != 30 {
+		t.Errorf("getPositiveInt() = %d, want 30", got)
+	}
+	if got := getPositiveInt("UNSET_LOCK_SECONDS", lockLeaseDurationSeconds, &zlog); got != lockLeaseDurationSeconds {
+		t.Errorf("getPositiveInt() = %d, want the default %d", got, lockLeaseDurationSeconds)
+	}
+}
+
+func TestGetHTTPConfig(t *testing.T) {
+	t.Setenv(httpTimeoutEnvName, "2m")
+	t.Setenv(httpIdleConnTimeoutEnvName, "45s")
+	zlog := zerolog.Nop()
+
+	want := openai.DefaultHTTPConfig()
+	want.Timeout = 2 * time.Minute
+	want.IdleConnTimeout = 45 * time.Second
+	want.MaxIdleConnsPerHost = 8
+	if got := getHTTPConfig(8, &zlog); got != want {
+		t.Errorf("getHTTPConfig() = %+v, want %+v", got, want)
+	}
+}
+
+func TestGetModelPrices(t *testing.T) {
+	zlog := zerolog.Nop()
+	got := getModelPrices("gpt-4=0.03:0.06, custom = 0.5 : 1", &zlog)
+	want := map[string]discord.ModelPrice{
+		"gpt-4":  {PromptPer1K: 0.03, CompletionPer1K: 0.06},
+		"custom": {PromptPer1K: 0.5, CompletionPer1K: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("getModelPrices() = %+v, want %+v", got, want)
+	}
+}
+
+func TestShouldFallBackToInMemoryLock(t *testing.T) {
+	unavailable := fmt.Errorf("%w: failed to describe table locks: connection refused", aws.LockTableUnavailableError)
+	tests := []struct {
+		name         string
+		err          error
+		lockRequired bool
+		want         bool
+	}{
+		{name: "table unavailable and locks optional", err: unavailable, want: true},
+		{name: "table unavailable and locks required", err: unavailable, lockRequired: true},
+		{name: "invalid config and locks optional", err: aws.InvalidLockConfigError},
+		{name: "other error and locks optional", err: errors.New("no credentials")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shouldFallBackToInMemoryLock(tt.err, tt.lockRequired); got != tt.want {
+				t.Errorf("shouldFallBackToInMemoryLock(%v, %v) = %v, want %v", tt.err, tt.lockRequired, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetLockRequired(t *testing.T) {
+	zlog := zerolog.Nop()
+	t.Setenv(lockRequiredEnvName, "")
+	os.Unsetenv(lockRequiredEnvName)
+	if !getLockRequired(&zlog) {
+		t.Error("getLockRequired() = false when unset, want true")
+	}
+	t.Setenv(lockRequiredEnvName, "false")
+	if getLockRequired(&zlog) {
+		t.Errorf("getLockRequired() = true with %s=false, want false", lockRequiredEnvName)
+	}
+}
+
+func TestGetComponentSettings(t *testing.T) {
+	zlog := zerolog.Nop()
+	secrets := map[string]string{
+		discordTokenEnvName: "discord-secret",
+		openaiTokenEnvName:  "sk-openai-secret",
+	}
+	for name, value := range secrets {
+		t.Setenv(name, value)
+	}
+	t.Setenv(lockTableNameEnvName, "locks")
+
+	settings := getComponentSettings(&zlog)
+	for name, value := range settings {
+		for _, secret := range secrets {
+			if strings.Contains(value, secret) {
+				t.Errorf("getComponentSettings()[%s] = %q, want no secrets", name, value)
+			}
+		}
+	}
+	if got := settings["lock_table"]; got != "locks" {
+		t.Errorf("getComponentSettings()[lock_table] = %q, want %q", got, "locks")
+	}
+}
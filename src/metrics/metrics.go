@@ -0,0 +1,51 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+// Package metrics defines the bot's Prometheus metrics. They are registered with the default Prometheus registry, and
+// served for scraping by promhttp.Handler. Labels must have bounded cardinality, e.g. a command name and never a user
+// ID.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "openai_discord_bot"
+
+var (
+	CommandsHandled = newCounterVec("commands_handled_total", "Slash commands handled, by command name.", "command")
+	OpenAITokens    = newCounterVec("openai_tokens_total", "OpenAI tokens used, by prompt or completion.", "type")
+	OpenAIRequests  = newCounterVec("openai_requests_total", "OpenAI API requests, by operation.", "operation")
+	Locks           = newCounterVec("locks_total", "Lock events, by acquired, released, or abandoned.", "event")
+	Errors          = newCounterVec("errors_total", "Errors, by component.", "component")
+	LockShards      = newCounterVec("lock_shards_total", "Locks created, by shard.", "shard")
+
+	InteractionsRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "interactions_rejected_total",
+		Help:      "Interactions refused because the queue was full.",
+	})
+)
+
+// newCounterVec creates and registers a counter partitioned by a single label.
+func newCounterVec(name string, help string, labelName string) *prometheus.CounterVec {
+	return promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, []string{labelName})
+}
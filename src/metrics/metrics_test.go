@@ -0,0 +1,87 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestScrapeAfterEvents records events as the call sites do, and checks that a scrape of /metrics reports them.
+func TestScrapeAfterEvents(t *testing.T) {
+	acquiredBefore := testutil.ToFloat64(Locks.WithLabelValues("acquired"))
+
+	CommandsHandled.WithLabelValues("complete").Inc()
+	CommandsHandled.WithLabelValues("complete").Inc()
+	OpenAITokens.WithLabelValues("prompt").Add(12)
+	OpenAITokens.WithLabelValues("completion").Add(30)
+	Locks.WithLabelValues("acquired").Inc()
+	Errors.WithLabelValues("lock").Inc()
+	InteractionsRejected.Inc()
+
+	if got := testutil.ToFloat64(CommandsHandled.WithLabelValues("complete")); got != 2 {
+		t.Errorf("commands handled = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(Locks.WithLabelValues("acquired")) - acquiredBefore; got != 1 {
+		t.Errorf("locks acquired increased by %v, want 1", got)
+	}
+
+	server := httptest.NewServer(promhttp.Handler())
+	defer server.Close()
+	response, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatalf("scrape failed: %v", err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("reading scrape failed: %v", err)
+	}
+	for _, want := range []string{
+		`openai_discord_bot_commands_handled_total{command="complete"} 2`,
+		`openai_discord_bot_openai_tokens_total{type="prompt"} 12`,
+		`openai_discord_bot_openai_tokens_total{type="completion"} 30`,
+		`openai_discord_bot_errors_total{component="lock"} 1`,
+		`openai_discord_bot_interactions_rejected_total 1`,
+		`openai_discord_bot_locks_total{event="acquired"}`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("scrape does not contain %q", want)
+		}
+	}
+}
+
+// TestMetricsLint checks the metrics against Prometheus naming conventions.
+func TestMetricsLint(t *testing.T) {
+	for _, collector := range []interface {
+		Describe(chan<- *prometheus.Desc)
+		Collect(chan<- prometheus.Metric)
+	}{CommandsHandled, OpenAITokens, OpenAIRequests, Locks, Errors, LockShards, InteractionsRejected} {
+		problems, err := testutil.CollectAndLint(collector)
+		if err != nil {
+			t.Fatalf("CollectAndLint() error = %v", err)
+		}
+		for _, problem := range problems {
+			t.Errorf("%s: %s", problem.Metric, problem.Text)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/rs/zerolog"
+	"src/metrics"
+	"sync"
+	"time"
+)
+
+var ServiceUnavailableError = errors.New("OpenAI is temporarily unavailable, please try again later")
+
+type BreakerState int
+
+const (
+	// BreakerClosed lets every call through.
+	BreakerClosed BreakerState = iota
+
+	// BreakerOpen fails every call with ServiceUnavailableError until the cooldown has passed.
+	BreakerOpen
+
+	// BreakerHalfOpen lets a single trial call through. If it succeeds the breaker closes, otherwise it opens again.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+type CircuitBreakerConfig struct {
+	// FailureThreshold is the number of consecutive failures that opens the breaker.
+	FailureThreshold int
+
+	// Cooldown is how long the breaker stays open before letting a trial call through.
+	Cooldown time.Duration
+}
+
+func DefaultCircuitBreakerConfig() CircuitBreakerConfig {
+	return CircuitBreakerConfig{
+		FailureThreshold: 5,
+		Cooldown:         30 * time.Second,
+	}
+}
+
+// CircuitBreaker wraps an OpenAIClient so that, once OpenAI has failed FailureThreshold times in a row, calls fail fast
+// with ServiceUnavailableError for Cooldown rather than each waiting on a request that is likely to fail. Errors caused
+// by the request itself, such as a prompt that is too long, do not count as failures.
+type CircuitBreaker struct {
+	client        OpenAIClient
+	config        CircuitBreakerConfig
+	state         BreakerState
+	failures      int
+	openedAt      time.Time
+	trialInFlight bool
+	mu            sync.Mutex // protects state, failures, openedAt, and trialInFlight
+	now           func() time.Time
+	zlog          *zerolog.Logger
+}
+
+func NewCircuitBreaker(client OpenAIClient, config CircuitBreakerConfig, zlog *zerolog.Logger) *CircuitBreaker {
+	return &CircuitBreaker{
+		client: client,
+		config: config,
+		state:  BreakerClosed,
+		now:    time.Now,
+		zlog:   zlog,
+	}
+}
+
+// State returns the current state of the breaker.
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.updateStateLocked()
+	return b.state
+}
+
+// Healthy returns whether the breaker is letting calls through.
+func (b *CircuitBreaker) Healthy() bool {
+	return b.State() != BreakerOpen
+}
+
+// updateStateLocked moves an open breaker to half-open once the cooldown has passed.
+func (b *CircuitBreaker) updateStateLocked() {
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.config.Cooldown {
+		b.setStateLocked(BreakerHalfOpen)
+	}
+}
+
+func (b *CircuitBreaker) setStateLocked(state BreakerState) {
+	if b.state == state {
+		return
+	}
+	b.zlog.Info().Str("from", b.state.String()).Str("to", state.String()).Msg("OpenAI circuit breaker changed state")
+	b.state = state
+	if state == BreakerOpen {
+		b.openedAt = b.now()
+	}
+}
+
+// allow returns whether a call may proceed. In the half-open state only one trial call is let through at a time.
+func (b *CircuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.updateStateLocked()
+
+	switch b.state {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if b.trialInFlight {
+			return false
+		}
+		b.trialInFlight = true
+	}
+	return true
+}
+
+// record updates the breaker with the outcome of a call that allow let through. Request errors say nothing about whether
+// OpenAI is available, so they leave the breaker as it is.
+func (b *CircuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trialInFlight = false
+
+	if isRequestError(err) {
+		return
+	}
+	if err == nil {
+		b.failures = 0
+		b.setStateLocked(BreakerClosed)
+		return
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.config.FailureThreshold {
+		b.setStateLocked(BreakerOpen)
+	}
+}
+
+// isRequestError returns whether err was caused by the request rather than by OpenAI being unavailable.
+func isRequestError(err error) bool {
+	return errors.Is(err, SystemPromptTooLongError) ||
+		errors.Is(err, MessageTooLongError) ||
+		errors.Is(err, PromptTooLongError) ||
+		errors.Is(err, ToolIterationsExceededError) ||
+		errors.Is(err, TooManyStopSequencesError) ||
+		errors.Is(err, PenaltyOutOfRangeError) ||
+		errors.Is(err, InvalidJSONSchemaError) ||
+		errors.Is(err, InvalidJSONResponseError) ||
+		errors.Is(err, context.Canceled)
+}
+
+func (b *CircuitBreaker) rejected(zlog *zerolog.Logger) error {
+	zlog.Warn().Msg("OpenAI circuit breaker is open, failing fast")
+	metrics.Errors.WithLabelValues("openai_breaker_open").Inc()
+	return ServiceUnavailableError
+}
+
+func (b *CircuitBreaker) CompleteChat(
+	messages []*ChatMessage,
+	options ChatOptions,
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) (*Completion, error) {
+	if !b.allow() {
+		return nil, b.rejected(zlog)
+	}
+	result, err := b.client.CompleteChat(messages, options, ctx, zlog)
+	b.record(err)
+	return result, err
+}
+
+func (b *CircuitBreaker) CompleteChatJSON(
+	messages []*ChatMessage,
+	schema json.RawMessage,
+	options ChatOptions,
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) (json.RawMessage, error) {
+	if !b.allow() {
+		return nil, b.rejected(zlog)
+	}
+	result, err := b.client.CompleteChatJSON(messages, schema, options, ctx, zlog)
+	b.record(err)
+	return result, err
+}
+
+func (b *CircuitBreaker) Complete(
+	prompt string,
+	options CompleteOptions,
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) (*Completion, error) {
+	if !b.allow() {
+		return nil, b.rejected(zlog)
+	}
+	result, err := b.client.Complete(prompt, options, ctx, zlog)
+	b.record(err)
+	return result, err
+}
+
+func (b *CircuitBreaker) CompleteStream(
+	prompt string,
+	options CompleteOptions,
+	onText func(text string),
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) (*Completion, error) {
+	if !b.allow() {
+		return nil, b.rejected(zlog)
+	}
+	result, err := b.client.CompleteStream(prompt, options, onText, ctx, zlog)
+	b.record(err)
+	return result, err
+}
+
+func (b *CircuitBreaker) CreateImage(prompt string, ctx context.Context, zlog *zerolog.Logger) (*CreateImageResponse, error) {
+	if !b.allow() {
+		return nil, b.rejected(zlog)
+	}
+	result, err := b.client.CreateImage(prompt, ctx, zlog)
+	b.record(err)
+	return result, err
+}
+
+func (b *CircuitBreaker) CreateImageVariation(
+	imageData []byte,
+	n int,
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) (*CreateImageResponse, error) {
+	if !b.allow() {
+		return nil, b.rejected(zlog)
+	}
+	result, err := b.client.CreateImageVariation(imageData, n, ctx, zlog)
+	b.record(err)
+	return result, err
+}
+
+func (b *CircuitBreaker) EditImage(
+	imageData []byte,
+	maskData []byte,
+	prompt string,
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) (*CreateImageResponse, error) {
+	if !b.allow() {
+		return nil, b.rejected(zlog)
+	}
+	result, err := b.client.EditImage(imageData, maskData, prompt, ctx, zlog)
+	b.record(err)
+	return result, err
+}
+
+func (b *CircuitBreaker) Summarize(content string, words int, ctx context.Context, zlog *zerolog.Logger) (string, error) {
+	if !b.allow() {
+		return "", b.rejected(zlog)
+	}
+	result, err := b.client.Summarize(content, words, ctx, zlog)
+	b.record(err)
+	return result, err
+}
+
+func (b *CircuitBreaker) SummarizeConversation(
+	messages []*ChatMessage,
+	sentences int,
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) (string, error) {
+	if !b.allow() {
+		return "", b.rejected(zlog)
+	}
+	result, err := b.client.SummarizeConversation(messages, sentences, ctx, zlog)
+	b.record(err)
+	return result, err
+}
+
+func (b *CircuitBreaker) Moderate(text string, ctx context.Context, zlog *zerolog.Logger) (*ModerationResult, error) {
+	if !b.allow() {
+		return nil, b.rejected(zlog)
+	}
+	result, err := b.client.Moderate(text, ctx, zlog)
+	b.record(err)
+	return result, err
+}
+
+func (b *CircuitBreaker) Close(zlog *zerolog.Logger) error {
+	return b.client.Close(zlog)
+}
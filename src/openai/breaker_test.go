@@ -0,0 +1,110 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package openai
+
+import (
+	"context"
+	"errors"
+	"github.com/rs/zerolog"
+	"testing"
+	"time"
+)
+
+// TestCircuitBreakerTransitions drives the breaker from closed to open, to half-open once the cooldown has passed, and
+// back to closed after a successful trial call.
+func TestCircuitBreakerTransitions(t *testing.T) {
+	zlog := zerolog.Nop()
+	stub := &stubClient{err: errors.New("HTTP 503")}
+	breaker := NewCircuitBreaker(stub, CircuitBreakerConfig{FailureThreshold: 2, Cooldown: time.Minute}, &zlog)
+	now := time.Date(2023, 2, 4, 5, 6, 7, 0, time.UTC)
+	breaker.now = func() time.Time { return now }
+
+	call := func() error {
+		_, err := breaker.CompleteChat(nil, ChatOptions{}, context.Background(), &zlog)
+		return err
+	}
+	expect := func(step string, wantState BreakerState, wantCalls int) {
+		t.Helper()
+		if state := breaker.State(); state != wantState {
+			t.Errorf("%s: State() = %v, want %v", step, state, wantState)
+		}
+		if stub.calls != wantCalls {
+			t.Errorf("%s: client called %d times, want %d", step, stub.calls, wantCalls)
+		}
+	}
+
+	_ = call()
+	expect("one failure", BreakerClosed, 1)
+
+	_ = call()
+	expect("threshold reached", BreakerOpen, 2)
+	if breaker.Healthy() {
+		t.Errorf("Healthy() = true while open, want false")
+	}
+
+	if err := call(); !errors.Is(err, ServiceUnavailableError) {
+		t.Errorf("call while open error = %v, want %v", err, ServiceUnavailableError)
+	}
+	expect("fails fast while open", BreakerOpen, 2)
+
+	now = now.Add(time.Minute)
+	expect("cooldown passed", BreakerHalfOpen, 2)
+
+	_ = call()
+	expect("failed trial reopens", BreakerOpen, 3)
+
+	now = now.Add(time.Minute)
+	stub.err = nil
+	if err := call(); err != nil {
+		t.Errorf("trial call error = %v, want nil", err)
+	}
+	expect("successful trial closes", BreakerClosed, 4)
+	if !breaker.Healthy() {
+		t.Errorf("Healthy() = false while closed, want true")
+	}
+}
+
+// TestCircuitBreakerSingleTrial checks that only one trial call is let through while half-open.
+func TestCircuitBreakerSingleTrial(t *testing.T) {
+	zlog := zerolog.Nop()
+	breaker := NewCircuitBreaker(&stubClient{}, CircuitBreakerConfig{FailureThreshold: 1, Cooldown: time.Minute}, &zlog)
+	now := time.Date(2023, 2, 4, 5, 6, 7, 0, time.UTC)
+	breaker.now = func() time.Time { return now }
+
+	breaker.record(errors.New("HTTP 503"))
+	now = now.Add(time.Minute)
+
+	if !breaker.allow() {
+		t.Fatalf("allow() = false for the first trial call, want true")
+	}
+	if breaker.allow() {
+		t.Errorf("allow() = true while a trial call is in flight, want false")
+	}
+}
+
+func TestCircuitBreakerIgnoresRequestErrors(t *testing.T) {
+	zlog := zerolog.Nop()
+	stub := &stubClient{err: PromptTooLongError}
+	breaker := NewCircuitBreaker(stub, CircuitBreakerConfig{FailureThreshold: 1, Cooldown: time.Minute}, &zlog)
+
+	for i := 0; i < 3; i++ {
+		_, _ = breaker.CompleteChat(nil, ChatOptions{}, context.Background(), &zlog)
+	}
+	if state := breaker.State(); state != BreakerClosed {
+		t.Errorf("State() = %v after request errors, want %v", state, BreakerClosed)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/rs/zerolog"
+	"golang.org/x/sync/semaphore"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// blockingServer answers chat completion requests only when told to, announcing each request on started.
+type blockingServer struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.started <- struct{}{}
+	<-s.release
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(textResponse("ok"))
+}
+
+func TestCompletionConcurrencyLimit(t *testing.T) {
+	const limit = 2
+	server := &blockingServer{started: make(chan struct{}, limit+1), release: make(chan struct{})}
+	client := newTestOpenAI(t, server)
+	client.completions = semaphore.NewWeighted(limit)
+	zlog := zerolog.Nop()
+
+	done := make(chan error, limit+1)
+	complete := func() {
+		messages := []*ChatMessage{{FromHuman: true, Text: "Hi"}}
+		_, err := client.CompleteChat(messages, DefaultChatOptions(), context.Background(), &zlog)
+		done <- err
+	}
+	for i := 0; i < limit; i++ {
+		go complete()
+		<-server.started
+	}
+
+	go complete()
+	select {
+	case <-server.started:
+		t.Fatalf("call %d reached OpenAI while %d were in flight", limit+1, limit)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	server.release <- struct{}{}
+	if err := <-done; err != nil {
+		t.Fatalf("CompleteChat() error = %v", err)
+	}
+	select {
+	case <-server.started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("call %d did not reach OpenAI after a call finished", limit+1)
+	}
+
+	close(server.release)
+	for i := 0; i < limit; i++ {
+		if err := <-done; err != nil {
+			t.Errorf("CompleteChat() error = %v", err)
+		}
+	}
+}
+
+func TestCompletionConcurrencyLimitCanceled(t *testing.T) {
+	client := newTestOpenAI(t, http.NotFoundHandler())
+	client.completions = semaphore.NewWeighted(1)
+	if !client.completions.TryAcquire(1) {
+		t.Fatal("TryAcquire() = false, want the only slot")
+	}
+	zlog := zerolog.Nop()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	messages := []*ChatMessage{{FromHuman: true, Text: "Hi"}}
+	if _, err := client.CompleteChat(messages, DefaultChatOptions(), ctx, &zlog); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("CompleteChat() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
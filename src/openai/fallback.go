@@ -0,0 +1,87 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package openai
+
+import (
+	"context"
+	"errors"
+	"github.com/rs/zerolog"
+	goopenai "github.com/sashabaranov/go-openai"
+	"net/http"
+)
+
+// modelChain returns the models to try for options in order: options.Model, then each of options.FallbackModels that
+// has not already been tried.
+func modelChain(options ChatOptions) []string {
+	chain := []string{options.Model}
+	seen := map[string]bool{options.Model: true}
+	for _, model := range options.FallbackModels {
+		if model == "" || seen[model] {
+			continue
+		}
+		seen[model] = true
+		chain = append(chain, model)
+	}
+	return chain
+}
+
+// shouldFallBack returns whether err from one model is worth retrying with the next model in the chain: the model is
+// overloaded, rate limited, or unavailable, or the prompt does not fit in its context window.
+func shouldFallBack(err error) bool {
+	if errors.Is(err, PromptTooLongError) {
+		return true
+	}
+
+	statusCode := 0
+	var apiErr *goopenai.APIError
+	var requestErr *goopenai.RequestError
+	if errors.As(err, &apiErr) {
+		statusCode = apiErr.HTTPStatusCode
+	} else if errors.As(err, &requestErr) {
+		statusCode = requestErr.HTTPStatusCode
+	}
+	return statusCode == http.StatusTooManyRequests || statusCode == http.StatusNotFound || statusCode >= 500
+}
+
+// chatCompleteWithFallback calls ChatComplete with each model of the chain in turn, until one succeeds, one fails with
+// an error a different model would not fix, or the chain is exhausted. The returned completion's Model shows which
+// model replied.
+func (o *OpenAI) chatCompleteWithFallback(
+	messages []goopenai.ChatCompletionMessage,
+	options ChatOptions,
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) (*Completion, error) {
+	chain := modelChain(options)
+	var err error
+	for n, model := range chain {
+		options.Model = model
+		var completion *Completion
+		completion, err = o.ChatComplete(messages, options, ctx, zlog)
+		if err == nil {
+			if n > 0 {
+				zlog.Warn().Str("model", model).Str("primaryModel", chain[0]).Msg("Completed chat with fallback model")
+			}
+			return completion, nil
+		}
+		if n == len(chain)-1 || !shouldFallBack(err) || ctx.Err() != nil {
+			break
+		}
+		zlog.Warn().Err(err).Str("model", model).Str("nextModel", chain[n+1]).Msg("Model failed, falling back")
+	}
+	return nil, err
+}
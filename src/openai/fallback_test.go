@@ -0,0 +1,167 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	goopenai "github.com/sashabaranov/go-openai"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// modelServer is an OpenAI chat completions API whose models in failures fail with the given status code, and whose
+// other models reply with their own name. It records the model of each request.
+type modelServer struct {
+	failures map[string]int
+
+	mu     sync.Mutex
+	models []string
+}
+
+func (s *modelServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var request goopenai.ChatCompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.models = append(s.models, request.Model)
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if status, ok := s.failures[request.Model]; ok {
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"error": {"message": "%s failed", "type": "server_error"}}`, request.Model)
+		return
+	}
+	response := textResponse("reply from " + request.Model)
+	response.Model = request.Model
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// requestedModels returns the model of each request the server has received so far.
+func (s *modelServer) requestedModels() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.models...)
+}
+
+func TestModelChain(t *testing.T) {
+	tests := []struct {
+		name      string
+		model     string
+		fallbacks []string
+		want      []string
+	}{
+		{name: "no fallbacks", model: "gpt-4", want: []string{"gpt-4"}},
+		{name: "fallbacks", model: "gpt-4", fallbacks: []string{"gpt-4-turbo", "gpt-3.5-turbo"}, want: []string{"gpt-4", "gpt-4-turbo", "gpt-3.5-turbo"}},
+		{name: "duplicates and blanks", model: "gpt-4", fallbacks: []string{"gpt-4", "", "gpt-3.5-turbo", "gpt-3.5-turbo"}, want: []string{"gpt-4", "gpt-3.5-turbo"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := modelChain(ChatOptions{Model: tt.model, FallbackModels: tt.fallbacks})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("modelChain() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShouldFallBack(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "overloaded", err: &goopenai.APIError{HTTPStatusCode: http.StatusServiceUnavailable}, want: true},
+		{name: "server error", err: &goopenai.APIError{HTTPStatusCode: http.StatusInternalServerError}, want: true},
+		{name: "rate limited", err: &goopenai.RequestError{HTTPStatusCode: http.StatusTooManyRequests}, want: true},
+		{name: "unknown model", err: &goopenai.APIError{HTTPStatusCode: http.StatusNotFound}, want: true},
+		{name: "prompt too long", err: fmt.Errorf("chat: %w", PromptTooLongError), want: true},
+		{name: "bad request", err: &goopenai.APIError{HTTPStatusCode: http.StatusBadRequest}},
+		{name: "unauthorized", err: &goopenai.APIError{HTTPStatusCode: http.StatusUnauthorized}},
+		{name: "other error", err: errors.New("boom")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shouldFallBack(tt.err); got != tt.want {
+				t.Errorf("shouldFallBack(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompleteChatFallsBack(t *testing.T) {
+	tests := []struct {
+		name       string
+		failures   map[string]int
+		wantModels []string
+		wantModel  string
+		wantErr    bool
+	}{
+		{name: "primary succeeds", wantModels: []string{"gpt-4"}, wantModel: "gpt-4"},
+		{
+			name:       "primary overloaded",
+			failures:   map[string]int{"gpt-4": http.StatusServiceUnavailable},
+			wantModels: []string{"gpt-4", "gpt-3.5-turbo"},
+			wantModel:  "gpt-3.5-turbo",
+		},
+		{
+			name:       "chain exhausted",
+			failures:   map[string]int{"gpt-4": http.StatusServiceUnavailable, "gpt-3.5-turbo": http.StatusServiceUnavailable},
+			wantModels: []string{"gpt-4", "gpt-3.5-turbo"},
+			wantErr:    true,
+		},
+		{
+			name:       "error a fallback would not fix",
+			failures:   map[string]int{"gpt-4": http.StatusBadRequest},
+			wantModels: []string{"gpt-4"},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &modelServer{failures: tt.failures}
+			client := newTestOpenAI(t, server)
+			zlog := zerolog.Nop()
+			options := DefaultChatOptions()
+			options.Model = "gpt-4"
+			options.FallbackModels = []string{"gpt-3.5-turbo"}
+
+			messages := []*ChatMessage{{FromHuman: true, Text: "Who made Go?"}}
+			completion, err := client.CompleteChat(messages, options, context.Background(), &zlog)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CompleteChat() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := server.requestedModels(); !reflect.DeepEqual(got, tt.wantModels) {
+				t.Errorf("CompleteChat() requested models %v, want %v", got, tt.wantModels)
+			}
+			if err != nil {
+				return
+			}
+			if completion.Model != tt.wantModel || completion.Text != "reply from "+tt.wantModel {
+				t.Errorf("CompleteChat() = %q from %s, want a reply from %s", completion.Text, completion.Model, tt.wantModel)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package openai
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+// idempotencyKeyHeader asks OpenAI to treat requests with the same key as one, so that retrying a request, e.g. an
+// expensive image generation, is not billed twice.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+type idempotencyKeyContextKey struct{}
+
+// IdempotencyKey derives a stable idempotency key for operation, e.g. "image", on behalf of the Discord interaction
+// interactionID. Every retry of the same interaction gets the same key.
+func IdempotencyKey(operation string, interactionID string) string {
+	sum := sha256.Sum256([]byte(operation + ":" + interactionID))
+	return "discord-" + hex.EncodeToString(sum[:16])
+}
+
+// WithIdempotencyKey returns a context whose OpenAI requests are sent with key as their idempotency key.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyContextKey{}, key)
+}
+
+// idempotencyTransport adds the idempotency key of the request's context, if it has one, as a header. go-openai does
+// not support per-request headers, but it does send each request with the caller's context.
+type idempotencyTransport struct {
+	base http.RoundTripper
+}
+
+func (t *idempotencyTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	key, ok := request.Context().Value(idempotencyKeyContextKey{}).(string)
+	if !ok || key == "" {
+		return t.base.RoundTrip(request)
+	}
+	request = request.Clone(request.Context())
+	request.Header.Set(idempotencyKeyHeader, key)
+	return t.base.RoundTrip(request)
+}
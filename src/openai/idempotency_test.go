@@ -0,0 +1,82 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package openai
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	key := IdempotencyKey("image", "1234")
+	if key != IdempotencyKey("image", "1234") {
+		t.Errorf("IdempotencyKey() = %q, want the same key for every retry", key)
+	}
+	if key == IdempotencyKey("image", "5678") {
+		t.Errorf("IdempotencyKey() = %q for two interactions, want different keys", key)
+	}
+	if key == IdempotencyKey("image-edit", "1234") {
+		t.Errorf("IdempotencyKey() = %q for two operations, want different keys", key)
+	}
+	// The operation and interaction ID are separated, so that they cannot run together.
+	if IdempotencyKey("image", "-edit1") == IdempotencyKey("image-", "edit1") {
+		t.Error("IdempotencyKey() is ambiguous, want the operation and interaction ID kept apart")
+	}
+	if len(key) != len("discord-")+32 {
+		t.Errorf("IdempotencyKey() = %q, want discord- followed by 32 hex digits", key)
+	}
+}
+
+func TestIdempotencyTransport(t *testing.T) {
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want string
+	}{
+		{name: "no key", ctx: context.Background()},
+		{name: "empty key", ctx: WithIdempotencyKey(context.Background(), "")},
+		{name: "key", ctx: WithIdempotencyKey(context.Background(), "discord-abc"), want: "discord-abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header.Get(idempotencyKeyHeader)
+			}))
+			defer server.Close()
+			client := &http.Client{Transport: &idempotencyTransport{base: http.DefaultTransport}}
+
+			request, err := http.NewRequestWithContext(tt.ctx, http.MethodPost, server.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response, err := client.Do(request)
+			if err != nil {
+				t.Fatalf("Do() error = %v", err)
+			}
+			response.Body.Close()
+			if got != tt.want {
+				t.Errorf("%s header = %q, want %q", idempotencyKeyHeader, got, tt.want)
+			}
+			if request.Header.Get(idempotencyKeyHeader) != "" {
+				t.Errorf("idempotencyTransport modified the caller's request, want a clone")
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package openai
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/rs/zerolog"
+	goopenai "github.com/sashabaranov/go-openai"
+	"io"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// imageServer stands in for the OpenAI image endpoints. It replies to every request with images, encoded as base64,
+// and records the path and uploaded files of each request.
+type imageServer struct {
+	images [][]byte
+
+	mu    sync.Mutex
+	paths []string
+	files []map[string][]byte
+}
+
+func (s *imageServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	files := make(map[string][]byte)
+	for name, headers := range r.MultipartForm.File {
+		file, err := headers[0].Open()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, err := io.ReadAll(file)
+		_ = file.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		files[name] = data
+	}
+	s.mu.Lock()
+	s.paths = append(s.paths, r.URL.Path)
+	s.files = append(s.files, files)
+	s.mu.Unlock()
+
+	var response goopenai.ImageResponse
+	for _, image := range s.images {
+		response.Data = append(response.Data, goopenai.ImageResponseDataInner{B64JSON: base64.StdEncoding.EncodeToString(image)})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+func TestCreateImageVariation(t *testing.T) {
+	server := &imageServer{images: [][]byte{[]byte("variation 1"), []byte("variation 2")}}
+	client := newTestOpenAI(t, server)
+	zlog := zerolog.Nop()
+
+	resp, err := client.CreateImageVariation([]byte("original"), 2, context.Background(), &zlog)
+	if err != nil {
+		t.Fatalf("CreateImageVariation() error = %v", err)
+	}
+
+	want := []Image{{Data: []byte("variation 1")}, {Data: []byte("variation 2")}}
+	if !reflect.DeepEqual(resp.Images, want) {
+		t.Errorf("CreateImageVariation() images = %q, want %q", resp.Images, want)
+	}
+	if want := []string{"/v1/images/variations"}; !reflect.DeepEqual(server.paths, want) {
+		t.Errorf("CreateImageVariation() requested %v, want %v", server.paths, want)
+	}
+	if got := string(server.files[0]["image"]); got != "original" {
+		t.Errorf("CreateImageVariation() uploaded image %q, want %q", got, "original")
+	}
+}
+
+func TestEditImage(t *testing.T) {
+	tests := []struct {
+		name      string
+		mask      []byte
+		wantFiles map[string][]byte
+	}{
+		{name: "without mask", wantFiles: map[string][]byte{"image": []byte("original")}},
+		{name: "with mask", mask: []byte("mask"), wantFiles: map[string][]byte{"image": []byte("original"), "mask": []byte("mask")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &imageServer{images: [][]byte{[]byte("edited")}}
+			client := newTestOpenAI(t, server)
+			zlog := zerolog.Nop()
+
+			resp, err := client.EditImage([]byte("original"), tt.mask, "add a hat", context.Background(), &zlog)
+			if err != nil {
+				t.Fatalf("EditImage() error = %v", err)
+			}
+
+			if want := []Image{{Data: []byte("edited")}}; !reflect.DeepEqual(resp.Images, want) {
+				t.Errorf("EditImage() images = %q, want %q", resp.Images, want)
+			}
+			if want := []string{"/v1/images/edits"}; !reflect.DeepEqual(server.paths, want) {
+				t.Errorf("EditImage() requested %v, want %v", server.paths, want)
+			}
+			if !reflect.DeepEqual(server.files[0], tt.wantFiles) {
+				t.Errorf("EditImage() uploaded %q, want %q", server.files[0], tt.wantFiles)
+			}
+		})
+	}
+}
+
+func TestDecodeImageResponseInvalid(t *testing.T) {
+	zlog := zerolog.Nop()
+	resp := goopenai.ImageResponse{Data: []goopenai.ImageResponseDataInner{{B64JSON: "not base64!"}}}
+	if _, err := decodeImageResponse(resp, &zlog); err == nil {
+		t.Error("decodeImageResponse() error = nil for invalid base64, want an error")
+	}
+}
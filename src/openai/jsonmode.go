@@ -0,0 +1,199 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"sort"
+	"strings"
+)
+
+var (
+	InvalidJSONSchemaError   = errors.New("invalid JSON schema")
+	InvalidJSONResponseError = errors.New("model did not reply with valid JSON")
+)
+
+// jsonModeAttempts is the number of times CompleteChatJSON asks for JSON before giving up, i.e. one retry.
+const jsonModeAttempts = 2
+
+// chatCompleter is the part of OpenAIClient that CompleteChatJSON builds on.
+type chatCompleter interface {
+	CompleteChat(messages []*ChatMessage, options ChatOptions, ctx context.Context, zlog *zerolog.Logger) (*Completion, error)
+}
+
+// CompleteChatJSON is like CompleteChat, but the model must reply with a JSON object. If schema is set, the reply must
+// also match it; see validateJSONSchema for the subset of JSON schema supported.
+func (o *OpenAI) CompleteChatJSON(
+	messages []*ChatMessage,
+	schema json.RawMessage,
+	options ChatOptions,
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) (json.RawMessage, error) {
+	return completeChatJSON(o, messages, schema, options, ctx, zlog)
+}
+
+// completeChatJSON asks client for a JSON object in JSON mode. If the reply is not valid JSON, or does not match
+// schema, the model is told what was wrong and asked once more. It returns an error wrapping InvalidJSONResponseError
+// if the model still does not produce valid JSON.
+func completeChatJSON(
+	client chatCompleter,
+	messages []*ChatMessage,
+	schema json.RawMessage,
+	options ChatOptions,
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) (json.RawMessage, error) {
+	var parsedSchema map[string]interface{}
+	if len(schema) > 0 {
+		if err := json.Unmarshal(schema, &parsedSchema); err != nil {
+			return nil, fmt.Errorf("%w: %s", InvalidJSONSchemaError, err)
+		}
+	}
+
+	// OpenAI rejects JSON mode requests unless the messages ask for JSON.
+	instructions := "Reply with only a single JSON object."
+	if len(schema) > 0 {
+		instructions += " It must match this JSON schema: " + string(schema)
+	}
+	request := append(messages[:len(messages):len(messages)], &ChatMessage{FromSystem: true, Text: instructions})
+	options.JSONMode = true
+
+	var lastErr error
+	for attempt := 1; attempt <= jsonModeAttempts; attempt++ {
+		completion, err := client.CompleteChat(request, options, ctx, zlog)
+		if err != nil {
+			return nil, err
+		}
+
+		reply := strings.TrimSpace(completion.Text)
+		lastErr = validateJSONReply(reply, parsedSchema)
+		if lastErr == nil {
+			return json.RawMessage(reply), nil
+		}
+		zlog.Warn().Err(lastErr).Int("attempt", attempt).Msg("Model replied with invalid JSON")
+		request = append(request,
+			&ChatMessage{Text: reply},
+			&ChatMessage{FromHuman: true, Text: "That reply was invalid: " + lastErr.Error() + ". " + instructions},
+		)
+	}
+	return nil, fmt.Errorf("%w: %s", InvalidJSONResponseError, lastErr)
+}
+
+// validateJSONReply returns an error if reply is not a JSON object, or does not match schema if it is set.
+func validateJSONReply(reply string, schema map[string]interface{}) error {
+	var value interface{}
+	if err := json.Unmarshal([]byte(reply), &value); err != nil {
+		return fmt.Errorf("not valid JSON: %w", err)
+	}
+	if _, ok := value.(map[string]interface{}); !ok {
+		return errors.New("not a JSON object")
+	}
+	if schema == nil {
+		return nil
+	}
+	return validateJSONSchema(value, schema, "$")
+}
+
+// validateJSONSchema checks value against the type, enum, required, properties, and items keywords of schema, which
+// covers the schemas the bot uses. Other keywords are ignored. path locates value in the reply for error messages.
+func validateJSONSchema(value interface{}, schema map[string]interface{}, path string) error {
+	if expected, ok := schema["type"].(string); ok && !hasJSONType(value, expected) {
+		return fmt.Errorf("%s must be of type %s", path, expected)
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, option := range enum {
+			if fmt.Sprint(option) == fmt.Sprint(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s must be one of %v", path, enum)
+		}
+	}
+
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if _, ok := typed[fmt.Sprint(name)]; !ok {
+					return fmt.Errorf("%s is missing required property %q", path, name)
+				}
+			}
+		}
+		if properties, ok := schema["properties"].(map[string]interface{}); ok {
+			names := make([]string, 0, len(properties))
+			for name := range properties {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				propertySchema, ok := properties[name].(map[string]interface{})
+				propertyValue, present := typed[name]
+				if !ok || !present {
+					continue
+				}
+				if err := validateJSONSchema(propertyValue, propertySchema, path+"."+name); err != nil {
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range typed {
+				if err := validateJSONSchema(item, items, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// hasJSONType returns whether value, as decoded by encoding/json, is of the JSON schema type expected.
+func hasJSONType(value interface{}, expected string) bool {
+	switch expected {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		number, ok := value.(float64)
+		return ok && number == float64(int64(number))
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	}
+	return true
+}
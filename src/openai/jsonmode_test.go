@@ -0,0 +1,160 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/rs/zerolog"
+	"strings"
+	"testing"
+)
+
+// scriptedCompleter replies to each chat completion with the next of replies, and records the requests it gets.
+type scriptedCompleter struct {
+	replies  []string
+	requests [][]*ChatMessage
+	options  []ChatOptions
+}
+
+func (c *scriptedCompleter) CompleteChat(messages []*ChatMessage, options ChatOptions, ctx context.Context, zlog *zerolog.Logger) (*Completion, error) {
+	c.requests = append(c.requests, messages)
+	c.options = append(c.options, options)
+	if len(c.requests) > len(c.replies) {
+		return nil, errors.New("no more replies")
+	}
+	return &Completion{Text: c.replies[len(c.requests)-1]}, nil
+}
+
+func TestCompleteChatJSON(t *testing.T) {
+	const schema = `{"type": "object", "required": ["name"], "properties": {"name": {"type": "string"}}}`
+	tests := []struct {
+		name      string
+		schema    string
+		replies   []string
+		want      string
+		wantErr   error
+		wantCalls int
+	}{
+		{name: "valid", replies: []string{` {"a": 1} `}, want: `{"a": 1}`, wantCalls: 1},
+		{name: "retry after invalid JSON", replies: []string{"not json", `{"a": 1}`}, want: `{"a": 1}`, wantCalls: 2},
+		{name: "retry after non-object", replies: []string{"[1, 2]", `{"a": 1}`}, want: `{"a": 1}`, wantCalls: 2},
+		{name: "invalid twice", replies: []string{"not json", "{"}, wantErr: InvalidJSONResponseError, wantCalls: 2},
+		{name: "matches schema", schema: schema, replies: []string{`{"name": "x"}`}, want: `{"name": "x"}`, wantCalls: 1},
+		{
+			name:      "retry after schema mismatch",
+			schema:    schema,
+			replies:   []string{`{"name": 1}`, `{"name": "x"}`},
+			want:      `{"name": "x"}`,
+			wantCalls: 2,
+		},
+		{
+			name:      "schema mismatch twice",
+			schema:    schema,
+			replies:   []string{`{}`, `{"name": 1}`},
+			wantErr:   InvalidJSONResponseError,
+			wantCalls: 2,
+		},
+		{name: "invalid schema", schema: "{", wantErr: InvalidJSONSchemaError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			zlog := zerolog.Nop()
+			client := &scriptedCompleter{replies: tt.replies}
+			messages := []*ChatMessage{{FromHuman: true, Text: "Describe a cat."}}
+			got, err := completeChatJSON(client, messages, json.RawMessage(tt.schema), ChatOptions{}, context.Background(), &zlog)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("completeChatJSON() error = %v, want %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("completeChatJSON() = %s, want %s", got, tt.want)
+			}
+			if len(client.requests) != tt.wantCalls {
+				t.Errorf("completeChatJSON() made %d requests, want %d", len(client.requests), tt.wantCalls)
+			}
+			for _, options := range client.options {
+				if !options.JSONMode {
+					t.Errorf("completeChatJSON() request options JSONMode = false, want true")
+				}
+			}
+			if len(messages) != 1 {
+				t.Errorf("completeChatJSON() modified messages, len = %d", len(messages))
+			}
+		})
+	}
+}
+
+func TestCompleteChatJSONRetryExplainsError(t *testing.T) {
+	zlog := zerolog.Nop()
+	client := &scriptedCompleter{replies: []string{"not json", `{"a": 1}`}}
+	messages := []*ChatMessage{{FromHuman: true, Text: "Describe a cat."}}
+	if _, err := completeChatJSON(client, messages, nil, ChatOptions{}, context.Background(), &zlog); err != nil {
+		t.Fatalf("completeChatJSON() error = %v", err)
+	}
+
+	first, retry := client.requests[0], client.requests[1]
+	if last := first[len(first)-1]; !last.FromSystem || !strings.Contains(last.Text, "JSON object") {
+		t.Errorf("first request ends with %+v, want JSON instructions", last)
+	}
+	if len(retry) != len(first)+2 {
+		t.Fatalf("retry has %d messages, want %d", len(retry), len(first)+2)
+	}
+	if reply := retry[len(first)]; reply.FromHuman || reply.FromSystem || reply.Text != "not json" {
+		t.Errorf("retry repeats reply %+v, want the invalid reply from the assistant", reply)
+	}
+	if correction := retry[len(first)+1]; !correction.FromHuman || !strings.Contains(correction.Text, "not valid JSON") {
+		t.Errorf("retry correction = %+v, want the validation error from the user", correction)
+	}
+}
+
+func TestValidateJSONSchema(t *testing.T) {
+	schema := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(`{
+		"type": "object",
+		"required": ["tags"],
+		"properties": {
+			"tags": {"type": "array", "items": {"type": "string"}},
+			"mood": {"enum": ["happy", "sad"]},
+			"count": {"type": "integer"}
+		}
+	}`), &schema); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		reply   string
+		wantErr string
+	}{
+		{name: "valid", reply: `{"tags": ["a"], "mood": "happy", "count": 2}`},
+		{name: "missing required", reply: `{"mood": "happy"}`, wantErr: `$ is missing required property "tags"`},
+		{name: "wrong item type", reply: `{"tags": ["a", 1]}`, wantErr: "$.tags[1] must be of type string"},
+		{name: "not in enum", reply: `{"tags": [], "mood": "angry"}`, wantErr: "$.mood must be one of [happy sad]"},
+		{name: "not an integer", reply: `{"tags": [], "count": 1.5}`, wantErr: "$.count must be of type integer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateJSONReply(tt.reply, schema)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validateJSONReply() error = %v, want nil", err)
+			}
+			if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("validateJSONReply() error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
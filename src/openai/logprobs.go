@@ -0,0 +1,54 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package openai
+
+import (
+	"github.com/rs/zerolog"
+	goopenai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	// debugTopLogProbs is the number of most likely alternatives requested for each token when LogProbs is set.
+	debugTopLogProbs = 5
+
+	// debugLogProbTokens is the number of tokens at the start of a reply whose log probabilities are logged.
+	debugLogProbTokens = 10
+)
+
+// logTokenLogProbs logs, at debug level, the log probability of the first few tokens of a reply and of their most
+// likely alternatives. logProbs may be nil, e.g. if the model does not support log probabilities.
+func logTokenLogProbs(logProbs *goopenai.LogProbs, zlog *zerolog.Logger) {
+	if logProbs == nil {
+		zlog.Debug().Msg("No log probabilities in chat completion")
+		return
+	}
+	for n, token := range logProbs.Content {
+		if n >= debugLogProbTokens {
+			break
+		}
+		top := zerolog.Dict()
+		for _, alternative := range token.TopLogProbs {
+			top.Float64(alternative.Token, alternative.LogProb)
+		}
+		zlog.Debug().
+			Int("position", n).
+			Str("token", token.Token).
+			Float64("logprob", token.LogProb).
+			Dict("top", top).
+			Msg("Token log probability")
+	}
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package openai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/rs/zerolog"
+	goopenai "github.com/sashabaranov/go-openai"
+	"strings"
+	"testing"
+)
+
+// sampleLogProbsResponse is a chat completion response with log probabilities, in the format the API returns them.
+const sampleLogProbsResponse = `{
+	"id": "chatcmpl-123",
+	"object": "chat.completion",
+	"model": "gpt-3.5-turbo-1106",
+	"choices": [{
+		"index": 0,
+		"message": {"role": "assistant", "content": "Hi there"},
+		"logprobs": {"content": [
+			{"token": "Hi", "logprob": -0.31, "bytes": [72, 105], "top_logprobs": [
+				{"token": "Hi", "logprob": -0.31, "bytes": [72, 105]},
+				{"token": "Hello", "logprob": -1.5, "bytes": null}
+			]},
+			{"token": " there", "logprob": -0.02, "bytes": null, "top_logprobs": []}
+		]},
+		"finish_reason": "stop"
+	}],
+	"usage": {"prompt_tokens": 5, "completion_tokens": 2, "total_tokens": 7}
+}`
+
+func TestChatCompleteLogProbs(t *testing.T) {
+	var response goopenai.ChatCompletionResponse
+	if err := json.Unmarshal([]byte(sampleLogProbsResponse), &response); err != nil {
+		t.Fatalf("failed to parse sample response: %v", err)
+	}
+
+	for _, logProbs := range []bool{false, true} {
+		server := &chatServer{responses: []goopenai.ChatCompletionResponse{response}}
+		client := newTestOpenAI(t, server)
+		zlog := zerolog.Nop()
+		options := DefaultChatOptions()
+		options.Model = goopenai.GPT3Dot5Turbo
+		options.LogProbs = logProbs
+		messages := []goopenai.ChatCompletionMessage{{Role: goopenai.ChatMessageRoleUser, Content: "Hi"}}
+
+		completion, err := client.ChatComplete(messages, options, context.Background(), &zlog)
+		if err != nil {
+			t.Fatalf("ChatComplete() with LogProbs %v error = %v", logProbs, err)
+		}
+		if completion.Text != "Hi there" {
+			t.Errorf("ChatComplete() with LogProbs %v text = %q, want %q", logProbs, completion.Text, "Hi there")
+		}
+
+		request := server.received()[0]
+		wantTop := 0
+		if logProbs {
+			wantTop = debugTopLogProbs
+		}
+		if request.LogProbs != logProbs || request.TopLogProbs != wantTop {
+			t.Errorf("with LogProbs %v, request logprobs = %v, top_logprobs = %d, want %v, %d",
+				logProbs, request.LogProbs, request.TopLogProbs, logProbs, wantTop)
+		}
+	}
+}
+
+func TestLogTokenLogProbs(t *testing.T) {
+	var response goopenai.ChatCompletionResponse
+	if err := json.Unmarshal([]byte(sampleLogProbsResponse), &response); err != nil {
+		t.Fatalf("failed to parse sample response: %v", err)
+	}
+	var output bytes.Buffer
+	zlog := zerolog.New(&output).Level(zerolog.DebugLevel)
+
+	logTokenLogProbs(response.Choices[0].LogProbs, &zlog)
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("logged %d lines, want one per token: %s", len(lines), output.String())
+	}
+	if !strings.Contains(lines[0], `"token":"Hi"`) || !strings.Contains(lines[0], `"Hello":-1.5`) {
+		t.Errorf("first line = %s, want the token and its alternatives", lines[0])
+	}
+
+	output.Reset()
+	logTokenLogProbs(nil, &zlog)
+	if !strings.Contains(output.String(), "No log probabilities") {
+		t.Errorf("logged %q for missing log probabilities", output.String())
+	}
+
+	output.Reset()
+	many := &goopenai.LogProbs{Content: make([]goopenai.LogProb, debugLogProbTokens+5)}
+	logTokenLogProbs(many, &zlog)
+	if got := strings.Count(output.String(), "\n"); got != debugLogProbTokens {
+		t.Errorf("logged %d tokens, want at most %d", got, debugLogProbTokens)
+	}
+}
@@ -0,0 +1,170 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package openai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+)
+
+// MockOpenAI is an OpenAIClient that returns canned responses without calling OpenAI, so that the full Discord flow
+// can be run locally without spending credits.
+type MockOpenAI struct{}
+
+func NewMockOpenAI() *MockOpenAI {
+	return &MockOpenAI{}
+}
+
+func (m *MockOpenAI) CompleteChat(
+	messages []*ChatMessage,
+	options ChatOptions,
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) (*Completion, error) {
+	zlog.Debug().Int("messages", len(messages)).Interface("options", options).Msg("Mock chat completion")
+	text := "Mock response."
+	if len(messages) > 0 {
+		text = fmt.Sprintf("Mock response from %s to: %s", options.Model, messages[len(messages)-1].Text)
+	}
+	return &Completion{Text: text, Model: options.Model}, nil
+}
+
+func (m *MockOpenAI) CompleteChatJSON(
+	messages []*ChatMessage,
+	schema json.RawMessage,
+	options ChatOptions,
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) (json.RawMessage, error) {
+	zlog.Debug().Int("messages", len(messages)).RawJSON("schema", schema).Msg("Mock JSON chat completion")
+	return json.RawMessage(`{"response": "Mock response."}`), nil
+}
+
+func (m *MockOpenAI) Complete(
+	prompt string,
+	options CompleteOptions,
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) (*Completion, error) {
+	zlog.Debug().Str("prompt", prompt).Strs("stop", options.Stop).Int("n", options.N).Msg("Mock completion")
+	choices := []string{"Mock completion."}
+	for len(choices) < options.N {
+		choices = append(choices, fmt.Sprintf("Mock completion %d.", len(choices)+1))
+	}
+	return &Completion{Text: choices[0], Choices: choices, Model: "text-davinci-003"}, nil
+}
+
+func (m *MockOpenAI) CompleteStream(
+	prompt string,
+	options CompleteOptions,
+	onText func(text string),
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) (*Completion, error) {
+	zlog.Debug().Str("prompt", prompt).Strs("stop", options.Stop).Msg("Mock streamed completion")
+	text := "Mock streamed completion."
+	for _, word := range strings.SplitAfter(text, " ") {
+		onText(word)
+	}
+	return &Completion{Text: text, Model: "text-davinci-003"}, nil
+}
+
+func (m *MockOpenAI) CreateImage(prompt string, ctx context.Context, zlog *zerolog.Logger) (*CreateImageResponse, error) {
+	zlog.Debug().Str("prompt", prompt).Msg("Mock image creation")
+
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 64; y++ {
+			img.Set(x, y, color.RGBA{R: 0x10, G: 0xa3, B: 0x7f, A: 0xff})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		zlog.Error().Err(err).Msg("Failed to encode mock image")
+		return nil, err
+	}
+
+	return &CreateImageResponse{Images: []Image{{Data: buf.Bytes()}}}, nil
+}
+
+func (m *MockOpenAI) CreateImageVariation(
+	imageData []byte,
+	n int,
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) (*CreateImageResponse, error) {
+	zlog.Debug().Int("bytes", len(imageData)).Int("n", n).Msg("Mock image variation")
+	images := make([]Image, 0, n)
+	for i := 0; i < n; i++ {
+		images = append(images, Image{Data: imageData})
+	}
+	return &CreateImageResponse{Images: images}, nil
+}
+
+func (m *MockOpenAI) EditImage(
+	imageData []byte,
+	maskData []byte,
+	prompt string,
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) (*CreateImageResponse, error) {
+	zlog.Debug().Int("bytes", len(imageData)).Bool("mask", maskData != nil).Str("prompt", prompt).Msg("Mock image edit")
+	return &CreateImageResponse{Images: []Image{{Data: imageData}}}, nil
+}
+
+func (m *MockOpenAI) Summarize(
+	content string,
+	words int,
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) (string, error) {
+	zlog.Debug().Str("content", content).Int("words", words).Msg("Mock summarization")
+	fields := strings.Fields(content)
+	if len(fields) > words {
+		fields = fields[:words]
+	}
+	if len(fields) == 0 {
+		return "Mock summary", nil
+	}
+	return strings.Join(fields, " "), nil
+}
+
+func (m *MockOpenAI) SummarizeConversation(
+	messages []*ChatMessage,
+	sentences int,
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) (string, error) {
+	zlog.Debug().Int("messages", len(messages)).Int("sentences", sentences).Msg("Mock conversation summarization")
+	return fmt.Sprintf("Mock summary of %d messages.", len(messages)), nil
+}
+
+func (m *MockOpenAI) Moderate(text string, ctx context.Context, zlog *zerolog.Logger) (*ModerationResult, error) {
+	zlog.Debug().Str("text", text).Msg("Mock moderation")
+	return &ModerationResult{Flagged: false, Categories: []string{}}, nil
+}
+
+func (m *MockOpenAI) Close(*zerolog.Logger) error {
+	return nil
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package openai
+
+import (
+	"context"
+	"github.com/rs/zerolog"
+	goopenai "github.com/sashabaranov/go-openai"
+	"sort"
+	"src/metrics"
+)
+
+// ModerationResult is whether text violates OpenAI's usage policies, and if so which categories it was flagged for.
+type ModerationResult struct {
+	Flagged    bool
+	Categories []string
+}
+
+func (o *OpenAI) Moderate(text string, ctx context.Context, zlog *zerolog.Logger) (*ModerationResult, error) {
+	o.limiter.Take()
+	resp, err := o.client.Moderations(ctx, goopenai.ModerationRequest{
+		Input: text,
+	})
+	metrics.OpenAIRequests.WithLabelValues("moderation").Inc()
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to moderate text")
+		metrics.Errors.WithLabelValues("openai").Inc()
+		return nil, err
+	}
+
+	result := ModerationResult{Categories: make([]string, 0)}
+	for _, r := range resp.Results {
+		if !r.Flagged {
+			continue
+		}
+		result.Flagged = true
+		result.Categories = append(result.Categories, flaggedCategories(r.Categories)...)
+	}
+	zlog.Debug().Bool("flagged", result.Flagged).Strs("categories", result.Categories).Msg("Moderated text")
+	return &result, nil
+}
+
+func flaggedCategories(categories goopenai.ResultCategories) []string {
+	flagged := make([]string, 0)
+	for name, isFlagged := range map[string]bool{
+		"hate":             categories.Hate,
+		"hate/threatening": categories.HateThreatening,
+		"self-harm":        categories.SelfHarm,
+		"sexual":           categories.Sexual,
+		"sexual/minors":    categories.SexualMinors,
+		"violence":         categories.Violence,
+		"violence/graphic": categories.ViolenceGraphic,
+	} {
+		if isFlagged {
+			flagged = append(flagged, name)
+		}
+	}
+	sort.Strings(flagged)
+	return flagged
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/rs/zerolog"
+	goopenai "github.com/sashabaranov/go-openai"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestModerate(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []goopenai.Result
+		want    ModerationResult
+	}{
+		{
+			name:    "unflagged",
+			results: []goopenai.Result{{Flagged: false}},
+			want:    ModerationResult{Categories: []string{}},
+		},
+		{
+			name: "flagged",
+			results: []goopenai.Result{{
+				Flagged:    true,
+				Categories: goopenai.ResultCategories{Violence: true, Hate: true},
+			}},
+			want: ModerationResult{Flagged: true, Categories: []string{"hate", "violence"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var input string
+			client := newTestOpenAI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var request goopenai.ModerationRequest
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				input = request.Input
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(goopenai.ModerationResponse{Results: tt.results})
+			}))
+			zlog := zerolog.Nop()
+
+			got, err := client.Moderate("some text", context.Background(), &zlog)
+			if err != nil {
+				t.Fatalf("Moderate() error = %v", err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("Moderate() = %+v, want %+v", *got, tt.want)
+			}
+			if input != "some text" {
+				t.Errorf("Moderate() sent %q, want %q", input, "some text")
+			}
+		})
+	}
+}
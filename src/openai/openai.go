@@ -20,124 +20,651 @@ import (
 	"context"
 	_ "embed"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"github.com/hashicorp/go-multierror"
 	"github.com/rs/zerolog"
 	goopenai "github.com/sashabaranov/go-openai"
 	"go.uber.org/ratelimit"
+	"golang.org/x/sync/semaphore"
+	"io"
+	"net/http"
+	"os"
+	"src/metrics"
 	"strconv"
 	"strings"
 	"time"
 )
 
 var (
-	FailedToCompletePrompt = errors.New("failed to complete prompt")
+	FailedToCompletePrompt    = errors.New("failed to complete prompt")
+	TooManyStopSequencesError = errors.New("OpenAI allows at most 4 stop sequences")
+	PenaltyOutOfRangeError    = errors.New("OpenAI penalties must be between -2.0 and 2.0")
 
 	//go:embed initial_prompt_01.txt
 	initialPrompt string
 )
 
+// OpenAIClient is the set of OpenAI operations the bot uses. It is implemented by OpenAI, which calls the OpenAI API,
+// and MockOpenAI, which returns canned responses.
+type OpenAIClient interface {
+	CompleteChat(messages []*ChatMessage, options ChatOptions, ctx context.Context, zlog *zerolog.Logger) (*Completion, error)
+	CompleteChatJSON(messages []*ChatMessage, schema json.RawMessage, options ChatOptions, ctx context.Context, zlog *zerolog.Logger) (json.RawMessage, error)
+	Complete(prompt string, options CompleteOptions, ctx context.Context, zlog *zerolog.Logger) (*Completion, error)
+	CompleteStream(prompt string, options CompleteOptions, onText func(text string), ctx context.Context, zlog *zerolog.Logger) (*Completion, error)
+	CreateImage(prompt string, ctx context.Context, zlog *zerolog.Logger) (*CreateImageResponse, error)
+	CreateImageVariation(imageData []byte, n int, ctx context.Context, zlog *zerolog.Logger) (*CreateImageResponse, error)
+	EditImage(imageData []byte, maskData []byte, prompt string, ctx context.Context, zlog *zerolog.Logger) (*CreateImageResponse, error)
+	Summarize(content string, words int, ctx context.Context, zlog *zerolog.Logger) (string, error)
+	SummarizeConversation(messages []*ChatMessage, sentences int, ctx context.Context, zlog *zerolog.Logger) (string, error)
+	Moderate(text string, ctx context.Context, zlog *zerolog.Logger) (*ModerationResult, error)
+	Close(zlog *zerolog.Logger) error
+}
+
 type OpenAI struct {
 	client        *goopenai.Client
+	httpClient    *http.Client
 	initialPrompt string
-	limiter       ratelimit.Limiter
+	limiter       *adaptiveLimiter
+	budgets       TokenBudgets
+
+	// completions limits the number of chat and text completions in flight at once.
+	completions *semaphore.Weighted
+}
+
+// DefaultMaxConcurrentCompletions is the number of completions allowed in flight at once if no limit is configured.
+const DefaultMaxConcurrentCompletions = 4
+
+// TokenBudgets caps the number of completion tokens requested by each operation, to control cost. Each is further
+// limited by the room the prompt leaves in the model's context window.
+type TokenBudgets struct {
+	// Complete is used by Complete, i.e. the /complete command.
+	Complete int
+
+	// Chat caps ChatOptions.MaxTokens in CompleteChat, i.e. thread replies.
+	Chat int
+
+	// Title is used by Summarize, i.e. thread titles.
+	Title int
+
+	// ConversationSummary is used by SummarizeConversation, i.e. summaries of older thread messages.
+	ConversationSummary int
+}
+
+func DefaultTokenBudgets() TokenBudgets {
+	return TokenBudgets{
+		Complete:            2048,
+		Chat:                4096,
+		Title:               32,
+		ConversationSummary: 512,
+	}
+}
+
+// Organization attributes API usage to an OpenAI organization and project. Empty fields are not sent.
+type Organization struct {
+	OrgID     string
+	ProjectID string
+}
+
+// projectHeaderTransport adds the OpenAI-Project header, which go-openai's ClientConfig does not support, to every
+// request.
+type projectHeaderTransport struct {
+	projectID string
+	base      http.RoundTripper
+}
+
+func (t *projectHeaderTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	request = request.Clone(request.Context())
+	request.Header.Set("OpenAI-Project", t.projectID)
+	return t.base.RoundTrip(request)
 }
 
-func NewOpenAI(token string) *OpenAI {
-	client := goopenai.NewClient(token)
-	limiter := ratelimit.New(1)
+// HTTPConfig configures the HTTP client used to call OpenAI.
+type HTTPConfig struct {
+	// Timeout bounds a whole request, including reading a streamed response.
+	Timeout time.Duration
+
+	// ResponseHeaderTimeout bounds the wait for OpenAI to start responding once a request is sent.
+	ResponseHeaderTimeout time.Duration
+
+	// IdleConnTimeout is how long an unused connection is kept open for reuse.
+	IdleConnTimeout time.Duration
+
+	// MaxIdleConnsPerHost is the most unused connections kept open for reuse.
+	MaxIdleConnsPerHost int
+}
+
+// DefaultHTTPConfig allows slow completions from large models, while not waiting forever on a hung connection.
+func DefaultHTTPConfig() HTTPConfig {
+	return HTTPConfig{
+		Timeout:               5 * time.Minute,
+		ResponseHeaderTimeout: 2 * time.Minute,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   DefaultMaxConcurrentCompletions,
+	}
+}
+
+// newHTTPClient returns the HTTP client for OpenAI requests, configured by config, that adds the project header if
+// organization has a project, adds the idempotency key of each request's context, and reports the rate limit headers
+// of every response to limiter.
+func newHTTPClient(config HTTPConfig, organization Organization, limiter *adaptiveLimiter) *http.Client {
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.ResponseHeaderTimeout = config.ResponseHeaderTimeout
+	base.IdleConnTimeout = config.IdleConnTimeout
+	base.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+
+	var transport http.RoundTripper = &idempotencyTransport{base: base}
+	if organization.ProjectID != "" {
+		transport = &projectHeaderTransport{projectID: organization.ProjectID, base: transport}
+	}
+	return &http.Client{
+		Transport: &rateLimitTransport{limiter: limiter, base: transport},
+		Timeout:   config.Timeout,
+	}
+}
+
+// newClientConfig returns the go-openai client config for token, attributing usage to organization and sending
+// requests with httpClient.
+func newClientConfig(token string, organization Organization, httpClient *http.Client) goopenai.ClientConfig {
+	config := goopenai.DefaultConfig(token)
+	config.OrgID = organization.OrgID
+	config.HTTPClient = httpClient
+	return config
+}
+
+// NewOpenAI returns a client that sends prompt as the system message of chats that have no persona. If prompt is empty
+// the embedded default is used. At most maxConcurrentCompletions calls to CompleteChat and Complete run at once; if it
+// is not positive, DefaultMaxConcurrentCompletions is used. Requests are sent at most once a second, and slower as
+// OpenAI's rate limit headers report the quota running out.
+func NewOpenAI(
+	token string,
+	prompt string,
+	budgets TokenBudgets,
+	organization Organization,
+	maxConcurrentCompletions int,
+	httpConfig HTTPConfig,
+	zlog *zerolog.Logger,
+) *OpenAI {
+	limiter := newAdaptiveLimiter(ratelimit.New(1), zlog)
+	httpClient := newHTTPClient(httpConfig, organization, limiter)
+	client := goopenai.NewClientWithConfig(newClientConfig(token, organization, httpClient))
+	if prompt == "" {
+		prompt = DefaultInitialPrompt()
+	}
+	if maxConcurrentCompletions <= 0 {
+		maxConcurrentCompletions = DefaultMaxConcurrentCompletions
+	}
 
 	return &OpenAI{
 		client:        client,
-		initialPrompt: initialPrompt,
+		httpClient:    httpClient,
+		initialPrompt: prompt,
 		limiter:       limiter,
+		budgets:       budgets,
+		completions:   semaphore.NewWeighted(int64(maxConcurrentCompletions)),
 	}
 }
 
-type ChatMessage struct {
-	FromHuman bool
-	Text      string
+// acquireCompletion waits for a completion slot, giving up if ctx is done first. The returned function releases the
+// slot.
+func (o *OpenAI) acquireCompletion(ctx context.Context, zlog *zerolog.Logger) (func(), error) {
+	if !o.completions.TryAcquire(1) {
+		zlog.Debug().Msg("Too many completions in flight, waiting for one to finish")
+		if err := o.completions.Acquire(ctx, 1); err != nil {
+			zlog.Warn().Err(err).Msg("Gave up waiting for a completion slot")
+			return nil, err
+		}
+	}
+	return func() { o.completions.Release(1) }, nil
 }
 
-// GetCurrentDate returns the current date e.g. 2023-02-04.
-func GetCurrentDate() string {
-	now := time.Now().Unix()
-	tm := time.Unix(now, 0)
-	return tm.Format("2006-01-02")
+// ChatMessage is a message in a conversation. Messages are from the assistant unless FromHuman or FromSystem is set;
+// FromSystem is used for context the bot adds itself, such as a summary of earlier messages. ImageURLs are images
+// attached to a human's message, which are only sent to vision-capable models.
+type ChatMessage struct {
+	FromHuman  bool
+	FromSystem bool
+	Text       string
+	ImageURLs  []string
 }
 
-func (o *OpenAI) CompleteChat(messages []*ChatMessage, ctx context.Context, zlog *zerolog.Logger) (string, error) {
-	o.limiter.Take()
-	var resultErr error
-	requestMessages := make([]goopenai.ChatCompletionMessage, 0, len(messages))
-
-	for i := 0; i < len(messages); i++ {
-		message := messages[i]
-		if message.FromHuman {
-			requestMessages = append(requestMessages, goopenai.ChatCompletionMessage{
+// ConvertChatMessagesToChatCompletionMessages converts messages to the chat completion request format. Images on
+// messages from a human are sent as image parts alongside the text if model is vision-capable, and dropped otherwise.
+func ConvertChatMessagesToChatCompletionMessages(messages []*ChatMessage, model string) []goopenai.ChatCompletionMessage {
+	vision := IsVisionModel(model)
+	result := make([]goopenai.ChatCompletionMessage, 0, len(messages))
+	for _, message := range messages {
+		if message.FromSystem {
+			result = append(result, goopenai.ChatCompletionMessage{
+				Role:    "system",
+				Content: message.Text,
+			})
+		} else if message.FromHuman && vision && len(message.ImageURLs) > 0 {
+			parts := make([]goopenai.ChatMessagePart, 0, len(message.ImageURLs)+1)
+			if message.Text != "" {
+				parts = append(parts, goopenai.ChatMessagePart{
+					Type: goopenai.ChatMessagePartTypeText,
+					Text: message.Text,
+				})
+			}
+			for _, imageURL := range message.ImageURLs {
+				parts = append(parts, goopenai.ChatMessagePart{
+					Type:     goopenai.ChatMessagePartTypeImageURL,
+					ImageURL: &goopenai.ChatMessageImageURL{URL: imageURL},
+				})
+			}
+			result = append(result, goopenai.ChatCompletionMessage{
+				Role:         "user",
+				MultiContent: parts,
+			})
+		} else if message.FromHuman {
+			result = append(result, goopenai.ChatCompletionMessage{
 				Role:    "user",
 				Content: message.Text,
 			})
 		} else {
-			requestMessages = append(requestMessages, goopenai.ChatCompletionMessage{
+			result = append(result, goopenai.ChatCompletionMessage{
 				Role:    "assistant",
 				Content: message.Text,
 			})
 		}
 	}
+	return result
+}
+
+func hasImages(messages []*ChatMessage) bool {
+	for _, message := range messages {
+		if len(message.ImageURLs) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ChatOptions configures a chat completion.
+type ChatOptions struct {
+	Model       string
+	Temperature float32
+
+	// Persona is sent as a system message before the conversation, in place of the client's initial prompt. It is
+	// never trimmed.
+	Persona string
+
+	// MaxPromptTokens, if positive, is the budget the conversation is trimmed to; otherwise it is whatever the model's
+	// context window leaves after MaxTokens.
+	MaxPromptTokens int
+
+	// MaxTokens caps the completion length, and is further limited by the room left in the context window.
+	MaxTokens int
+
+	// Stop sequences end the reply early when the model generates one of them.
+	Stop []string
+
+	// JSONMode asks the model to reply with a JSON object; use CompleteChatJSON rather than setting it directly.
+	JSONMode bool
+
+	// Tools are functions the model may call before replying, for at most MaxToolIterations rounds.
+	Tools             []Tool
+	MaxToolIterations int
+
+	// Seed, if set, asks the model to sample deterministically, so that the same request gives the same reply.
+	Seed *int
+
+	// FallbackModels are tried in order if Model is overloaded or otherwise unavailable.
+	FallbackModels []string
+
+	// PresencePenalty and FrequencyPenalty, between MinPenalty and MaxPenalty, discourage repeating topics and words
+	// when positive; zero leaves the model's behavior unchanged.
+	PresencePenalty  float32
+	FrequencyPenalty float32
+
+	// LogProbs, if true, logs the log probabilities of the first tokens of each reply at debug level, for tuning
+	// prompts.
+	LogProbs bool
+
+	// Language, if set, asks the model to reply in that language, or in the user's language if it is
+	// LanguageMatchUser.
+	Language string
+}
+
+// LanguageMatchUser is the ChatOptions.Language that asks the model to reply in the language of the user's latest
+// message.
+const LanguageMatchUser = "auto"
+
+// languageInstruction returns the system prompt instruction for ChatOptions.Language, or "" if it is not set.
+func languageInstruction(language string) string {
+	switch strings.TrimSpace(language) {
+	case "":
+		return ""
+	case LanguageMatchUser:
+		return "Always reply in the same language as the user's latest message."
+	default:
+		return "Always reply in " + strings.TrimSpace(language) + ", whatever language the user writes in."
+	}
+}
+
+func DefaultChatOptions() ChatOptions {
+	return ChatOptions{
+		Model:       goopenai.GPT4,
+		Temperature: 0.0,
+		MaxTokens:   4096,
+	}
+}
+
+// DefaultInitialPrompt returns the initial prompt compiled into the binary.
+func DefaultInitialPrompt() string {
+	return initialPrompt
+}
+
+// systemPrompt returns the initial prompt, filling in the current date if the prompt ends with "Current date:".
+func (o *OpenAI) systemPrompt() string {
+	prompt := strings.TrimSpace(o.initialPrompt)
+	if strings.HasSuffix(prompt, "Current date:") {
+		prompt += " " + GetCurrentDate()
+	}
+	return prompt
+}
+
+// GetCurrentDate returns the current date e.g. 2023-02-04.
+func GetCurrentDate() string {
+	now := time.Now().Unix()
+	tm := time.Unix(now, 0)
+	return tm.Format("2006-01-02")
+}
+
+// Completion is the text the model generated, along with the model that generated it and the tokens it used. If
+// several candidates were requested, Choices holds all of them and Text is the first.
+type Completion struct {
+	Text    string
+	Choices []string
+	Model   string
+	Usage   Usage
+}
+
+// Usage is the number of tokens a completion used. If a completion took several requests, e.g. to call tools, it is
+// the total over all of them.
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+	TotalTokens      int
+}
 
-	completion, err := o.ChatComplete(requestMessages, ctx, zlog)
+func (u *Usage) add(usage goopenai.Usage) {
+	u.PromptTokens += usage.PromptTokens
+	u.CompletionTokens += usage.CompletionTokens
+	u.TotalTokens += usage.TotalTokens
+}
+
+func (o *OpenAI) CompleteChat(
+	messages []*ChatMessage,
+	options ChatOptions,
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) (*Completion, error) {
+	var resultErr error
+	if err := ValidateStopSequences(options.Stop); err != nil {
+		resultErr = multierror.Append(resultErr, err, FailedToCompletePrompt)
+		return nil, resultErr
+	}
+	if err := ValidatePenalties(options.PresencePenalty, options.FrequencyPenalty); err != nil {
+		resultErr = multierror.Append(resultErr, err, FailedToCompletePrompt)
+		return nil, resultErr
+	}
+	release, err := o.acquireCompletion(ctx, zlog)
+	if err != nil {
+		resultErr = multierror.Append(resultErr, err, FailedToCompletePrompt)
+		return nil, resultErr
+	}
+	defer release()
+
+	o.limiter.Take()
+	requestMessages := make([]goopenai.ChatCompletionMessage, 0, len(messages)+1)
+
+	if o.budgets.Chat > 0 && (options.MaxTokens <= 0 || options.MaxTokens > o.budgets.Chat) {
+		options.MaxTokens = o.budgets.Chat
+	}
+
+	persona := options.Persona
+	if persona == "" {
+		persona = o.systemPrompt()
+	}
+	if instruction := languageInstruction(options.Language); instruction != "" {
+		persona += "\n\n" + instruction
+	}
+	requestMessages = append(requestMessages, goopenai.ChatCompletionMessage{
+		Role:    "system",
+		Content: persona,
+	})
+
+	if !IsVisionModel(options.Model) && hasImages(messages) {
+		zlog.Info().Str("model", options.Model).Msg("Model does not support images, sending text only")
+	}
+	requestMessages = append(requestMessages, ConvertChatMessagesToChatCompletionMessages(messages, options.Model)...)
+
+	promptBudget := options.PromptTokenBudget()
+	trimmedMessages, err := TrimMessagesToFit(requestMessages, promptBudget)
+	if err != nil {
+		zlog.Error().Err(err).Int("promptBudget", promptBudget).Msg("Failed to trim messages")
+		resultErr = multierror.Append(resultErr, err)
+		return nil, resultErr
+	}
+	if len(trimmedMessages) < len(requestMessages) {
+		zlog.Info().
+			Int("before", len(requestMessages)).
+			Int("after", len(trimmedMessages)).
+			Int("promptBudget", promptBudget).
+			Msg("Trimmed messages to fit prompt token budget")
+	}
+	requestMessages = trimmedMessages
+
+	completion, err := o.chatCompleteWithFallback(requestMessages, options, ctx, zlog)
 	if err != nil {
 		zlog.Error().Err(err).Msg("Failed to complete prompt")
 		resultErr = multierror.Append(resultErr, err)
-		return "", resultErr
+		return nil, resultErr
 	}
-	zlog.Debug().Interface("requestMessages", requestMessages).Msgf("completion: %s", completion)
+	zlog.Debug().Interface("requestMessages", requestMessages).Interface("options", options).Msgf("completion: %s", completion.Text)
 
 	return completion, nil
 }
 
+// ChatComplete sends messages to the chat completion API and returns the model's reply. If options.Tools is set the
+// model may call them; each round of tool calls is run and the results sent back in a follow-up request, until the
+// model replies with text or options.MaxToolIterations rounds have been made.
 func (o *OpenAI) ChatComplete(
 	messages []goopenai.ChatCompletionMessage,
+	options ChatOptions,
 	ctx context.Context,
 	zlog *zerolog.Logger,
-) (string, error) {
-	o.limiter.Take()
+) (*Completion, error) {
 	var resultErr error
-	completion, err := o.client.CreateChatCompletion(ctx, goopenai.ChatCompletionRequest{
-		Model:       goopenai.GPT4,
-		Messages:    messages,
-		MaxTokens:   4096,
-		Temperature: 0.0,
-		TopP:        1.0,
-		Stream:      false,
-		Stop:        []string{"<|endoftext|>"},
-	})
+	var usage Usage
+	maxIterations := options.MaxToolIterations
+	if maxIterations <= 0 {
+		maxIterations = DefaultMaxToolIterations
+	}
+	tools := toRequestTools(options.Tools)
+
+	for iteration := 0; iteration <= maxIterations; iteration++ {
+		o.limiter.Take()
+		promptTokens := EstimateMessagesTokens(messages)
+		maxTokens, err := MaxCompletionTokens(options.Model, promptTokens, options.MaxTokens)
+		if err != nil {
+			zlog.Error().Err(err).Str("model", options.Model).Int("promptTokens", promptTokens).Msg("Prompt is too long")
+			resultErr = multierror.Append(resultErr, err, FailedToCompletePrompt)
+			return nil, resultErr
+		}
+		zlog.Debug().Int("promptTokens", promptTokens).Int("maxTokens", maxTokens).Msg("Computed max tokens")
+
+		request := goopenai.ChatCompletionRequest{
+			Model:       options.Model,
+			Messages:    messages,
+			MaxTokens:   maxTokens,
+			Temperature: options.Temperature,
+			TopP:        1.0,
+			Stream:      false,
+			Stop:        stopSequences(options.Stop),
+			Tools:       tools,
+			Seed:        options.Seed,
+
+			PresencePenalty:  options.PresencePenalty,
+			FrequencyPenalty: options.FrequencyPenalty,
+		}
+		if options.JSONMode {
+			request.ResponseFormat = &goopenai.ChatCompletionResponseFormat{
+				Type: goopenai.ChatCompletionResponseFormatTypeJSONObject,
+			}
+		}
+		if options.LogProbs {
+			request.LogProbs = true
+			request.TopLogProbs = debugTopLogProbs
+		}
+		completion, err := o.client.CreateChatCompletion(ctx, request)
+		metrics.OpenAIRequests.WithLabelValues("chat_completion").Inc()
+		if err != nil {
+			zlog.Error().Err(err).Msg("Failed to complete chat")
+			metrics.Errors.WithLabelValues("openai").Inc()
+			resultErr = multierror.Append(resultErr, err, FailedToCompletePrompt)
+			return nil, resultErr
+		}
+		recordUsage(completion.Usage)
+		usage.add(completion.Usage)
+		zlog.Debug().
+			Interface("seed", options.Seed).
+			Str("systemFingerprint", completion.SystemFingerprint).
+			Msg("Completed chat")
+		if options.LogProbs {
+			logTokenLogProbs(completion.Choices[0].LogProbs, zlog)
+		}
+
+		reply := completion.Choices[0].Message
+		if len(reply.ToolCalls) == 0 {
+			return &Completion{Text: reply.Content, Model: completion.Model, Usage: usage}, resultErr
+		}
+		zlog.Debug().Int("iteration", iteration).Int("toolCalls", len(reply.ToolCalls)).Msg("Model called tools")
+		messages = append(messages, reply)
+		messages = append(messages, callTools(options.Tools, reply.ToolCalls, ctx, zlog)...)
+	}
+
+	zlog.Error().Int("maxIterations", maxIterations).Msg("Model kept calling tools")
+	resultErr = multierror.Append(resultErr, ToolIterationsExceededError, FailedToCompletePrompt)
+	return nil, resultErr
+}
+
+// CompleteOptions configures a text completion. Stop sequences, if set, end the completion early when the model
+// generates one of them. N is the number of candidate completions to generate, one if not set.
+type CompleteOptions struct {
+	Stop []string
+	N    int
+}
+
+// MaxStopSequences is the most stop sequences OpenAI accepts in a request.
+const MaxStopSequences = 4
+
+const (
+	// MinPenalty and MaxPenalty bound ChatOptions.PresencePenalty and ChatOptions.FrequencyPenalty.
+	MinPenalty = -2.0
+	MaxPenalty = 2.0
+)
+
+// ValidatePenalties returns PenaltyOutOfRangeError if either penalty is outside MinPenalty to MaxPenalty.
+func ValidatePenalties(penalties ...float32) error {
+	for _, penalty := range penalties {
+		if penalty < MinPenalty || penalty > MaxPenalty {
+			return PenaltyOutOfRangeError
+		}
+	}
+	return nil
+}
+
+// defaultStopSequences are sent when no stop sequences are configured.
+var defaultStopSequences = []string{"<|endoftext|>"}
+
+// ValidateStopSequences returns TooManyStopSequencesError if stop has more sequences than OpenAI allows.
+func ValidateStopSequences(stop []string) error {
+	if len(stop) > MaxStopSequences {
+		return TooManyStopSequencesError
+	}
+	return nil
+}
+
+// stopSequences returns stop, or the default stop sequences if it is empty.
+func stopSequences(stop []string) []string {
+	if len(stop) == 0 {
+		return defaultStopSequences
+	}
+	return stop
+}
+
+// Complete completes prompt with the legacy completions endpoint. MaxTokens is reduced to fit the room the prompt
+// leaves in the model's context window, and PromptTooLongError is returned without calling the API if there is none.
+func (o *OpenAI) Complete(
+	prompt string,
+	options CompleteOptions,
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) (*Completion, error) {
+	var resultErr error
+	if err := ValidateStopSequences(options.Stop); err != nil {
+		resultErr = multierror.Append(resultErr, err, FailedToCompletePrompt)
+		return nil, resultErr
+	}
+	release, err := o.acquireCompletion(ctx, zlog)
 	if err != nil {
-		zlog.Error().Err(err).Msg("Failed to complete chat")
 		resultErr = multierror.Append(resultErr, err, FailedToCompletePrompt)
-		return "", resultErr
+		return nil, resultErr
 	}
-	return completion.Choices[0].Message.Content, resultErr
-}
+	defer release()
 
-func (o *OpenAI) Complete(prompt string, ctx context.Context, zlog *zerolog.Logger) (string, error) {
 	o.limiter.Take()
-	var resultErr error
-	completion, err := o.client.CreateCompletion(ctx, goopenai.CompletionRequest{
-		Model:       goopenai.GPT3TextDavinci003,
-		MaxTokens:   2048,
-		Prompt:      prompt,
-		Temperature: 0.0,
-		TopP:        1.0,
-		Stop:        []string{"<|endoftext|>"},
-	})
+	request, err := o.completionRequest(prompt, options, zlog)
+	if err != nil {
+		resultErr = multierror.Append(resultErr, err, FailedToCompletePrompt)
+		return nil, resultErr
+	}
+
+	completion, err := o.client.CreateCompletion(ctx, request)
+	metrics.OpenAIRequests.WithLabelValues("completion").Inc()
 	if err != nil {
 		zlog.Error().Err(err).Msg("Failed to complete prompt")
+		metrics.Errors.WithLabelValues("openai").Inc()
 		resultErr = multierror.Append(resultErr, err, FailedToCompletePrompt)
-		return "", resultErr
+		return nil, resultErr
+	}
+	recordUsage(completion.Usage)
+	var usage Usage
+	usage.add(completion.Usage)
+	choices := make([]string, 0, len(completion.Choices))
+	for _, choice := range completion.Choices {
+		choices = append(choices, choice.Text)
 	}
-	return completion.Choices[0].Text, resultErr
+	return &Completion{Text: choices[0], Choices: choices, Model: completion.Model, Usage: usage}, resultErr
+}
+
+// completionRequest returns the legacy completions request for prompt, with MaxTokens reduced to fit the room the
+// prompt leaves in the model's context window.
+func (o *OpenAI) completionRequest(
+	prompt string,
+	options CompleteOptions,
+	zlog *zerolog.Logger,
+) (goopenai.CompletionRequest, error) {
+	promptTokens := EstimateTokens(prompt)
+	maxTokens, err := MaxCompletionTokens(goopenai.GPT3TextDavinci003, promptTokens, o.budgets.Complete)
+	if err != nil {
+		zlog.Error().Err(err).Int("promptTokens", promptTokens).Msg("Prompt is too long")
+		return goopenai.CompletionRequest{}, err
+	}
+	zlog.Debug().Int("promptTokens", promptTokens).Int("maxTokens", maxTokens).Msg("Computed max tokens")
+
+	return goopenai.CompletionRequest{
+		Model:       goopenai.GPT3TextDavinci003,
+		MaxTokens:   maxTokens,
+		Prompt:      prompt,
+		Temperature: 0.0,
+		TopP:        1.0,
+		Stop:        stopSequences(options.Stop),
+		N:           options.N,
+	}, nil
 }
 
 type CreateImageResponse struct {
@@ -156,11 +683,94 @@ func (o *OpenAI) CreateImage(prompt string, ctx context.Context, zlog *zerolog.L
 		Size:           goopenai.CreateImageSize1024x1024,
 		ResponseFormat: goopenai.CreateImageResponseFormatB64JSON,
 	})
+	metrics.OpenAIRequests.WithLabelValues("image").Inc()
 	if err != nil {
 		zlog.Error().Err(err).Msg("Failed to create image")
+		metrics.Errors.WithLabelValues("openai").Inc()
+		return nil, err
+	}
+
+	return decodeImageResponse(resp, zlog)
+}
+
+// CreateImageVariation creates n variations of a PNG image.
+func (o *OpenAI) CreateImageVariation(
+	imageData []byte,
+	n int,
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) (*CreateImageResponse, error) {
+	o.limiter.Take()
+	image, err := writeTempPNG(imageData)
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to write image to a temporary file")
+		return nil, err
+	}
+	defer removeTempFile(image, zlog)
+
+	resp, err := o.client.CreateVariImage(ctx, goopenai.ImageVariRequest{
+		Image:          image,
+		N:              n,
+		Size:           goopenai.CreateImageSize1024x1024,
+		ResponseFormat: goopenai.CreateImageResponseFormatB64JSON,
+	})
+	metrics.OpenAIRequests.WithLabelValues("image_variation").Inc()
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to create image variation")
+		metrics.Errors.WithLabelValues("openai").Inc()
 		return nil, err
 	}
 
+	return decodeImageResponse(resp, zlog)
+}
+
+// EditImage edits a PNG image as described by prompt. The transparent areas of maskData, a PNG the same size as the
+// image, mark where it should be edited. If maskData is nil the image's own transparent areas are used.
+func (o *OpenAI) EditImage(
+	imageData []byte,
+	maskData []byte,
+	prompt string,
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) (*CreateImageResponse, error) {
+	o.limiter.Take()
+	image, err := writeTempPNG(imageData)
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to write image to a temporary file")
+		return nil, err
+	}
+	defer removeTempFile(image, zlog)
+
+	request := goopenai.ImageEditRequest{
+		Image:          image,
+		Prompt:         prompt,
+		N:              1,
+		Size:           goopenai.CreateImageSize1024x1024,
+		ResponseFormat: goopenai.CreateImageResponseFormatB64JSON,
+	}
+	if maskData != nil {
+		mask, err := writeTempPNG(maskData)
+		if err != nil {
+			zlog.Error().Err(err).Msg("Failed to write mask to a temporary file")
+			return nil, err
+		}
+		defer removeTempFile(mask, zlog)
+		request.Mask = mask
+	}
+
+	resp, err := o.client.CreateEditImage(ctx, request)
+	metrics.OpenAIRequests.WithLabelValues("image_edit").Inc()
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to edit image")
+		metrics.Errors.WithLabelValues("openai").Inc()
+		return nil, err
+	}
+
+	return decodeImageResponse(resp, zlog)
+}
+
+// decodeImageResponse decodes the base64 images in resp.
+func decodeImageResponse(resp goopenai.ImageResponse, zlog *zerolog.Logger) (*CreateImageResponse, error) {
 	result := CreateImageResponse{Images: make([]Image, 0, len(resp.Data))}
 	for _, data := range resp.Data {
 		imageData, err := base64.StdEncoding.DecodeString(data.B64JSON)
@@ -174,42 +784,93 @@ func (o *OpenAI) CreateImage(prompt string, ctx context.Context, zlog *zerolog.L
 	return &result, nil
 }
 
+// writeTempPNG writes data to a temporary .png file, because go-openai uploads images from files. The file is open
+// and positioned at the start.
+func writeTempPNG(data []byte) (*os.File, error) {
+	file, err := os.CreateTemp("", "openai-image-*.png")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
+
+func removeTempFile(file *os.File, zlog *zerolog.Logger) {
+	_ = file.Close()
+	if err := os.Remove(file.Name()); err != nil {
+		zlog.Warn().Err(err).Str("path", file.Name()).Msg("Failed to remove temporary file")
+	}
+}
+
+func recordUsage(usage goopenai.Usage) {
+	metrics.OpenAITokens.WithLabelValues("prompt").Add(float64(usage.PromptTokens))
+	metrics.OpenAITokens.WithLabelValues("completion").Add(float64(usage.CompletionTokens))
+}
+
+// Close closes the idle connections to OpenAI. Requests in flight are not interrupted.
 func (o *OpenAI) Close(*zerolog.Logger) error {
-	//o.client.HTTPClient.CloseIdleConnections()
+	o.httpClient.CloseIdleConnections()
 	return nil
 }
 
+// maxSummaryInputTokens caps the message content Summarize sends to OpenAI.
+const maxSummaryInputTokens = 1024
+
 func (o *OpenAI) Summarize(
 	content string,
 	words int,
 	ctx context.Context,
 	zlog *zerolog.Logger,
 ) (string, error) {
-	o.limiter.Take()
+	options := ChatOptions{
+		Model:       goopenai.GPT3Dot5Turbo,
+		Temperature: 0.0,
+		MaxTokens:   o.budgets.Title,
+	}
+	instructions := "Summarize the user's message as a short title of fewer than " + strconv.Itoa(words) +
+		" words. Reply with only the title."
 
-	var promptBuilder strings.Builder
-	promptBuilder.WriteString(o.initialPrompt)
-	promptBuilder.WriteString(GetCurrentDate())
-	promptBuilder.WriteString("\n\n")
-	promptBuilder.WriteString("Summarize the following message into less than ")
-	promptBuilder.WriteString(strconv.Itoa(words))
-	promptBuilder.WriteString(" words:\n\n")
-	promptBuilder.WriteString(content)
-	prompt := promptBuilder.String()
-
-	completion, err := o.client.CreateCompletion(ctx, goopenai.CompletionRequest{
-		Model:     goopenai.GPT3TextDavinci003,
-		MaxTokens: 16,
-		Prompt:    prompt,
-		Stop:      []string{"<|endoftext|>"},
-	})
+	// A title needs far less than a whole long message, which may not even fit in the model's context.
+	budget := ModelContextLimit(options.Model) - options.MaxTokens - EstimateTokens(instructions) - 2*tokensPerMessage - tokensPerReply
+	if budget > maxSummaryInputTokens {
+		budget = maxSummaryInputTokens
+	}
+	content, truncated := truncateMiddle(content, budget)
+	if truncated {
+		zlog.Info().Int("budget", budget).Msg("Message too long to summarize in full, dropping its middle")
+		instructions += " The message was too long, so its middle has been replaced with [...]."
+	}
+
+	requestMessages := []goopenai.ChatCompletionMessage{
+		{
+			Role:    "system",
+			Content: instructions,
+		},
+		{
+			Role:    "user",
+			Content: content,
+		},
+	}
+	completion, err := o.ChatComplete(requestMessages, options, ctx, zlog)
 	if err != nil {
-		zlog.Error().Err(err).Msg("Failed to complete prompt")
+		zlog.Error().Err(err).Msg("Failed to summarize message")
 		return "", err
 	}
 
 	// trim space from summary
-	summary := strings.TrimSpace(completion.Choices[0].Text)
+	summary := strings.TrimSpace(completion.Text)
+
+	// chat models sometimes quote the title
+	summary = strings.Trim(summary, "\"")
 
 	// trim punctuation from summary
 	summary = strings.TrimRight(summary, ".")
@@ -233,3 +894,65 @@ func (o *OpenAI) Summarize(
 
 	return summary, err
 }
+
+// SummarizeConversation summarizes a conversation so that it can stand in for the full history, in at most sentences
+// sentences if sentences is positive. If the conversation is too long for the summarization model, only the most
+// recent messages that fit are summarized.
+func (o *OpenAI) SummarizeConversation(
+	messages []*ChatMessage,
+	sentences int,
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) (string, error) {
+	options := ChatOptions{
+		Model:       goopenai.GPT3Dot5Turbo,
+		Temperature: 0.0,
+		MaxTokens:   o.budgets.ConversationSummary,
+	}
+	instructions := "Summarize the following conversation between a user and an assistant. Keep the key " +
+		"facts, decisions, and open questions so that the conversation can continue without the full history."
+	if sentences > 0 {
+		instructions += " Use at most " + strconv.Itoa(sentences) + " sentences."
+	}
+
+	// Build the transcript from newest to oldest, stopping once it no longer fits alongside the summary.
+	budget := ModelContextLimit(options.Model) - options.MaxTokens - EstimateTokens(instructions) - 2*tokensPerMessage - tokensPerReply
+	lines := make([]string, 0, len(messages))
+	for i := len(messages) - 1; i >= 0; i-- {
+		var line string
+		if messages[i].FromHuman {
+			line = "User: " + messages[i].Text
+		} else {
+			line = "Assistant: " + messages[i].Text
+		}
+		budget -= EstimateTokens(line) + 1
+		if budget < 0 {
+			zlog.Info().Int("dropped", i+1).Msg("Conversation too long to summarize in full, dropping oldest messages")
+			break
+		}
+		lines = append(lines, line)
+	}
+	var transcript strings.Builder
+	for i := len(lines) - 1; i >= 0; i-- {
+		transcript.WriteString(lines[i])
+		transcript.WriteString("\n\n")
+	}
+
+	requestMessages := []goopenai.ChatCompletionMessage{
+		{
+			Role:    "system",
+			Content: instructions,
+		},
+		{
+			Role:    "user",
+			Content: transcript.String(),
+		},
+	}
+	summary, err := o.ChatComplete(requestMessages, options, ctx, zlog)
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to summarize conversation")
+		return "", err
+	}
+
+	return strings.TrimSpace(summary.Text), nil
+}
@@ -0,0 +1,612 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/rs/zerolog"
+	goopenai "github.com/sashabaranov/go-openai"
+	"go.uber.org/ratelimit"
+	"golang.org/x/sync/semaphore"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chatServer stands in for the OpenAI API. It answers chat completion requests with responses, in order, and records
+// each request it receives. Once responses run out it fails every request.
+type chatServer struct {
+	mu        sync.Mutex
+	responses []goopenai.ChatCompletionResponse
+	requests  []goopenai.ChatCompletionRequest
+}
+
+func (s *chatServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var request goopenai.ChatCompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, request)
+	if len(s.responses) == 0 {
+		s.mu.Unlock()
+		http.Error(w, `{"error": {"message": "no more responses"}}`, http.StatusInternalServerError)
+		return
+	}
+	response := s.responses[0]
+	s.responses = s.responses[1:]
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// received returns the requests the server has received so far.
+func (s *chatServer) received() []goopenai.ChatCompletionRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]goopenai.ChatCompletionRequest(nil), s.requests...)
+}
+
+// textResponse is a chat completion response whose reply is text.
+func textResponse(text string) goopenai.ChatCompletionResponse {
+	return goopenai.ChatCompletionResponse{
+		Model: goopenai.GPT3Dot5Turbo,
+		Choices: []goopenai.ChatCompletionChoice{{
+			Message:      goopenai.ChatCompletionMessage{Role: goopenai.ChatMessageRoleAssistant, Content: text},
+			FinishReason: goopenai.FinishReasonStop,
+		}},
+	}
+}
+
+// stubClient is an OpenAIClient whose chat completions fail with err, or succeed if it is nil, and are counted.
+// Methods a test does not set up are left to the embedded nil client, and panic if called.
+type stubClient struct {
+	OpenAIClient
+
+	mu    sync.Mutex
+	err   error
+	calls int
+}
+
+func (c *stubClient) CompleteChat(messages []*ChatMessage, options ChatOptions, ctx context.Context, zlog *zerolog.Logger) (*Completion, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &Completion{Text: "ok"}, nil
+}
+
+// newTestOpenAI returns a client that sends its requests to handler rather than OpenAI, without rate limiting.
+func newTestOpenAI(t *testing.T, handler http.Handler) *OpenAI {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	zlog := zerolog.Nop()
+	config := goopenai.DefaultConfig("test-token")
+	config.BaseURL = server.URL + "/v1"
+	config.HTTPClient = server.Client()
+	return &OpenAI{
+		client:        goopenai.NewClientWithConfig(config),
+		httpClient:    server.Client(),
+		initialPrompt: "You are a test.",
+		limiter:       newAdaptiveLimiter(ratelimit.NewUnlimited(), &zlog),
+		completions:   semaphore.NewWeighted(DefaultMaxConcurrentCompletions),
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	long := strings.Repeat("word ", 30)
+	tests := []struct {
+		name  string
+		reply string
+		want  string
+	}{
+		{name: "plain", reply: "Planning a trip", want: "Planning a trip"},
+		{name: "trims space, quotes, and periods", reply: "  \"Planning a trip.\"\n", want: "Planning a trip"},
+		{name: "truncated to Discord's limit", reply: long, want: strings.Repeat("word ", 19)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &chatServer{responses: []goopenai.ChatCompletionResponse{textResponse(tt.reply)}}
+			client := newTestOpenAI(t, server)
+			zlog := zerolog.Nop()
+
+			got, err := client.Summarize("Where should I go on holiday?", 5, context.Background(), &zlog)
+			if err != nil {
+				t.Fatalf("Summarize() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Summarize() = %q, want %q", got, tt.want)
+			}
+
+			requests := server.received()
+			if len(requests) != 1 {
+				t.Fatalf("Summarize() made %d requests, want 1", len(requests))
+			}
+			messages := requests[0].Messages
+			if len(messages) != 2 || messages[0].Role != goopenai.ChatMessageRoleSystem || messages[1].Role != goopenai.ChatMessageRoleUser {
+				t.Fatalf("Summarize() sent %+v, want a system instruction and the user's message", messages)
+			}
+			if !strings.Contains(messages[0].Content, "fewer than 5 words") {
+				t.Errorf("Summarize() instruction = %q, want the word limit", messages[0].Content)
+			}
+			if messages[1].Content != "Where should I go on holiday?" {
+				t.Errorf("Summarize() user message = %q, want the content", messages[1].Content)
+			}
+		})
+	}
+}
+
+func TestSummarizeTruncatesLongMessage(t *testing.T) {
+	server := &chatServer{responses: []goopenai.ChatCompletionResponse{textResponse("A long story")}}
+	client := newTestOpenAI(t, server)
+	zlog := zerolog.Nop()
+	content := "Once upon a time" + strings.Repeat(" and then", 10000) + " what happened next?"
+
+	if _, err := client.Summarize(content, 5, context.Background(), &zlog); err != nil {
+		t.Fatalf("Summarize() error = %v", err)
+	}
+	messages := server.received()[0].Messages
+	if !strings.Contains(messages[0].Content, "[...]") {
+		t.Errorf("Summarize() instruction = %q, want a note about the truncation", messages[0].Content)
+	}
+	sent := messages[1].Content
+	if EstimateTokens(sent) > maxSummaryInputTokens {
+		t.Errorf("Summarize() sent %d tokens, want at most %d", EstimateTokens(sent), maxSummaryInputTokens)
+	}
+	if !strings.HasPrefix(sent, "Once upon a time") || !strings.HasSuffix(sent, "what happened next?") {
+		t.Errorf("Summarize() user message = %q, want the start and end of the content", sent)
+	}
+}
+
+func TestCompletionRequestFitsPrompt(t *testing.T) {
+	tests := []struct {
+		name          string
+		promptTokens  int
+		wantMaxTokens int
+		wantErr       error
+	}{
+		{name: "short prompt", promptTokens: 100, wantMaxTokens: 2048},
+		{name: "prompt leaves exactly the budget", promptTokens: 2049, wantMaxTokens: 2048},
+		{name: "prompt leaves less than the budget", promptTokens: 2050, wantMaxTokens: 2047},
+		{name: "prompt leaves one token", promptTokens: 4096, wantMaxTokens: 1},
+		{name: "prompt fills the context", promptTokens: 4097, wantErr: PromptTooLongError},
+		{name: "prompt exceeds the context", promptTokens: 5000, wantErr: PromptTooLongError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &OpenAI{budgets: DefaultTokenBudgets()}
+			zlog := zerolog.Nop()
+			prompt := strings.Repeat("abcd", tt.promptTokens)
+
+			request, err := client.completionRequest(prompt, CompleteOptions{}, &zlog)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("completionRequest() error = %v, want %v", err, tt.wantErr)
+			}
+			if request.MaxTokens != tt.wantMaxTokens {
+				t.Errorf("completionRequest() MaxTokens = %d, want %d", request.MaxTokens, tt.wantMaxTokens)
+			}
+		})
+	}
+}
+
+func TestNewOpenAIInitialPrompt(t *testing.T) {
+	tests := []struct {
+		name   string
+		prompt string
+		want   string
+	}{
+		{name: "configured", prompt: "You are a pirate.", want: "You are a pirate."},
+		{name: "embedded default", prompt: "", want: DefaultInitialPrompt()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			zlog := zerolog.Nop()
+			client := NewOpenAI("token", tt.prompt, DefaultTokenBudgets(), Organization{}, 0, HTTPConfig{}, &zlog)
+			if client.initialPrompt != tt.want {
+				t.Errorf("NewOpenAI() initial prompt = %q, want %q", client.initialPrompt, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertChatMessagesWithImages(t *testing.T) {
+	messages := []*ChatMessage{
+		{FromSystem: true, Text: "You are a test."},
+		{FromHuman: true, Text: "What is this?", ImageURLs: []string{"https://example.com/a.png", "https://example.com/b.png"}},
+		{FromHuman: true, ImageURLs: []string{"https://example.com/c.png"}},
+		{Text: "A cat."},
+	}
+	tests := []struct {
+		name  string
+		model string
+		want  []goopenai.ChatCompletionMessage
+	}{
+		{
+			name:  "vision model",
+			model: "gpt-4-vision-preview",
+			want: []goopenai.ChatCompletionMessage{
+				{Role: "system", Content: "You are a test."},
+				{Role: "user", MultiContent: []goopenai.ChatMessagePart{
+					{Type: goopenai.ChatMessagePartTypeText, Text: "What is this?"},
+					{Type: goopenai.ChatMessagePartTypeImageURL, ImageURL: &goopenai.ChatMessageImageURL{URL: "https://example.com/a.png"}},
+					{Type: goopenai.ChatMessagePartTypeImageURL, ImageURL: &goopenai.ChatMessageImageURL{URL: "https://example.com/b.png"}},
+				}},
+				{Role: "user", MultiContent: []goopenai.ChatMessagePart{
+					{Type: goopenai.ChatMessagePartTypeImageURL, ImageURL: &goopenai.ChatMessageImageURL{URL: "https://example.com/c.png"}},
+				}},
+				{Role: "assistant", Content: "A cat."},
+			},
+		},
+		{
+			name:  "images dropped for other models",
+			model: goopenai.GPT4,
+			want: []goopenai.ChatCompletionMessage{
+				{Role: "system", Content: "You are a test."},
+				{Role: "user", Content: "What is this?"},
+				{Role: "user", Content: ""},
+				{Role: "assistant", Content: "A cat."},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ConvertChatMessagesToChatCompletionMessages(messages, tt.model)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ConvertChatMessagesToChatCompletionMessages() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenBudgets(t *testing.T) {
+	budgets := TokenBudgets{Complete: 100, Chat: 200, Title: 10, ConversationSummary: 50}
+	messages := []*ChatMessage{{FromHuman: true, Text: "Where should I go on holiday?"}}
+	tests := []struct {
+		name string
+		call func(client *OpenAI, zlog *zerolog.Logger) error
+		want int
+	}{
+		{
+			name: "thread reply",
+			call: func(client *OpenAI, zlog *zerolog.Logger) error {
+				_, err := client.CompleteChat(messages, DefaultChatOptions(), context.Background(), zlog)
+				return err
+			},
+			want: budgets.Chat,
+		},
+		{
+			name: "title",
+			call: func(client *OpenAI, zlog *zerolog.Logger) error {
+				_, err := client.Summarize("Where should I go on holiday?", 5, context.Background(), zlog)
+				return err
+			},
+			want: budgets.Title,
+		},
+		{
+			name: "conversation summary",
+			call: func(client *OpenAI, zlog *zerolog.Logger) error {
+				_, err := client.SummarizeConversation(messages, 2, context.Background(), zlog)
+				return err
+			},
+			want: budgets.ConversationSummary,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &chatServer{responses: []goopenai.ChatCompletionResponse{textResponse("ok")}}
+			client := newTestOpenAI(t, server)
+			client.budgets = budgets
+			zlog := zerolog.Nop()
+
+			if err := tt.call(client, &zlog); err != nil {
+				t.Fatalf("call error = %v", err)
+			}
+			requests := server.received()
+			if len(requests) != 1 {
+				t.Fatalf("made %d requests, want 1", len(requests))
+			}
+			if requests[0].MaxTokens != tt.want {
+				t.Errorf("MaxTokens = %d, want %d", requests[0].MaxTokens, tt.want)
+			}
+		})
+	}
+
+	t.Run("complete", func(t *testing.T) {
+		client := &OpenAI{budgets: budgets}
+		zlog := zerolog.Nop()
+		request, err := client.completionRequest("Once upon a time", CompleteOptions{}, &zlog)
+		if err != nil {
+			t.Fatalf("completionRequest() error = %v", err)
+		}
+		if request.MaxTokens != budgets.Complete {
+			t.Errorf("completionRequest() MaxTokens = %d, want %d", request.MaxTokens, budgets.Complete)
+		}
+	})
+}
+
+func TestCompleteChatSeed(t *testing.T) {
+	seed := 42
+	tests := []struct {
+		name string
+		seed *int
+	}{
+		{name: "unset"},
+		{name: "set", seed: &seed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &chatServer{responses: []goopenai.ChatCompletionResponse{textResponse("ok")}}
+			client := newTestOpenAI(t, server)
+			zlog := zerolog.Nop()
+			options := DefaultChatOptions()
+			options.Seed = tt.seed
+
+			messages := []*ChatMessage{{FromHuman: true, Text: "Pick a number"}}
+			if _, err := client.CompleteChat(messages, options, context.Background(), &zlog); err != nil {
+				t.Fatalf("CompleteChat() error = %v", err)
+			}
+			requests := server.received()
+			if len(requests) != 1 {
+				t.Fatalf("CompleteChat() made %d requests, want 1", len(requests))
+			}
+			if got := requests[0].Seed; !reflect.DeepEqual(got, tt.seed) {
+				t.Errorf("CompleteChat() sent seed %v, want %v", got, tt.seed)
+			}
+		})
+	}
+}
+
+func TestCompleteChatLanguage(t *testing.T) {
+	tests := []struct {
+		name     string
+		language string
+		want     string
+	}{
+		{name: "unset"},
+		{name: "match the user", language: LanguageMatchUser, want: "Always reply in the same language as the user's latest message."},
+		{name: "forced", language: " French ", want: "Always reply in French, whatever language the user writes in."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &chatServer{responses: []goopenai.ChatCompletionResponse{textResponse("ok")}}
+			client := newTestOpenAI(t, server)
+			zlog := zerolog.Nop()
+			options := DefaultChatOptions()
+			options.Persona = "You are helpful."
+			options.Language = tt.language
+
+			messages := []*ChatMessage{{FromHuman: true, Text: "Bonjour"}}
+			if _, err := client.CompleteChat(messages, options, context.Background(), &zlog); err != nil {
+				t.Fatalf("CompleteChat() error = %v", err)
+			}
+			system := server.received()[0].Messages[0]
+			if system.Role != goopenai.ChatMessageRoleSystem || !strings.HasPrefix(system.Content, "You are helpful.") {
+				t.Fatalf("CompleteChat() system message = %+v, want the persona first", system)
+			}
+			if tt.want == "" && strings.Contains(system.Content, "Always reply in") {
+				t.Errorf("CompleteChat() system message = %q, want no language instruction", system.Content)
+			}
+			if tt.want != "" && !strings.HasSuffix(system.Content, "\n\n"+tt.want) {
+				t.Errorf("CompleteChat() system message = %q, want it to end with %q", system.Content, tt.want)
+			}
+		})
+	}
+}
+
+func TestSummarizeConversationSentences(t *testing.T) {
+	tests := []struct {
+		name      string
+		sentences int
+		want      string
+	}{
+		{name: "limited", sentences: 3, want: "Use at most 3 sentences."},
+		{name: "unlimited", sentences: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &chatServer{responses: []goopenai.ChatCompletionResponse{textResponse(" The summary. ")}}
+			client := newTestOpenAI(t, server)
+			zlog := zerolog.Nop()
+			messages := []*ChatMessage{{FromHuman: true, Text: "Who made Go?"}, {Text: "Google."}}
+
+			got, err := client.SummarizeConversation(messages, tt.sentences, context.Background(), &zlog)
+			if err != nil {
+				t.Fatalf("SummarizeConversation() error = %v", err)
+			}
+			if got != "The summary." {
+				t.Errorf("SummarizeConversation() = %q, want %q", got, "The summary.")
+			}
+			requests := server.received()
+			if len(requests) != 1 || len(requests[0].Messages) != 2 {
+				t.Fatalf("SummarizeConversation() sent %+v, want one request with an instruction and a transcript", requests)
+			}
+			instruction := requests[0].Messages[0].Content
+			if tt.want != "" && !strings.Contains(instruction, tt.want) {
+				t.Errorf("SummarizeConversation() instruction = %q, want it to contain %q", instruction, tt.want)
+			}
+			if tt.want == "" && strings.Contains(instruction, "sentences") {
+				t.Errorf("SummarizeConversation() instruction = %q, want no sentence limit", instruction)
+			}
+			if transcript := requests[0].Messages[1].Content; transcript != "User: Who made Go?\n\nAssistant: Google.\n\n" {
+				t.Errorf("SummarizeConversation() transcript = %q", transcript)
+			}
+		})
+	}
+}
+
+func TestOrganizationHeaders(t *testing.T) {
+	tests := []struct {
+		name         string
+		organization Organization
+		wantOrg      string
+		wantProject  string
+	}{
+		{name: "unset", organization: Organization{}},
+		{name: "organization and project", organization: Organization{OrgID: "org-123", ProjectID: "proj_456"}, wantOrg: "org-123", wantProject: "proj_456"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var headers http.Header
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				headers = r.Header.Clone()
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(textResponse("ok"))
+			}))
+			defer server.Close()
+
+			zlog := zerolog.Nop()
+			limiter := newAdaptiveLimiter(ratelimit.NewUnlimited(), &zlog)
+			config := newClientConfig("test-token", tt.organization, newHTTPClient(DefaultHTTPConfig(), tt.organization, limiter))
+			config.BaseURL = server.URL + "/v1"
+			client := goopenai.NewClientWithConfig(config)
+
+			_, err := client.CreateChatCompletion(context.Background(), goopenai.ChatCompletionRequest{
+				Model:    goopenai.GPT3Dot5Turbo,
+				Messages: []goopenai.ChatCompletionMessage{{Role: goopenai.ChatMessageRoleUser, Content: "Hi"}},
+			})
+			if err != nil {
+				t.Fatalf("CreateChatCompletion() error = %v", err)
+			}
+			if got := headers.Get("OpenAI-Organization"); got != tt.wantOrg {
+				t.Errorf("OpenAI-Organization header = %q, want %q", got, tt.wantOrg)
+			}
+			if got := headers.Get("OpenAI-Project"); got != tt.wantProject {
+				t.Errorf("OpenAI-Project header = %q, want %q", got, tt.wantProject)
+			}
+		})
+	}
+}
+
+func TestCompletionRequestStop(t *testing.T) {
+	tests := []struct {
+		name string
+		stop []string
+		want []string
+	}{
+		{name: "default", want: []string{"<|endoftext|>"}},
+		{name: "configured", stop: []string{"```", "\n\n"}, want: []string{"```", "\n\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &OpenAI{budgets: DefaultTokenBudgets()}
+			zlog := zerolog.Nop()
+
+			request, err := client.completionRequest("Write a function", CompleteOptions{Stop: tt.stop}, &zlog)
+			if err != nil {
+				t.Fatalf("completionRequest() error = %v", err)
+			}
+			if !reflect.DeepEqual(request.Stop, tt.want) {
+				t.Errorf("completionRequest() Stop = %q, want %q", request.Stop, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompleteChatStop(t *testing.T) {
+	tests := []struct {
+		name    string
+		stop    []string
+		want    []string
+		wantErr error
+	}{
+		{name: "default", want: []string{"<|endoftext|>"}},
+		{name: "configured", stop: []string{"```"}, want: []string{"```"}},
+		{name: "at the limit", stop: []string{"a", "b", "c", "d"}, want: []string{"a", "b", "c", "d"}},
+		{name: "too many", stop: []string{"a", "b", "c", "d", "e"}, wantErr: TooManyStopSequencesError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &chatServer{responses: []goopenai.ChatCompletionResponse{textResponse("ok")}}
+			client := newTestOpenAI(t, server)
+			zlog := zerolog.Nop()
+			options := DefaultChatOptions()
+			options.Stop = tt.stop
+
+			messages := []*ChatMessage{{FromHuman: true, Text: "Write a function"}}
+			_, err := client.CompleteChat(messages, options, context.Background(), &zlog)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("CompleteChat() error = %v, want %v", err, tt.wantErr)
+			}
+			requests := server.received()
+			if tt.wantErr != nil {
+				if len(requests) != 0 {
+					t.Errorf("CompleteChat() made %d requests, want none", len(requests))
+				}
+				return
+			}
+			if len(requests) != 1 {
+				t.Fatalf("CompleteChat() made %d requests, want 1", len(requests))
+			}
+			if got := requests[0].Stop; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CompleteChat() sent stop %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestNewOpenAIHTTPClient checks that the client sends requests with an HTTP client configured by the HTTPConfig.
+func TestNewOpenAIHTTPClient(t *testing.T) {
+	zlog := zerolog.Nop()
+	config := HTTPConfig{
+		Timeout:               time.Minute,
+		ResponseHeaderTimeout: 20 * time.Second,
+		IdleConnTimeout:       30 * time.Second,
+		MaxIdleConnsPerHost:   7,
+	}
+
+	client := NewOpenAI("token", "", DefaultTokenBudgets(), Organization{}, 0, config, &zlog)
+
+	if client.httpClient.Timeout != config.Timeout {
+		t.Errorf("NewOpenAI() HTTP client timeout = %v, want %v", client.httpClient.Timeout, config.Timeout)
+	}
+	rateLimit, ok := client.httpClient.Transport.(*rateLimitTransport)
+	if !ok || rateLimit.limiter != client.limiter {
+		t.Fatalf("NewOpenAI() transport = %T, want one reporting rate limits to the client's limiter", client.httpClient.Transport)
+	}
+	idempotency, ok := rateLimit.base.(*idempotencyTransport)
+	if !ok {
+		t.Fatalf("NewOpenAI() rate limit transport wraps %T, want *idempotencyTransport", rateLimit.base)
+	}
+	base, ok := idempotency.base.(*http.Transport)
+	if !ok {
+		t.Fatalf("NewOpenAI() idempotency transport wraps %T, want *http.Transport", idempotency.base)
+	}
+	if base.ResponseHeaderTimeout != config.ResponseHeaderTimeout ||
+		base.IdleConnTimeout != config.IdleConnTimeout ||
+		base.MaxIdleConnsPerHost != config.MaxIdleConnsPerHost {
+		t.Errorf("NewOpenAI() transport = %+v, want configured by %+v", base, config)
+	}
+
+	if got := newClientConfig("token", Organization{}, client.httpClient).HTTPClient; got != client.httpClient {
+		t.Errorf("newClientConfig() HTTPClient = %p, want %p", got, client.httpClient)
+	}
+	if err := client.Close(&zlog); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+}
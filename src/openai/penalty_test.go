@@ -0,0 +1,96 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package openai
+
+import (
+	"context"
+	"errors"
+	"github.com/hashicorp/go-multierror"
+	"github.com/rs/zerolog"
+	goopenai "github.com/sashabaranov/go-openai"
+	"testing"
+	"time"
+)
+
+func TestValidatePenalties(t *testing.T) {
+	tests := []struct {
+		name      string
+		penalties []float32
+		wantErr   error
+	}{
+		{name: "none"},
+		{name: "zero", penalties: []float32{0, 0}},
+		{name: "bounds", penalties: []float32{MinPenalty, MaxPenalty}},
+		{name: "in range", penalties: []float32{0.5, -1.25}},
+		{name: "above maximum", penalties: []float32{0, 2.01}, wantErr: PenaltyOutOfRangeError},
+		{name: "below minimum", penalties: []float32{-2.5, 0}, wantErr: PenaltyOutOfRangeError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidatePenalties(tt.penalties...); !errors.Is(err, tt.wantErr) {
+				t.Errorf("ValidatePenalties(%v) = %v, want %v", tt.penalties, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCompleteChatPenalties(t *testing.T) {
+	server := &chatServer{responses: []goopenai.ChatCompletionResponse{textResponse("Hello")}}
+	client := newTestOpenAI(t, server)
+	zlog := zerolog.Nop()
+	messages := []*ChatMessage{{FromHuman: true, Text: "Hi"}}
+
+	options := DefaultChatOptions()
+	options.Model = goopenai.GPT3Dot5Turbo
+	options.PresencePenalty = 0.5
+	options.FrequencyPenalty = -1
+	if _, err := client.CompleteChat(messages, options, context.Background(), &zlog); err != nil {
+		t.Fatalf("CompleteChat() error = %v", err)
+	}
+	request := server.received()[0]
+	if request.PresencePenalty != 0.5 || request.FrequencyPenalty != -1 {
+		t.Errorf("request penalties = %v, %v, want 0.5, -1", request.PresencePenalty, request.FrequencyPenalty)
+	}
+
+	options.FrequencyPenalty = 3
+	if _, err := client.CompleteChat(messages, options, context.Background(), &zlog); !errors.Is(err, PenaltyOutOfRangeError) {
+		t.Errorf("CompleteChat() with an out of range penalty error = %v, want %v", err, PenaltyOutOfRangeError)
+	}
+	if got := len(server.received()); got != 1 {
+		t.Errorf("sent %d requests, want no request for the invalid penalty", got)
+	}
+}
+
+// TestPenaltyErrorDoesNotTripBreaker checks that penalties rejected before any request is sent do not count as OpenAI
+// failing.
+func TestPenaltyErrorDoesNotTripBreaker(t *testing.T) {
+	zlog := zerolog.Nop()
+	stub := &stubClient{err: multierror.Append(PenaltyOutOfRangeError, FailedToCompletePrompt)}
+	breaker := NewCircuitBreaker(stub, CircuitBreakerConfig{FailureThreshold: 2, Cooldown: time.Hour}, &zlog)
+
+	for n := 0; n < 5; n++ {
+		if _, err := breaker.CompleteChat(nil, DefaultChatOptions(), context.Background(), &zlog); !errors.Is(err, PenaltyOutOfRangeError) {
+			t.Fatalf("CompleteChat() error = %v, want %v", err, PenaltyOutOfRangeError)
+		}
+	}
+	if state := breaker.State(); state != BreakerClosed {
+		t.Errorf("breaker is %s after penalty errors, want closed", state)
+	}
+	if stub.calls != 5 {
+		t.Errorf("client called %d times, want every call let through", stub.calls)
+	}
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package openai
+
+import (
+	"github.com/rs/zerolog"
+	"go.uber.org/ratelimit"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Headers OpenAI sends with every response describing the remaining request and token quota.
+const (
+	limitRequestsHeader     = "x-ratelimit-limit-requests"
+	remainingRequestsHeader = "x-ratelimit-remaining-requests"
+	resetRequestsHeader     = "x-ratelimit-reset-requests"
+	limitTokensHeader       = "x-ratelimit-limit-tokens"
+	remainingTokensHeader   = "x-ratelimit-remaining-tokens"
+	resetTokensHeader       = "x-ratelimit-reset-tokens"
+)
+
+// rateLimitSlowdownFraction is the fraction of the quota remaining below which requests are spread out over the time
+// until the quota resets, rather than sent as fast as the base limiter allows.
+const rateLimitSlowdownFraction = 0.1
+
+// rateLimitWindow is one of OpenAI's quotas, either requests or tokens, as reported by the rate limit headers.
+type rateLimitWindow struct {
+	limit     int
+	remaining int
+	reset     time.Duration
+}
+
+// parseRateLimitWindow reads a quota from header. It returns false if any of the headers are missing or malformed.
+func parseRateLimitWindow(header http.Header, limitName, remainingName, resetName string) (rateLimitWindow, bool) {
+	limit, err := strconv.Atoi(header.Get(limitName))
+	if err != nil {
+		return rateLimitWindow{}, false
+	}
+	remaining, err := strconv.Atoi(header.Get(remainingName))
+	if err != nil {
+		return rateLimitWindow{}, false
+	}
+	reset, err := time.ParseDuration(header.Get(resetName))
+	if err != nil {
+		return rateLimitWindow{}, false
+	}
+	return rateLimitWindow{limit: limit, remaining: remaining, reset: reset}, true
+}
+
+// nearLimit returns whether less than rateLimitSlowdownFraction of the quota remains.
+func (w rateLimitWindow) nearLimit() bool {
+	return w.limit > 0 && float64(w.remaining) < float64(w.limit)*rateLimitSlowdownFraction
+}
+
+// pacingInterval returns how far apart requests should be so that the quota lasts until it resets. Requests are not
+// slowed down until the quota is near its limit; once it is exhausted, the next request waits for the whole reset.
+func (w rateLimitWindow) pacingInterval() time.Duration {
+	if !w.nearLimit() {
+		return 0
+	}
+	if w.remaining <= 0 {
+		return w.reset
+	}
+	return w.reset / time.Duration(w.remaining)
+}
+
+// adaptiveLimiter is a ratelimit.Limiter that paces requests using the base limiter, and further slows down as OpenAI
+// reports the remaining quota approaching zero.
+type adaptiveLimiter struct {
+	base ratelimit.Limiter
+	zlog *zerolog.Logger
+
+	mu       sync.Mutex // protects interval and last
+	interval time.Duration
+	last     time.Time
+}
+
+func newAdaptiveLimiter(base ratelimit.Limiter, zlog *zerolog.Logger) *adaptiveLimiter {
+	return &adaptiveLimiter{base: base, zlog: zlog}
+}
+
+// Take blocks until the next request may be sent, and returns the time it may be sent at.
+func (l *adaptiveLimiter) Take() time.Time {
+	now := l.base.Take()
+
+	l.mu.Lock()
+	wait := l.last.Add(l.interval).Sub(now)
+	if wait > 0 {
+		now = now.Add(wait)
+	}
+	l.last = now
+	l.mu.Unlock()
+
+	if wait > 0 {
+		l.zlog.Debug().Dur("wait", wait).Msg("Pacing OpenAI request to stay under the rate limit")
+		time.Sleep(wait)
+	}
+	return now
+}
+
+// observe updates the pacing from the rate limit headers of an OpenAI response. Responses without the headers, such as
+// errors from a proxy, leave the pacing unchanged.
+func (l *adaptiveLimiter) observe(header http.Header) {
+	requests, hasRequests := parseRateLimitWindow(header, limitRequestsHeader, remainingRequestsHeader, resetRequestsHeader)
+	tokens, hasTokens := parseRateLimitWindow(header, limitTokensHeader, remainingTokensHeader, resetTokensHeader)
+	if !hasRequests && !hasTokens {
+		return
+	}
+
+	interval := time.Duration(0)
+	for _, window := range []struct {
+		name    string
+		window  rateLimitWindow
+		present bool
+	}{
+		{"requests", requests, hasRequests},
+		{"tokens", tokens, hasTokens},
+	} {
+		if !window.present || !window.window.nearLimit() {
+			continue
+		}
+		l.zlog.Warn().
+			Str("quota", window.name).
+			Int("limit", window.window.limit).
+			Int("remaining", window.window.remaining).
+			Dur("reset", window.window.reset).
+			Msg("Near the OpenAI rate limit, slowing down")
+		if windowInterval := window.window.pacingInterval(); windowInterval > interval {
+			interval = windowInterval
+		}
+	}
+
+	l.mu.Lock()
+	l.interval = interval
+	l.mu.Unlock()
+}
+
+// rateLimitTransport passes the rate limit headers of every response to limiter.
+type rateLimitTransport struct {
+	limiter *adaptiveLimiter
+	base    http.RoundTripper
+}
+
+func (t *rateLimitTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, err := t.base.RoundTrip(request)
+	if response != nil {
+		t.limiter.observe(response.Header)
+	}
+	return response, err
+}
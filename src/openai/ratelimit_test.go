@@ -0,0 +1,125 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package openai
+
+import (
+	"github.com/rs/zerolog"
+	"go.uber.org/ratelimit"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// rateLimitHeader returns response headers reporting the request and token quotas.
+func rateLimitHeader(requestsRemaining, requestsReset, tokensRemaining, tokensReset string) http.Header {
+	header := http.Header{}
+	header.Set(limitRequestsHeader, "100")
+	header.Set(remainingRequestsHeader, requestsRemaining)
+	header.Set(resetRequestsHeader, requestsReset)
+	header.Set(limitTokensHeader, "10000")
+	header.Set(remainingTokensHeader, tokensRemaining)
+	header.Set(resetTokensHeader, tokensReset)
+	return header
+}
+
+func TestParseRateLimitWindow(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   rateLimitWindow
+		wantOK bool
+	}{
+		{
+			name:   "all headers",
+			header: rateLimitHeader("42", "1m30s", "9000", "6ms"),
+			want:   rateLimitWindow{limit: 100, remaining: 42, reset: 90 * time.Second},
+			wantOK: true,
+		},
+		{name: "no headers", header: http.Header{}},
+		{name: "malformed remaining", header: rateLimitHeader("many", "1s", "9000", "1s")},
+		{name: "malformed reset", header: rateLimitHeader("42", "soon", "9000", "1s")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseRateLimitWindow(tt.header, limitRequestsHeader, remainingRequestsHeader, resetRequestsHeader)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("parseRateLimitWindow() = %+v, %v, want %+v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestPacingInterval(t *testing.T) {
+	tests := []struct {
+		name   string
+		window rateLimitWindow
+		want   time.Duration
+	}{
+		{name: "plenty remaining", window: rateLimitWindow{limit: 100, remaining: 50, reset: 10 * time.Second}},
+		{name: "at the slowdown threshold", window: rateLimitWindow{limit: 100, remaining: 10, reset: 10 * time.Second}},
+		{name: "near the limit", window: rateLimitWindow{limit: 100, remaining: 5, reset: 10 * time.Second}, want: 2 * time.Second},
+		{name: "one remaining", window: rateLimitWindow{limit: 100, remaining: 1, reset: 10 * time.Second}, want: 10 * time.Second},
+		{name: "exhausted", window: rateLimitWindow{limit: 100, remaining: 0, reset: 10 * time.Second}, want: 10 * time.Second},
+		{name: "no limit", window: rateLimitWindow{remaining: 0, reset: 10 * time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.window.pacingInterval(); got != tt.want {
+				t.Errorf("pacingInterval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdaptiveLimiterObserve(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+	}{
+		{name: "plenty remaining", header: rateLimitHeader("90", "10s", "9000", "10s")},
+		{name: "requests near the limit", header: rateLimitHeader("5", "10s", "9000", "10s"), want: 2 * time.Second},
+		{name: "tokens near the limit", header: rateLimitHeader("90", "10s", "500", "5s"), want: 10 * time.Millisecond},
+		{name: "both near the limit uses the slower", header: rateLimitHeader("5", "10s", "500", "5s"), want: 2 * time.Second},
+		{name: "no headers keeps the pacing", header: http.Header{}, want: time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			zlog := zerolog.Nop()
+			limiter := newAdaptiveLimiter(ratelimit.NewUnlimited(), &zlog)
+			limiter.interval = time.Minute
+
+			limiter.observe(tt.header)
+
+			if limiter.interval != tt.want {
+				t.Errorf("observe() interval = %v, want %v", limiter.interval, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdaptiveLimiterTake(t *testing.T) {
+	zlog := zerolog.Nop()
+	limiter := newAdaptiveLimiter(ratelimit.NewUnlimited(), &zlog)
+	limiter.interval = 50 * time.Millisecond
+
+	first := limiter.Take()
+	second := limiter.Take()
+	if gap := second.Sub(first); gap < limiter.interval {
+		t.Errorf("Take() spaced requests %v apart, want at least %v", gap, limiter.interval)
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package openai
+
+import (
+	"context"
+	"errors"
+	"github.com/hashicorp/go-multierror"
+	"github.com/rs/zerolog"
+	"io"
+	"src/metrics"
+	"strings"
+)
+
+// CompleteStream is like Complete, but streams the completion, calling onText with each piece of text as it is
+// generated. The returned completion holds the whole text. Streamed responses do not report usage, so it is estimated.
+func (o *OpenAI) CompleteStream(
+	prompt string,
+	options CompleteOptions,
+	onText func(text string),
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) (*Completion, error) {
+	var resultErr error
+	if err := ValidateStopSequences(options.Stop); err != nil {
+		resultErr = multierror.Append(resultErr, err, FailedToCompletePrompt)
+		return nil, resultErr
+	}
+	release, err := o.acquireCompletion(ctx, zlog)
+	if err != nil {
+		resultErr = multierror.Append(resultErr, err, FailedToCompletePrompt)
+		return nil, resultErr
+	}
+	defer release()
+
+	o.limiter.Take()
+	request, err := o.completionRequest(prompt, options, zlog)
+	if err != nil {
+		resultErr = multierror.Append(resultErr, err, FailedToCompletePrompt)
+		return nil, resultErr
+	}
+	request.Stream = true
+
+	stream, err := o.client.CreateCompletionStream(ctx, request)
+	metrics.OpenAIRequests.WithLabelValues("completion_stream").Inc()
+	if err != nil {
+		zlog.Error().Err(err).Msg("Failed to start completion stream")
+		metrics.Errors.WithLabelValues("openai").Inc()
+		resultErr = multierror.Append(resultErr, err, FailedToCompletePrompt)
+		return nil, resultErr
+	}
+	defer stream.Close()
+
+	var text strings.Builder
+	model := request.Model
+	for {
+		response, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			zlog.Error().Err(err).Int("received", text.Len()).Msg("Completion stream failed")
+			metrics.Errors.WithLabelValues("openai").Inc()
+			resultErr = multierror.Append(resultErr, err, FailedToCompletePrompt)
+			return nil, resultErr
+		}
+		if response.Model != "" {
+			model = response.Model
+		}
+		for _, choice := range response.Choices {
+			if choice.Text == "" {
+				continue
+			}
+			text.WriteString(choice.Text)
+			onText(choice.Text)
+		}
+	}
+
+	usage := Usage{PromptTokens: EstimateTokens(prompt), CompletionTokens: EstimateTokens(text.String())}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	metrics.OpenAITokens.WithLabelValues("prompt").Add(float64(usage.PromptTokens))
+	metrics.OpenAITokens.WithLabelValues("completion").Add(float64(usage.CompletionTokens))
+	return &Completion{Text: text.String(), Model: model, Usage: usage}, nil
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog"
+	goopenai "github.com/sashabaranov/go-openai"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// completionStreamServer is an OpenAI completions API that streams chunks as server-sent events, and then ends the
+// stream, or fails it if fail is set.
+type completionStreamServer struct {
+	chunks []string
+	fail   bool
+}
+
+func (s *completionStreamServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	for _, chunk := range s.chunks {
+		response := goopenai.CompletionResponse{
+			Model:   goopenai.GPT3TextDavinci003,
+			Choices: []goopenai.CompletionChoice{{Text: chunk}},
+		}
+		data, _ := json.Marshal(response)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+	}
+	if s.fail {
+		fmt.Fprint(w, `data: {"error": {"message": "stream interrupted", "type": "server_error"}}`+"\n\n")
+		return
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+func TestCompleteStream(t *testing.T) {
+	server := &completionStreamServer{chunks: []string{"One", "", ", two", ", three"}}
+	client := newTestOpenAI(t, server)
+	zlog := zerolog.Nop()
+
+	var received []string
+	completion, err := client.CompleteStream("Count to three", CompleteOptions{}, func(text string) {
+		received = append(received, text)
+	}, context.Background(), &zlog)
+	if err != nil {
+		t.Fatalf("CompleteStream() error = %v", err)
+	}
+	if want := []string{"One", ", two", ", three"}; !reflect.DeepEqual(received, want) {
+		t.Errorf("CompleteStream() streamed %q, want %q", received, want)
+	}
+	if completion.Text != "One, two, three" || completion.Model != goopenai.GPT3TextDavinci003 {
+		t.Errorf("CompleteStream() = %q from %s, want the whole text", completion.Text, completion.Model)
+	}
+	if completion.Usage.TotalTokens != completion.Usage.PromptTokens+completion.Usage.CompletionTokens || completion.Usage.CompletionTokens == 0 {
+		t.Errorf("CompleteStream() usage = %+v, want estimated prompt and completion tokens", completion.Usage)
+	}
+}
+
+func TestCompleteStreamFails(t *testing.T) {
+	server := &completionStreamServer{chunks: []string{"One"}, fail: true}
+	client := newTestOpenAI(t, server)
+	zlog := zerolog.Nop()
+
+	_, err := client.CompleteStream("Count to three", CompleteOptions{}, func(string) {}, context.Background(), &zlog)
+	if err == nil {
+		t.Error("CompleteStream() error = nil, want the stream's error")
+	}
+}
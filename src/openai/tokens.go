@@ -0,0 +1,233 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package openai
+
+import (
+	"errors"
+	goopenai "github.com/sashabaranov/go-openai"
+	"unicode/utf8"
+)
+
+const (
+	// tokensPerMessage is the approximate per-message overhead the chat format adds on top of the message content.
+	tokensPerMessage = 4
+
+	// tokensPerReply is the number of tokens every reply is primed with.
+	tokensPerReply = 3
+
+	// tokensPerImage approximates the cost of a high detail 1024x1024 image.
+	tokensPerImage = 765
+
+	// defaultContextLimit is used for models missing from modelContextLimits.
+	defaultContextLimit = 4096
+
+	// defaultResponseTokens is the room reserved for the response when fitting a prompt and MaxTokens is not set.
+	defaultResponseTokens = 1024
+)
+
+// modelContextLimits is the context window, in tokens, of each model. The prompt and the completion share this window.
+var modelContextLimits = map[string]int{
+	"gpt-4":              8192,
+	"gpt-4-0314":         8192,
+	"gpt-4-32k":          32768,
+	"gpt-4-32k-0314":     32768,
+	"gpt-3.5-turbo":      4096,
+	"gpt-3.5-turbo-0301": 4096,
+	"text-davinci-003":   4097,
+
+	"gpt-3.5-turbo-1106":   16385,
+	"gpt-4-1106-preview":   128000,
+	"gpt-4-0125-preview":   128000,
+	"gpt-4-turbo-preview":  128000,
+	"gpt-4-turbo":          128000,
+	"gpt-4-vision-preview": 128000,
+}
+
+// visionModels are the models that accept images in user messages.
+var visionModels = map[string]bool{
+	"gpt-4-vision-preview": true,
+}
+
+// IsVisionModel returns whether model accepts images in user messages.
+func IsVisionModel(model string) bool {
+	return visionModels[model]
+}
+
+var (
+	SystemPromptTooLongError = errors.New("system prompt alone exceeds the prompt token budget")
+	MessageTooLongError      = errors.New("most recent message exceeds the prompt token budget")
+	PromptTooLongError       = errors.New("prompt leaves no room for a completion in the model's context window")
+)
+
+// truncationMarker replaces the middle of text cut by truncateMiddle.
+const truncationMarker = "\n\n[...]\n\n"
+
+// truncateMiddle returns text if it is estimated to fit in maxTokens. Otherwise it keeps as much of the start and end
+// of text as fits, in equal parts, joined by truncationMarker, and returns true. The start of a message usually says
+// what it is about, and the end what is being asked.
+func truncateMiddle(text string, maxTokens int) (string, bool) {
+	if EstimateTokens(text) <= maxTokens {
+		return text, false
+	}
+	keep := maxTokens*4 - len(truncationMarker)
+	if keep < 2 {
+		return truncationMarker, true
+	}
+
+	// Cut on rune boundaries so that neither part ends in a partial UTF-8 sequence.
+	headEnd := keep / 2
+	for headEnd > 0 && !utf8.RuneStart(text[headEnd]) {
+		headEnd--
+	}
+	tailStart := len(text) - keep/2
+	for tailStart < len(text) && !utf8.RuneStart(text[tailStart]) {
+		tailStart++
+	}
+	return text[:headEnd] + truncationMarker + text[tailStart:], true
+}
+
+// EstimateTokens approximates the number of tokens in text using the rule of thumb of four characters per token. It
+// over-counts slightly for English text so that trimmed prompts err on the side of fitting.
+func EstimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
+
+func estimateMessageTokens(message goopenai.ChatCompletionMessage) int {
+	tokens := tokensPerMessage + EstimateTokens(message.Content)
+	for _, part := range message.MultiContent {
+		if part.Type == goopenai.ChatMessagePartTypeImageURL {
+			tokens += tokensPerImage
+		} else {
+			tokens += EstimateTokens(part.Text)
+		}
+	}
+	for _, toolCall := range message.ToolCalls {
+		tokens += EstimateTokens(toolCall.Function.Name) + EstimateTokens(toolCall.Function.Arguments)
+	}
+	return tokens
+}
+
+// EstimateMessagesTokens approximates the number of prompt tokens a chat completion request for messages uses.
+func EstimateMessagesTokens(messages []goopenai.ChatCompletionMessage) int {
+	tokens := tokensPerReply
+	for _, message := range messages {
+		tokens += estimateMessageTokens(message)
+	}
+	return tokens
+}
+
+// ModelContextLimit returns the context window of model in tokens.
+func ModelContextLimit(model string) int {
+	if limit, ok := modelContextLimits[model]; ok {
+		return limit
+	}
+	return defaultContextLimit
+}
+
+// MaxCompletionTokens returns the largest MaxTokens that can be requested for a prompt of promptTokens tokens, i.e.
+// min(configuredMax, modelContextLimit - promptTokens). It returns PromptTooLongError if the prompt leaves no room.
+func MaxCompletionTokens(model string, promptTokens int, configuredMax int) (int, error) {
+	available := ModelContextLimit(model) - promptTokens
+	if available <= 0 {
+		return 0, PromptTooLongError
+	}
+	if configuredMax > 0 && configuredMax < available {
+		return configuredMax, nil
+	}
+	return available, nil
+}
+
+// PromptTokenBudget returns how many tokens the prompt may use: MaxPromptTokens if it is set, and otherwise whatever
+// the model's context window leaves after reserving MaxTokens for the response. Large-context models therefore get
+// far more of the conversation than small ones.
+func (o ChatOptions) PromptTokenBudget() int {
+	if o.MaxPromptTokens > 0 {
+		return o.MaxPromptTokens
+	}
+	reserved := o.MaxTokens
+	if reserved <= 0 {
+		reserved = defaultResponseTokens
+	}
+	budget := ModelContextLimit(o.Model) - reserved
+	if budget <= 0 {
+		// Leave the response at least half of the window rather than sending no prompt at all.
+		budget = ModelContextLimit(o.Model) / 2
+	}
+	return budget
+}
+
+// FitRecentMessages returns how many of the most recent messages fit within budget tokens when sent to model. The
+// count stops at the first message, walking back from the newest, that does not fit, so the result is a contiguous
+// suffix of messages.
+func FitRecentMessages(messages []*ChatMessage, model string, budget int) int {
+	converted := ConvertChatMessagesToChatCompletionMessages(messages, model)
+	tokens := tokensPerReply
+	fit := 0
+	for i := len(converted) - 1; i >= 0; i-- {
+		tokens += estimateMessageTokens(converted[i])
+		if tokens > budget {
+			break
+		}
+		fit++
+	}
+	return fit
+}
+
+// TrimMessagesToFit drops the oldest user and assistant messages until the estimated size of messages fits within
+// budget tokens. System messages are always kept, and are never truncated, because dropping them would change the
+// bot's behavior mid-conversation. The relative order of the kept messages is preserved.
+func TrimMessagesToFit(messages []goopenai.ChatCompletionMessage, budget int) ([]goopenai.ChatCompletionMessage, error) {
+	systemTokens := 0
+	totalTokens := 0
+	for _, message := range messages {
+		tokens := estimateMessageTokens(message)
+		if message.Role == "system" {
+			systemTokens += tokens
+		}
+		totalTokens += tokens
+	}
+	if systemTokens > budget {
+		return nil, SystemPromptTooLongError
+	}
+
+	// Walk from oldest to newest, marking user and assistant messages to drop until we fit.
+	drop := make([]bool, len(messages))
+	for i := 0; i < len(messages) && totalTokens > budget; i++ {
+		if messages[i].Role == "system" {
+			continue
+		}
+		drop[i] = true
+		totalTokens -= estimateMessageTokens(messages[i])
+	}
+
+	result := make([]goopenai.ChatCompletionMessage, 0, len(messages))
+	keptConversation := false
+	for i, message := range messages {
+		if drop[i] {
+			continue
+		}
+		if message.Role != "system" {
+			keptConversation = true
+		}
+		result = append(result, message)
+	}
+	if !keptConversation && len(result) < len(messages) {
+		return nil, MessageTooLongError
+	}
+
+	return result, nil
+}
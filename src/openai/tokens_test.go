@@ -0,0 +1,226 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package openai
+
+import (
+	"errors"
+	goopenai "github.com/sashabaranov/go-openai"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTrimMessagesToFit(t *testing.T) {
+	// Each message of 8 characters is estimated at tokensPerMessage + 2 = 6 tokens.
+	system := goopenai.ChatCompletionMessage{Role: "system", Content: "be nice."}
+	system2 := goopenai.ChatCompletionMessage{Role: "system", Content: "be brief"}
+	user1 := goopenai.ChatCompletionMessage{Role: "user", Content: "hello 1."}
+	assistant1 := goopenai.ChatCompletionMessage{Role: "assistant", Content: "hi there"}
+	user2 := goopenai.ChatCompletionMessage{Role: "user", Content: "hello 2."}
+	huge := goopenai.ChatCompletionMessage{Role: "user", Content: strings.Repeat("x", 400)}
+
+	tests := []struct {
+		name     string
+		messages []goopenai.ChatCompletionMessage
+		budget   int
+		want     []goopenai.ChatCompletionMessage
+		wantErr  error
+	}{
+		{
+			name:     "fits",
+			messages: []goopenai.ChatCompletionMessage{system, user1, assistant1, user2},
+			budget:   24,
+			want:     []goopenai.ChatCompletionMessage{system, user1, assistant1, user2},
+		},
+		{
+			name:     "only system prompt",
+			messages: []goopenai.ChatCompletionMessage{system, system2},
+			budget:   12,
+			want:     []goopenai.ChatCompletionMessage{system, system2},
+		},
+		{
+			name:     "only system prompt too long",
+			messages: []goopenai.ChatCompletionMessage{system, system2},
+			budget:   11,
+			wantErr:  SystemPromptTooLongError,
+		},
+		{
+			name:     "drops oldest first",
+			messages: []goopenai.ChatCompletionMessage{system, user1, assistant1, user2},
+			budget:   18,
+			want:     []goopenai.ChatCompletionMessage{system, assistant1, user2},
+		},
+		{
+			name:     "preserves order around system messages",
+			messages: []goopenai.ChatCompletionMessage{system, user1, system2, assistant1, user2},
+			budget:   24,
+			want:     []goopenai.ChatCompletionMessage{system, system2, assistant1, user2},
+		},
+		{
+			name:     "keeps only the newest message",
+			messages: []goopenai.ChatCompletionMessage{user1, assistant1, user2},
+			budget:   6,
+			want:     []goopenai.ChatCompletionMessage{user2},
+		},
+		{
+			name:     "oversized last message",
+			messages: []goopenai.ChatCompletionMessage{system, user1, huge},
+			budget:   50,
+			wantErr:  MessageTooLongError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := TrimMessagesToFit(tt.messages, tt.budget)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("TrimMessagesToFit() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TrimMessagesToFit() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxCompletionTokens(t *testing.T) {
+	tests := []struct {
+		name          string
+		model         string
+		promptTokens  int
+		configuredMax int
+		want          int
+		wantErr       error
+	}{
+		{name: "configured max fits", model: "gpt-4", promptTokens: 1000, configuredMax: 500, want: 500},
+		{name: "configured max exceeds room", model: "gpt-4", promptTokens: 8000, configuredMax: 500, want: 192},
+		{name: "no configured max", model: "gpt-4", promptTokens: 1000, configuredMax: 0, want: 7192},
+		{name: "prompt fills the context", model: "gpt-4", promptTokens: 8192, configuredMax: 500, wantErr: PromptTooLongError},
+		{name: "prompt exceeds the context", model: "gpt-4", promptTokens: 9000, wantErr: PromptTooLongError},
+		{name: "unknown model", model: "unknown", promptTokens: 96, configuredMax: 0, want: defaultContextLimit - 96},
+		{name: "large context model", model: "gpt-4-turbo", promptTokens: 100000, configuredMax: 4096, want: 4096},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MaxCompletionTokens(tt.model, tt.promptTokens, tt.configuredMax)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("MaxCompletionTokens() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("MaxCompletionTokens() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPromptTokenBudget(t *testing.T) {
+	tests := []struct {
+		name    string
+		options ChatOptions
+		want    int
+	}{
+		{name: "8k model", options: ChatOptions{Model: "gpt-4", MaxTokens: 1024}, want: 8192 - 1024},
+		{name: "128k model", options: ChatOptions{Model: "gpt-4-turbo", MaxTokens: 1024}, want: 128000 - 1024},
+		{name: "default response reserve", options: ChatOptions{Model: "gpt-4"}, want: 8192 - defaultResponseTokens},
+		{name: "configured prompt budget", options: ChatOptions{Model: "gpt-4-turbo", MaxPromptTokens: 2000}, want: 2000},
+		{name: "response larger than the window", options: ChatOptions{Model: "gpt-4", MaxTokens: 10000}, want: 4096},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.options.PromptTokenBudget(); got != tt.want {
+				t.Errorf("PromptTokenBudget() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFitRecentMessages(t *testing.T) {
+	messages := make([]*ChatMessage, 300)
+	for i := range messages {
+		messages[i] = &ChatMessage{FromHuman: true, Text: strings.Repeat("word ", 80)}
+	}
+
+	small := FitRecentMessages(messages, "gpt-4", ChatOptions{Model: "gpt-4", MaxTokens: 1024}.PromptTokenBudget())
+	large := FitRecentMessages(messages, "gpt-4-turbo", ChatOptions{Model: "gpt-4-turbo", MaxTokens: 1024}.PromptTokenBudget())
+	if small < 1 || small >= large {
+		t.Errorf("FitRecentMessages() = %d for gpt-4 and %d for gpt-4-turbo, want fewer but some for gpt-4", small, large)
+	}
+	if large != len(messages) {
+		t.Errorf("FitRecentMessages() = %d for gpt-4-turbo, want all %d", large, len(messages))
+	}
+
+	// The fitted messages are within the budget, and one more would not be.
+	budget := 1000
+	fit := FitRecentMessages(messages, "gpt-4", budget)
+	fitted := ConvertChatMessagesToChatCompletionMessages(messages[len(messages)-fit:], "gpt-4")
+	oneMore := ConvertChatMessagesToChatCompletionMessages(messages[len(messages)-fit-1:], "gpt-4")
+	if EstimateMessagesTokens(fitted) > budget || EstimateMessagesTokens(oneMore) <= budget {
+		t.Errorf("FitRecentMessages() = %d, want the most messages that fit in %d tokens", fit, budget)
+	}
+}
+
+func TestTruncateMiddle(t *testing.T) {
+	head := strings.Repeat("h", 100)
+	tail := strings.Repeat("t", 100)
+	tests := []struct {
+		name          string
+		text          string
+		maxTokens     int
+		want          string
+		wantTruncated bool
+	}{
+		{name: "empty", text: "", maxTokens: 10, want: ""},
+		{name: "well under the budget", text: "hello", maxTokens: 10, want: "hello"},
+		{name: "exactly the budget", text: strings.Repeat("x", 40), maxTokens: 10, want: strings.Repeat("x", 40)},
+		{
+			name:          "just over the budget",
+			text:          strings.Repeat("x", 41),
+			maxTokens:     10,
+			want:          strings.Repeat("x", 15) + truncationMarker + strings.Repeat("x", 15),
+			wantTruncated: true,
+		},
+		{
+			name:          "keeps the head and tail",
+			text:          head + strings.Repeat("m", 10000) + tail,
+			maxTokens:     52,
+			want:          head[:99] + truncationMarker + tail[:99],
+			wantTruncated: true,
+		},
+		{name: "budget too small for any content", text: head, maxTokens: 2, want: truncationMarker, wantTruncated: true},
+		{
+			name:          "cuts on rune boundaries",
+			text:          strings.Repeat("é", 40),
+			maxTokens:     10,
+			want:          strings.Repeat("é", 7) + truncationMarker + strings.Repeat("é", 7),
+			wantTruncated: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, truncated := truncateMiddle(tt.text, tt.maxTokens)
+			if got != tt.want || truncated != tt.wantTruncated {
+				t.Errorf("truncateMiddle() = %q, %v, want %q, %v", got, truncated, tt.want, tt.wantTruncated)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("truncateMiddle() = %q, want valid UTF-8", got)
+			}
+			if EstimateTokens(got) > tt.maxTokens && got != truncationMarker {
+				t.Errorf("truncateMiddle() is %d tokens, want at most %d", EstimateTokens(got), tt.maxTokens)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	goopenai "github.com/sashabaranov/go-openai"
+	"time"
+)
+
+// DefaultMaxToolIterations is the number of tool-calling round trips allowed for one completion when
+// ChatOptions.MaxToolIterations is not set.
+const DefaultMaxToolIterations = 5
+
+var (
+	ToolIterationsExceededError = errors.New("model kept calling tools after the maximum number of iterations")
+	UnknownToolError            = errors.New("model called a tool that is not registered")
+)
+
+// ToolHandler runs a tool. arguments is the JSON object the model supplied, matching the tool's Parameters schema. The
+// returned string is sent back to the model as the tool's result.
+type ToolHandler func(arguments string, ctx context.Context, zlog *zerolog.Logger) (string, error)
+
+// Tool is a function the model may call during a chat completion. Parameters is the JSON schema of the arguments
+// object, e.g. {"type": "object", "properties": {"expression": {"type": "string"}}}.
+type Tool struct {
+	Name        string
+	Description string
+	Parameters  json.RawMessage
+	Handler     ToolHandler `json:"-"`
+}
+
+// CurrentTimeTool returns a tool that tells the model the current date and time, which it otherwise cannot know.
+func CurrentTimeTool() Tool {
+	return Tool{
+		Name:        "current_time",
+		Description: "Returns the current date and time in UTC, in RFC 3339 format.",
+		Parameters:  json.RawMessage(`{"type": "object", "properties": {}}`),
+		Handler: func(arguments string, ctx context.Context, zlog *zerolog.Logger) (string, error) {
+			return time.Now().UTC().Format(time.RFC3339), nil
+		},
+	}
+}
+
+// BuiltinTool returns the built-in tool with the given name, if there is one.
+func BuiltinTool(name string) (Tool, bool) {
+	switch name {
+	case "current_time":
+		return CurrentTimeTool(), true
+	default:
+		return Tool{}, false
+	}
+}
+
+func toRequestTools(tools []Tool) []goopenai.Tool {
+	if len(tools) == 0 {
+		return nil
+	}
+	result := make([]goopenai.Tool, 0, len(tools))
+	for _, tool := range tools {
+		result = append(result, goopenai.Tool{
+			Type: goopenai.ToolTypeFunction,
+			Function: goopenai.FunctionDefinition{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
+	}
+	return result
+}
+
+// callTools runs each tool call the model asked for and returns one tool message per call, in the same order. Handler
+// failures and unknown tools are reported back to the model as the tool's result rather than failing the completion,
+// so the model can recover, e.g. by fixing its arguments.
+func callTools(
+	tools []Tool,
+	toolCalls []goopenai.ToolCall,
+	ctx context.Context,
+	zlog *zerolog.Logger,
+) []goopenai.ChatCompletionMessage {
+	handlers := make(map[string]ToolHandler, len(tools))
+	for _, tool := range tools {
+		handlers[tool.Name] = tool.Handler
+	}
+
+	results := make([]goopenai.ChatCompletionMessage, 0, len(toolCalls))
+	for _, toolCall := range toolCalls {
+		name := toolCall.Function.Name
+		var result string
+		handler, ok := handlers[name]
+		if !ok {
+			zlog.Warn().Str("tool", name).Msg("Model called an unknown tool")
+			result = fmt.Sprintf("error: %s: %s", UnknownToolError, name)
+		} else {
+			output, err := handler(toolCall.Function.Arguments, ctx, zlog)
+			if err != nil {
+				zlog.Warn().Err(err).Str("tool", name).Str("arguments", toolCall.Function.Arguments).Msg("Tool failed")
+				result = fmt.Sprintf("error: %s", err)
+			} else {
+				zlog.Debug().Str("tool", name).Str("arguments", toolCall.Function.Arguments).Str("result", output).Msg("Called tool")
+				result = output
+			}
+		}
+		results = append(results, goopenai.ChatCompletionMessage{
+			Role:       goopenai.ChatMessageRoleTool,
+			Content:    result,
+			ToolCallID: toolCall.ID,
+		})
+	}
+	return results
+}
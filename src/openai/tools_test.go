@@ -0,0 +1,170 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/rs/zerolog"
+	goopenai "github.com/sashabaranov/go-openai"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// toolCallResponse is a chat completion response in which the model calls the named tool with arguments.
+func toolCallResponse(id string, name string, arguments string) goopenai.ChatCompletionResponse {
+	return goopenai.ChatCompletionResponse{
+		Model: goopenai.GPT3Dot5Turbo,
+		Choices: []goopenai.ChatCompletionChoice{{
+			Message: goopenai.ChatCompletionMessage{
+				Role: goopenai.ChatMessageRoleAssistant,
+				ToolCalls: []goopenai.ToolCall{{
+					ID:       id,
+					Type:     goopenai.ToolTypeFunction,
+					Function: goopenai.FunctionCall{Name: name, Arguments: arguments},
+				}},
+			},
+			FinishReason: goopenai.FinishReasonToolCalls,
+		}},
+	}
+}
+
+// addTool is a mock calculator tool that adds two numbers and records the arguments it was called with.
+func addTool(calls *[]string) Tool {
+	return Tool{
+		Name:        "add",
+		Description: "Adds two numbers.",
+		Parameters:  json.RawMessage(`{"type": "object", "properties": {"a": {"type": "number"}, "b": {"type": "number"}}}`),
+		Handler: func(arguments string, ctx context.Context, zlog *zerolog.Logger) (string, error) {
+			*calls = append(*calls, arguments)
+			var args struct{ A, B float64 }
+			if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+				return "", err
+			}
+			return strconv.FormatFloat(args.A+args.B, 'f', -1, 64), nil
+		},
+	}
+}
+
+func TestChatCompleteCallsTools(t *testing.T) {
+	server := &chatServer{responses: []goopenai.ChatCompletionResponse{
+		toolCallResponse("call-1", "add", `{"a": 1, "b": 2}`),
+		textResponse("1 + 2 = 3"),
+	}}
+	client := newTestOpenAI(t, server)
+	zlog := zerolog.Nop()
+
+	var calls []string
+	options := DefaultChatOptions()
+	options.Model = goopenai.GPT3Dot5Turbo
+	options.Tools = []Tool{addTool(&calls)}
+	messages := []goopenai.ChatCompletionMessage{{Role: goopenai.ChatMessageRoleUser, Content: "What is 1 + 2?"}}
+
+	completion, err := client.ChatComplete(messages, options, context.Background(), &zlog)
+	if err != nil {
+		t.Fatalf("ChatComplete() error = %v", err)
+	}
+	if completion.Text != "1 + 2 = 3" {
+		t.Errorf("ChatComplete() text = %q, want %q", completion.Text, "1 + 2 = 3")
+	}
+	if len(calls) != 1 || calls[0] != `{"a": 1, "b": 2}` {
+		t.Errorf("tool calls = %q, want one call with the model's arguments", calls)
+	}
+
+	requests := server.received()
+	if len(requests) != 2 {
+		t.Fatalf("got %d requests, want 2", len(requests))
+	}
+	if len(requests[0].Tools) != 1 || requests[0].Tools[0].Function.Name != "add" {
+		t.Errorf("first request tools = %+v, want the add tool", requests[0].Tools)
+	}
+	followUp := requests[1].Messages
+	if len(followUp) != 3 {
+		t.Fatalf("follow-up request has %d messages, want 3", len(followUp))
+	}
+	if len(followUp[1].ToolCalls) != 1 || followUp[1].ToolCalls[0].ID != "call-1" {
+		t.Errorf("follow-up message 1 = %+v, want the model's tool call", followUp[1])
+	}
+	result := followUp[2]
+	if result.Role != goopenai.ChatMessageRoleTool || result.ToolCallID != "call-1" || result.Content != "3" {
+		t.Errorf("follow-up message 2 = %+v, want the tool's result for call-1", result)
+	}
+}
+
+func TestChatCompleteStopsAfterMaxToolIterations(t *testing.T) {
+	server := &chatServer{}
+	for i := 0; i < 10; i++ {
+		server.responses = append(server.responses, toolCallResponse("call", "add", `{"a": 1, "b": 1}`))
+	}
+	client := newTestOpenAI(t, server)
+	zlog := zerolog.Nop()
+
+	var calls []string
+	options := DefaultChatOptions()
+	options.Model = goopenai.GPT3Dot5Turbo
+	options.Tools = []Tool{addTool(&calls)}
+	options.MaxToolIterations = 2
+	messages := []goopenai.ChatCompletionMessage{{Role: goopenai.ChatMessageRoleUser, Content: "Keep adding."}}
+
+	_, err := client.ChatComplete(messages, options, context.Background(), &zlog)
+	if !errors.Is(err, ToolIterationsExceededError) {
+		t.Fatalf("ChatComplete() error = %v, want %v", err, ToolIterationsExceededError)
+	}
+	if got := len(server.received()); got != 3 {
+		t.Errorf("got %d requests, want 3", got)
+	}
+	if len(calls) != 3 {
+		t.Errorf("tool called %d times, want 3", len(calls))
+	}
+}
+
+func TestCallToolsReportsFailuresToModel(t *testing.T) {
+	zlog := zerolog.Nop()
+	failing := Tool{
+		Name: "fail",
+		Handler: func(arguments string, ctx context.Context, zlog *zerolog.Logger) (string, error) {
+			return "", errors.New("out of order")
+		},
+	}
+	toolCalls := []goopenai.ToolCall{
+		{ID: "call-1", Function: goopenai.FunctionCall{Name: "fail"}},
+		{ID: "call-2", Function: goopenai.FunctionCall{Name: "missing"}},
+	}
+
+	results := callTools([]Tool{failing}, toolCalls, context.Background(), &zlog)
+	if len(results) != 2 {
+		t.Fatalf("callTools() returned %d results, want 2", len(results))
+	}
+	if results[0].ToolCallID != "call-1" || !strings.Contains(results[0].Content, "out of order") {
+		t.Errorf("callTools() result 0 = %+v, want the handler's error", results[0])
+	}
+	if results[1].ToolCallID != "call-2" || !strings.Contains(results[1].Content, UnknownToolError.Error()) {
+		t.Errorf("callTools() result 1 = %+v, want the unknown tool error", results[1])
+	}
+}
+
+func TestBuiltinTool(t *testing.T) {
+	tool, ok := BuiltinTool("current_time")
+	if !ok || tool.Name != "current_time" || tool.Handler == nil {
+		t.Errorf("BuiltinTool(current_time) = %+v, %v, want the current time tool", tool, ok)
+	}
+	if _, ok := BuiltinTool("calculator"); ok {
+		t.Errorf("BuiltinTool(calculator) found a tool, want none")
+	}
+}
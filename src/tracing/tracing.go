@@ -0,0 +1,61 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+// Package tracing correlates the log lines of a single request, i.e. one Discord interaction or message, by tagging
+// them with a request ID. The ID and a logger carrying it travel together in a context.Context.
+package tracing
+
+import (
+	"context"
+	"github.com/gofrs/uuid"
+	"github.com/rs/zerolog"
+)
+
+// RequestIDField is the log field holding the request ID.
+const RequestIDField = "request"
+
+type requestIDKey struct{}
+
+// NewRequest starts a request with a new ID. It returns ctx carrying the ID and a logger derived from zlog that adds
+// the ID to every line; Logger returns the same logger from the context.
+func NewRequest(ctx context.Context, zlog *zerolog.Logger) (context.Context, *zerolog.Logger) {
+	// A random UUID cannot fail to generate unless the system's source of randomness does, in which case an ID-less
+	// request is more useful than a failed one.
+	id, err := uuid.NewV4()
+	if err != nil {
+		zlog.Warn().Err(err).Msg("Failed to generate request ID")
+		return ctx, zlog
+	}
+
+	requestLog := zlog.With().Str(RequestIDField, id.String()).Logger()
+	ctx = context.WithValue(ctx, requestIDKey{}, id.String())
+	ctx = requestLog.WithContext(ctx)
+	return ctx, &requestLog
+}
+
+// RequestID returns the ID of the request ctx belongs to, or an empty string if it does not belong to one.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Logger returns the request logger in ctx, or fallback if ctx does not belong to a request.
+func Logger(ctx context.Context, fallback *zerolog.Logger) *zerolog.Logger {
+	if RequestID(ctx) == "" {
+		return fallback
+	}
+	return zerolog.Ctx(ctx)
+}
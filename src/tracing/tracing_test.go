@@ -0,0 +1,77 @@
+/*
+ * Copyright (C) 2023 Asim Ihsan
+ * SPDX-License-Identifier: AGPL-3.0-only
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License as published by the Free
+ * Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program. If not, see <https://www.gnu.org/licenses/>
+ */
+
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/rs/zerolog"
+	"testing"
+)
+
+// logFields returns the fields of the single JSON log line in buf.
+func logFields(t *testing.T, buf *bytes.Buffer) map[string]interface{} {
+	t.Helper()
+	var fields map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+		t.Fatalf("failed to parse log line %q: %v", buf.String(), err)
+	}
+	return fields
+}
+
+func TestNewRequest(t *testing.T) {
+	var buf bytes.Buffer
+	zlog := zerolog.New(&buf)
+
+	ctx, requestLog := NewRequest(context.Background(), &zlog)
+
+	id := RequestID(ctx)
+	if id == "" {
+		t.Fatal("RequestID() is empty, want the new request's ID")
+	}
+	requestLog.Info().Msg("handled")
+	if got := logFields(t, &buf)[RequestIDField]; got != id {
+		t.Errorf("log field %q = %v, want %q", RequestIDField, got, id)
+	}
+
+	buf.Reset()
+	Logger(ctx, &zlog).Info().Msg("handled")
+	if got := logFields(t, &buf)[RequestIDField]; got != id {
+		t.Errorf("Logger() log field %q = %v, want %q", RequestIDField, got, id)
+	}
+}
+
+func TestNewRequestIDsAreUnique(t *testing.T) {
+	zlog := zerolog.Nop()
+	first, _ := NewRequest(context.Background(), &zlog)
+	second, _ := NewRequest(context.Background(), &zlog)
+	if RequestID(first) == RequestID(second) {
+		t.Errorf("RequestID() = %q for two requests, want different IDs", RequestID(first))
+	}
+}
+
+func TestLoggerOutsideRequest(t *testing.T) {
+	zlog := zerolog.Nop()
+
+	if id := RequestID(context.Background()); id != "" {
+		t.Errorf("RequestID() = %q, want empty outside a request", id)
+	}
+	if got := Logger(context.Background(), &zlog); got != &zlog {
+		t.Errorf("Logger() = %p, want the fallback logger %p", got, &zlog)
+	}
+}